@@ -0,0 +1,58 @@
+package acl
+
+import (
+	"path"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Permission is an access right on a channel
+type Permission int
+
+const (
+	Read  Permission = iota // Subscribe to the channel
+	Write                   // Publish to the channel
+)
+
+// String returns the permission name used in logs and errors
+func (p Permission) String() string {
+	if p == Write {
+		return "write"
+	}
+	return "read"
+}
+
+// Granted reports whether a channel matches one of the patterns a token was granted.
+// An empty grant list does not restrict the channel.
+func Granted(patterns []string, channel string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, channel); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether rules grant a permission on a channel. Rules are checked in
+// order and the first one whose pattern matches decides. Without any rules every channel
+// is open; once rules are configured, channels that match none of them are denied.
+func Allowed(rules []config.ACLRule, channel string, permission Permission) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, rule := range rules {
+		if matched, _ := path.Match(rule.Pattern, channel); !matched {
+			continue
+		}
+		if permission == Write {
+			return rule.Write
+		}
+		return rule.Read
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+func TestGranted(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		channel  string
+		want     bool
+	}{
+		{"no grants allow any channel", nil, "orders", true},
+		{"exact name", []string{"orders"}, "orders", true},
+		{"other name", []string{"orders"}, "invoices", false},
+		{"wildcard", []string{"user-42-*"}, "user-42-inbox", true},
+		{"wildcard of another user", []string{"user-42-*"}, "user-43-inbox", false},
+		{"any of several", []string{"news", "user-42-*"}, "news", true},
+		{"wildcard stops at a slash", []string{"team/*"}, "team/a/b", false},
+		{"malformed pattern matches nothing", []string{"orders["}, "orders[", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Granted(tt.patterns, tt.channel); got != tt.want {
+				t.Errorf("Granted(%q, %q) = %v, want %v", tt.patterns, tt.channel, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	rules := []config.ACLRule{
+		{Pattern: "public.*", Read: true},
+		{Pattern: "chat.lobby", Read: true, Write: true},
+		{Pattern: "chat.*", Read: true},
+		{Pattern: "admin.*"},
+	}
+
+	tests := []struct {
+		name       string
+		rules      []config.ACLRule
+		channel    string
+		permission Permission
+		want       bool
+	}{
+		{"no rules allow reading", nil, "anything", Read, true},
+		{"no rules allow writing", nil, "anything", Write, true},
+		{"read-only rule allows reading", rules, "public.news", Read, true},
+		{"read-only rule denies writing", rules, "public.news", Write, false},
+		{"first matching rule decides", rules, "chat.lobby", Write, true},
+		{"later rule for other channels", rules, "chat.room", Write, false},
+		{"rule without permissions denies", rules, "admin.users", Read, false},
+		{"unmatched channel is denied", rules, "private", Read, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Allowed(tt.rules, tt.channel, tt.permission); got != tt.want {
+				t.Errorf("Allowed(%q, %s) = %v, want %v", tt.channel, tt.permission, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionString(t *testing.T) {
+	tests := []struct {
+		permission Permission
+		want       string
+	}{
+		{Read, "read"},
+		{Write, "write"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.permission.String(); got != tt.want {
+			t.Errorf("Permission(%d).String() = %q, want %q", tt.permission, got, tt.want)
+		}
+	}
+}
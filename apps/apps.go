@@ -0,0 +1,139 @@
+package apps
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+var mu sync.Mutex
+
+// Open connections per app key, used to enforce max_connections
+var connections = make(map[string]int)
+
+// Publish rate limiter per app key, used to enforce max_publish_rate
+var publishLimiters = make(map[string]*rate.Limiter)
+
+// Enabled reports whether the server runs in multi-tenant mode
+func Enabled(config *config.Config) bool {
+	return len(config.Apps) > 0
+}
+
+// KeyFromRequest returns the app key presented on an upgrade request, preferring the
+// X-App-Key header over the app_key query parameter
+func KeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-App-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("app_key")
+}
+
+// Lookup returns the app registered under a key
+func Lookup(config *config.Config, key string) (config.App, bool) {
+	app, ok := config.Apps[key]
+	return app, ok
+}
+
+// Acquire reserves a connection slot for an app, returning false when the app is at its quota
+func Acquire(key string, app config.App) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if app.MaxConnections > 0 && connections[key] >= app.MaxConnections {
+		return false
+	}
+	connections[key]++
+	return true
+}
+
+// Release frees a connection slot reserved with Acquire
+func Release(key string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	connections[key]--
+	if connections[key] <= 0 {
+		delete(connections, key)
+	}
+}
+
+// AllowPublish reports whether an app is within its publish rate quota
+func AllowPublish(key string, app config.App) bool {
+	if app.MaxPublishRate <= 0 {
+		return true
+	}
+
+	mu.Lock()
+	limiter, ok := publishLimiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(app.MaxPublishRate), int(app.MaxPublishRate)+1)
+		publishLimiters[key] = limiter
+	}
+	mu.Unlock()
+
+	return limiter.Allow()
+}
+
+// AuthorizeURL returns the authorize URL for an app, falling back to the server default
+func AuthorizeURL(config *config.Config, app config.App) string {
+	if app.AuthorizeUrl != "" {
+		return app.AuthorizeUrl
+	}
+	return config.Server.Authorize.Url
+}
+
+// AuthorizeURLs returns the distinct authorize URLs of the server and its apps, sorted
+func AuthorizeURLs(config *config.Config) []string {
+	seen := make(map[string]bool)
+	if config.Server.Authorize.Url != "" {
+		seen[config.Server.Authorize.Url] = true
+	}
+	for _, app := range config.Apps {
+		if url := AuthorizeURL(config, app); url != "" {
+			seen[url] = true
+		}
+	}
+
+	urls := make([]string, 0, len(seen))
+	for url := range seen {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// ValidateToken validates a token against the authorize URL of the given app, or the
+// server-wide authorize URL when appKey is empty
+func ValidateToken(ctx context.Context, rdb redis.UniversalClient, config *config.Config, appKey string, request auth.AuthorizeRequest) (auth.TokenInfo, error) {
+	cacheTTL := CacheTTL(config)
+	if appKey == "" {
+		return auth.ValidateToken(ctx, rdb, request, config.Server.Authorize.Url, cacheTTL)
+	}
+
+	app, _ := Lookup(config, appKey)
+	return auth.ValidateAppToken(ctx, rdb, appKey, request, AuthorizeURL(config, app), cacheTTL)
+}
+
+// CacheTTL returns the auth cache lifetimes. Valid results default to cash_time_out
+// minutes and invalid results to the same lifetime as valid ones.
+func CacheTTL(config *config.Config) auth.CacheTTL {
+	cache := config.Server.Authorize.CacheTTL
+
+	valid := time.Duration(config.Server.Authorize.CashTimeOut) * time.Minute
+	if cache.Valid > 0 {
+		valid = time.Duration(cache.Valid) * time.Second
+	}
+	invalid := valid
+	if cache.Invalid > 0 {
+		invalid = time.Duration(cache.Invalid) * time.Second
+	}
+
+	return auth.CacheTTL{Valid: valid, Invalid: invalid, Jitter: cache.Jitter}
+}
@@ -0,0 +1,149 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// Logger of the audit package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the audit package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Actions recorded in the audit log
+const (
+	ActionAuthenticate = "authenticate"
+	ActionSubscribe    = "subscribe"
+	ActionUnsubscribe  = "unsubscribe"
+	ActionPublish      = "publish"
+	ActionAdmin        = "admin"
+)
+
+// Outcomes of an audited action
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+	OutcomeError   = "error"
+)
+
+// Event is one entry of the audit log. Tokens are never recorded.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome"`
+	ConnID     string    `json:"conn_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Identity   string    `json:"identity,omitempty"` // Subject of the client certificate
+	App        string    `json:"app,omitempty"`
+	Channel    string    `json:"channel,omitempty"`
+	Path       string    `json:"path,omitempty"` // Admin route that was called
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// Sink stores audit events
+type Sink interface {
+	Write(event Event) error
+}
+
+// Events waiting to be written. Record blocks once it is full, so events are delayed
+// rather than lost while the sink is slow.
+const queueSize = 4096
+
+var mu sync.Mutex
+var queue chan Event
+
+// SetSink starts writing audit events to a sink. Until it is called Record does nothing.
+func SetSink(sink Sink) {
+	mu.Lock()
+	defer mu.Unlock()
+	if queue != nil {
+		return
+	}
+	queue = make(chan Event, queueSize)
+	go write(sink, queue)
+}
+
+// Record adds an event to the audit log, stamping it with the current time
+func Record(event Event) {
+	mu.Lock()
+	events := queue
+	mu.Unlock()
+	if events == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	events <- event
+}
+
+func write(sink Sink, events <-chan Event) {
+	for event := range events {
+		if err := sink.Write(event); err != nil {
+			// Keep the event in the operational log rather than losing it
+			logger.Error("Failed to write audit event", "error", err, "audit_action", event.Action, "audit_outcome", event.Outcome, "conn_id", event.ConnID, "channel", event.Channel)
+		}
+	}
+}
+
+// writerSink writes events as JSON lines
+type writerSink struct {
+	encoder *json.Encoder
+}
+
+// NewWriterSink returns a sink writing one JSON object per event and line, such as a file
+func NewWriterSink(w io.Writer) Sink {
+	return writerSink{encoder: json.NewEncoder(w)}
+}
+
+func (s writerSink) Write(event Event) error {
+	return s.encoder.Encode(event)
+}
+
+// redisSink appends events to a Redis stream
+type redisSink struct {
+	rdb    redis.UniversalClient
+	stream string
+	maxLen int64
+}
+
+// NewRedisSink returns a sink adding each event to a Redis stream, trimmed to about maxLen
+// entries when maxLen is positive
+func NewRedisSink(rdb redis.UniversalClient, stream string, maxLen int64) Sink {
+	return redisSink{rdb: rdb, stream: stream, maxLen: maxLen}
+}
+
+func (s redisSink) Write(event Event) error {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	args := &redis.XAddArgs{
+		Stream: s.stream,
+		Values: map[string]interface{}{"event": encoded},
+	}
+	if s.maxLen > 0 {
+		args.MaxLen = s.maxLen
+		args.Approx = true
+	}
+	if err := s.rdb.XAdd(ctx, args).Err(); err != nil {
+		return fmt.Errorf("failed to add to stream %s: %v", s.stream, err)
+	}
+	return nil
+}
@@ -1,134 +1,437 @@
 package auth
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/metrics"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
 )
 
-// Global logger variable
-var logger *log.Logger
+// Logger of the auth package, replaced through server.SetLogger
+var logger = slog.Default()
 
-// SetLogger sets the global logger instance
-func SetLogger(l *log.Logger) {
+// SetLogger sets the structured logger the auth package writes to
+func SetLogger(l *slog.Logger) {
 	logger = l
 }
 
-// InitLogger initializes the logger based on the log file or standard output
-func InitLogger(logFile string) (*log.Logger, error) {
-	var logOutput *os.File
-	var err error
-
-	if logFile != "" {
-		// Log to file
-		logOutput, err = os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-		if err != nil {
-			return nil, fmt.Errorf("could not open log file: %v", err)
+// TokenFromRequest extracts an auth token from an upgrade request, preferring an
+// "Authorization: Bearer" header over the "token" query parameter
+func TokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
 		}
-	} else {
-		// Log to standard output
-		logOutput = os.Stdout
 	}
+	return r.URL.Query().Get("token")
+}
+
+// TokenInfo is what validating a token learned about it
+type TokenInfo struct {
+	Valid           bool            `json:"valid"`
+	Scopes          []string        `json:"scopes,omitempty"`           // OAuth2 scopes granted to the token, from introspection
+	ExpiresAt       int64           `json:"expires_at,omitempty"`       // Unix seconds the token expires at, 0 when unknown
+	UserID          string          `json:"user_id,omitempty"`          // User the token belongs to
+	AllowedChannels []string        `json:"allowed_channels,omitempty"` // Channel names or patterns the token is limited to, empty for no limit
+	Metadata        json.RawMessage `json:"metadata,omitempty"`         // Application data about the user, passed through as is
+	Roles           []string        `json:"roles,omitempty"`            // Roles mapped to channel permissions by the roles config
+}
 
-	// Initialize the logger with INFO prefix and appropriate flags for date, time, and file
-	logger = log.New(logOutput, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	return logger, nil
+// authorizeResponse is the optional JSON body of a 200 response from the authorize API
+type authorizeResponse struct {
+	UserID          json.RawMessage `json:"user_id"`    // String or number
+	ExpiresIn       int64           `json:"expires_in"` // Seconds until the token expires
+	AllowedChannels []string        `json:"allowed_channels"`
+	Metadata        json.RawMessage `json:"metadata"`
+	Roles           []string        `json:"roles"`
 }
 
 // ValidateToken validates a token using Redis and an external API
-func ValidateToken(rdb *redis.Client, token, authorizeURL string, cacheTimeout int16) (bool, error) {
-	ctx := context.Background()
+func ValidateToken(ctx context.Context, rdb redis.UniversalClient, request AuthorizeRequest, authorizeURL string, cacheTTL CacheTTL) (TokenInfo, error) {
+	return validateToken(ctx, rdb, request.Token, request, authorizeURL, cacheTTL)
+}
+
+// ValidateAppToken validates a token for a tenant app. Cache entries are namespaced by
+// app key so a token accepted by one app's authorize URL is never reused for another.
+func ValidateAppToken(ctx context.Context, rdb redis.UniversalClient, appKey string, request AuthorizeRequest, authorizeURL string, cacheTTL CacheTTL) (TokenInfo, error) {
+	return validateToken(ctx, rdb, appKey+":"+request.Token, request, authorizeURL, cacheTTL)
+}
+
+// ErrUnavailable wraps failures to reach the authorize API; such results are never cached
+var ErrUnavailable = errors.New("authorization API unavailable")
+
+// Upstream validations in flight, keyed by cache key
+var validations singleflight.Group
 
-	// Check if logger is initialized
-	if logger == nil {
-		return false, fmt.Errorf("logger is not initialized")
+// Longest a shared upstream validation may take, including retries and caching its result
+const validationTimeout = 30 * time.Second
+
+// Suffixes of per-channel cache entries and of the set indexing them under a token's cache key
+const (
+	channelKeySuffix = "#channel:"
+	channelSetSuffix = "#channels"
+)
+
+// validateToken records the validation of a token as an auth.validate_token span
+func validateToken(ctx context.Context, rdb redis.UniversalClient, cacheKey string, request AuthorizeRequest, authorizeURL string, cacheTTL CacheTTL) (TokenInfo, error) {
+	ctx, span := tracing.Start(ctx, "auth.validate_token", attribute.String("channel", request.Channel))
+	info, err := lookupToken(ctx, rdb, cacheKey, request, authorizeURL, cacheTTL)
+	span.SetAttributes(attribute.Bool("auth.valid", info.Valid))
+	tracing.End(span, err)
+	return info, err
+}
+
+// lookupToken checks the Redis cache under cacheKey before calling the authorize API,
+// or the introspection endpoint when one is configured. A Redis lookup that times out is
+// reported as ErrUnavailable so the client retries instead of treating the token as invalid.
+func lookupToken(ctx context.Context, rdb redis.UniversalClient, cacheKey string, request AuthorizeRequest, authorizeURL string, cacheTTL CacheTTL) (TokenInfo, error) {
+	token := request.Token
+	baseKey := cacheKey
+
+	// When the authorize API sees the channel, its decision only holds for that channel
+	if channelScoped && request.Channel != "" {
+		cacheKey = baseKey + channelKeySuffix + request.Channel
 	}
 
 	// Log the start of the token validation
-	logger.Printf("Validating token: %s", token)
+	logger.Debug("Validating token", "token", token, "channel", request.Channel)
+
+	// JWTs are verified locally when a JWKS is configured; only opaque tokens reach Redis and the authorize API
+	if jwks != nil && isJWT(token) {
+		info, err := ValidateJWT(token)
+		if err == nil {
+			tracing.Annotate(ctx, attribute.String("auth.source", "jwt"))
+			logger.Debug("Token validated locally as JWT", "token", token, "valid", info.Valid)
+			return info, nil
+		}
+		logger.Warn("Local JWT validation failed, falling back to authorization API", "token", token, "error", err)
+	}
+
+	// Hot tokens are answered from memory before asking Redis
+	info, ok := l1.get(cacheKey)
+	if l1 != nil {
+		metrics.AuthCacheLookup("memory", ok, info.Valid)
+	}
+	if ok {
+		tracing.Annotate(ctx, attribute.String("auth.source", "memory"))
+		logger.Debug("Token found in in-process cache", "token", token, "valid", info.Valid)
+		return info, nil
+	}
 
 	// Check the cache for the token first
-	cached, err := rdb.Get(ctx, token).Result()
+	lookupCtx, cancel := redisconn.WithTimeout(ctx)
+	cached, err := rdb.Get(lookupCtx, cacheKey).Result()
+	cancel()
 	if err == redis.Nil {
-		// Token is not found in cache, so we call the external API
-		logger.Printf("Token %s not found in cache. Calling authorization API...", token)
+		metrics.AuthCacheLookup("redis", false, false)
 
-		isValid, err := CallAuthorizeAPI(token, authorizeURL)
-		if err != nil {
-			logger.Printf("Authorization API call failed for token %s: %v", token, err)
-			return false, fmt.Errorf("authorization API call failed: %v", err)
-		}
-
-		// Cache the result of the validation
-		ttl := time.Duration(cacheTimeout) * time.Minute
-		if isValid {
-			rdb.Set(ctx, token, "valid", ttl)
-			logger.Printf("Token %s is valid. Cached with TTL %d minutes.", token, cacheTimeout)
-		} else {
-			rdb.Set(ctx, token, "invalid", ttl)
-			logger.Printf("Token %s is invalid. Cached with TTL %d minutes.", token, cacheTimeout)
+		// Token is not found in cache, so we call the external API. Concurrent misses for
+		// the same cache key share a single upstream call, which runs detached from the
+		// request that started it, so that request going away does not fail the others.
+		// Each caller still stops waiting when its own context ends.
+		tracing.Annotate(ctx, attribute.String("auth.source", "upstream"))
+		results := validations.DoChan(cacheKey, func() (interface{}, error) {
+			fetchCtx, cancel := context.WithTimeout(tracing.Detach(ctx), validationTimeout)
+			defer cancel()
+			return fetchAndCache(fetchCtx, rdb, cacheKey, baseKey, request, authorizeURL, cacheTTL)
+		})
+		select {
+		case result := <-results:
+			if result.Shared {
+				logger.Debug("Token validation shared with a concurrent request", "token", token)
+			}
+			return result.Val.(TokenInfo), result.Err
+		case <-ctx.Done():
+			return TokenInfo{}, fmt.Errorf("%w: gave up waiting for the token validation: %v", ErrUnavailable, ctx.Err())
 		}
-		return isValid, nil
 	} else if err != nil {
 		// Error occurred while fetching the token from Redis
-		logger.Printf("Error fetching token %s from Redis: %v", token, err)
-		return false, fmt.Errorf("error fetching token from Redis: %v", err)
+		logger.Error("Failed to fetch token from Redis", "token", token, "error", err)
+		if redisconn.IsTimeout(err) {
+			return TokenInfo{}, fmt.Errorf("%w: Redis lookup timed out: %v", ErrUnavailable, err)
+		}
+		return TokenInfo{}, fmt.Errorf("error fetching token from Redis: %v", err)
 	}
 
+	tracing.Annotate(ctx, attribute.String("auth.source", "redis"))
+	info = decodeCached(cached)
+	metrics.AuthCacheLookup("redis", true, info.Valid)
+	l1.put(cacheKey, info)
+
 	// If the token is found in cache, log the result
-	if cached == "valid" {
-		logger.Printf("Token %s is valid (cached).", token)
+	if info.Valid {
+		logger.Debug("Token found in cache", "token", token, "valid", true)
 	} else {
-		logger.Printf("Token %s is invalid (cached).", token)
+		logger.Debug("Token found in cache", "token", token, "valid", false)
 	}
 
-	return cached == "valid", nil
+	return info, nil
 }
 
-// CallAuthorizeAPI makes a request to the authorization API to validate the token
-func CallAuthorizeAPI(token, authorizeURL string) (bool, error) {
-	logger.Printf("Calling authorization API for token: %s", token)
+// fetchAndCache validates a token upstream and stores the result under cacheKey
+func fetchAndCache(ctx context.Context, rdb redis.UniversalClient, cacheKey, baseKey string, request AuthorizeRequest, authorizeURL string, cacheTTL CacheTTL) (TokenInfo, error) {
+	token := request.Token
 
-	req, err := http.NewRequest("POST", authorizeURL, nil)
+	info, err := callUpstream(ctx, request, authorizeURL)
+	if err != nil {
+		reporting.Capture(ctx, fmt.Errorf("authorization API call failed: %v", err), reporting.Fields{"authorize_url": authorizeURL})
+		if stale, ok := staleResult(ctx, rdb, cacheKey); ok {
+			logger.Warn("Authorization API unavailable, using stale cached result", "token", token, "error", err)
+			return stale, nil
+		}
+		logger.Error("Authorization API call failed", "token", token, "error", err)
+		return TokenInfo{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	ctx, cancel := redisconn.WithTimeout(ctx)
+	defer cancel()
+
+	// Cache the result of the validation, but never beyond the token's own expiry
+	ttl := cacheTTL.forResult(info.Valid)
+	if info.ExpiresAt > 0 {
+		if remaining := time.Until(time.Unix(info.ExpiresAt, 0)); remaining < ttl {
+			ttl = remaining
+		}
+	}
+	// A TTL of zero would keep the entry forever, so results of tokens that already
+	// expired, or of a cache configured off, are not stored at all
+	if ttl <= 0 {
+		logger.Debug("Token not cached", "token", token, "valid", info.Valid)
+		return info, nil
+	}
+	encoded, _ := json.Marshal(info)
+	rdb.Set(ctx, cacheKey, encoded, ttl)
+	l1.put(cacheKey, info)
+	indexTTL := cacheTTL.longest()
+	if staleFallback {
+		rdb.Set(ctx, cacheKey+staleKeySuffix, encoded, staleTTL)
+		if staleTTL > indexTTL {
+			indexTTL = staleTTL
+		}
+	}
+	if info.Valid {
+		logger.Debug("Token cached", "token", token, "valid", true, "ttl", ttl)
+	} else {
+		logger.Debug("Token cached", "token", token, "valid", false, "ttl", ttl)
+	}
+	if cacheKey != baseKey {
+		// Index channel entries so InvalidateToken can find them
+		rdb.SAdd(ctx, baseKey+channelSetSuffix, request.Channel)
+		rdb.Expire(ctx, baseKey+channelSetSuffix, indexTTL)
+	}
+	return info, nil
+}
+
+// callUpstream validates a token with the introspection endpoint or the authorize API,
+// unless the circuit breaker considers it down
+func callUpstream(ctx context.Context, request AuthorizeRequest, authorizeURL string) (TokenInfo, error) {
+	if !authorizeBreaker.allow() {
+		metrics.AuthCircuitOpen()
+		return TokenInfo{}, ErrCircuitOpen
+	}
+
+	var info TokenInfo
+	var err error
+	start := time.Now()
+	if introspection != nil {
+		logger.Debug("Token not found in cache, calling introspection endpoint", "token", request.Token)
+		info, err = Introspect(ctx, request.Token)
+	} else {
+		logger.Debug("Token not found in cache, calling authorization API", "token", request.Token)
+		info, err = CallAuthorizeAPI(ctx, request, authorizeURL)
+	}
+	authorizeBreaker.record(err == nil)
+
+	result := "invalid"
+	if err != nil {
+		result = "error"
+	} else if info.Valid {
+		result = "valid"
+	}
+	metrics.AuthRequest(result, time.Since(start))
+	return info, err
+}
+
+// staleResult returns the last known result for a cache key when the stale fallback is enabled
+func staleResult(ctx context.Context, rdb redis.UniversalClient, cacheKey string) (TokenInfo, bool) {
+	if !staleFallback {
+		return TokenInfo{}, false
+	}
+
+	ctx, cancel := redisconn.WithTimeout(ctx)
+	defer cancel()
+	cached, err := rdb.Get(ctx, cacheKey+staleKeySuffix).Result()
+	if err != nil {
+		return TokenInfo{}, false
+	}
+	return decodeCached(cached), true
+}
+
+// decodeCached reads a cached validation result, including the plain "valid" and
+// "invalid" markers written by earlier versions
+func decodeCached(cached string) TokenInfo {
+	var info TokenInfo
+	if err := json.Unmarshal([]byte(cached), &info); err != nil {
+		return TokenInfo{Valid: cached == "valid"}
+	}
+	return info
+}
+
+// InvalidateToken removes a token's cached validation results, including the entries
+// kept separately for each tenant app
+func InvalidateToken(ctx context.Context, rdb redis.UniversalClient, token string, appKeys ...string) error {
+	baseKeys := []string{token}
+	for _, appKey := range appKeys {
+		baseKeys = append(baseKeys, appKey+":"+token)
+	}
+
+	ctx, cancel := redisconn.WithTimeout(ctx)
+	defer cancel()
+
+	var keys []string
+	for _, baseKey := range baseKeys {
+		keys = append(keys, baseKey, baseKey+staleKeySuffix, baseKey+channelSetSuffix)
+		channels, err := rdb.SMembers(ctx, baseKey+channelSetSuffix).Result()
+		if err != nil {
+			return fmt.Errorf("failed to list cached channels of token: %v", err)
+		}
+		for _, channel := range channels {
+			keys = append(keys, baseKey+channelKeySuffix+channel, baseKey+channelKeySuffix+channel+staleKeySuffix)
+		}
+	}
+
+	l1.remove(keys...)
+
+	// Keys are deleted one by one since they may live in different cluster slots
+	pipe := rdb.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete cached token: %v", err)
+	}
+	logger.Info("Token removed from cache", "token", token)
+	return nil
+}
+
+// CallAuthorizeAPI makes a request to the authorization API to validate the token,
+// retrying network errors and 5xx responses as configured. The trace context of ctx is
+// passed on in the traceparent header.
+func CallAuthorizeAPI(ctx context.Context, request AuthorizeRequest, authorizeURL string) (TokenInfo, error) {
+	for retry := 0; ; retry++ {
+		info, retryable, err := callAuthorizeOnce(ctx, request, authorizeURL)
+		if err == nil || !retryable || retry >= retries.attempts {
+			return info, err
+		}
+
+		delay := retries.backoff(retry)
+		logger.Warn("Retrying authorization API", "token", request.Token, "delay", delay, "attempt", retry+1, "attempts", retries.attempts, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return info, err
+		}
+	}
+}
+
+// callAuthorizeOnce makes a single authorize API call and reports whether a failure may be retried
+func callAuthorizeOnce(ctx context.Context, request AuthorizeRequest, authorizeURL string) (info TokenInfo, retryable bool, err error) {
+	ctx, span := tracing.Start(ctx, "auth.authorize_request", attribute.String("http.url", authorizeURL))
+	defer func() { tracing.End(span, err) }()
+
+	token := request.Token
+	logger.Debug("Calling authorization API", "token", token, "url", authorizeURL)
+
+	req, err := newAuthorizeHTTPRequest(request, authorizeURL)
 	if err != nil {
 		// Log the failure to create the HTTP request
-		logger.Printf("Failed to create request for token %s: %v", token, err)
-		return false, fmt.Errorf("failed to create request: %v", err)
+		logger.Error("Failed to create authorization API request", "token", token, "error", err)
+		return TokenInfo{}, false, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 	resp, err := client.Do(req)
 	if err != nil {
 		// Log the failure of the API request
-		logger.Printf("API request failed for token %s: %v", token, err)
-		return false, fmt.Errorf("API request failed: %v", err)
+		logger.Error("Authorization API request failed", "token", token, "error", err)
+		return TokenInfo{}, true, fmt.Errorf("API request failed: %v", err)
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 
 	// Read response body for detailed error logging using io.ReadAll
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logger.Printf("Failed to read response body for token %s: %v", token, err)
+		logger.Error("Failed to read authorization API response", "token", token, "error", err)
 	}
 
 	// Log the response body for debugging
-	logger.Printf("API Response for token %s: %s", token, string(body))
+	logger.Debug("Authorization API response", "token", token, "status", resp.StatusCode, "body", string(body))
+
+	// Check the response from the authorization API. Only 401 and 403 reject the token;
+	// any other status says nothing about it and must not be cached.
+	switch resp.StatusCode {
+	case http.StatusOK:
+		logger.Debug("Authorization API accepted token", "token", token)
+		return parseAuthorizeResponse(token, body), false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		logger.Debug("Authorization API rejected token", "token", token, "status", resp.StatusCode)
+		return TokenInfo{}, false, nil
+	}
 
-	// Check the response from the authorization API
-	if resp.StatusCode == http.StatusOK {
-		logger.Printf("Authorization API for token %s returned OK", token)
-		return true, nil
+	logger.Error("Authorization API returned unexpected status", "token", token, "status", resp.StatusCode)
+	retryable = resp.StatusCode >= http.StatusInternalServerError
+	return TokenInfo{}, retryable, fmt.Errorf("authorization API returned status %d", resp.StatusCode)
+}
+
+// parseAuthorizeResponse reads the identity and channel grants from an accepting
+// response. Bodies that are empty or not JSON still accept the token.
+func parseAuthorizeResponse(token string, body []byte) TokenInfo {
+	info := TokenInfo{Valid: true}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return info
 	}
 
-	logger.Printf("Authorization API for token %s returned non-OK status: %d", token, resp.StatusCode)
-	return false, nil
+	var response authorizeResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		logger.Warn("Ignoring authorization API response body", "token", token, "error", err)
+		return info
+	}
+
+	// Numeric IDs are kept in their exact textual form
+	if err := json.Unmarshal(response.UserID, &info.UserID); err != nil && len(response.UserID) > 0 && string(response.UserID) != "null" {
+		info.UserID = string(response.UserID)
+	}
+	info.AllowedChannels = response.AllowedChannels
+	info.Metadata = response.Metadata
+	info.Roles = response.Roles
+	if response.ExpiresIn > 0 {
+		info.ExpiresAt = time.Now().Unix() + response.ExpiresIn
+	}
+	return info
+}
+
+// IsUnavailable reports whether a validation error means the auth service could not
+// give an answer, so the client may retry, rather than the token being rejected
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
 }
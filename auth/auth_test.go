@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/context"
+)
+
+func TestFetchAndCacheTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		ttl     CacheTTL
+		wantTTL time.Duration // Zero when the result must not be cached
+	}{
+		{"valid token cached", http.StatusOK, `{}`, CacheTTL{Valid: time.Minute}, time.Minute},
+		{"cache lifetime capped by the token's", http.StatusOK, `{"expires_in": 30}`, CacheTTL{Valid: time.Minute}, 30 * time.Second},
+		{"rejected token cached", http.StatusForbidden, ``, CacheTTL{Valid: time.Minute, Invalid: 10 * time.Second}, 10 * time.Second},
+		{"rejections not cached", http.StatusForbidden, ``, CacheTTL{Valid: time.Minute}, 0},
+		{"caching off", http.StatusOK, `{}`, CacheTTL{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer upstream.Close()
+			store := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: store.Addr()})
+			defer rdb.Close()
+
+			if _, err := fetchAndCache(context.Background(), rdb, "token:t", "token:t", AuthorizeRequest{Token: "t"}, upstream.URL, tt.ttl); err != nil {
+				t.Fatalf("fetchAndCache: %v", err)
+			}
+			if tt.wantTTL == 0 {
+				if store.Exists("token:t") {
+					t.Errorf("result cached with TTL %v", store.TTL("token:t"))
+				}
+				return
+			}
+			if got := store.TTL("token:t"); got < tt.wantTTL-time.Second || got > tt.wantTTL {
+				t.Errorf("cached with TTL %v, want %v", got, tt.wantTTL)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling the authorize API while it is considered down
+var ErrCircuitOpen = errors.New("authorize API circuit is open")
+
+// Circuit breaker states
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stops calling the authorize API after repeated failures, then lets a
+// few probe calls through once the open period ends to find out whether it recovered
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int           // Consecutive failures that open the circuit
+	openFor   time.Duration // How long the circuit stays open before probing
+	probes    int           // Successful probes needed to close the circuit
+
+	state     int
+	failures  int
+	openedAt  time.Time
+	inFlight  int
+	successes int
+}
+
+// Breaker guarding authorize and introspection calls, nil when disabled
+var authorizeBreaker *circuitBreaker
+
+// Whether expired cache entries are honored while the authorize API is unavailable
+var staleFallback bool
+
+// How long expired results are kept for the stale fallback
+var staleTTL time.Duration
+
+// Suffix of the long-lived copy of a cache entry used by the stale fallback
+const staleKeySuffix = "#stale"
+
+// ConfigureBreaker enables the circuit breaker around the authorize API. With the
+// "stale" fallback, tokens whose cache entry expired are judged by their last known
+// result while the API is unavailable; otherwise they are rejected.
+func ConfigureBreaker(threshold int, openFor time.Duration, probes int, fallback string, keepStale time.Duration) {
+	if probes < 1 {
+		probes = 1
+	}
+	authorizeBreaker = &circuitBreaker{
+		threshold: threshold,
+		openFor:   openFor,
+		probes:    probes,
+	}
+	staleFallback = fallback == "stale"
+	staleTTL = keepStale
+}
+
+// allow reports whether a call may go through, reserving a probe slot when half-open
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.inFlight = 0
+		b.successes = 0
+		logger.Info("Authorize API circuit half-open, probing")
+		fallthrough
+	case circuitHalfOpen:
+		if b.inFlight >= b.probes {
+			return false
+		}
+		b.inFlight++
+	}
+	return true
+}
+
+// record reports the outcome of a call allowed by allow
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.trip()
+		}
+	case circuitHalfOpen:
+		b.inFlight--
+		if !success {
+			b.trip()
+			return
+		}
+		b.successes++
+		if b.successes >= b.probes {
+			b.state = circuitClosed
+			b.failures = 0
+			logger.Info("Authorize API circuit closed")
+		}
+	}
+}
+
+// stateName returns the state of the breaker for reports, empty when it is disabled
+func (b *circuitBreaker) stateName() string {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+func (b *circuitBreaker) trip() {
+	b.state = circuitOpen
+	b.openedAt = time.Now()
+	logger.Warn("Authorize API circuit opened", "duration", b.openFor)
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"math/rand"
+	"time"
+)
+
+// CacheTTL controls how long validation results stay in the Redis cache
+type CacheTTL struct {
+	Valid   time.Duration // Lifetime of results accepting a token
+	Invalid time.Duration // Lifetime of results rejecting a token
+	Jitter  float64       // Fraction of the lifetime randomly added or removed per entry
+}
+
+// forResult returns the jittered lifetime of a validation result, so entries written
+// together do not all expire and hit the authorize API at the same moment
+func (c CacheTTL) forResult(valid bool) time.Duration {
+	ttl := c.Invalid
+	if valid {
+		ttl = c.Valid
+	}
+	if c.Jitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+
+	jittered := time.Duration(float64(ttl) * (1 + c.Jitter*(2*rand.Float64()-1)))
+	if jittered < time.Second {
+		return time.Second
+	}
+	return jittered
+}
+
+// longest returns the longest lifetime any result may be given
+func (c CacheTTL) longest() time.Duration {
+	ttl := c.Valid
+	if c.Invalid > ttl {
+		ttl = c.Invalid
+	}
+	if c.Jitter > 0 {
+		ttl = time.Duration(float64(ttl) * (1 + c.Jitter))
+	}
+	return ttl
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadClientCAs reads the PEM bundle of CAs trusted to sign client certificates
+func LoadClientCAs(caFile string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle '%s': %v", caFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle '%s'", caFile)
+	}
+	return pool, nil
+}
+
+// CertificateIdentity returns the identity of a verified client certificate. The SANs
+// (DNS names, URIs and email addresses) and the subject CN are checked in that order and
+// the first name that known accepts wins; without a match the CN is used. It returns an
+// empty string when the client did not present a verified certificate.
+func CertificateIdentity(state *tls.ConnectionState, known func(string) bool) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+
+	var names []string
+	names = append(names, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	names = append(names, cert.Subject.CommonName)
+
+	for _, name := range names {
+		if name != "" && known(name) {
+			return name
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(names) > 1 {
+		return names[0]
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package auth
+
+import "testing"
+
+func TestSignChannel(t *testing.T) {
+	const want = "5da6f1be7e02330572533045c44dd3f66505254316baa0c37f7bb29884ecb010"
+	if got := SignChannel("secret", "123.456", "private-orders"); got != want {
+		t.Errorf("SignChannel = %s, want %s", got, want)
+	}
+}
+
+func TestVerifyChannelSignature(t *testing.T) {
+	secrets := map[string]string{"app": "secret", "other": "other-secret"}
+	signature := "app:" + SignChannel("secret", "123.456", "private-orders")
+
+	tests := []struct {
+		name      string
+		socketID  string
+		channel   string
+		signature string
+		want      bool
+	}{
+		{"valid", "123.456", "private-orders", signature, true},
+		{"other socket", "123.457", "private-orders", signature, false},
+		{"other channel", "123.456", "private-invoices", signature, false},
+		{"signed with another app's secret", "123.456", "private-orders", "other:" + SignChannel("secret", "123.456", "private-orders"), false},
+		{"unknown app key", "123.456", "private-orders", "missing:" + SignChannel("secret", "123.456", "private-orders"), false},
+		{"no app key", "123.456", "private-orders", SignChannel("secret", "123.456", "private-orders"), false},
+		{"empty", "123.456", "private-orders", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyChannelSignature(secrets, tt.socketID, tt.channel, tt.signature); got != tt.want {
+				t.Errorf("VerifyChannelSignature = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"body", "secret", "1700000000", `{"channel":"news"}`, "ed0976b75bdee0faea529626e91d5495895cae0ce1988dd8e7932375f8166e29"},
+		{"empty body", "secret", "1700000000", "", "4bc5f74d868b97888288889c5d9d65df02526f94c1592a79fdf4fe8b26e311e5"},
+		{"other secret and timestamp", "other", "1700000001", `{"channel":"news"}`, "64b4349067aeee4f5f5d93a87421c06b99aee5b6ff1e736880b90a873198a207"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SignRequest(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("SignRequest = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestSignature(t *testing.T) {
+	body := []byte(`{"channel":"news"}`)
+	signature := SignRequest("secret", "1700000000", body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{"valid", "secret", "1700000000", body, signature, true},
+		{"wrong secret", "other", "1700000000", body, signature, false},
+		{"changed timestamp", "secret", "1700000001", body, signature, false},
+		{"changed body", "secret", "1700000000", []byte(`{"channel":"admin"}`), signature, false},
+		{"truncated signature", "secret", "1700000000", body, signature[:32], false},
+		{"empty signature", "secret", "1700000000", body, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyRequestSignature(tt.secret, tt.timestamp, tt.body, tt.signature); got != tt.want {
+				t.Errorf("VerifyRequestSignature = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
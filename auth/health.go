@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// EndpointHealth reports whether an authorize URL answered its last probe
+type EndpointHealth struct {
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Circuit   string `json:"circuit,omitempty"`    // State of the circuit breaker, when enabled
+	LastError string `json:"last_error,omitempty"` // Error of the last failed probe
+	Since     int64  `json:"since"`                // Unix seconds the URL entered its current state
+}
+
+var healthMu sync.Mutex
+
+// Last probe result of each authorize URL
+var endpointHealths = make(map[string]*EndpointHealth)
+
+// Probe checks that an authorize URL answers. Without a token the endpoint is expected to
+// refuse the call, so any response short of a server error counts as reachable.
+func Probe(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("answered %s", response.Status)
+	}
+	return nil
+}
+
+// MonitorHealth probes the authorize URLs on an interval so the health endpoint can
+// report them without calling out on every request
+func MonitorHealth(urls []string, interval time.Duration) {
+	for {
+		for _, url := range urls {
+			recordProbe(url, Probe(url))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// recordProbe updates the state of a URL after a probe
+func recordProbe(url string, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	state, ok := endpointHealths[url]
+	if !ok {
+		state = &EndpointHealth{URL: url, Reachable: err == nil, Since: time.Now().Unix()}
+		endpointHealths[url] = state
+		if err != nil {
+			logger.Warn("Authorization API is unreachable", "url", url, "error", err)
+		}
+	}
+
+	if err != nil {
+		state.LastError = err.Error()
+		if state.Reachable {
+			state.Reachable, state.Since = false, time.Now().Unix()
+			logger.Warn("Authorization API is unreachable", "url", url, "error", err)
+		}
+		return
+	}
+	state.LastError = ""
+	if !state.Reachable {
+		state.Reachable, state.Since = true, time.Now().Unix()
+		logger.Info("Authorization API is reachable again", "url", url)
+	}
+}
+
+// Health returns the state of the probed authorize URLs, sorted by URL
+func Health() []EndpointHealth {
+	circuit := authorizeBreaker.stateName()
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healths := make([]EndpointHealth, 0, len(endpointHealths))
+	for _, state := range endpointHealths {
+		health := *state
+		health.Circuit = circuit
+		healths = append(healths, health)
+	}
+	sort.Slice(healths, func(i, j int) bool { return healths[i].URL < healths[j].URL })
+	return healths
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// introspectionClient calls an OAuth2 token introspection endpoint (RFC 7662)
+type introspectionClient struct {
+	url          string
+	clientID     string
+	clientSecret string
+}
+
+// Introspection endpoint used instead of the authorize API, nil when disabled
+var introspection *introspectionClient
+
+// introspectionResponse holds the RFC 7662 fields gopush acts on
+type introspectionResponse struct {
+	Active bool   `json:"active"`
+	Exp    int64  `json:"exp"`
+	Scope  string `json:"scope"`
+	Sub    string `json:"sub"`
+}
+
+// ConfigureIntrospection validates opaque tokens against an introspection endpoint,
+// authenticating with the given client credentials
+func ConfigureIntrospection(endpoint, clientID, clientSecret string) {
+	introspection = &introspectionClient{
+		url:          endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+	}
+}
+
+// Introspect asks the introspection endpoint whether a token is active and which scopes
+// it grants. The request is abandoned when ctx is done.
+func Introspect(ctx context.Context, token string) (TokenInfo, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, introspection.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return TokenInfo{}, fmt.Errorf("failed to create introspection request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if introspection.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(introspection.clientID), url.QueryEscape(introspection.clientSecret))
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return TokenInfo{}, fmt.Errorf("introspection request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return TokenInfo{}, fmt.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	var result introspectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return TokenInfo{}, fmt.Errorf("failed to decode introspection response: %v", err)
+	}
+
+	// Some servers report expired tokens as active, so exp is checked as well
+	if !result.Active || (result.Exp > 0 && result.Exp <= time.Now().Unix()) {
+		logger.Debug("Introspection reports token as inactive", "token", token)
+		return TokenInfo{}, nil
+	}
+
+	logger.Debug("Introspection reports token as active", "token", token, "scopes", result.Scope)
+	return TokenInfo{
+		Valid:     true,
+		Scopes:    strings.Fields(result.Scope),
+		ExpiresAt: result.Exp,
+		UserID:    result.Sub,
+	}, nil
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lruCache is a bounded in-process cache of validation results in front of Redis
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // Most recently used entries first
+	entries map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type lruEntry struct {
+	key       string
+	info      TokenInfo
+	expiresAt time.Time
+}
+
+// In-process cache consulted before Redis, nil when disabled
+var l1 *lruCache
+
+// ConfigureL1Cache keeps up to size validation results in memory for ttl
+func ConfigureL1Cache(size int, ttl time.Duration) {
+	l1 = &lruCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// L1Stats returns how many lookups the in-process cache answered and how many it missed
+func L1Stats() (hits, misses uint64) {
+	if l1 == nil {
+		return 0, 0
+	}
+	return l1.hits.Load(), l1.misses.Load()
+}
+
+func (c *lruCache) get(key string) (TokenInfo, bool) {
+	if c == nil {
+		return TokenInfo{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return TokenInfo{}, false
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		c.misses.Add(1)
+		return TokenInfo{}, false
+	}
+
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return entry.info, true
+}
+
+// put stores a result, never beyond the token's own expiry
+func (c *lruCache) put(key string, info TokenInfo) {
+	if c == nil {
+		return
+	}
+
+	expiresAt := time.Now().Add(c.ttl)
+	if info.ExpiresAt > 0 && time.Unix(info.ExpiresAt, 0).Before(expiresAt) {
+		expiresAt = time.Unix(info.ExpiresAt, 0)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = &lruEntry{key: key, info: info, expiresAt: expiresAt}
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, info: info, expiresAt: expiresAt})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) remove(keys ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
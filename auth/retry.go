@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"math/rand"
+	"time"
+)
+
+// retryPolicy controls how failed authorize API calls are retried
+type retryPolicy struct {
+	attempts  int           // Retries after the first call
+	baseDelay time.Duration // Delay before the first retry, doubled for each one after
+	maxDelay  time.Duration // Upper bound of a single delay
+}
+
+// Retry policy of authorize API calls, no retries by default
+var retries retryPolicy
+
+// ConfigureRetries retries authorize API calls that failed with a network error or a
+// 5xx status up to attempts times, backing off exponentially from baseDelay to maxDelay
+func ConfigureRetries(attempts int, baseDelay, maxDelay time.Duration) {
+	if maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+	retries = retryPolicy{attempts: attempts, baseDelay: baseDelay, maxDelay: maxDelay}
+}
+
+// backoff returns the delay before a retry, with up to half of it randomized so clients
+// retrying together do not hit the authorize API in lockstep
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := p.baseDelay
+	for i := 0; i < retry && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/sahakavatar/gopush/ipfilter"
+)
+
+// AuthorizeRequest carries what the authorize API may be told about a token check
+type AuthorizeRequest struct {
+	Token     string
+	Channel   string // Channel being subscribed to, empty at upgrade and on refresh
+	ClientIP  string
+	UserAgent string
+	Headers   http.Header // Upgrade request headers selected by forward_headers
+}
+
+// HTTP method used to call the authorize API
+var authorizeMethod = http.MethodPost
+
+// Template rendered as the authorize request body, nil sends an empty body
+var bodyTemplate *template.Template
+
+// Upgrade request headers copied onto authorize calls
+var forwardHeaders []string
+
+// Whether the body mentions the channel, in which case decisions are cached per channel
+var channelScoped bool
+
+// ConfigureAuthorizeRequest sets the shape of authorize API calls. The body template is
+// a Go text/template over AuthorizeRequest; its json function renders a value as a JSON literal.
+func ConfigureAuthorizeRequest(method, body string, headers []string) error {
+	if method != "" {
+		authorizeMethod = strings.ToUpper(method)
+	}
+
+	if body != "" {
+		tmpl, err := template.New("authorize").Funcs(template.FuncMap{"json": jsonLiteral}).Parse(body)
+		if err != nil {
+			return fmt.Errorf("invalid authorize body template: %v", err)
+		}
+		bodyTemplate = tmpl
+		channelScoped = strings.Contains(body, ".Channel")
+	}
+
+	forwardHeaders = headers
+	return nil
+}
+
+func jsonLiteral(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// NewAuthorizeRequest captures the client details of an upgrade request for later authorize calls
+func NewAuthorizeRequest(r *http.Request, token string) AuthorizeRequest {
+	request := AuthorizeRequest{
+		Token:     token,
+		UserAgent: r.UserAgent(),
+		Headers:   make(http.Header),
+	}
+	if ip := ipfilter.ClientIP(r); ip != nil {
+		request.ClientIP = ip.String()
+	}
+	for _, name := range forwardHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			request.Headers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return request
+}
+
+// newAuthorizeHTTPRequest builds the configured authorize API call for a token check
+func newAuthorizeHTTPRequest(request AuthorizeRequest, authorizeURL string) (*http.Request, error) {
+	var body io.Reader
+	if bodyTemplate != nil {
+		var buf bytes.Buffer
+		if err := bodyTemplate.Execute(&buf, request); err != nil {
+			return nil, fmt.Errorf("failed to render request body: %v", err)
+		}
+		body = &buf
+	}
+
+	req, err := http.NewRequest(authorizeMethod, authorizeURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range request.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+request.Token)
+	return req, nil
+}
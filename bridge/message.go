@@ -0,0 +1,39 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// Delivery is a channel message as published by the send action, the publish API or a
+// bridge, taken apart for clients of other protocols
+type Delivery struct {
+	Channel   string          `json:"channel"`
+	Event     string          `json:"event"`
+	Message   json.RawMessage `json:"message"`
+	MessageID string          `json:"message_id"`
+	SocketID  string          `json:"socket_id"` // Socket ID of the session that published the message
+}
+
+// Decode takes a channel message apart. Payloads that are not JSON objects, such as
+// those of other publishers on the broker, come back whole as the message.
+func Decode(payload string) Delivery {
+	var delivery Delivery
+	if err := json.Unmarshal([]byte(payload), &delivery); err != nil || len(delivery.Message) == 0 {
+		if json.Valid([]byte(payload)) {
+			return Delivery{Message: json.RawMessage(payload)}
+		}
+		message, _ := json.Marshal(payload)
+		return Delivery{Message: message}
+	}
+	return delivery
+}
+
+// clientIP returns the host part of a peer address
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,368 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/acl"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/metrics"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/websocket"
+	"golang.org/x/net/context"
+)
+
+// WriteTimeout is the time a write to a bridged client may take before the connection
+// is closed
+const WriteTimeout = 10 * time.Second
+
+// Reasons a session refuses a client, a subscription or a message
+var (
+	ErrUnknownApp    = errors.New("unknown app key")
+	ErrQuotaExceeded = errors.New("app quota exceeded")
+	ErrUnauthorized  = errors.New("invalid or missing token")
+	ErrForbidden     = errors.New("not allowed on this channel")
+	ErrTooLarge      = errors.New("message too large")
+)
+
+// Refused reports whether an error refuses a client, a subscription or a message, as
+// opposed to a failure of the authorize API or the broker
+func Refused(err error) bool {
+	return errors.Is(err, ErrUnknownApp) || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrUnauthorized) ||
+		errors.Is(err, ErrForbidden) || errors.Is(err, ErrTooLarge)
+}
+
+// ErrorCode returns the code clients of the WebSocket API receive for an error
+func ErrorCode(err error) websocket.ErrorCode {
+	switch {
+	case errors.Is(err, ErrUnknownApp), errors.Is(err, ErrUnauthorized):
+		return websocket.ErrTokenInvalid
+	case errors.Is(err, ErrQuotaExceeded):
+		return websocket.ErrQuotaExceeded
+	case errors.Is(err, ErrForbidden):
+		return websocket.ErrForbidden
+	case errors.Is(err, ErrTooLarge):
+		return websocket.ErrMessageTooLarge
+	case auth.IsUnavailable(err):
+		return websocket.ErrAuthUnavailable
+	case redisconn.IsTimeout(err):
+		return websocket.ErrTimeout
+	}
+	return websocket.ErrInternal
+}
+
+// Session is a client of another protocol than gopush's own WebSocket API. It
+// authenticates, subscribes and publishes like a WebSocket connection, through the same
+// authorize API, ACLs, app quotas and broker, and keeps the client's subscriptions.
+type Session struct {
+	ConnID   string
+	SocketID string // Sent along with the client's messages when set, so it can be spared their echo
+	Log      *slog.Logger
+	Grants   websocket.Grants
+
+	broker broker.Broker
+	rdb    redis.UniversalClient
+	config *config.Config
+
+	namespace string // Channel namespace of the client's app
+	token     string
+	request   auth.AuthorizeRequest
+	acquired  bool // Holds a connection slot of its app
+
+	mu            sync.Mutex
+	subscriptions map[string]*broker.Subscription // Keyed by channel
+}
+
+// NewSession starts the session of a client connected over protocol from remoteAddr
+func NewSession(protocol, remoteAddr string, b broker.Broker, rdb redis.UniversalClient, config *config.Config) *Session {
+	connID := websocket.NewConnectionID()
+	return &Session{
+		ConnID:        connID,
+		Log:           slog.With("conn_id", connID, "remote_addr", remoteAddr, "protocol", protocol),
+		broker:        b,
+		rdb:           rdb,
+		config:        config,
+		request:       auth.AuthorizeRequest{ClientIP: clientIP(remoteAddr)},
+		subscriptions: make(map[string]*broker.Subscription),
+	}
+}
+
+// SetRequest keeps the client details of an HTTP upgrade request for authorize calls
+func (s *Session) SetRequest(request auth.AuthorizeRequest) {
+	s.request = request
+}
+
+// Authenticate admits a client presenting an app key in multi-tenant mode, a client
+// certificate listed in identities or a token. Tokens are validated like upgrade tokens:
+// a client may connect without one unless server.authorize.require_upgrade_token is set,
+// but needs one to subscribe.
+func (s *Session) Authenticate(appKey, token string, state *tls.ConnectionState) error {
+	if apps.Enabled(s.config) {
+		app, ok := apps.Lookup(s.config, appKey)
+		if !ok {
+			s.Log.Warn("Rejected client with unknown app key", "app_key", appKey)
+			s.Audit(audit.ActionAuthenticate, audit.OutcomeDenied, "", "unknown app key")
+			return ErrUnknownApp
+		}
+		if !apps.Acquire(appKey, app) {
+			s.Log.Warn("Rejected client, app is at its connection quota", "app_key", appKey)
+			s.Audit(audit.ActionAuthenticate, audit.OutcomeDenied, "", "app connection quota exceeded")
+			return ErrQuotaExceeded
+		}
+		s.acquired = true
+		s.Grants.AppKey = appKey
+		s.namespace = app.Namespace
+	}
+
+	// Clients with a verified certificate are authenticated by the TLS handshake
+	s.Grants.Identity = auth.CertificateIdentity(state, websocket.KnownIdentity(s.config))
+
+	s.token = token
+	s.request.Token = token
+	if s.Grants.Identity == "" && (token != "" || s.config.Server.Authorize.RequireUpgradeToken) {
+		ctx := reporting.WithFields(context.Background(), reporting.Fields{"conn_id": s.ConnID, "app": appKey})
+		info, err := apps.ValidateToken(ctx, s.rdb, s.config, appKey, s.request)
+		if auth.IsUnavailable(err) {
+			s.Log.Error("Rejected client, authorization service unavailable", "error", err)
+			s.Audit(audit.ActionAuthenticate, audit.OutcomeError, "", err.Error())
+			return err
+		}
+		if token == "" || err != nil || !info.Valid {
+			s.Log.Warn("Rejected unauthorized client", "error", err)
+			s.Audit(audit.ActionAuthenticate, audit.OutcomeDenied, "", "invalid or missing token")
+			return ErrUnauthorized
+		}
+		s.Grants.Channels = info.AllowedChannels
+		s.Grants.Scopes = info.Scopes
+		s.Grants.Roles = info.Roles
+	}
+	s.Audit(audit.ActionAuthenticate, audit.OutcomeAllowed, "", "")
+	return nil
+}
+
+// CanPublish reports whether the client may publish to a channel
+func (s *Session) CanPublish(channel string) bool {
+	return websocket.ChannelAllowed(s.Grants, channel, acl.Write, s.config)
+}
+
+// VerifySignature checks a channel signature issued for the client's socket ID, signed
+// with the secret of its app in multi-tenant mode or one of server.channel_auth.secrets
+func (s *Session) VerifySignature(subject, signature string) bool {
+	secrets := s.config.Server.ChannelAuth.Secrets
+	if s.Grants.AppKey != "" {
+		app, _ := apps.Lookup(s.config, s.Grants.AppKey)
+		secrets = map[string]string{s.Grants.AppKey: app.Secret}
+	}
+	return auth.VerifyChannelSignature(secrets, s.SocketID, subject, signature)
+}
+
+// Subscribe authorizes a subscription like a WebSocket subscription authorized with the
+// connection's token, then passes the channel's messages to deliver until Unsubscribe
+// or Close. Subscribing to a channel again replaces the previous subscription.
+func (s *Session) Subscribe(channel string, deliver func(payload string)) error {
+	if s.Grants.Identity == "" {
+		if s.token == "" {
+			s.Log.Warn("Refused subscription without a token", "action", "subscribe", "channel", channel)
+			s.Audit(audit.ActionSubscribe, audit.OutcomeDenied, channel, "missing token")
+			return ErrUnauthorized
+		}
+		request := s.request
+		request.Channel = channel
+		ctx := reporting.WithFields(context.Background(), reporting.Fields{"conn_id": s.ConnID, "channel": channel})
+		info, err := apps.ValidateToken(ctx, s.rdb, s.config, s.Grants.AppKey, request)
+		if auth.IsUnavailable(err) {
+			s.Log.Error("Token validation failed", "action", "subscribe", "channel", channel, "error", err)
+			s.Audit(audit.ActionSubscribe, audit.OutcomeError, channel, err.Error())
+			return err
+		}
+		if err != nil || !info.Valid || !acl.Granted(info.AllowedChannels, channel) {
+			s.Log.Warn("Token validation failed", "action", "subscribe", "channel", channel, "error", err)
+			s.Audit(audit.ActionSubscribe, audit.OutcomeDenied, channel, "invalid token")
+			return ErrUnauthorized
+		}
+	}
+	return s.SubscribeAuthorized(channel, deliver)
+}
+
+// SubscribeAuthorized subscribes to a channel the client was authorized for by other
+// means than its token, such as a channel signature. The ACLs still apply.
+func (s *Session) SubscribeAuthorized(channel string, deliver func(payload string)) error {
+	if !websocket.ChannelAllowed(s.Grants, channel, acl.Read, s.config) {
+		s.Log.Warn("ACL denied subscription", "action", "subscribe", "channel", channel)
+		s.Audit(audit.ActionSubscribe, audit.OutcomeDenied, channel, "denied by ACL")
+		return ErrForbidden
+	}
+
+	redisChannel := s.namespace + channel
+	sub, err := s.broker.Subscribe(redisChannel, func(msg broker.Message) error {
+		if msg.Gap {
+			return nil
+		}
+		deliver(msg.Payload)
+		metrics.MessageOut(redisChannel, len(msg.Payload))
+		return nil
+	})
+	if err != nil {
+		s.Log.Error("Failed to subscribe", "channel", channel, "error", err)
+		return err
+	}
+
+	s.mu.Lock()
+	previous := s.subscriptions[channel]
+	s.subscriptions[channel] = sub
+	s.mu.Unlock()
+	if previous != nil {
+		s.broker.Unsubscribe(previous)
+		metrics.Unsubscribed(redisChannel)
+	}
+	metrics.Subscribed(redisChannel)
+
+	s.Log.Info("Client subscribed", "action", "subscribe", "channel", channel)
+	s.Audit(audit.ActionSubscribe, audit.OutcomeAllowed, channel, "")
+	return nil
+}
+
+// Unsubscribe ends the subscription of a channel and reports whether there was one
+func (s *Session) Unsubscribe(channel string) bool {
+	s.mu.Lock()
+	sub := s.subscriptions[channel]
+	delete(s.subscriptions, channel)
+	s.mu.Unlock()
+	if sub == nil {
+		return false
+	}
+
+	s.broker.Unsubscribe(sub)
+	metrics.Unsubscribed(sub.Channel)
+	s.Log.Info("Client unsubscribed", "channel", channel)
+	s.Audit(audit.ActionUnsubscribe, audit.OutcomeAllowed, channel, "")
+	return true
+}
+
+// Subscribed reports whether the client is subscribed to a channel
+func (s *Session) Subscribed(channel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subscriptions[channel] != nil
+}
+
+// Publish sends a message to a channel in the format of the publish API and returns its
+// message ID. An empty event is left out.
+func (s *Session) Publish(channel, event string, message json.RawMessage) (string, error) {
+	if !s.CanPublish(channel) {
+		s.Log.Warn("ACL denied publish", "action", "publish", "channel", channel)
+		s.Audit(audit.ActionPublish, audit.OutcomeDenied, channel, "denied by ACL")
+		return "", ErrForbidden
+	}
+
+	messageID := websocket.NewMessageID()
+	data := map[string]interface{}{
+		"channel":         channel,
+		"message":         message,
+		"message_id":      messageID,
+		"published_at_ms": time.Now().UnixMilli(),
+	}
+	if event != "" {
+		data["event"] = event
+	}
+	if s.SocketID != "" {
+		data["socket_id"] = s.SocketID
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	if websocket.PayloadTooLarge(payload) {
+		s.Log.Warn("Dropped message over the payload limit", "action", "publish", "channel", channel, "size", len(payload))
+		return "", ErrTooLarge
+	}
+	if s.Grants.AppKey != "" {
+		app, _ := apps.Lookup(s.config, s.Grants.AppKey)
+		if !apps.AllowPublish(s.Grants.AppKey, app) {
+			s.Audit(audit.ActionPublish, audit.OutcomeDenied, channel, "app publish quota exceeded")
+			return "", ErrQuotaExceeded
+		}
+	}
+
+	redisChannel := s.namespace + channel
+	ctx, cancel := redisconn.WithPublishTimeout(context.Background())
+	err = websocket.Publish(ctx, redisChannel, payload)
+	cancel()
+	if err != nil {
+		s.Log.Error("Failed to publish message", "action", "publish", "channel", redisChannel, "error", err)
+		s.Audit(audit.ActionPublish, audit.OutcomeError, channel, err.Error())
+		return "", err
+	}
+	s.Audit(audit.ActionPublish, audit.OutcomeAllowed, channel, "")
+	return messageID, nil
+}
+
+// Announce publishes an event of the server itself to a channel, such as a presence
+// change. The client's ACLs and publish quota do not apply.
+func (s *Session) Announce(channel, event string, message json.RawMessage) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"channel":         channel,
+		"event":           event,
+		"message":         message,
+		"message_id":      websocket.NewMessageID(),
+		"published_at_ms": time.Now().UnixMilli(),
+		"socket_id":       s.SocketID,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := redisconn.WithPublishTimeout(context.Background())
+	defer cancel()
+	if err := websocket.Publish(ctx, s.namespace+channel, payload); err != nil {
+		s.Log.Error("Failed to announce event", "channel", channel, "event", event, "error", err)
+		return err
+	}
+	return nil
+}
+
+// RedisChannel returns the broker channel of a client channel in the namespace of its app
+func (s *Session) RedisChannel(channel string) string {
+	return s.namespace + channel
+}
+
+// Close ends every subscription of the session and gives back its app connection slot
+func (s *Session) Close() {
+	s.mu.Lock()
+	subscriptions := s.subscriptions
+	s.subscriptions = make(map[string]*broker.Subscription)
+	s.mu.Unlock()
+	for _, sub := range subscriptions {
+		s.broker.Unsubscribe(sub)
+		metrics.Unsubscribed(sub.Channel)
+	}
+
+	if s.acquired {
+		apps.Release(s.Grants.AppKey)
+		s.acquired = false
+	}
+}
+
+// Audit records an event of the client in the audit log
+func (s *Session) Audit(action, outcome, channel, reason string) {
+	audit.Record(audit.Event{
+		Action:     action,
+		Outcome:    outcome,
+		ConnID:     s.ConnID,
+		RemoteAddr: s.request.ClientIP,
+		Identity:   s.Grants.Identity,
+		App:        s.Grants.AppKey,
+		Channel:    channel,
+		Reason:     reason,
+	})
+}
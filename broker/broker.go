@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// Logger of the broker package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the broker package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Message is a payload received on a subscribed channel
+type Message struct {
+	Channel string
+	Payload string
+	Gap     bool // The subscription was interrupted and earlier messages may be missing, Payload is empty
+}
+
+// Handler receives the messages of a subscription one at a time. Backends that track
+// delivery hand a message over again when the handler returned an error for it.
+type Handler func(Message) error
+
+// Broker carries messages from publishers to the subscribers of a channel on every server
+type Broker interface {
+	// Publish sends a payload to every subscriber of a channel and keeps it for History
+	Publish(ctx context.Context, channel string, payload []byte) error
+
+	// Subscribe passes a channel's messages to a handler until Unsubscribe is called.
+	// Lost connections are restored in the background and reported as a Gap message.
+	Subscribe(channel string, handler Handler) (*Subscription, error)
+
+	// Unsubscribe stops a subscription
+	Unsubscribe(sub *Subscription)
+
+	// History returns the payloads published on a channel after a point in time, oldest first
+	History(ctx context.Context, channel string, since time.Time) ([]string, error)
+}
+
+// PatternSubscriber is implemented by brokers that can subscribe to every channel matching
+// a glob pattern at once, where * matches any characters and ? a single one. Such a subscription also receives messages
+// published to the broker directly, on every server holding one. Its handler is called with
+// the channel each message was published to, possibly from several goroutines, and the
+// subscription is stopped with Unsubscribe.
+type PatternSubscriber interface {
+	SubscribePattern(pattern string, handler Handler) (*Subscription, error)
+}
+
+// ErrPatternsUnsupported is returned by SubscribePattern when the broker's configuration
+// has no pattern subscriptions
+var ErrPatternsUnsupported = errors.New("pattern subscriptions are not supported by the broker")
+
+// Subscription is a running subscription of a Broker
+type Subscription struct {
+	Channel string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start runs a backend's receive loop for a channel in the background. The loop must
+// return once its context is canceled.
+func start(channel string, loop func(ctx context.Context)) *Subscription {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := &Subscription{Channel: channel, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(sub.done)
+		loop(ctx)
+	}()
+	return sub
+}
+
+// Done is closed once the subscription has stopped
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// stop ends a subscription started with start
+func (s *Subscription) stop() {
+	s.cancel()
+}
+
+// New creates the broker selected by broker.type in the config
+func New(config *config.Config) (Broker, error) {
+	switch config.Broker.Type {
+	case "", "redis":
+		return newRedisBroker(config), nil
+	case "nats":
+		return newNATSBroker(config)
+	case "kafka":
+		return newKafkaBroker(config)
+	case "amqp":
+		return newAMQPBroker(config)
+	case "pubsub":
+		return newPubSubBroker(config)
+	case "memory":
+		return newMemoryBroker(config), nil
+	}
+	return nil, fmt.Errorf("unknown broker type '%s'", config.Broker.Type)
+}
+
+// History limits used when the resume block is missing from the config
+const (
+	defaultBufferTTL  = 2 * time.Minute
+	defaultBufferSize = 100
+)
+
+// bufferTTL returns how long published messages are kept for History
+func bufferTTL(config *config.Config) time.Duration {
+	if config.Server.Resume.BufferTTL > 0 {
+		return time.Duration(config.Server.Resume.BufferTTL) * time.Second
+	}
+	return defaultBufferTTL
+}
+
+// bufferSize returns how many published messages are kept per channel for History
+func bufferSize(config *config.Config) int {
+	if config.Server.Resume.BufferSize > 0 {
+		return config.Server.Resume.BufferSize
+	}
+	return defaultBufferSize
+}
+
+// Delays between attempts to restore a lost subscription
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// nextDelay doubles a retry delay up to retryMaxDelay
+func nextDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return delay
+}
+
+// sleep waits for a delay, returning false when the context is canceled first
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,169 @@
+package broker
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Messages a subscriber can fall behind by before newer ones are dropped
+const fanoutQueueSize = 256
+
+// fanout hands messages received once per process to every local subscription of
+// their channel, or of a pattern matching it. Backends that deliver to the server rather
+// than to each subscription (memory, AMQP) build on it.
+type fanout struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*Subscription]*queuedSubscriber
+}
+
+// queuedSubscriber queues a subscription's messages so a slow handler does not hold up the others
+type queuedSubscriber struct {
+	queue    chan Message
+	overflow chan struct{}
+}
+
+func newFanout() *fanout {
+	return &fanout{subscribers: make(map[string]map[*Subscription]*queuedSubscriber)}
+}
+
+// add starts a subscription fed by deliver and reports whether it is the channel's first
+func (f *fanout) add(channel string, handler Handler) (*Subscription, bool) {
+	subscriber := &queuedSubscriber{
+		queue:    make(chan Message, fanoutQueueSize),
+		overflow: make(chan struct{}, 1),
+	}
+
+	sub := start(channel, func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-subscriber.overflow:
+				handler(Message{Channel: channel, Gap: true})
+			case msg := <-subscriber.queue:
+				handler(msg)
+			}
+		}
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	first := len(f.subscribers[channel]) == 0
+	if first {
+		f.subscribers[channel] = make(map[*Subscription]*queuedSubscriber)
+	}
+	f.subscribers[channel][sub] = subscriber
+	return sub, first
+}
+
+// remove stops a subscription and reports whether it was the channel's last
+func (f *fanout) remove(sub *Subscription) bool {
+	f.mu.Lock()
+	_, ok := f.subscribers[sub.Channel][sub]
+	delete(f.subscribers[sub.Channel], sub)
+	last := ok && len(f.subscribers[sub.Channel]) == 0
+	if last {
+		delete(f.subscribers, sub.Channel)
+	}
+	f.mu.Unlock()
+
+	sub.stop()
+	return last
+}
+
+// deliver queues a payload for every subscription of a channel
+func (f *fanout) deliver(channel, payload string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, subscriber := range f.subscribers[channel] {
+		subscriber.send(Message{Channel: channel, Payload: payload})
+	}
+}
+
+// deliverMatching queues a payload for every subscription added under a pattern matching its channel
+func (f *fanout) deliverMatching(channel, payload string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for pattern, subscribers := range f.subscribers {
+		if !matchGlob(pattern, channel) {
+			continue
+		}
+		for _, subscriber := range subscribers {
+			subscriber.send(Message{Channel: channel, Payload: payload})
+		}
+	}
+}
+
+// gapAll tells every subscription that messages may have been lost
+func (f *fanout) gapAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, subscribers := range f.subscribers {
+		for _, subscriber := range subscribers {
+			subscriber.gap()
+		}
+	}
+}
+
+// channels returns the channels with at least one subscription
+func (f *fanout) channels() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channels := make([]string, 0, len(f.subscribers))
+	for channel := range f.subscribers {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func (s *queuedSubscriber) send(msg Message) {
+	select {
+	case s.queue <- msg:
+	default:
+		// The subscriber is too far behind, tell it that messages were lost
+		s.gap()
+	}
+}
+
+func (s *queuedSubscriber) gap() {
+	select {
+	case s.overflow <- struct{}{}:
+	default:
+	}
+}
+
+// matchGlob reports whether a channel matches a pattern the way Redis PSUBSCRIBE matches
+// it: * stands for any characters, / included, ? for one and \\ escapes the next one
+func matchGlob(pattern, channel string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(channel); i >= 0; i-- {
+				if matchGlob(pattern[1:], channel[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if channel == "" {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if channel == "" || channel[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, channel = pattern[1:], channel[1:]
+	}
+	return channel == ""
+}
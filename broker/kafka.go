@@ -0,0 +1,322 @@
+//go:build kafka
+
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sahakavatar/gopush/config"
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/net/context"
+)
+
+// Default shared topic used when the kafka block does not name one
+const defaultKafkaTopic = "gopush"
+
+// How long a reader waits for new messages before polling again
+const kafkaMaxWait = time.Second
+
+// How long the startup cleanup of stale consumer groups may take
+const kafkaCleanupTimeout = 10 * time.Second
+
+// kafkaBroker delivers messages through Kafka, either on one shared topic keyed by
+// channel or on a topic per channel. Each server consumes through one consumer group of
+// its own, with a reader per topic its clients subscribed to, and fans the messages of
+// subscribed channels out locally.
+type kafkaBroker struct {
+	brokers         []string
+	topic           string
+	topicPerChannel bool
+	topicPrefix     string
+	groupPrefix     string
+	group           string
+	writer          *kafka.Writer
+
+	subscribers *fanout
+
+	mu       sync.Mutex
+	readers  map[string]*kafkaReader
+	consumed map[string]bool // Topics the group has committed offsets in
+}
+
+// kafkaReader consumes one topic for the channels of the server subscribed to it
+type kafkaReader struct {
+	channels int
+	cancel   context.CancelFunc
+}
+
+func newKafkaBroker(config *config.Config) (Broker, error) {
+	settings := config.Broker.Kafka
+	if len(settings.Brokers) == 0 {
+		return nil, fmt.Errorf("broker.kafka.brokers is empty")
+	}
+
+	b := &kafkaBroker{
+		brokers:         settings.Brokers,
+		topic:           settings.Topic,
+		topicPerChannel: settings.TopicPerChannel,
+		topicPrefix:     settings.TopicPrefix,
+		groupPrefix:     settings.GroupPrefix,
+		subscribers:     newFanout(),
+		readers:         make(map[string]*kafkaReader),
+		consumed:        make(map[string]bool),
+	}
+	if b.topic == "" {
+		b.topic = defaultKafkaTopic
+	}
+	if b.groupPrefix == "" {
+		b.groupPrefix = "gopush-"
+	}
+	b.group = b.groupPrefix + newGroupName()
+
+	b.writer = &kafka.Writer{
+		Addr: kafka.TCP(settings.Brokers...),
+		// Messages of one channel share a key and therefore a partition, keeping them in order
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireOne,
+		AllowAutoTopicCreation: settings.TopicPerChannel,
+		BatchTimeout:           10 * time.Millisecond,
+	}
+
+	b.deleteStaleGroups()
+	return b, nil
+}
+
+// deleteStaleGroups deletes the consumer groups left behind by servers that stopped.
+// Groups of running servers have members and are kept.
+func (b *kafkaBroker) deleteStaleGroups() {
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaCleanupTimeout)
+	defer cancel()
+
+	client := &kafka.Client{Addr: kafka.TCP(b.brokers...)}
+	listed, err := client.ListGroups(ctx, &kafka.ListGroupsRequest{})
+	if err != nil {
+		logger.Warn("Failed to list Kafka consumer groups", "error", err)
+		return
+	}
+
+	var groups []string
+	for _, group := range listed.Groups {
+		if strings.HasPrefix(group.GroupID, b.groupPrefix) {
+			groups = append(groups, group.GroupID)
+		}
+	}
+	if len(groups) == 0 {
+		return
+	}
+
+	described, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: groups})
+	if err != nil {
+		logger.Warn("Failed to describe Kafka consumer groups", "error", err)
+		return
+	}
+	for _, group := range described.Groups {
+		if group.Error != nil || group.GroupState != "Empty" {
+			continue
+		}
+		// Each request goes to the coordinator of its first group, so delete them one at a time
+		deleted, err := client.DeleteGroups(ctx, &kafka.DeleteGroupsRequest{GroupIDs: []string{group.GroupID}})
+		if err == nil {
+			err = deleted.Errors[group.GroupID]
+		}
+		if err != nil {
+			logger.Warn("Failed to delete stale Kafka consumer group", "group", group.GroupID, "error", err)
+			continue
+		}
+		logger.Info("Deleted stale Kafka consumer group", "group", group.GroupID)
+	}
+}
+
+// topicFor returns the topic holding a channel's messages. Per-channel topic names keep
+// the characters Kafka allows and hex-encode the rest.
+func (b *kafkaBroker) topicFor(channel string) string {
+	if !b.topicPerChannel {
+		return b.topic
+	}
+
+	name := []byte(b.topicPrefix)
+	for i := 0; i < len(channel); i++ {
+		c := channel[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' {
+			name = append(name, c)
+		} else {
+			name = append(name, fmt.Sprintf("_%02X", c)...)
+		}
+	}
+	return string(name)
+}
+
+func (b *kafkaBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.writer.WriteMessages(ctx, kafka.Message{
+		Topic: b.topicFor(channel),
+		Key:   []byte(channel),
+		Value: payload,
+	})
+}
+
+// Subscribe starts reading the channel's topic when no other local subscription reads it yet
+func (b *kafkaBroker) Subscribe(channel string, handler Handler) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, first := b.subscribers.add(channel, handler)
+	if !first {
+		return sub, nil
+	}
+
+	topic := b.topicFor(channel)
+	reader, ok := b.readers[topic]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		reader = &kafkaReader{cancel: cancel}
+		b.readers[topic] = reader
+
+		// A topic read again after a pause resumes from the group's committed offset,
+		// and what was published meanwhile had no subscriber to go to
+		var since time.Time
+		if b.consumed[topic] {
+			since = time.Now()
+		}
+		b.consumed[topic] = true
+		go b.consume(ctx, topic, since)
+	}
+	reader.channels++
+	return sub, nil
+}
+
+// Unsubscribe stops reading a topic once none of its channels has a local subscription left
+func (b *kafkaBroker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.subscribers.remove(sub) {
+		return
+	}
+
+	topic := b.topicFor(sub.Channel)
+	if reader, ok := b.readers[topic]; ok {
+		reader.channels--
+		if reader.channels == 0 {
+			reader.cancel()
+			delete(b.readers, topic)
+		}
+	}
+}
+
+// consume reads a topic through the server's consumer group, skipping messages older
+// than since. A failed read restarts the reader from the group's committed offset.
+func (b *kafkaBroker) consume(ctx context.Context, topic string, since time.Time) {
+	logger.Info("Consuming Kafka topic", "topic", topic, "group", b.group)
+
+	delay := retryBaseDelay
+	for ctx.Err() == nil {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     b.brokers,
+			GroupID:     b.group,
+			Topic:       topic,
+			StartOffset: kafka.LastOffset,
+			MaxWait:     kafkaMaxWait,
+		})
+
+		err := b.readMessages(ctx, reader, since)
+		reader.Close()
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Warn("Kafka reader stopped, restarting", "topic", topic, "delay", delay, "error", err)
+		b.subscribers.gapAll()
+		sleep(ctx, delay)
+		delay = nextDelay(delay)
+	}
+}
+
+// readMessages passes a reader's messages to the local subscribers of their channel and commits them
+func (b *kafkaBroker) readMessages(ctx context.Context, reader *kafka.Reader, since time.Time) error {
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Messages are keyed by channel, and channels without local subscribers are skipped
+		if !msg.Time.Before(since) {
+			b.subscribers.deliver(string(msg.Key), string(msg.Value))
+		}
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// History reads the channel's messages written after a point in time, looking offsets
+// up by timestamp in every partition of its topic
+func (b *kafkaBroker) History(ctx context.Context, channel string, since time.Time) ([]string, error) {
+	topic := b.topicFor(channel)
+
+	conn, err := kafka.DialContext(ctx, "tcp", b.brokers[0])
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []kafka.Message
+	for _, partition := range partitions {
+		read, err := b.readPartitionSince(ctx, topic, partition.ID, channel, since)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, read...)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Time.Before(messages[j].Time) })
+	payloads := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		payloads = append(payloads, string(msg.Value))
+	}
+	return payloads, nil
+}
+
+func (b *kafkaBroker) readPartitionSince(ctx context.Context, topic string, partition int, channel string, since time.Time) ([]kafka.Message, error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", b.brokers[0], topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	offset, err := conn.ReadOffset(since.Add(time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	last, err := conn.ReadLastOffset()
+	if err != nil || offset >= last {
+		return nil, err
+	}
+	if _, err := conn.Seek(offset, kafka.SeekAbsolute); err != nil {
+		return nil, err
+	}
+
+	var messages []kafka.Message
+	batch := conn.ReadBatch(1, 10e6)
+	defer batch.Close()
+	for offset < last {
+		msg, err := batch.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		offset = msg.Offset + 1
+		if string(msg.Key) == channel {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
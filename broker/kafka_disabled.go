@@ -0,0 +1,15 @@
+//go:build !kafka
+
+package broker
+
+import (
+	"fmt"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// newKafkaBroker reports that Kafka support was left out of this build. The Kafka client
+// is only compiled in with the kafka build tag.
+func newKafkaBroker(config *config.Config) (Broker, error) {
+	return nil, fmt.Errorf("this server was built without Kafka support, rebuild it with -tags kafka")
+}
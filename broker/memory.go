@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// memoryBroker fans messages out to the subscriptions of this process only. It needs no
+// external service, which suits single-server installs, but servers running it do not
+// see each other's messages.
+type memoryBroker struct {
+	ttl  time.Duration
+	size int
+
+	subscribers *fanout
+	patterns    *fanout // Pattern subscriptions, keyed by pattern
+
+	mu      sync.Mutex
+	history map[string][]storedMessage
+}
+
+// storedMessage is a published payload kept for History
+type storedMessage struct {
+	at      time.Time
+	payload string
+}
+
+func newMemoryBroker(config *config.Config) Broker {
+	b := &memoryBroker{
+		ttl:         bufferTTL(config),
+		size:        bufferSize(config),
+		subscribers: newFanout(),
+		patterns:    newFanout(),
+		history:     make(map[string][]storedMessage),
+	}
+	go b.expireHistory()
+	return b
+}
+
+// expireHistory periodically forgets stored messages of channels nobody publishes to anymore
+func (b *memoryBroker) expireHistory() {
+	ticker := time.NewTicker(b.ttl)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		b.mu.Lock()
+		for channel := range b.history {
+			if stored := b.trim(channel, now); stored != nil {
+				b.history[channel] = stored
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	now := time.Now()
+
+	b.mu.Lock()
+	b.history[channel] = append(b.trim(channel, now), storedMessage{at: now, payload: string(payload)})
+	if len(b.history[channel]) > b.size {
+		b.history[channel] = b.history[channel][len(b.history[channel])-b.size:]
+	}
+	b.mu.Unlock()
+
+	b.subscribers.deliver(channel, string(payload))
+	b.patterns.deliverMatching(channel, string(payload))
+	return nil
+}
+
+// trim drops a channel's stored messages that are older than the buffer TTL. The lock must be held.
+func (b *memoryBroker) trim(channel string, now time.Time) []storedMessage {
+	stored := b.history[channel]
+	for len(stored) > 0 && now.Sub(stored[0].at) > b.ttl {
+		stored = stored[1:]
+	}
+	if len(stored) == 0 {
+		delete(b.history, channel)
+		return nil
+	}
+	return stored
+}
+
+func (b *memoryBroker) Subscribe(channel string, handler Handler) (*Subscription, error) {
+	sub, _ := b.subscribers.add(channel, handler)
+	return sub, nil
+}
+
+func (b *memoryBroker) SubscribePattern(pattern string, handler Handler) (*Subscription, error) {
+	sub, _ := b.patterns.add(pattern, handler)
+	return sub, nil
+}
+
+func (b *memoryBroker) Unsubscribe(sub *Subscription) {
+	b.subscribers.remove(sub)
+	b.patterns.remove(sub)
+}
+
+func (b *memoryBroker) History(ctx context.Context, channel string, since time.Time) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var payloads []string
+	for _, stored := range b.trim(channel, time.Now()) {
+		if stored.at.After(since) {
+			payloads = append(payloads, stored.payload)
+		}
+	}
+	return payloads, nil
+}
@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// memoryConfig returns a config for a memory broker keeping size messages per channel
+func memoryConfig(size int) *config.Config {
+	cfg := &config.Config{}
+	cfg.Broker.Type = "memory"
+	cfg.Server.Resume.BufferSize = size
+	cfg.Server.Resume.BufferTTL = 60
+	return cfg
+}
+
+// collect subscribes a handler that passes messages on to the returned channel
+func collect(t *testing.T, subscribe func(Handler) (*Subscription, error)) (*Subscription, <-chan Message) {
+	t.Helper()
+	messages := make(chan Message, 1024)
+	sub, err := subscribe(func(msg Message) error {
+		messages <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	return sub, messages
+}
+
+// receive waits for the next message of a subscription
+func receive(t *testing.T, messages <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return Message{}
+	}
+}
+
+// nothing checks that a subscription receives no message for a moment
+func nothing(t *testing.T, messages <-chan Message) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Errorf("unexpected message %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerDelivery(t *testing.T) {
+	b := newMemoryBroker(memoryConfig(10))
+	first, firstMessages := collect(t, func(h Handler) (*Subscription, error) { return b.Subscribe("news", h) })
+	_, secondMessages := collect(t, func(h Handler) (*Subscription, error) { return b.Subscribe("news", h) })
+	_, otherMessages := collect(t, func(h Handler) (*Subscription, error) { return b.Subscribe("sports", h) })
+
+	if err := b.Publish(context.Background(), "news", []byte("hello")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	want := Message{Channel: "news", Payload: "hello"}
+	if got := receive(t, firstMessages); got != want {
+		t.Errorf("first subscriber got %+v, want %+v", got, want)
+	}
+	if got := receive(t, secondMessages); got != want {
+		t.Errorf("second subscriber got %+v, want %+v", got, want)
+	}
+	nothing(t, otherMessages)
+
+	b.Unsubscribe(first)
+	select {
+	case <-first.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscription did not stop")
+	}
+	b.Publish(context.Background(), "news", []byte("again"))
+	if got := receive(t, secondMessages); got.Payload != "again" {
+		t.Errorf("remaining subscriber got %+v", got)
+	}
+	nothing(t, firstMessages)
+}
+
+func TestMemoryBrokerOrder(t *testing.T) {
+	b := newMemoryBroker(memoryConfig(10))
+	_, messages := collect(t, func(h Handler) (*Subscription, error) { return b.Subscribe("news", h) })
+
+	for i := 0; i < 100; i++ {
+		b.Publish(context.Background(), "news", []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 100; i++ {
+		if got := receive(t, messages); got.Payload != fmt.Sprint(i) {
+			t.Fatalf("message %d has payload %q", i, got.Payload)
+		}
+	}
+}
+
+func TestMemoryBrokerPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		channel string
+		want    bool
+	}{
+		{"*", "news", true},
+		{"orders-*", "orders-42", true},
+		{"orders-*", "invoices-42", false},
+		{"team/*", "team/a/b", true},
+		{"user-?", "user-1", true},
+		{"user-?", "user-12", false},
+		{`news\*`, "news*", true},
+		{`news\*`, "news-1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.channel, func(t *testing.T) {
+			b := newMemoryBroker(memoryConfig(10)).(*memoryBroker)
+			sub, messages := collect(t, func(h Handler) (*Subscription, error) { return b.SubscribePattern(tt.pattern, h) })
+			defer b.Unsubscribe(sub)
+
+			b.Publish(context.Background(), tt.channel, []byte("hello"))
+			if !tt.want {
+				nothing(t, messages)
+				return
+			}
+			if got := receive(t, messages); got.Channel != tt.channel || got.Payload != "hello" {
+				t.Errorf("pattern subscriber got %+v", got)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerHistory(t *testing.T) {
+	b := newMemoryBroker(memoryConfig(3))
+	before := time.Now().Add(-time.Second)
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		b.Publish(context.Background(), "news", []byte(payload))
+	}
+
+	tests := []struct {
+		name    string
+		channel string
+		since   time.Time
+		want    []string
+	}{
+		{"last buffer_size messages", "news", before, []string{"2", "3", "4"}},
+		{"nothing after now", "news", time.Now().Add(time.Second), nil},
+		{"other channel", "sports", before, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.History(context.Background(), tt.channel, tt.since)
+			if err != nil {
+				t.Fatalf("History: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("History = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerGap(t *testing.T) {
+	b := newMemoryBroker(memoryConfig(10))
+	release := make(chan struct{})
+	messages := make(chan Message, 2*fanoutQueueSize)
+	b.Subscribe("news", func(msg Message) error {
+		<-release
+		messages <- msg
+		return nil
+	})
+
+	// The handler blocks on the first message, so the queue overflows
+	for i := 0; i < fanoutQueueSize+10; i++ {
+		b.Publish(context.Background(), "news", []byte(fmt.Sprint(i)))
+	}
+	close(release)
+
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case msg := <-messages:
+			if msg.Gap {
+				return
+			}
+		case <-deadline:
+			t.Fatal("subscriber that fell behind got no gap")
+		}
+	}
+}
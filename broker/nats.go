@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// Defaults used when the nats block is missing from the config
+const (
+	defaultSubjectPrefix = "gopush"
+	defaultStreamName    = "GOPUSH"
+)
+
+// How long History waits for JetStream to deliver the stored messages
+const historyFetchTimeout = 5 * time.Second
+
+// natsBroker delivers messages through core NATS subjects. With JetStream, messages are
+// also stored in a stream so History can replay them.
+type natsBroker struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream // nil without JetStream
+	stream string
+	prefix string
+
+	mu          sync.Mutex
+	reconnected chan struct{} // Closed and replaced after every reconnect
+}
+
+func newNATSBroker(config *config.Config) (*natsBroker, error) {
+	settings := config.Broker.NATS
+
+	b := &natsBroker{
+		prefix:      settings.SubjectPrefix,
+		stream:      settings.Stream,
+		reconnected: make(chan struct{}),
+	}
+	if b.prefix == "" {
+		b.prefix = defaultSubjectPrefix
+	}
+	if b.stream == "" {
+		b.stream = defaultStreamName
+	}
+
+	url := settings.Url
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	options := []nats.Option{
+		nats.Name("gopush"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn("Disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.Info("Reconnected to NATS", "url", conn.ConnectedUrl())
+			b.mu.Lock()
+			close(b.reconnected)
+			b.reconnected = make(chan struct{})
+			b.mu.Unlock()
+		}),
+	}
+	if settings.CredentialsFile != "" {
+		options = append(options, nats.UserCredentials(settings.CredentialsFile))
+	}
+
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %v", url, err)
+	}
+	b.conn = conn
+
+	if !settings.JetStream {
+		return b, nil
+	}
+
+	b.js, err = jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up JetStream: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), historyFetchTimeout)
+	defer cancel()
+	_, err = b.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:              b.stream,
+		Subjects:          []string{b.prefix + ".>"},
+		MaxAge:            bufferTTL(config),
+		MaxMsgsPerSubject: int64(bufferSize(config)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream stream %s: %v", b.stream, err)
+	}
+	return b, nil
+}
+
+// subject maps a channel to a single NATS subject token under the prefix. Characters
+// NATS gives a meaning to, such as . * and >, are percent-encoded.
+func (b *natsBroker) subject(channel string) string {
+	var token strings.Builder
+	for i := 0; i < len(channel); i++ {
+		c := channel[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == ':' {
+			token.WriteByte(c)
+		} else {
+			fmt.Fprintf(&token, "%%%02X", c)
+		}
+	}
+	return b.prefix + "." + token.String()
+}
+
+func (b *natsBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	if b.js != nil {
+		_, err := b.js.Publish(ctx, b.subject(channel), payload)
+		return err
+	}
+	return b.conn.Publish(b.subject(channel), payload)
+}
+
+// Subscribe listens on the channel's subject. NATS restores subscriptions after a
+// reconnect by itself; messages published while disconnected are lost, so every
+// reconnect is reported as a gap.
+func (b *natsBroker) Subscribe(channel string, handler Handler) (*Subscription, error) {
+	// Messages are handed over one at a time, like the other backends
+	var handlerMu sync.Mutex
+	sub, err := b.conn.Subscribe(b.subject(channel), func(msg *nats.Msg) {
+		handlerMu.Lock()
+		defer handlerMu.Unlock()
+		handler(Message{Channel: channel, Payload: string(msg.Data)})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return start(channel, func(ctx context.Context) {
+		defer sub.Unsubscribe()
+		for {
+			b.mu.Lock()
+			reconnected := b.reconnected
+			b.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-reconnected:
+				handlerMu.Lock()
+				handler(Message{Channel: channel, Gap: true})
+				handlerMu.Unlock()
+			}
+		}
+	}), nil
+}
+
+func (b *natsBroker) Unsubscribe(sub *Subscription) {
+	sub.stop()
+}
+
+// History replays the channel's messages stored by JetStream. Without JetStream nothing
+// is stored and History returns no messages.
+func (b *natsBroker) History(ctx context.Context, channel string, since time.Time) ([]string, error) {
+	if b.js == nil {
+		return nil, nil
+	}
+
+	start := since.Add(time.Millisecond)
+	consumer, err := b.js.CreateConsumer(ctx, b.stream, jetstream.ConsumerConfig{
+		FilterSubject:     b.subject(channel),
+		DeliverPolicy:     jetstream.DeliverByStartTimePolicy,
+		OptStartTime:      &start,
+		AckPolicy:         jetstream.AckNonePolicy,
+		InactiveThreshold: time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer b.js.DeleteConsumer(context.Background(), b.stream, consumer.CachedInfo().Name)
+
+	pending := int(consumer.CachedInfo().NumPending)
+	if pending == 0 {
+		return nil, nil
+	}
+
+	batch, err := consumer.Fetch(pending, jetstream.FetchMaxWait(historyFetchTimeout))
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([]string, 0, pending)
+	for msg := range batch.Messages() {
+		payloads = append(payloads, string(msg.Data()))
+	}
+	return payloads, batch.Error()
+}
@@ -0,0 +1,238 @@
+//go:build pubsub
+
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+// Defaults used when the pubsub block is missing from the config
+const (
+	defaultPubSubTopic              = "gopush"
+	defaultPubSubSubscriptionPrefix = "gopush-"
+)
+
+// Subscriptions left behind by a server that stopped without deleting them are removed
+// by Pub/Sub after this long without activity, the shortest expiration it allows
+const pubsubSubscriptionExpiry = 24 * time.Hour
+
+// pubsubBroker delivers messages through Google Cloud Pub/Sub, on a topic per channel or
+// on one shared topic with the channel as message attribute. Each server creates a
+// subscription per channel its clients subscribed to and fans its messages out locally.
+type pubsubBroker struct {
+	client             *pubsub.Client
+	topic              string
+	topicPerChannel    bool
+	topicPrefix        string
+	subscriptionPrefix string
+
+	subscribers *fanout
+
+	mu        sync.Mutex
+	topics    map[string]*pubsub.Topic
+	receivers map[string]context.CancelFunc
+}
+
+func newPubSubBroker(config *config.Config) (Broker, error) {
+	settings := config.Broker.PubSub
+	if settings.ProjectID == "" {
+		return nil, fmt.Errorf("broker.pubsub.project_id is empty")
+	}
+
+	var options []option.ClientOption
+	if settings.CredentialsFile != "" {
+		options = append(options, option.WithCredentialsFile(settings.CredentialsFile))
+	}
+	client, err := pubsub.NewClient(context.Background(), settings.ProjectID, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %v", err)
+	}
+
+	b := &pubsubBroker{
+		client:             client,
+		topic:              settings.Topic,
+		topicPerChannel:    settings.TopicPerChannel,
+		topicPrefix:        settings.TopicPrefix,
+		subscriptionPrefix: settings.SubscriptionPrefix,
+		subscribers:        newFanout(),
+		topics:             make(map[string]*pubsub.Topic),
+		receivers:          make(map[string]context.CancelFunc),
+	}
+	if b.topic == "" {
+		b.topic = defaultPubSubTopic
+	}
+	if b.subscriptionPrefix == "" {
+		b.subscriptionPrefix = defaultPubSubSubscriptionPrefix
+	}
+	return b, nil
+}
+
+// topicID returns the ID of the topic holding a channel's messages. Per-channel topic
+// IDs keep the characters Pub/Sub allows and percent-encode the rest.
+func (b *pubsubBroker) topicID(channel string) string {
+	if !b.topicPerChannel {
+		return b.topic
+	}
+
+	id := []byte(b.topicPrefix)
+	for i := 0; i < len(channel); i++ {
+		c := channel[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '+' {
+			id = append(id, c)
+		} else {
+			id = append(id, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(id)
+}
+
+// topicFor returns the channel's topic, creating it on first use
+func (b *pubsubBroker) topicFor(ctx context.Context, channel string) (*pubsub.Topic, error) {
+	id := b.topicID(channel)
+
+	b.mu.Lock()
+	topic, ok := b.topics[id]
+	b.mu.Unlock()
+	if ok {
+		return topic, nil
+	}
+
+	topic = b.client.Topic(id)
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if topic, err = b.client.CreateTopic(ctx, id); err != nil {
+			return nil, fmt.Errorf("failed to create topic %s: %v", id, err)
+		}
+	}
+	// Messages of one channel share an ordering key and arrive in order
+	topic.EnableMessageOrdering = true
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cached, ok := b.topics[id]; ok {
+		topic.Stop()
+		return cached, nil
+	}
+	b.topics[id] = topic
+	return topic, nil
+}
+
+func (b *pubsubBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	topic, err := b.topicFor(ctx, channel)
+	if err != nil {
+		return err
+	}
+
+	result := topic.Publish(ctx, &pubsub.Message{
+		Data:        payload,
+		Attributes:  map[string]string{"channel": channel},
+		OrderingKey: channel,
+	})
+	if _, err := result.Get(ctx); err != nil {
+		// A failed publish pauses its ordering key until resumed
+		topic.ResumePublish(channel)
+		return err
+	}
+	return nil
+}
+
+// Subscribe creates the server's Pub/Sub subscription for a channel when it is the
+// channel's first local subscription
+func (b *pubsubBroker) Subscribe(channel string, handler Handler) (*Subscription, error) {
+	b.mu.Lock()
+	sub, first := b.subscribers.add(channel, handler)
+	b.mu.Unlock()
+	if !first {
+		return sub, nil
+	}
+
+	if err := b.receive(channel); err != nil {
+		b.Unsubscribe(sub)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// receive creates a subscription for a channel and passes its messages to the local
+// subscribers until the channel's last subscriber leaves, then deletes it
+func (b *pubsubBroker) receive(channel string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	topic, err := b.topicFor(ctx, channel)
+	if err != nil {
+		cancel()
+		return err
+	}
+	settings := pubsub.SubscriptionConfig{
+		Topic:                 topic,
+		AckDeadline:           10 * time.Second,
+		EnableMessageOrdering: true,
+		ExpirationPolicy:      pubsubSubscriptionExpiry,
+	}
+	if !b.topicPerChannel {
+		settings.Filter = "attributes.channel = " + strconv.Quote(channel)
+	}
+
+	id := b.subscriptionPrefix + newGroupName()
+	subscription, err := b.client.CreateSubscription(ctx, id, settings)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to create subscription for channel %s: %v", channel, err)
+	}
+
+	b.mu.Lock()
+	b.receivers[channel] = cancel
+	b.mu.Unlock()
+
+	go func() {
+		defer subscription.Delete(context.Background())
+
+		delay := retryBaseDelay
+		for ctx.Err() == nil {
+			err := subscription.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+				b.subscribers.deliver(channel, string(msg.Data))
+				msg.Ack()
+			})
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+
+			// Unacknowledged messages stay in the subscription, so nothing is lost meanwhile
+			logger.Warn("Pub/Sub subscription failed, restarting", "subscription", id, "delay", delay, "error", err)
+			sleep(ctx, delay)
+			delay = nextDelay(delay)
+		}
+	}()
+	return nil
+}
+
+// Unsubscribe deletes the channel's Pub/Sub subscription once its last local subscription is gone
+func (b *pubsubBroker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers.remove(sub) {
+		if cancel, ok := b.receivers[sub.Channel]; ok {
+			cancel()
+			delete(b.receivers, sub.Channel)
+		}
+	}
+}
+
+// History returns no messages. A Pub/Sub subscription only receives messages published
+// after it was created, so there is nothing to replay from.
+func (b *pubsubBroker) History(ctx context.Context, channel string, since time.Time) ([]string, error) {
+	return nil, nil
+}
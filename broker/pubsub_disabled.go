@@ -0,0 +1,15 @@
+//go:build !pubsub
+
+package broker
+
+import (
+	"fmt"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// newPubSubBroker reports that Google Cloud Pub/Sub support was left out of this build.
+// The Pub/Sub client is only compiled in with the pubsub build tag.
+func newPubSubBroker(config *config.Config) (Broker, error) {
+	return nil, fmt.Errorf("this server was built without Google Cloud Pub/Sub support, rebuild it with -tags pubsub")
+}
@@ -0,0 +1,320 @@
+package broker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+)
+
+// Redis key prefix of the per-channel replay buffers
+const bufferKeyPrefix = "gopush:buffer:"
+
+// redisBroker delivers messages through Redis pub/sub, or through Redis Streams when
+// redis.backend is streams. Channels live on the node the hash ring assigns them to.
+type redisBroker struct {
+	config *config.Config
+
+	// Per channel, the subscription of this server that copies received messages into
+	// the replay buffer, so each message is written once per server
+	bufferers sync.Map
+
+	// With the streams backend, the consumer group of this server and the local
+	// subscriptions of the streams it reads
+	group             string
+	streamSubscribers *fanout
+	mu                sync.Mutex
+	streamReaders     map[string]context.CancelFunc
+}
+
+func newRedisBroker(config *config.Config) *redisBroker {
+	b := &redisBroker{config: config}
+	if b.streams() {
+		b.group = streamGroupPrefix + newGroupName()
+		b.streamSubscribers = newFanout()
+		b.streamReaders = make(map[string]context.CancelFunc)
+		b.destroyStaleGroups()
+	}
+	return b
+}
+
+func (b *redisBroker) streams() bool {
+	return b.config.Redis.Backend == "streams"
+}
+
+// Publish sends a payload on the node owning the channel and buffers it for History.
+// With broadcast_publish pub/sub messages go to every node instead, for subscribers that
+// still listen on a single node.
+func (b *redisBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	if b.streams() {
+		return b.publishStream(ctx, channel, payload)
+	}
+
+	if !b.config.Redis.BroadcastPublish {
+		if err := b.publishTo(ctx, redisconn.ForChannel(channel), channel, payload); err != nil {
+			return err
+		}
+	} else if err := b.broadcast(ctx, channel, payload); err != nil {
+		return err
+	}
+
+	// Keep a copy so clients that reconnect with a resume token can catch up
+	b.buffer(ctx, channel, payload)
+	return nil
+}
+
+// Broadcast limits used when the redis block leaves them unset
+const (
+	defaultBroadcastConcurrency = 8
+	defaultBroadcastTimeout     = time.Second
+)
+
+// broadcast publishes a payload to every node in parallel, a bounded number at a time.
+// All nodes share one deadline, so a slow node cannot hold up the publisher for long.
+func (b *redisBroker) broadcast(ctx context.Context, channel string, payload []byte) error {
+	concurrency := b.config.Redis.BroadcastConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultBroadcastConcurrency
+	}
+	timeout := defaultBroadcastTimeout
+	if b.config.Redis.BroadcastTimeout > 0 {
+		timeout = time.Duration(b.config.Redis.BroadcastTimeout) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// A plain group, so one failing node does not cancel the publishes to the others
+	var group errgroup.Group
+	group.SetLimit(concurrency)
+	for _, rdb := range redisconn.Nodes() {
+		group.Go(func() error {
+			err := b.publishTo(ctx, rdb, channel, payload)
+			if err != nil {
+				logger.Error("Failed to publish message to Redis node", "error", err)
+			}
+			return err
+		})
+	}
+	return group.Wait()
+}
+
+func (b *redisBroker) publishTo(ctx context.Context, rdb redis.UniversalClient, channel string, payload []byte) error {
+	if b.config.Redis.ShardedPubSub {
+		return rdb.SPublish(ctx, channel, payload).Err()
+	}
+	return rdb.Publish(ctx, channel, payload).Err()
+}
+
+// buffer keeps a payload in a short-lived buffer on the node owning the channel. Both the
+// publishing and the receiving servers buffer messages, so the first copy is kept.
+func (b *redisBroker) buffer(ctx context.Context, channel string, payload []byte) {
+	key := bufferKeyPrefix + channel
+	now := time.Now()
+
+	size := int64(bufferSize(b.config))
+	cutoff := now.Add(-bufferTTL(b.config)).UnixMilli()
+
+	pipe := redisconn.ForChannel(channel).TxPipeline()
+	pipe.ZAddNX(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: payload})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(cutoff, 10))
+	pipe.ZRemRangeByRank(ctx, key, 0, -size-1)
+	pipe.Expire(ctx, key, bufferTTL(b.config))
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Error("Failed to buffer message", "channel", channel, "error", err)
+	}
+}
+
+// History reads the replay buffer, or the stream itself with the streams backend
+func (b *redisBroker) History(ctx context.Context, channel string, since time.Time) ([]string, error) {
+	if b.streams() {
+		return b.streamHistory(ctx, channel, since)
+	}
+	return redisconn.ForChannel(channel).ZRangeByScore(ctx, bufferKeyPrefix+channel, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(since.UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+func (b *redisBroker) Subscribe(channel string, handler Handler) (*Subscription, error) {
+	if b.streams() {
+		return b.subscribeStream(channel, handler), nil
+	}
+	return start(channel, func(ctx context.Context) { b.listen(ctx, channel, handler) }), nil
+}
+
+// SubscribePattern receives the messages of every channel matching a pattern from every
+// node. Sharded pub/sub and Streams have no pattern subscriptions.
+func (b *redisBroker) SubscribePattern(pattern string, handler Handler) (*Subscription, error) {
+	if b.streams() || b.config.Redis.ShardedPubSub {
+		return nil, ErrPatternsUnsupported
+	}
+	return start(pattern, func(ctx context.Context) { b.listenPattern(ctx, pattern, handler) }), nil
+}
+
+func (b *redisBroker) Unsubscribe(sub *Subscription) {
+	if b.streams() {
+		b.unsubscribeStream(sub)
+		return
+	}
+	sub.stop()
+}
+
+// subscribe opens a subscription to a Redis channel and returns it with a Go channel of
+// its messages and subscription confirmations. With sharded pub/sub the subscription is
+// made on the cluster shard owning the channel. A node that does not confirm in time is
+// treated like a failed one, so the caller retries instead of hanging on it.
+func (b *redisBroker) subscribe(ctx context.Context, rdb redis.UniversalClient, channel string) (*redis.PubSub, <-chan interface{}, error) {
+	ctx, cancel := redisconn.WithSubscribeTimeout(ctx)
+	defer cancel()
+
+	var pubsub *redis.PubSub
+	var err error
+	if b.config.Redis.ShardedPubSub {
+		pubsub = rdb.SSubscribe(ctx)
+		err = pubsub.SSubscribe(ctx, channel)
+	} else {
+		pubsub = rdb.Subscribe(ctx)
+		err = pubsub.Subscribe(ctx, channel)
+	}
+	if err != nil {
+		pubsub.Close()
+		return nil, nil, err
+	}
+	return pubsub, pubsub.ChannelWithSubscriptions(), nil
+}
+
+// resubscribe subscribes on the node owning the channel, retrying with exponential
+// backoff until it succeeds or the context is canceled
+func (b *redisBroker) resubscribe(ctx context.Context, channel string) (redis.UniversalClient, *redis.PubSub, <-chan interface{}, bool) {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		rdb := redisconn.ForChannel(channel)
+		pubsub, messages, err := b.subscribe(ctx, rdb, channel)
+		if err == nil {
+			if attempt > 1 {
+				logger.Info("Resubscribed to channel", "channel", channel, "attempts", attempt)
+			}
+			return rdb, pubsub, messages, true
+		}
+
+		logger.Warn("Failed to subscribe to channel, retrying", "channel", channel, "delay", delay, "error", err)
+		if !sleep(ctx, delay) {
+			return nil, nil, nil, false
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+// listen receives a channel's messages through pub/sub. The subscription follows the
+// channel to another node when a rebalance moves it, and a subscription lost with its
+// Redis connection is restored and reported as a gap.
+func (b *redisBroker) listen(ctx context.Context, channel string, handler Handler) {
+	rdb, pubsub, messages, ok := b.resubscribe(ctx, channel)
+	if !ok {
+		return
+	}
+	defer func() { pubsub.Close() }()
+	defer b.bufferers.CompareAndDelete(channel, ctx)
+
+	logger.Info("Listening for messages", "channel", channel)
+
+	ringChanged := redisconn.RingChanged()
+
+	// go-redis quietly resubscribes after a dropped connection; every confirmation after
+	// the first one means messages published in between were lost
+	confirmed := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case received, ok := <-messages:
+			if !ok {
+				// The Redis client was closed under the subscription
+				var restored bool
+				if rdb, pubsub, messages, restored = b.resubscribe(ctx, channel); !restored {
+					return
+				}
+				confirmed = false
+				handler(Message{Channel: channel, Gap: true})
+				continue
+			}
+
+			switch msg := received.(type) {
+			case *redis.Subscription:
+				if msg.Kind != "subscribe" && msg.Kind != "ssubscribe" {
+					continue
+				}
+				if confirmed {
+					handler(Message{Channel: channel, Gap: true})
+				}
+				confirmed = true
+			case *redis.Message:
+				handler(Message{Channel: channel, Payload: msg.Payload})
+
+				// Messages published to Redis directly did not go through Publish
+				if bufferer, _ := b.bufferers.LoadOrStore(channel, ctx); bufferer == ctx {
+					b.buffer(ctx, channel, []byte(msg.Payload))
+				}
+			}
+		case <-ringChanged:
+			ringChanged = redisconn.RingChanged()
+			owner := redisconn.ForChannel(channel)
+			if owner == rdb {
+				continue
+			}
+			// Subscribe on the new owner before leaving the old one to narrow the gap
+			moved, movedMessages, err := b.subscribe(ctx, owner, channel)
+			if err != nil {
+				logger.Error("Failed to move channel to another Redis node", "channel", channel, "error", err)
+				continue
+			}
+			pubsub.Close()
+			rdb, pubsub, messages, confirmed = owner, moved, movedMessages, false
+			logger.Info("Moved channel to another Redis node", "channel", channel)
+		}
+	}
+}
+
+// listenPattern subscribes to a pattern on every node, again whenever nodes are added or removed
+func (b *redisBroker) listenPattern(ctx context.Context, pattern string, handler Handler) {
+	for ctx.Err() == nil {
+		ringChanged := redisconn.RingChanged()
+		nodesCtx, cancel := context.WithCancel(ctx)
+		for _, rdb := range redisconn.Nodes() {
+			go b.listenPatternOn(nodesCtx, rdb, pattern, handler)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-ringChanged:
+		}
+		cancel()
+	}
+}
+
+// listenPatternOn passes the messages of a pattern subscription on one node to the handler.
+// go-redis restores the subscription after a dropped connection.
+func (b *redisBroker) listenPatternOn(ctx context.Context, rdb redis.UniversalClient, pattern string, handler Handler) {
+	pubsub := rdb.PSubscribe(ctx, pattern)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			handler(Message{Channel: msg.Channel, Payload: msg.Payload})
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// Redis key prefix of the stream holding each channel's messages
+const streamKeyPrefix = "stream:"
+
+// Defaults used when the streams block is missing from the config
+const (
+	defaultStreamMaxLen    = 10000
+	defaultStreamBatchSize = 100
+)
+
+// How long a read waits for new entries before checking the subscription again
+const streamBlockTimeout = time.Second
+
+// Field of a stream entry holding the message
+const streamPayloadField = "payload"
+
+// Prefix of the consumer group each server reads streams through
+const streamGroupPrefix = "gopush-"
+
+// How long all consumers of a group must have been inactive for it to be taken for the
+// group of a stopped server, and how long the cleanup at startup may take
+const (
+	staleGroupInactivity = 10 * time.Minute
+	streamCleanupTimeout = 30 * time.Second
+)
+
+func (b *redisBroker) publishStream(ctx context.Context, channel string, payload []byte) error {
+	maxLen := b.config.Redis.Streams.MaxLen
+	if maxLen <= 0 {
+		maxLen = defaultStreamMaxLen
+	}
+	return redisconn.ForChannel(channel).XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKeyPrefix + channel,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: map[string]interface{}{streamPayloadField: payload},
+	}).Err()
+}
+
+// streamHistory reads the entries added since a point in time. Entry IDs start with the
+// Unix millisecond they were added, so the stream itself serves as the replay buffer.
+func (b *redisBroker) streamHistory(ctx context.Context, channel string, since time.Time) ([]string, error) {
+	entries, err := redisconn.ForChannel(channel).XRange(ctx, streamKeyPrefix+channel,
+		strconv.FormatInt(since.UnixMilli()+1, 10), "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		payload, _ := entry.Values[streamPayloadField].(string)
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+// subscribeStream starts reading a channel's stream when no other local subscription reads it yet
+func (b *redisBroker) subscribeStream(channel string, handler Handler) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, first := b.streamSubscribers.add(channel, handler)
+	if first {
+		ctx, cancel := context.WithCancel(context.Background())
+		b.streamReaders[channel] = cancel
+		go b.consumeStream(ctx, channel)
+	}
+	return sub
+}
+
+// unsubscribeStream stops reading a channel's stream once its last local subscription is gone
+func (b *redisBroker) unsubscribeStream(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.streamSubscribers.remove(sub) {
+		if cancel, ok := b.streamReaders[sub.Channel]; ok {
+			cancel()
+			delete(b.streamReaders, sub.Channel)
+		}
+	}
+}
+
+// consumeStream reads a channel's stream through the server's consumer group and hands
+// each entry to the local subscriptions of the channel, acknowledging it once they have
+// it queued. A lost connection resumes from the group's position, so nothing published
+// meanwhile is lost; a subscription too far behind misses entries and is told so. The
+// group is destroyed when the last local subscription ends.
+func (b *redisBroker) consumeStream(ctx context.Context, channel string) {
+	stream := streamKeyPrefix + channel
+
+	batchSize := b.config.Redis.Streams.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultStreamBatchSize
+	}
+
+	var rdb redis.UniversalClient
+	defer func() {
+		if rdb != nil {
+			if err := rdb.XGroupDestroy(context.Background(), stream, b.group).Err(); err != nil {
+				logger.Error("Failed to remove consumer group", "channel", channel, "error", err)
+			}
+		}
+	}()
+
+	logger.Info("Reading stream", "channel", channel, "group", b.group)
+
+	// Read pending entries first, they were read but never acknowledged
+	start := "0"
+	delay := retryBaseDelay
+	for ctx.Err() == nil {
+		// The group starts at the end of the stream on whichever node owns the channel
+		if owner := redisconn.ForChannel(channel); owner != rdb {
+			if err := owner.XGroupCreateMkStream(ctx, stream, b.group, "$").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				logger.Warn("Failed to create consumer group, retrying", "channel", channel, "delay", delay, "error", err)
+				sleep(ctx, delay)
+				delay = nextDelay(delay)
+				continue
+			}
+			rdb, start = owner, "0"
+		}
+
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    b.group,
+			Consumer: b.group,
+			Streams:  []string{stream, start},
+			Count:    batchSize,
+			Block:    streamBlockTimeout,
+		}).Result()
+		if err == redis.Nil || ctx.Err() != nil {
+			continue
+		}
+		if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+			// Another server took the group for a stale one, or the stream was deleted
+			logger.Warn("Consumer group is gone, creating it again", "channel", channel, "group", b.group)
+			b.streamSubscribers.gapAll()
+			rdb = nil
+			continue
+		}
+		if err != nil {
+			logger.Warn("Failed to read stream, retrying", "channel", channel, "delay", delay, "error", err)
+			sleep(ctx, delay)
+			delay = nextDelay(delay)
+			continue
+		}
+		delay = retryBaseDelay
+
+		entries := streams[0].Messages
+		if start == "0" && len(entries) == 0 {
+			// No pending entries left, wait for new ones
+			start = ">"
+			continue
+		}
+
+		ids := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			payload, _ := entry.Values[streamPayloadField].(string)
+			b.streamSubscribers.deliver(channel, payload)
+			ids = append(ids, entry.ID)
+		}
+		if err := rdb.XAck(ctx, stream, b.group, ids...).Err(); err != nil {
+			logger.Error("Failed to acknowledge stream entries", "channel", channel, "count", len(ids), "error", err)
+		}
+	}
+}
+
+// destroyStaleGroups removes the consumer groups left behind by servers that stopped
+// without destroying theirs. Groups of running servers read their streams every
+// streamBlockTimeout, so a group whose consumers have all been inactive for
+// staleGroupInactivity is stale, and one without consumers never started reading.
+func (b *redisBroker) destroyStaleGroups() {
+	ctx, cancel := context.WithTimeout(context.Background(), streamCleanupTimeout)
+	defer cancel()
+
+	nodes := redisconn.Nodes()
+	if _, ok := redisconn.Primary().(*redis.ClusterClient); ok {
+		masters, err := redisconn.Masters(ctx)
+		if err != nil {
+			logger.Warn("Failed to list Redis Cluster masters for stale consumer groups", "error", err)
+			return
+		}
+		nodes = masters
+	}
+
+	for _, rdb := range nodes {
+		iter := rdb.Scan(ctx, 0, streamKeyPrefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			b.destroyStaleGroupsOf(ctx, rdb, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			logger.Warn("Failed to look for stale consumer groups", "error", err)
+		}
+	}
+}
+
+// destroyStaleGroupsOf removes the stale groups of one stream
+func (b *redisBroker) destroyStaleGroupsOf(ctx context.Context, rdb redis.UniversalClient, stream string) {
+	groups, err := rdb.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		// Keys under the prefix that are not streams are skipped
+		return
+	}
+
+	for _, group := range groups {
+		if !strings.HasPrefix(group.Name, streamGroupPrefix) || group.Name == b.group {
+			continue
+		}
+		consumers, err := rdb.XInfoConsumers(ctx, stream, group.Name).Result()
+		if err != nil {
+			logger.Warn("Failed to inspect consumer group", "stream", stream, "group", group.Name, "error", err)
+			continue
+		}
+		stale := true
+		for _, consumer := range consumers {
+			// Inactive is only reported by Redis 7.2 and later. Before that, idle counts from
+			// the last entry delivered, so the group of a quiet stream may be removed while
+			// its server runs; that server then creates it again.
+			inactive := consumer.Inactive
+			if inactive <= 0 {
+				inactive = consumer.Idle
+			}
+			if inactive < staleGroupInactivity {
+				stale = false
+			}
+		}
+		if !stale {
+			continue
+		}
+		if err := rdb.XGroupDestroy(ctx, stream, group.Name).Err(); err != nil {
+			logger.Warn("Failed to remove stale consumer group", "stream", stream, "group", group.Name, "error", err)
+			continue
+		}
+		logger.Info("Removed stale consumer group", "stream", stream, "group", group.Name)
+	}
+}
+
+// newGroupName returns a random name for a consumer group or subscription
+func newGroupName() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
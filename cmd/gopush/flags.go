@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sahakavatar/gopush/config"
+	"os"
+)
+
+// Command line flags. Each one left unset keeps the value from the config file or its
+// GOPUSH_* environment variable.
+var (
+	configFlag      = flag.String("config", os.Getenv("GOPUSH_CONFIG"), "Path of the config file, or a consul:// or etcd:// key (env GOPUSH_CONFIG, defaults to /app/config.json or ./config.json, also .yaml, .yml or .toml)")
+	hostFlag        = flag.String("host", "", "Address to listen on, overrides server.host")
+	portFlag        = flag.String("port", "", "Port to listen on, overrides server.port")
+	unixSocketFlag  = flag.String("unix-socket", "", "Path of a unix socket to listen on instead of host:port, overrides server.unix_socket.path")
+	wsPathFlag      = flag.String("ws-path", "", "Path of the WebSocket endpoint, overrides server.ws_url")
+	logLevelFlag    = flag.String("log-level", "", "Log level, overrides logging.level")
+	environmentFlag = flag.String("environment", "", "Environment name such as production, overrides environment and selects its profile")
+	adminFlag       = flag.String("admin", "", "host:port of the admin listener, overrides server.admin.address")
+	debugFlag       = flag.Bool("debug", false, "Serve pprof, expvar and goroutine dumps on the admin listener, sets server.admin.debug")
+)
+
+// parseFlags parses the command line, resolves the config path and registers the flags
+// as overrides of every config loaded, including reloads on SIGHUP
+func parseFlags() {
+	flag.Parse()
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The environment also selects the profile of the config file, so it goes through
+	// GOPUSH_ENVIRONMENT instead of an override
+	if *environmentFlag != "" {
+		os.Setenv("GOPUSH_ENVIRONMENT", *environmentFlag)
+	}
+
+	configPath = *configFlag
+	if configPath == "" {
+		configPath = findConfig()
+	}
+
+	config.Override(func(config *config.Config) {
+		if *hostFlag != "" {
+			config.Server.Host = *hostFlag
+		}
+		if *portFlag != "" {
+			config.Server.Port = *portFlag
+		}
+		if *unixSocketFlag != "" {
+			config.Server.UnixSocket.Path = *unixSocketFlag
+		}
+		if *wsPathFlag != "" {
+			config.Server.WsUrl = *wsPathFlag
+		}
+		if *logLevelFlag != "" {
+			config.Logging.Level = *logLevelFlag
+		}
+		if *adminFlag != "" {
+			config.Server.Admin.Address = *adminFlag
+		}
+		if *debugFlag {
+			config.Server.Admin.Debug = true
+		}
+	})
+}
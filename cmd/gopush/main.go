@@ -0,0 +1,134 @@
+// Command gopush runs the gopush server with the config file given by --config.
+package main
+
+import (
+	"fmt"
+	"github.com/sahakavatar/gopush"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/server"
+	"log/slog"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Build details, set at build time with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/gopush
+//
+// A commit or build date left unset is taken from the VCS stamp Go adds to the binary, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// Candidate configuration files, in order of preference, used when --config is not given.
+// The first one that exists is read at startup and again on SIGHUP.
+var configPaths = []string{
+	"/app/config.json", "/app/config.yaml", "/app/config.yml", "/app/config.toml",
+	"config.json", "config.yaml", "config.yml", "config.toml",
+}
+
+// Path of the configuration file in use, set by parseFlags
+var configPath string
+
+// findConfig returns the first candidate configuration file that exists
+func findConfig() string {
+	for _, path := range configPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return configPaths[0]
+}
+
+// fatal logs an error and stops the server
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func main() {
+	server.SetBuild(version, commit, buildDate)
+
+	// "gopush validate" checks a config and exits instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		runValidate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		runVersion()
+		return
+	}
+	parseFlags()
+
+	// Log JSON lines to stdout until the configured destination is known
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	// Load the configuration
+	cfg, err := gopush.LoadConfig(configPath)
+	if err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+
+	// Set up logging
+	logger, err := server.NewLogger(cfg)
+	if err != nil {
+		fatal("Failed to set up logging", "error", err)
+	}
+	server.SetLogger(logger)
+
+	buildVersion, revision, date := server.Build()
+	slog.Info("Starting gopush", "version", buildVersion, "commit", revision, "build_date", date, "go_version", runtime.Version())
+
+	// Accept on the sockets of the previous process when started by a restart
+	if err := server.InheritListeners(); err != nil {
+		fatal("Failed to inherit listeners", "error", err)
+	}
+
+	s, err := gopush.New(cfg)
+	if err != nil {
+		fatal("Failed to start gopush", "error", err)
+	}
+
+	// Stop taking new connections on SIGINT or SIGTERM, then flush the spans and error
+	// reports and exit. SIGUSR2 hands the listeners to a new process first.
+	go shutdownOnSignal(s, time.Duration(cfg.Server.ShutdownDrain)*time.Second, time.Duration(cfg.Server.RestartDrain)*time.Second)
+
+	// Apply the reload-safe settings and move channels between standalone nodes when the
+	// config is reloaded on SIGHUP, or as soon as it changes in Consul or etcd
+	go reloadOnSignal(s)
+	go reloadOnRemoteChange(s)
+
+	if err := s.ListenAndServe(); err != nil {
+		fatal("Server stopped", "error", err)
+	}
+}
+
+// runVersion implements "gopush version": it prints the build details and exits
+func runVersion() {
+	buildVersion, revision, date := server.Build()
+	fmt.Fprintf(os.Stdout, "gopush %s\n", buildVersion)
+	if revision != "" {
+		fmt.Fprintf(os.Stdout, "commit:     %s\n", revision)
+	}
+	if date != "" {
+		fmt.Fprintf(os.Stdout, "built:      %s\n", date)
+	}
+	fmt.Fprintf(os.Stdout, "go version: %s\n", runtime.Version())
+}
+
+// reloadConfig rereads the config and applies it to the running server
+func reloadConfig(s *server.Server) {
+	reloaded, err := config.LoadConfig(configPath)
+	if err != nil {
+		slog.Error("Failed to reload configuration", "error", err)
+		return
+	}
+	if err := s.Reload(reloaded); err != nil {
+		slog.Error("Failed to apply the reloaded configuration", "error", err)
+		return
+	}
+	slog.Info("Reloaded configuration", "redis_nodes", len(reloaded.Redis.Nodes))
+}
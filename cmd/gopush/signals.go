@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/server"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownOnSignal drains the server on SIGINT or SIGTERM: it reports not ready for the
+// drain period so load balancers stop sending new upgrades, shuts the server down and
+// exits. On SIGUSR2 it restarts instead: a new process takes over the listeners, and the
+// connections of this one are closed over restartDrain so their clients reconnect to it.
+func shutdownOnSignal(s *server.Server, drain, restartDrain time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	for {
+		if <-signals != syscall.SIGUSR2 {
+			s.Drain()
+			if drain > 0 {
+				slog.Info("Draining before shutdown", "duration", drain)
+				time.Sleep(drain)
+			}
+			break
+		}
+
+		slog.Info("Restarting")
+		if err := s.Restart(restartDrain); err != nil {
+			// The new process failed, so this one keeps serving
+			slog.Error("Failed to restart", "error", err)
+			continue
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Error("Failed to shut down cleanly", "error", err)
+	}
+	slog.Info("Server stopped")
+	os.Exit(0)
+}
+
+// reloadOnSignal rereads the config on SIGHUP and applies it
+func reloadOnSignal(s *server.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		reloadConfig(s)
+	}
+}
+
+// reloadOnRemoteChange reloads the config whenever it changes in Consul or etcd
+func reloadOnRemoteChange(s *server.Server) {
+	if config.IsRemote(configPath) {
+		config.WatchRemote(configPath, func() { reloadConfig(s) })
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"os"
+)
+
+// runValidate implements "gopush validate": it loads a config the way the server does,
+// which validates it and reads its secret files, optionally probes Redis and the authorize
+// URLs, prints a report and exits non-zero on any problem
+func runValidate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := flags.String("config", os.Getenv("GOPUSH_CONFIG"), "Path of the config file, or a consul:// or etcd:// key (env GOPUSH_CONFIG)")
+	environment := flags.String("environment", "", "Environment profile to validate")
+	probe := flags.Bool("probe", false, "Also connect to the Redis nodes and call the authorize URLs")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gopush validate [--config path] [--environment name] [--probe]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *environment != "" {
+		os.Setenv("GOPUSH_ENVIRONMENT", *environment)
+	}
+	configPath = *path
+	if configPath == "" {
+		configPath = findConfig()
+	}
+
+	loaded, err := config.LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("ok   %s is valid\n", configPath)
+
+	if !*probe {
+		return
+	}
+
+	failed := false
+	report := func(what string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", what, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", what)
+	}
+
+	if len(loaded.Redis.Nodes) == 0 && len(loaded.Redis.Cluster.Addresses) == 0 && loaded.Redis.Sentinel.MasterName == "" {
+		fmt.Println("ok   no Redis configured, the embedded store will be used")
+	} else {
+		problems := redisconn.Probe(loaded)
+		for _, err := range problems {
+			report("Redis", err)
+		}
+		if len(problems) == 0 {
+			report("Redis is reachable", nil)
+		}
+	}
+
+	for _, url := range apps.AuthorizeURLs(loaded) {
+		report("authorize URL "+url, auth.Probe(url))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the environment variables overriding config fields
+const envPrefix = "GOPUSH"
+
+// applyEnv overrides config fields with GOPUSH_* environment variables. A field's
+// variable is its JSON path in upper case joined by underscores, with slice indexes and
+// map keys as path elements, e.g. GOPUSH_SERVER_PORT or GOPUSH_REDIS_NODES_0_PASSWORD.
+// Lists of plain values are comma-separated. Variables may append entries to a list of
+// objects, but map entries must already exist in the config file.
+func applyEnv(config *Config) error {
+	env := make(map[string]bool)
+	for _, entry := range os.Environ() {
+		if name, _, ok := strings.Cut(entry, "="); ok && strings.HasPrefix(name, envPrefix+"_") {
+			env[name] = true
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return overrideFromEnv(reflect.ValueOf(config).Elem(), envPrefix, env)
+}
+
+// overrideFromEnv applies the variables under name to a config value and its children
+func overrideFromEnv(value reflect.Value, name string, env map[string]bool) error {
+	switch value.Kind() {
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || tag == "" || tag == "-" {
+				continue
+			}
+			if err := overrideFromEnv(value.Field(i), name+"_"+envName(tag), env); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			// Map values are not addressable, so override a copy and store it back
+			entry := reflect.New(value.Type().Elem()).Elem()
+			entry.Set(value.MapIndex(key))
+			if err := overrideFromEnv(entry, name+"_"+envName(key.String()), env); err != nil {
+				return err
+			}
+			value.SetMapIndex(key, entry)
+		}
+		return nil
+
+	case reflect.Slice:
+		if isScalar(value.Type().Elem().Kind()) {
+			break
+		}
+		for i := 0; ; i++ {
+			entryName := name + "_" + strconv.Itoa(i)
+			if i >= value.Len() {
+				if !hasPrefix(env, entryName+"_") {
+					return nil
+				}
+				value.Set(reflect.Append(value, reflect.Zero(value.Type().Elem())))
+			}
+			if err := overrideFromEnv(value.Index(i), entryName, env); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !env[name] {
+		return nil
+	}
+	if err := setFromString(value, os.Getenv(name)); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", name, err)
+	}
+	return nil
+}
+
+// setFromString parses an environment variable into a plain config value or list
+func setFromString(value reflect.Value, raw string) error {
+	if value.Kind() == reflect.Slice {
+		list := reflect.MakeSlice(value.Type(), 0, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			entry := reflect.New(value.Type().Elem()).Elem()
+			if err := setFromString(entry, item); err != nil {
+				return err
+			}
+			list = reflect.Append(list, entry)
+		}
+		value.Set(list)
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetFloat(parsed)
+	default:
+		return fmt.Errorf("fields of type %s cannot be set from the environment", value.Type())
+	}
+	return nil
+}
+
+func isScalar(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Pointer, reflect.Interface:
+		return false
+	}
+	return true
+}
+
+// envName turns a JSON key or map key into a variable name element
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func hasPrefix(env map[string]bool, prefix string) bool {
+	for name := range env {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
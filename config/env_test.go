@@ -0,0 +1,66 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigEnvironment(t *testing.T) {
+	const content = `{"redis": {"nodes": [{"address": "127.0.0.1:6379", "password": "file"}]}, "server": {"host": "localhost", "port": "6001", "allowed_origins": ["https://a.example.com"]}}`
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(t *testing.T, config *Config)
+	}{
+		{
+			name: "scalar",
+			env:  map[string]string{"GOPUSH_SERVER_PORT": "7001"},
+			check: func(t *testing.T, config *Config) {
+				if config.Server.Port != "7001" {
+					t.Errorf("server.port = %q, want 7001", config.Server.Port)
+				}
+			},
+		},
+		{
+			name: "slice entry",
+			env:  map[string]string{"GOPUSH_REDIS_NODES_0_PASSWORD": "env"},
+			check: func(t *testing.T, config *Config) {
+				if config.Redis.Nodes[0].Password != "env" {
+					t.Errorf("redis.nodes[0].password = %q, want env", config.Redis.Nodes[0].Password)
+				}
+			},
+		},
+		{
+			name: "appended slice entry",
+			env:  map[string]string{"GOPUSH_REDIS_NODES_1_ADDRESS": "127.0.0.2:6379"},
+			check: func(t *testing.T, config *Config) {
+				if len(config.Redis.Nodes) != 2 || config.Redis.Nodes[1].Address != "127.0.0.2:6379" {
+					t.Errorf("redis.nodes = %+v, want a second node at 127.0.0.2:6379", config.Redis.Nodes)
+				}
+			},
+		},
+		{
+			name: "comma-separated list",
+			env:  map[string]string{"GOPUSH_SERVER_ALLOWED_ORIGINS": "https://b.example.com,https://c.example.com"},
+			check: func(t *testing.T, config *Config) {
+				if got := strings.Join(config.Server.AllowedOrigins, ","); got != "https://b.example.com,https://c.example.com" {
+					t.Errorf("server.allowed_origins = %q", config.Server.AllowedOrigins)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			config, err := LoadConfig(writeFile(t, "config.json", content))
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			tt.check(t, config)
+		})
+	}
+}
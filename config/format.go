@@ -0,0 +1,58 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// formatOf returns the format of a config file from its extension, JSON unless it ends
+// in .yaml, .yml or .toml
+func formatOf(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		return "YAML"
+	case ".toml":
+		return "TOML"
+	}
+	return "JSON"
+}
+
+// decodeConfig decodes a config file in the given format. Documents are flattened to the
+// selected environment profile and converted to JSON, so every format uses the same json
+// keys of Config.
+func decodeConfig(format string, data []byte, config *Config) error {
+	var document interface{}
+	switch format {
+	case "YAML":
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return err
+		}
+	case "TOML":
+		if err := toml.Unmarshal(data, &document); err != nil {
+			return err
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return err
+		}
+	}
+
+	document, err := applyProfile(document)
+	if err != nil {
+		return err
+	}
+
+	converted, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("unsupported value: %v", err)
+	}
+	return json.Unmarshal(converted, config)
+}
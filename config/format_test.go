@@ -0,0 +1,105 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a file into a test's temporary directory and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name:    "JSON",
+			file:    "config.json",
+			content: `{"redis": {"nodes": [{"address": "127.0.0.1:6379"}]}, "server": {"host": "localhost", "port": "6001"}}`,
+		},
+		{
+			name: "YAML",
+			file: "config.yaml",
+			content: `
+redis:
+  nodes: [{address: "127.0.0.1:6379"}]
+server:
+  host: localhost
+  port: "6001"
+`,
+		},
+		{
+			name: "YML",
+			file: "config.yml",
+			content: `
+redis: {nodes: [{address: "127.0.0.1:6379"}]}
+server: {host: localhost, port: "6001"}
+`,
+		},
+		{
+			name: "TOML",
+			file: "config.toml",
+			content: `
+[server]
+host = "localhost"
+port = "6001"
+
+[[redis.nodes]]
+address = "127.0.0.1:6379"
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfig(writeFile(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if config.Server.Host != "localhost" || config.Server.Port != "6001" {
+				t.Errorf("server = %s:%s, want localhost:6001", config.Server.Host, config.Server.Port)
+			}
+			if len(config.Redis.Nodes) != 1 || config.Redis.Nodes[0].Address != "127.0.0.1:6379" {
+				t.Errorf("redis.nodes = %+v, want one node at 127.0.0.1:6379", config.Redis.Nodes)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"malformed JSON", "config.json", `{"server": `, "failed to decode JSON config"},
+		{"malformed YAML", "config.yaml", "server: [", "failed to decode YAML config"},
+		{"wrong type", "config.json", `{"server": {"port": 6001}}`, "failed to decode JSON config"},
+		{"invalid settings", "config.json", `{"server": {"host": "localhost", "port": "0"}}`, "server.port: must be a number from 1 to 65535"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeFile(t, tt.file, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadConfig error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil || !strings.Contains(err.Error(), "failed to open config file") {
+		t.Errorf("LoadConfig of a missing file = %v, want an open error", err)
+	}
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// applyProfile flattens a config laid out as "defaults" plus "environments" overlays into
+// a plain config. The environment is taken from GOPUSH_ENVIRONMENT, falling back to the
+// "environment" field of the defaults. Documents without either key are returned as is.
+func applyProfile(document interface{}) (interface{}, error) {
+	root, ok := document.(map[string]interface{})
+	if !ok {
+		return document, nil
+	}
+	defaults, hasDefaults := root["defaults"]
+	environments, hasEnvironments := root["environments"]
+	if !hasDefaults && !hasEnvironments {
+		return document, nil
+	}
+
+	// Keys outside defaults and environments are shared by every environment too
+	base := map[string]interface{}{}
+	if defaults != nil {
+		values, ok := defaults.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("defaults: must be an object")
+		}
+		base = merge(base, values).(map[string]interface{})
+	}
+	for key, value := range root {
+		if key != "defaults" && key != "environments" {
+			base[key] = merge(base[key], value)
+		}
+	}
+
+	profiles := map[string]interface{}{}
+	if environments != nil {
+		if profiles, ok = environments.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("environments: must be an object keyed by environment name")
+		}
+	}
+
+	name := os.Getenv("GOPUSH_ENVIRONMENT")
+	if name == "" {
+		name, _ = base["environment"].(string)
+	}
+	if name == "" {
+		return base, nil
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for key := range profiles {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("environment %q has no entry in environments (have %s)", name, strings.Join(names, ", "))
+	}
+	if profile != nil {
+		if _, ok := profile.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("environments.%s: must be an object", name)
+		}
+	}
+
+	merged := merge(base, profile).(map[string]interface{})
+	merged["environment"] = name
+	return merged, nil
+}
+
+// merge overlays one decoded document on another. Objects are merged key by key, any
+// other value, lists included, replaces the one underneath.
+func merge(base, overlay interface{}) interface{} {
+	overlayObject, ok := overlay.(map[string]interface{})
+	if !ok {
+		if overlay == nil {
+			return base
+		}
+		return overlay
+	}
+	baseObject, ok := base.(map[string]interface{})
+	if !ok {
+		baseObject = map[string]interface{}{}
+	}
+
+	merged := make(map[string]interface{}, len(baseObject)+len(overlayObject))
+	for key, value := range baseObject {
+		merged[key] = value
+	}
+	for key, value := range overlayObject {
+		merged[key] = merge(merged[key], value)
+	}
+	return merged
+}
@@ -0,0 +1,40 @@
+package config
+
+import "testing"
+
+func TestLoadConfigProfiles(t *testing.T) {
+	const content = `{
+		"defaults": {
+			"environment": "staging",
+			"redis": {"nodes": [{"address": "127.0.0.1:6379"}]},
+			"server": {"host": "localhost", "port": "6001"}
+		},
+		"environments": {
+			"staging": {"server": {"port": "6002"}},
+			"production": {"server": {"host": "push.example.com"}}
+		}
+	}`
+
+	tests := []struct {
+		name        string
+		environment string
+		wantHost    string
+		wantPort    string
+	}{
+		{"environment from the defaults", "", "localhost", "6002"},
+		{"environment from the variable", "production", "push.example.com", "6001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOPUSH_ENVIRONMENT", tt.environment)
+			config, err := LoadConfig(writeFile(t, "config.json", content))
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if config.Server.Host != tt.wantHost || config.Server.Port != tt.wantPort {
+				t.Errorf("server = %s:%s, want %s:%s", config.Server.Host, config.Server.Port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
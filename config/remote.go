@@ -0,0 +1,300 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Remote config sources are given as consul://host:port/key or etcd://host:port/key in
+// place of a file path. The key's extension selects the format like a file's does.
+var remoteSchemes = map[string]bool{"consul": true, "etcd": true}
+
+// Client used for remote config sources. Watches hold requests open for up to five
+// minutes, so the client has no overall timeout and relies on contexts instead.
+var remoteClient = &http.Client{}
+
+// IsRemote reports whether a config path names a Consul or etcd key instead of a file
+func IsRemote(path string) bool {
+	scheme, _, ok := strings.Cut(path, "://")
+	return ok && remoteSchemes[scheme]
+}
+
+// remoteSource is a parsed consul:// or etcd:// config path
+type remoteSource struct {
+	kind     string
+	endpoint string // scheme://host:port of the HTTP API
+	key      string
+	username string // etcd user, from the URL
+	password string
+	token    string // Consul ACL token, from ?token= or CONSUL_HTTP_TOKEN
+}
+
+func parseRemote(path string) (*remoteSource, error) {
+	parsed, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote config source: %v", err)
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if parsed.Host == "" || key == "" {
+		return nil, fmt.Errorf("remote config source must look like %s://host:port/key", parsed.Scheme)
+	}
+
+	// ?scheme=https talks to the API over TLS
+	scheme := parsed.Query().Get("scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	source := &remoteSource{kind: parsed.Scheme, endpoint: scheme + "://" + parsed.Host, key: key}
+	if parsed.User != nil {
+		source.username = parsed.User.Username()
+		source.password, _ = parsed.User.Password()
+	}
+	source.token = parsed.Query().Get("token")
+	if source.token == "" {
+		source.token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	return source, nil
+}
+
+// readConfig reads a config file, or fetches the config from Consul or etcd for a remote
+// source
+func readConfig(path string) ([]byte, error) {
+	if IsRemote(path) {
+		return readRemote(path)
+	}
+	return os.ReadFile(path)
+}
+
+// readRemote fetches the current value of a remote config key
+func readRemote(path string) ([]byte, error) {
+	source, err := parseRemote(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	value, _, err := source.fetch(ctx, 0)
+	return value, err
+}
+
+// WatchRemote calls onChange every time the value of a remote config key changes, until
+// the process exits. Failed watches are retried with backoff.
+func WatchRemote(path string, onChange func()) {
+	source, err := parseRemote(path)
+	if err != nil {
+		slog.Error("Not watching remote config", "error", err)
+		return
+	}
+
+	var index int64
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute+30*time.Second)
+		value, next, err := source.fetch(ctx, index)
+		cancel()
+		if err != nil {
+			slog.Warn("Failed to watch remote config", "source", path, "error", err)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		// The first fetch only records where the loaded config stands
+		if index != 0 && next != index && value != nil {
+			onChange()
+		}
+		// Consul resets indexes that go backwards, e.g. after a snapshot restore
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// fetch reads the key. With a non-zero index it first waits for a change past that index.
+// It returns the value and the index to wait on next.
+func (source *remoteSource) fetch(ctx context.Context, index int64) ([]byte, int64, error) {
+	if source.kind == "consul" {
+		return source.fetchConsul(ctx, index)
+	}
+	if index != 0 {
+		err := source.watchEtcd(ctx, index)
+		if ctx.Err() != nil {
+			// Nothing changed before the watch timed out
+			return nil, index, nil
+		}
+		if err != nil {
+			return nil, index, err
+		}
+	}
+	return source.fetchEtcd(ctx)
+}
+
+// fetchConsul reads a Consul KV key, as a blocking query when an index is given
+func (source *remoteSource) fetchConsul(ctx context.Context, index int64) ([]byte, int64, error) {
+	address := source.endpoint + "/v1/kv/" + source.key + "?raw"
+	if index != 0 {
+		address += "&wait=5m&index=" + strconv.FormatInt(index, 10)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, index, err
+	}
+	if source.token != "" {
+		request.Header.Set("X-Consul-Token", source.token)
+	}
+
+	response, err := remoteClient.Do(request)
+	if err != nil {
+		return nil, index, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, index, fmt.Errorf("consul key %s does not exist", source.key)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, index, fmt.Errorf("consul returned %s", response.Status)
+	}
+	value, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, index, err
+	}
+	next, _ := strconv.ParseInt(response.Header.Get("X-Consul-Index"), 10, 64)
+	return value, next, nil
+}
+
+// etcdRangeResponse is the part of an etcd v3 range response that is used. The gateway
+// encodes keys and values in base64, which encoding/json decodes into []byte.
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Value       []byte `json:"value"`
+		ModRevision string `json:"mod_revision"`
+	} `json:"kvs"`
+}
+
+// fetchEtcd reads an etcd key through the v3 JSON gateway. Keys are passed as []byte so
+// they are encoded in base64 as the gateway expects.
+func (source *remoteSource) fetchEtcd(ctx context.Context) ([]byte, int64, error) {
+	var response etcdRangeResponse
+	if err := source.callEtcd(ctx, "/v3/kv/range", map[string]interface{}{"key": []byte(source.key)}, &response); err != nil {
+		return nil, 0, err
+	}
+	if len(response.Kvs) == 0 {
+		return nil, 0, fmt.Errorf("etcd key %s does not exist", source.key)
+	}
+	revision, _ := strconv.ParseInt(response.Kvs[0].ModRevision, 10, 64)
+	return response.Kvs[0].Value, revision, nil
+}
+
+// watchEtcd waits until the key is modified after the given revision
+func (source *remoteSource) watchEtcd(ctx context.Context, revision int64) error {
+	request := map[string]interface{}{
+		"create_request": map[string]interface{}{"key": []byte(source.key), "start_revision": strconv.FormatInt(revision+1, 10)},
+	}
+	body, err := source.openEtcd(ctx, "/v3/watch", request)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// The watch streams one JSON object per event batch, the first one confirming the watch
+	decoder := json.NewDecoder(body)
+	for {
+		var message struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			return err
+		}
+		if message.Error != nil {
+			return fmt.Errorf("etcd watch failed: %s", message.Error.Message)
+		}
+		if message.Result.Canceled {
+			return fmt.Errorf("etcd canceled the watch")
+		}
+		if len(message.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+// callEtcd posts a request to the etcd v3 JSON gateway and decodes the response
+func (source *remoteSource) callEtcd(ctx context.Context, endpoint string, request, response interface{}) error {
+	body, err := source.openEtcd(ctx, endpoint, request)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(response)
+}
+
+// openEtcd posts a request to the etcd v3 JSON gateway, authenticating first when the
+// source has a user, and returns the response body
+func (source *remoteSource) openEtcd(ctx context.Context, endpoint string, request interface{}) (io.ReadCloser, error) {
+	token := ""
+	if source.username != "" {
+		var authenticated struct {
+			Token string `json:"token"`
+		}
+		credentials := map[string]string{"name": source.username, "password": source.password}
+		body, err := source.postEtcd(ctx, "/v3/auth/authenticate", credentials, "")
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(body).Decode(&authenticated)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("etcd authentication failed: %v", err)
+		}
+		token = authenticated.Token
+	}
+	return source.postEtcd(ctx, endpoint, request, token)
+}
+
+func (source *remoteSource) postEtcd(ctx context.Context, endpoint string, request interface{}, token string) (io.ReadCloser, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, source.endpoint+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpRequest.Header.Set("Authorization", token)
+	}
+
+	response, err := remoteClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		return nil, fmt.Errorf("etcd returned %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	return response.Body, nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// ReadSecretFile reads a secret mounted as a file, such as a Docker or Kubernetes secret,
+// without the trailing newline most tools write
+func ReadSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// loadSecretFiles fills secret fields from their *_file variants. A string field tagged
+// x_file holds the path of the value of its sibling x, and a map tagged x_files holds the
+// paths of the entries of its sibling xs. Values read from files replace inline ones.
+func loadSecretFiles(config *Config) error {
+	v := &validator{}
+	readSecretFiles(reflect.ValueOf(config).Elem(), "", v)
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func readSecretFiles(value reflect.Value, path string, v *validator) {
+	switch value.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]reflect.Value)
+		for i := 0; i < value.NumField(); i++ {
+			if tag, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ","); tag != "" && tag != "-" {
+				fields[tag] = value.Field(i)
+			}
+		}
+
+		for tag, field := range fields {
+			fieldPath := strings.TrimPrefix(path+"."+tag, ".")
+			switch {
+			case strings.HasSuffix(tag, "_file") && field.Kind() == reflect.String:
+				target, ok := fields[strings.TrimSuffix(tag, "_file")]
+				if ok && target.Kind() == reflect.String && field.String() != "" {
+					secret, err := ReadSecretFile(field.String())
+					if err != nil {
+						v.addf(fieldPath, "%v", err)
+						continue
+					}
+					target.SetString(secret)
+				}
+			case strings.HasSuffix(tag, "_files") && field.Kind() == reflect.Map:
+				target, ok := fields[strings.TrimSuffix(tag, "_files")+"s"]
+				if !ok || target.Type() != field.Type() || field.Len() == 0 {
+					continue
+				}
+				if target.IsNil() {
+					target.Set(reflect.MakeMap(target.Type()))
+				}
+				for _, key := range field.MapKeys() {
+					secret, err := ReadSecretFile(field.MapIndex(key).String())
+					if err != nil {
+						v.addf(fmt.Sprintf("%s.%s", fieldPath, key), "%v", err)
+						continue
+					}
+					target.SetMapIndex(key, reflect.ValueOf(secret))
+				}
+			default:
+				readSecretFiles(field, fieldPath, v)
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			readSecretFiles(value.Index(i), fmt.Sprintf("%s[%d]", path, i), v)
+		}
+
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			// Map values are not addressable, so fill a copy and store it back
+			entry := reflect.New(value.Type().Elem()).Elem()
+			entry.Set(value.MapIndex(key))
+			readSecretFiles(entry, fmt.Sprintf("%s.%s", path, key), v)
+			value.SetMapIndex(key, entry)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	token := write("token", "from-file\n")
+	secret := write("secret", "app-secret\r\n")
+
+	content := `{
+		"redis": {"nodes": [{"address": "127.0.0.1:6379"}]},
+		"server": {
+			"host": "localhost", "port": "6001",
+			"admin": {"address": "127.0.0.1:6061", "token": "inline", "token_file": "` + token + `"},
+			"channel_auth": {"secrets": {"a": "inline-a"}, "secret_files": {"b": "` + secret + `"}}
+		},
+		"apps": {"tenant": {"secret_file": "` + secret + `"}}
+	}`
+	config, err := LoadConfig(writeFile(t, "config.json", content))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	tests := []struct {
+		field string
+		got   string
+		want  string
+	}{
+		{"server.admin.token", config.Server.Admin.Token, "from-file"},
+		{"server.channel_auth.secrets.a", config.Server.ChannelAuth.Secrets["a"], "inline-a"},
+		{"server.channel_auth.secrets.b", config.Server.ChannelAuth.Secrets["b"], "app-secret"},
+		{"apps.tenant.secret", config.Apps["tenant"].Secret, "app-secret"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.field, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigUnreadableSecretFile(t *testing.T) {
+	content := `{"redis": {"nodes": [{"address": "127.0.0.1:6379"}]}, "server": {"host": "localhost", "port": "6001", "admin": {"token_file": "/nonexistent/token"}}}`
+	_, err := LoadConfig(writeFile(t, "config.json", content))
+	if err == nil || !strings.Contains(err.Error(), "server.admin.token_file") {
+		t.Errorf("LoadConfig error = %v, want one naming server.admin.token_file", err)
+	}
+}
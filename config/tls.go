@@ -0,0 +1,55 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// Protocol version of the listener when server.tls.min_version is not set
+const defaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// TLSVersion returns the protocol version named in server.tls.min_version, "1.2" or "1.3"
+func TLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version '%s', use 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// CipherSuite returns the ID of a cipher suite given by its standard name, such as
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Suites with known weaknesses are rejected.
+func CipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite '%s' is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite '%s'", name)
+}
+
+// CurveID returns the key exchange curve named "X25519", "P-256", "P-384" or "P-521"
+func CurveID(name string) (tls.CurveID, error) {
+	curve, ok := tlsCurves[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown curve '%s', use X25519, P-256, P-384 or P-521", name)
+	}
+	return curve, nil
+}
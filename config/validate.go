@@ -0,0 +1,682 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cache lifetime in seconds given to valid tokens when neither cash_time_out nor
+// cache_ttl.valid is set, so results are not cached forever
+const defaultValidCacheTTL = 300
+
+// Log file used when logging.file is not set
+const defaultLogFile = "/var/log/websocket-server.log"
+
+// Where ACME certificates are kept and HTTP-01 challenges are answered when
+// server.tls.autocert leaves them unset
+const (
+	defaultAutocertCacheDir    = "/var/lib/gopush/autocert"
+	defaultAutocertHTTPAddress = ":80"
+)
+
+// Seconds over which a restarting process closes its connections when
+// server.restart_drain is not set
+const defaultRestartDrain = 30
+
+// Permissions of the socket file when server.unix_socket.mode is not set, letting the
+// group of the server, such as the one of the reverse proxy, connect
+const defaultUnixSocketMode = "0660"
+
+// Channel labels of the metrics when metrics.max_channels is not set
+const defaultMetricsChannels = 1000
+
+// Seconds between StatsD pushes when metrics.statsd.interval is not set
+const defaultStatsDInterval = 10
+
+// Seconds a signed publish request may be off when server.publish_api.max_skew is not set
+const defaultPublishMaxSkew = 300
+
+// Destinations of the audit sinks when audit.file and audit.stream are not set
+const (
+	defaultAuditFile   = "/var/log/websocket-audit.log"
+	defaultAuditStream = "gopush:audit"
+)
+
+// ValidationError lists every problem found in a config, each prefixed with the path of its field
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+// validator collects the problems of a config
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate fills in defaults for unset fields and checks the config. Instead of stopping
+// at the first problem it returns a ValidationError listing all of them.
+func (c *Config) Validate() error {
+	c.applyDefaults()
+
+	v := &validator{}
+	c.validateRedis(v)
+	c.validateBroker(v)
+	c.validateServer(v)
+	c.validateAuthorize(v)
+	for key, app := range c.Apps {
+		path := fmt.Sprintf("apps.%s", key)
+		v.url(path+".authorize_url", app.AuthorizeUrl)
+		v.nonNegative(path+".max_connections", app.MaxConnections)
+		v.nonNegativeFloat(path+".max_publish_rate", app.MaxPublishRate)
+		v.acl(path+".acl", app.ACL)
+		for role, rules := range app.Roles {
+			v.acl(fmt.Sprintf("%s.roles.%s", path, role), rules)
+		}
+	}
+	c.validateAppNamespaces(v)
+	for name, identity := range c.Identities {
+		v.acl(fmt.Sprintf("identities.%s.acl", name), identity.ACL)
+	}
+	v.oneOf("audit.sink", c.Audit.Sink, "file", "redis")
+	if c.Audit.MaxLen < 0 {
+		v.addf("audit.max_len", "must not be negative, got %d", c.Audit.MaxLen)
+	}
+	v.oneOf("metrics.channel_label", c.Metrics.ChannelLabel, "prefix", "channel", "none")
+	v.nonNegative("metrics.max_channels", c.Metrics.MaxChannels)
+	v.oneOf("metrics.sink", c.Metrics.Sink, "prometheus", "statsd")
+	if c.Metrics.Enabled && c.Metrics.Sink == "prometheus" && c.Server.Admin.Address == "" {
+		v.addf("metrics.enabled", "requires server.admin.address, metrics are served on the admin listener")
+	}
+	if c.Metrics.StatsD.Address != "" {
+		v.address("metrics.statsd.address", c.Metrics.StatsD.Address)
+	} else if c.Metrics.Enabled && c.Metrics.Sink == "statsd" {
+		v.addf("metrics.statsd.address", "required when metrics.sink is statsd")
+	}
+	v.nonNegative("metrics.statsd.interval", c.Metrics.StatsD.Interval)
+	v.url("tracing.endpoint", c.Tracing.Endpoint)
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		v.addf("tracing.sample_ratio", "must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	}
+	v.url("sentry.dsn", c.Sentry.Dsn)
+	if c.Sentry.SampleRate < 0 || c.Sentry.SampleRate > 1 {
+		v.addf("sentry.sample_rate", "must be between 0 and 1, got %v", c.Sentry.SampleRate)
+	}
+	v.url("webhooks.url", c.Webhooks.URL)
+	for i, event := range c.Webhooks.Events {
+		v.oneOf(fmt.Sprintf("webhooks.events[%d]", i), event, "connect", "disconnect", "subscribe", "unsubscribe")
+	}
+	v.nonNegative("webhooks.batch_size", c.Webhooks.BatchSize)
+	v.nonNegative("webhooks.batch_interval", c.Webhooks.BatchInterval)
+	v.nonNegative("webhooks.queue_size", c.Webhooks.QueueSize)
+	v.nonNegative("webhooks.timeout", c.Webhooks.Timeout)
+	v.nonNegative("webhooks.retries", c.Webhooks.Retries)
+	for i, subscriber := range c.Webhooks.Subscribers {
+		prefix := fmt.Sprintf("webhooks.subscribers[%d]", i)
+		if subscriber.URL == "" {
+			v.addf(prefix+".url", "required")
+		}
+		v.url(prefix+".url", subscriber.URL)
+		if len(subscriber.Channels) == 0 {
+			v.addf(prefix+".channels", "required")
+		}
+		for j, pattern := range subscriber.Channels {
+			if _, err := path.Match(pattern, ""); err != nil {
+				v.addf(fmt.Sprintf("%s.channels[%d]", prefix, j), "invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	if c.Push.UserChannel != "" && strings.Count(c.Push.UserChannel, "{user_id}") != 1 {
+		v.addf("push.user_channel", "must contain {user_id} once, got %q", c.Push.UserChannel)
+	}
+	v.nonNegative("push.online_ttl", c.Push.OnlineTTL)
+	v.nonNegative("push.queue_size", c.Push.QueueSize)
+	v.file("push.fcm.credentials_file", c.Push.FCM.CredentialsFile)
+	v.url("push.fcm.url", c.Push.FCM.URL)
+	if apns := c.Push.APNs; apns.KeyFile != "" {
+		v.file("push.apns.key_file", apns.KeyFile)
+		if apns.KeyID == "" || apns.TeamID == "" || apns.Topic == "" {
+			v.addf("push.apns", "key_id, team_id and topic are required with key_file")
+		}
+	}
+	v.url("push.apns.url", c.Push.APNs.URL)
+	if webPush := c.Push.WebPush; webPush.PrivateKey != "" {
+		if !strings.HasPrefix(webPush.Subject, "mailto:") && !strings.HasPrefix(webPush.Subject, "https://") {
+			v.addf("push.webpush.subject", "must be a mailto: or https: URL, got %q", webPush.Subject)
+		}
+		if webPush.Path != "" {
+			v.path("push.webpush.path", webPush.Path)
+		}
+		for i, pattern := range webPush.EndpointHosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				v.addf(fmt.Sprintf("push.webpush.endpoint_hosts[%d]", i), "invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	v.nonNegative("push.webpush.ttl", c.Push.WebPush.TTL)
+	if c.MQTT.Address != "" {
+		v.address("mqtt.address", c.MQTT.Address)
+	}
+	if c.MQTT.TLS && !c.Server.TLS.Enabled {
+		v.addf("mqtt.tls", "requires server.tls.enabled")
+	}
+	if strings.ContainsAny(c.MQTT.ChannelPrefix, "+#") {
+		v.addf("mqtt.channel_prefix", "must not contain the MQTT wildcards + and #")
+	}
+	v.nonNegative("mqtt.max_packet_size", c.MQTT.MaxPacketSize)
+	v.oneOf("logging.level", strings.ToLower(c.Logging.Level), "", "debug", "info", "warn", "warning", "error")
+	v.oneOf("logging.output", c.Logging.Output, "stdout", "file", "both")
+	v.oneOf("logging.fallback", c.Logging.Fallback, "stdout", "fail")
+	v.oneOf("logging.redaction.tokens", c.Logging.Redaction.Tokens, "hash", "truncate", "none")
+	v.oneOf("logging.format", c.Logging.Format, "", "json", "text")
+	v.nonNegative("logging.rotation.max_size", c.Logging.Rotation.MaxSize)
+	v.nonNegative("logging.rotation.max_age", c.Logging.Rotation.MaxAge)
+	v.nonNegative("logging.rotation.max_backups", c.Logging.Rotation.MaxBackups)
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// applyDefaults sets fields whose zero value would silently misbehave
+func (c *Config) applyDefaults() {
+	if c.Broker.Type == "" {
+		c.Broker.Type = "redis"
+	}
+	if c.Server.WsUrl == "" {
+		c.Server.WsUrl = "/ws"
+	}
+	if c.Server.Protocol == "" {
+		c.Server.Protocol = "ws"
+		if c.Server.TLS.Enabled {
+			c.Server.Protocol = "wss"
+		}
+	}
+	if c.Server.RestartDrain == 0 {
+		c.Server.RestartDrain = defaultRestartDrain
+	}
+	if c.Server.UnixSocket.Mode == "" {
+		c.Server.UnixSocket.Mode = defaultUnixSocketMode
+	}
+	if c.Server.TLS.MinVersion == "" {
+		c.Server.TLS.MinVersion = defaultTLSMinVersion
+	}
+	if c.Server.TLS.Autocert.CacheDir == "" {
+		c.Server.TLS.Autocert.CacheDir = defaultAutocertCacheDir
+	}
+	if c.Server.TLS.Autocert.HTTPAddress == "" {
+		c.Server.TLS.Autocert.HTTPAddress = defaultAutocertHTTPAddress
+	}
+	if c.Server.Authorize.CashTimeOut <= 0 && c.Server.Authorize.CacheTTL.Valid == 0 {
+		c.Server.Authorize.CacheTTL.Valid = defaultValidCacheTTL
+	}
+	if c.Logging.Output == "" {
+		c.Logging.Output = "stdout"
+		if c.Environment == "production" {
+			c.Logging.Output = "file"
+		}
+	}
+	if c.Logging.File == "" {
+		c.Logging.File = defaultLogFile
+	}
+	if c.Logging.Fallback == "" {
+		c.Logging.Fallback = "stdout"
+	}
+	if c.Logging.Redaction.Tokens == "" {
+		c.Logging.Redaction.Tokens = "hash"
+	}
+	if c.Metrics.ChannelLabel == "" {
+		c.Metrics.ChannelLabel = "prefix"
+	}
+	if c.Metrics.PrefixSeparator == "" {
+		c.Metrics.PrefixSeparator = ":"
+	}
+	if c.Metrics.MaxChannels == 0 {
+		c.Metrics.MaxChannels = defaultMetricsChannels
+	}
+	if c.Metrics.Sink == "" {
+		c.Metrics.Sink = "prometheus"
+	}
+	if c.Metrics.StatsD.Interval == 0 {
+		c.Metrics.StatsD.Interval = defaultStatsDInterval
+	}
+	if c.Server.PublishAPI.MaxSkew == 0 {
+		c.Server.PublishAPI.MaxSkew = defaultPublishMaxSkew
+	}
+	if c.Audit.Sink == "" {
+		c.Audit.Sink = "file"
+	}
+	for key, app := range c.Apps {
+		// Apps without a namespace would share channels with single-tenant clients and each other
+		if app.Namespace == "" {
+			app.Namespace = key + ":"
+			c.Apps[key] = app
+		}
+	}
+	if c.Audit.File == "" {
+		c.Audit.File = defaultAuditFile
+	}
+	if c.Audit.Stream == "" {
+		c.Audit.Stream = defaultAuditStream
+	}
+}
+
+// validateAppNamespaces checks that no app's channels can land in another app's namespace.
+// A namespace that starts with another one would let that app reach the first app's channels.
+func (c *Config) validateAppNamespaces(v *validator) {
+	keys := make([]string, 0, len(c.Apps))
+	for key := range c.Apps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, other := range keys {
+			namespace, otherNamespace := c.Apps[key].Namespace, c.Apps[other].Namespace
+			if key != other && strings.HasPrefix(namespace, otherNamespace) {
+				v.addf(fmt.Sprintf("apps.%s.namespace", key), "%q overlaps the namespace %q of app %s", namespace, otherNamespace, other)
+			}
+		}
+	}
+}
+
+func (c *Config) validateRedis(v *validator) {
+	redis := c.Redis
+	configured := 0
+	if len(redis.Nodes) > 0 {
+		configured++
+	}
+	if len(redis.Cluster.Addresses) > 0 {
+		configured++
+	}
+	if redis.Sentinel.MasterName != "" {
+		configured++
+	}
+	if configured == 0 && c.Broker.Type != "memory" {
+		v.addf("redis", "set nodes, cluster.addresses or sentinel.master_name")
+	}
+	if configured > 1 {
+		v.addf("redis", "set only one of nodes, cluster.addresses and sentinel.master_name")
+	}
+
+	for i, node := range redis.Nodes {
+		path := fmt.Sprintf("redis.nodes[%d]", i)
+		v.address(path+".address", node.Address)
+		v.redisTLS(path+".tls", node.TLS)
+		v.redisPool(path+".pool", node.Pool)
+	}
+	for i, address := range redis.Cluster.Addresses {
+		v.address(fmt.Sprintf("redis.cluster.addresses[%d]", i), address)
+	}
+	v.redisTLS("redis.cluster.tls", redis.Cluster.TLS)
+	v.redisPool("redis.cluster.pool", redis.Cluster.Pool)
+	if redis.Sentinel.MasterName != "" && len(redis.Sentinel.Addresses) == 0 {
+		v.addf("redis.sentinel.addresses", "required with master_name")
+	}
+	for i, address := range redis.Sentinel.Addresses {
+		v.address(fmt.Sprintf("redis.sentinel.addresses[%d]", i), address)
+	}
+	v.redisTLS("redis.sentinel.tls", redis.Sentinel.TLS)
+	v.redisPool("redis.sentinel.pool", redis.Sentinel.Pool)
+
+	v.oneOf("redis.backend", redis.Backend, "", "pubsub", "streams")
+	v.nonNegative("redis.broadcast_concurrency", redis.BroadcastConcurrency)
+	v.nonNegative("redis.broadcast_timeout", redis.BroadcastTimeout)
+	v.nonNegative("redis.timeouts.operation", redis.Timeouts.Operation)
+	v.nonNegative("redis.timeouts.publish", redis.Timeouts.Publish)
+	v.nonNegative("redis.timeouts.subscribe", redis.Timeouts.Subscribe)
+	v.nonNegative("redis.streams.max_len", int(redis.Streams.MaxLen))
+	v.nonNegative("redis.streams.batch_size", int(redis.Streams.BatchSize))
+	v.nonNegative("redis.keyspace.database", redis.Keyspace.Database)
+	if redis.Keyspace.Enabled && len(redis.Keyspace.Keys) == 0 {
+		v.addf("redis.keyspace.keys", "required when keyspace notifications are enabled")
+	}
+	for i, pattern := range redis.Keyspace.Keys {
+		field := fmt.Sprintf("redis.keyspace.keys[%d]", i)
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.addf(field, "invalid pattern %q: %v", pattern, err)
+		} else if pattern == "" || strings.ContainsAny(pattern[:1], `*?[\`) {
+			// Auth cache entries are keyed by token, a pattern without a literal prefix would reveal them
+			v.addf(field, "must start with a literal prefix, got %q", pattern)
+		}
+	}
+	v.nonNegative("redis.health_check.interval", redis.HealthCheck.Interval)
+	v.nonNegative("redis.health_check.failure_threshold", redis.HealthCheck.FailureThreshold)
+}
+
+func (c *Config) validateBroker(v *validator) {
+	broker := c.Broker
+	v.oneOf("broker.type", broker.Type, "redis", "nats", "kafka", "amqp", "pubsub", "memory")
+	v.file("broker.nats.credentials_file", broker.NATS.CredentialsFile)
+	v.file("broker.pubsub.credentials_file", broker.PubSub.CredentialsFile)
+
+	switch broker.Type {
+	case "kafka":
+		if len(broker.Kafka.Brokers) == 0 {
+			v.addf("broker.kafka.brokers", "required with the kafka broker")
+		}
+		for i, address := range broker.Kafka.Brokers {
+			v.address(fmt.Sprintf("broker.kafka.brokers[%d]", i), address)
+		}
+	case "pubsub":
+		if broker.PubSub.ProjectID == "" {
+			v.addf("broker.pubsub.project_id", "required with the pubsub broker")
+		}
+	}
+}
+
+func (c *Config) validateServer(v *validator) {
+	server := c.Server
+	if server.Host == "" {
+		v.addf("server.host", "required")
+	} else if _, _, err := net.SplitHostPort(server.Host); err == nil {
+		v.addf("server.host", "must not include a port, set server.port instead")
+	}
+	if port, err := strconv.Atoi(server.Port); err != nil || port < 1 || port > 65535 {
+		v.addf("server.port", "must be a number from 1 to 65535, got %q", server.Port)
+	}
+	v.oneOf("server.protocol", server.Protocol, "ws", "wss")
+	v.path("server.ws_url", server.WsUrl)
+	if server.HealthCheckUrl != "" {
+		v.path("server.health_check_url", server.HealthCheckUrl)
+	}
+	if server.LivenessUrl != "" {
+		v.path("server.liveness_url", server.LivenessUrl)
+	}
+	if server.ReadinessUrl != "" {
+		v.path("server.readiness_url", server.ReadinessUrl)
+	}
+	if server.VersionUrl != "" {
+		v.path("server.version_url", server.VersionUrl)
+	}
+	if publish := server.PublishAPI; publish.Url != "" {
+		v.path("server.publish_api.url", publish.Url)
+		if publish.Key == "" && publish.Secret == "" && len(c.Apps) == 0 {
+			v.addf("server.publish_api.url", "requires server.publish_api.key, server.publish_api.secret or apps to authenticate requests")
+		}
+	}
+	v.nonNegative("server.publish_api.max_skew", server.PublishAPI.MaxSkew)
+	if server.SocketIO.Path != "" {
+		v.path("server.socketio.path", server.SocketIO.Path)
+	}
+	v.nonNegative("server.socketio.ping_interval", server.SocketIO.PingInterval)
+	v.nonNegative("server.socketio.ping_timeout", server.SocketIO.PingTimeout)
+	if server.Pusher.Enabled && len(server.ChannelAuth.Secrets) == 0 && len(c.Apps) == 0 {
+		// Pusher clients connect with an app key, which selects the secret of channel signatures
+		v.addf("server.pusher.enabled", "requires server.channel_auth.secrets or apps")
+	}
+	v.nonNegative("server.pusher.activity_timeout", server.Pusher.ActivityTimeout)
+	if server.GraphQL.Path != "" {
+		v.path("server.graphql.path", server.GraphQL.Path)
+		if len(server.GraphQL.Subscriptions) == 0 {
+			v.addf("server.graphql.subscriptions", "required with server.graphql.path")
+		}
+	}
+	for name, template := range server.GraphQL.Subscriptions {
+		if !balancedBraces(template) {
+			v.addf("server.graphql.subscriptions."+name, "unbalanced braces in %q", template)
+		}
+	}
+	for i, origin := range server.CORS.AllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			v.addf(fmt.Sprintf("server.cors.allowed_origins[%d]", i), "invalid pattern %q: %v", origin, err)
+		}
+	}
+	v.nonNegative("server.cors.max_age", server.CORS.MaxAge)
+	v.nonNegative("server.timeouts.read_header", server.Timeouts.ReadHeader)
+	v.nonNegative("server.timeouts.read", server.Timeouts.Read)
+	v.nonNegative("server.timeouts.write", server.Timeouts.Write)
+	v.nonNegative("server.timeouts.idle", server.Timeouts.Idle)
+	v.nonNegative("server.timeouts.handshake", server.Timeouts.Handshake)
+	v.nonNegative("server.timeouts.max_header_bytes", server.Timeouts.MaxHeaderBytes)
+	v.nonNegative("server.shutdown_drain", server.ShutdownDrain)
+	v.nonNegative("server.restart_drain", server.RestartDrain)
+	if server.Admin.Address != "" {
+		v.address("server.admin.address", server.Admin.Address)
+	} else if server.Admin.Debug {
+		v.addf("server.admin.address", "required when server.admin.debug is enabled")
+	} else if server.Admin.Token != "" {
+		v.addf("server.admin.address", "required when server.admin.token is set")
+	}
+
+	if server.ReusePort && c.Broker.Type == "memory" {
+		// Processes sharing the port only see each other's messages through a real broker
+		v.addf("server.reuse_port", "requires a broker shared by the processes, not the memory broker")
+	}
+	v.unixSocket("server.unix_socket.path", server.UnixSocket.Path)
+	if mode, err := strconv.ParseUint(server.UnixSocket.Mode, 8, 32); err != nil || mode > 0777 {
+		v.addf("server.unix_socket.mode", "must be octal permissions such as \"0660\", got %q", server.UnixSocket.Mode)
+	}
+	for i, listener := range server.Listeners {
+		path := fmt.Sprintf("server.listeners[%d]", i)
+		if (listener.Address == "") == (listener.UnixSocket == "") {
+			v.addf(path, "set either address or unix_socket")
+		} else if listener.Address != "" {
+			v.address(path+".address", listener.Address)
+		}
+		v.unixSocket(path+".unix_socket", listener.UnixSocket)
+		if listener.TLS && !server.TLS.Enabled {
+			v.addf(path+".tls", "requires server.tls.enabled")
+		}
+	}
+
+	autocert := server.TLS.Autocert
+	if autocert.Enabled {
+		if !server.TLS.Enabled {
+			v.addf("server.tls.autocert.enabled", "requires server.tls.enabled")
+		}
+		if len(autocert.Domains) == 0 {
+			v.addf("server.tls.autocert.domains", "required when autocert is enabled")
+		}
+		for i, domain := range autocert.Domains {
+			if domain == "" || strings.ContainsAny(domain, "*:/ ") {
+				v.addf(fmt.Sprintf("server.tls.autocert.domains[%d]", i), "must be a host name, got %q", domain)
+			}
+		}
+		v.address("server.tls.autocert.http_address", autocert.HTTPAddress)
+		v.url("server.tls.autocert.directory_url", autocert.DirectoryURL)
+	}
+
+	if server.TLS.Enabled {
+		if server.TLS.CertFile == "" && !autocert.Enabled {
+			v.addf("server.tls.cert_file", "required when TLS is enabled")
+		}
+		if server.TLS.KeyFile == "" && !autocert.Enabled {
+			v.addf("server.tls.key_file", "required when TLS is enabled")
+		}
+		v.file("server.tls.cert_file", server.TLS.CertFile)
+		v.file("server.tls.key_file", server.TLS.KeyFile)
+		v.file("server.tls.client_ca_file", server.TLS.ClientCAFile)
+		if _, err := TLSVersion(server.TLS.MinVersion); err != nil {
+			v.addf("server.tls.min_version", "%v", err)
+		}
+		for i, name := range server.TLS.CipherSuites {
+			if _, err := CipherSuite(name); err != nil {
+				v.addf(fmt.Sprintf("server.tls.cipher_suites[%d]", i), "%v", err)
+			}
+		}
+		for i, name := range server.TLS.CurvePreferences {
+			if _, err := CurveID(name); err != nil {
+				v.addf(fmt.Sprintf("server.tls.curve_preferences[%d]", i), "%v", err)
+			}
+		}
+	}
+
+	v.nonNegative("server.acks.receipt_ttl", server.Acks.ReceiptTTL)
+	v.nonNegative("server.resume.session_ttl", server.Resume.SessionTTL)
+	v.nonNegative("server.resume.buffer_ttl", server.Resume.BufferTTL)
+	v.nonNegative("server.resume.buffer_size", server.Resume.BufferSize)
+	v.nonNegativeFloat("server.rate_limit.messages_per_second", server.RateLimit.MessagesPerSecond)
+	v.nonNegative("server.rate_limit.burst", server.RateLimit.Burst)
+	v.nonNegative("server.rate_limit.max_violations", server.RateLimit.MaxViolations)
+	v.nonNegative("server.limits.max_frame_size", int(server.Limits.MaxFrameSize))
+	v.nonNegative("server.limits.max_payload_size", server.Limits.MaxPayloadSize)
+	v.nonNegative("server.slow_clients.max_queue", server.SlowClients.MaxQueue)
+	v.nonNegative("server.slow_clients.max_write_latency", server.SlowClients.MaxWriteLatency)
+	v.nonNegative("server.slow_clients.grace", server.SlowClients.Grace)
+	v.nonNegative("server.slow_clients.write_timeout", server.SlowClients.WriteTimeout)
+	if level := server.Compression.Level; level < 0 || level > 9 {
+		v.addf("server.compression.level", "must be from 0 to 9, got %d", level)
+	}
+	v.nonNegative("server.compression.min_size", server.Compression.MinSize)
+
+	v.acl("server.acl", server.ACL)
+	for role, rules := range server.Roles {
+		v.acl("server.roles."+role, rules)
+	}
+}
+
+func (c *Config) validateAuthorize(v *validator) {
+	authorize := c.Server.Authorize
+	v.url("server.authorize.url", authorize.Url)
+	v.url("server.authorize.jwt.jwks_url", authorize.JWT.JwksUrl)
+	v.url("server.authorize.introspection.url", authorize.Introspection.Url)
+
+	v.nonNegative("server.authorize.cash_time_out", int(authorize.CashTimeOut))
+	v.nonNegative("server.authorize.cache_ttl.valid", authorize.CacheTTL.Valid)
+	v.nonNegative("server.authorize.cache_ttl.invalid", authorize.CacheTTL.Invalid)
+	if jitter := authorize.CacheTTL.Jitter; jitter < 0 || jitter >= 1 {
+		v.addf("server.authorize.cache_ttl.jitter", "must be at least 0 and below 1, got %v", jitter)
+	}
+	v.nonNegative("server.authorize.cache_ttl.l1_size", authorize.CacheTTL.L1Size)
+	v.nonNegative("server.authorize.cache_ttl.l1_ttl", authorize.CacheTTL.L1TTL)
+
+	v.nonNegative("server.authorize.circuit_breaker.failure_threshold", authorize.CircuitBreaker.FailureThreshold)
+	v.nonNegative("server.authorize.circuit_breaker.open_duration", authorize.CircuitBreaker.OpenDuration)
+	v.nonNegative("server.authorize.circuit_breaker.half_open_probes", authorize.CircuitBreaker.HalfOpenProbes)
+	v.oneOf("server.authorize.circuit_breaker.fallback", authorize.CircuitBreaker.Fallback, "", "closed", "stale")
+	v.nonNegative("server.authorize.circuit_breaker.stale_ttl", authorize.CircuitBreaker.StaleTTL)
+
+	v.nonNegative("server.authorize.retry.attempts", authorize.Retry.Attempts)
+	v.nonNegative("server.authorize.retry.base_delay", authorize.Retry.BaseDelay)
+	v.nonNegative("server.authorize.retry.max_delay", authorize.Retry.MaxDelay)
+
+	for scope, rules := range authorize.Introspection.ScopeACL {
+		v.acl("server.authorize.introspection.scope_acl."+scope, rules)
+	}
+}
+
+func (v *validator) redisTLS(path string, settings RedisTLS) {
+	if !settings.Enabled {
+		return
+	}
+	v.file(path+".ca_file", settings.CAFile)
+	v.file(path+".cert_file", settings.CertFile)
+	v.file(path+".key_file", settings.KeyFile)
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		v.addf(path, "cert_file and key_file must be set together")
+	}
+}
+
+func (v *validator) redisPool(path string, pool RedisPool) {
+	v.nonNegative(path+".pool_size", pool.PoolSize)
+	v.nonNegative(path+".min_idle_conns", pool.MinIdleConns)
+	v.nonNegative(path+".dial_timeout", pool.DialTimeout)
+}
+
+func (v *validator) acl(path string, rules []ACLRule) {
+	for i, rule := range rules {
+		if rule.Pattern == "" {
+			v.addf(fmt.Sprintf("%s[%d].pattern", path, i), "required")
+		}
+	}
+}
+
+func (v *validator) nonNegative(path string, value int) {
+	if value < 0 {
+		v.addf(path, "must not be negative, got %d", value)
+	}
+}
+
+func (v *validator) nonNegativeFloat(path string, value float64) {
+	if value < 0 {
+		v.addf(path, "must not be negative, got %v", value)
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	for _, option := range allowed {
+		if value == option {
+			return
+		}
+	}
+	v.addf(path, "must be one of %q, got %q", allowed, value)
+}
+
+// address checks a host:port address
+func (v *validator) address(path, address string) {
+	if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+		v.addf(path, "must be a host:port address, got %q", address)
+	}
+}
+
+// unixSocket checks an optional unix socket path, which has to fit sun_path of struct
+// sockaddr_un
+func (v *validator) unixSocket(path, name string) {
+	if len(name) > 107 {
+		v.addf(path, "must be at most 107 bytes long, got %d", len(name))
+	}
+}
+
+// url checks an optional absolute http or https URL
+func (v *validator) url(path, raw string) {
+	if raw == "" {
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.addf(path, "must be an absolute http or https URL, got %q", raw)
+	}
+}
+
+// path checks an HTTP route
+func (v *validator) path(path, route string) {
+	if !strings.HasPrefix(route, "/") {
+		v.addf(path, "must start with /, got %q", route)
+	}
+}
+
+// file checks that an optional file exists
+func (v *validator) file(path, name string) {
+	if name == "" {
+		return
+	}
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		v.addf(path, "%s does not exist", name)
+	} else if err != nil {
+		v.addf(path, "%v", err)
+	}
+}
+
+// balancedBraces reports whether the {name} placeholders of a template are well formed
+func balancedBraces(template string) bool {
+	open := false
+	for _, c := range template {
+		switch c {
+		case '{':
+			if open {
+				return false
+			}
+			open = true
+		case '}':
+			if !open {
+				return false
+			}
+			open = false
+		}
+	}
+	return !open
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// validConfig returns the smallest config that passes validation
+func validConfig(t *testing.T) *Config {
+	t.Helper()
+	c := &Config{}
+	if err := json.Unmarshal([]byte(`{"redis": {"nodes": [{"address": "127.0.0.1:6379"}]}, "server": {"host": "localhost", "port": "6001"}}`), c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string // Problems reported, none when empty
+	}{
+		{
+			name:   "minimal config",
+			modify: func(c *Config) {},
+		},
+		{
+			name:   "missing redis",
+			modify: func(c *Config) { c.Redis.Nodes = nil },
+			want:   []string{"redis: set nodes, cluster.addresses or sentinel.master_name"},
+		},
+		{
+			name:   "missing host",
+			modify: func(c *Config) { c.Server.Host = "" },
+			want:   []string{"server.host: required"},
+		},
+		{
+			name:   "host with a port",
+			modify: func(c *Config) { c.Server.Host = "localhost:6001" },
+			want:   []string{"server.host: must not include a port"},
+		},
+		{
+			name:   "port out of range",
+			modify: func(c *Config) { c.Server.Port = "70000" },
+			want:   []string{`server.port: must be a number from 1 to 65535, got "70000"`},
+		},
+		{
+			name:   "negative max_queue",
+			modify: func(c *Config) { c.Server.SlowClients.MaxQueue = -1 },
+			want:   []string{"server.slow_clients.max_queue: must not be negative, got -1"},
+		},
+		{
+			name:   "ACL rule without a pattern",
+			modify: func(c *Config) { c.Server.ACL = []ACLRule{{Pattern: "news", Read: true}, {Read: true}} },
+			want:   []string{"server.acl[1].pattern: required"},
+		},
+		{
+			name: "overlapping app namespaces",
+			modify: func(c *Config) {
+				c.Apps = map[string]App{"a": {Namespace: "shop:"}, "b": {Namespace: "shop:eu:"}}
+			},
+			want: []string{`apps.b.namespace: "shop:eu:" overlaps the namespace "shop:" of app a`},
+		},
+		{
+			name:   "prometheus metrics without the admin listener",
+			modify: func(c *Config) { c.Metrics.Enabled = true },
+			want:   []string{"metrics.enabled: requires server.admin.address"},
+		},
+		{
+			name:   "sample ratio out of range",
+			modify: func(c *Config) { c.Tracing.SampleRatio = 1.5 },
+			want:   []string{"tracing.sample_ratio: must be between 0 and 1, got 1.5"},
+		},
+		{
+			name:   "unknown webhook event",
+			modify: func(c *Config) { c.Webhooks.Events = []string{"connect", "publish"} },
+			want:   []string{"webhooks.events[1]"},
+		},
+		{
+			name: "every problem is reported",
+			modify: func(c *Config) {
+				c.Server.Host = ""
+				c.Server.Port = "0"
+				c.Tracing.SampleRatio = -1
+			},
+			want: []string{"server.host: required", "server.port:", "tracing.sample_ratio:"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(t)
+			tt.modify(c)
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("Validate() = %v, want a ValidationError", err)
+			}
+			for _, want := range tt.want {
+				found := false
+				for _, problem := range invalid.Problems {
+					if strings.Contains(problem, want) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("problems %q do not mention %q", invalid.Problems, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	c := validConfig(t)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+
+	tests := []struct {
+		field string
+		got   interface{}
+		want  interface{}
+	}{
+		{"server.publish_api.max_skew", c.Server.PublishAPI.MaxSkew, defaultPublishMaxSkew},
+		{"server.restart_drain", c.Server.RestartDrain, defaultRestartDrain},
+		{"audit.stream", c.Audit.Stream, defaultAuditStream},
+		{"metrics.max_channels", c.Metrics.MaxChannels, defaultMetricsChannels},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.field, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package cors
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Defaults of the server.cors block
+var (
+	defaultMethods = []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+	defaultHeaders = []string{"Authorization", "Content-Type", "X-App-Key", "X-Timestamp", "X-Signature"}
+)
+
+// policy holds the CORS settings in the form the handler needs them
+type policy struct {
+	origins     []string // Lower-cased patterns
+	anyOrigin   bool
+	methods     string
+	headers     string
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+var mu sync.Mutex
+var current *policy
+
+// Configure applies the server.cors block. Without allowed origins no CORS headers are
+// sent and browsers keep blocking cross-origin calls.
+func Configure(config *config.Config) {
+	settings := config.Server.CORS
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(settings.AllowedOrigins) == 0 {
+		current = nil
+		return
+	}
+
+	p := &policy{
+		methods:     strings.Join(orDefault(settings.AllowedMethods, defaultMethods), ", "),
+		headers:     strings.Join(orDefault(settings.AllowedHeaders, defaultHeaders), ", "),
+		exposed:     strings.Join(settings.ExposedHeaders, ", "),
+		credentials: settings.AllowCredentials,
+	}
+	for _, origin := range settings.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		if origin == "*" {
+			p.anyOrigin = true
+		}
+		p.origins = append(p.origins, origin)
+	}
+	if settings.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(settings.MaxAge)
+	}
+	current = p
+}
+
+func orDefault(values, fallback []string) []string {
+	if len(values) == 0 {
+		return fallback
+	}
+	return values
+}
+
+func currentPolicy() *policy {
+	mu.Lock()
+	defer mu.Unlock()
+	return current
+}
+
+// Handler adds the CORS headers to the responses of the HTTP endpoints and answers
+// preflight requests itself. WebSocket upgrades pass through untouched, they are checked
+// against server.allowed_origins instead.
+func Handler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := currentPolicy()
+		origin := r.Header.Get("Origin")
+		if p == nil || origin == "" || websocket.IsWebSocketUpgrade(r) {
+			next(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !p.allows(origin) {
+			if preflight {
+				// Without the allow headers the browser refuses the actual request
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		// A wildcard cannot be combined with credentials, so the origin is echoed instead
+		if p.anyOrigin && !p.credentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			header.Set("Access-Control-Allow-Methods", p.methods)
+			header.Set("Access-Control-Allow-Headers", p.headers)
+			if p.maxAge != "" {
+				header.Set("Access-Control-Max-Age", p.maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if p.exposed != "" {
+			header.Set("Access-Control-Expose-Headers", p.exposed)
+		}
+		next(w, r)
+	}
+}
+
+// allows reports whether an origin matches an entry, given as a full origin
+// ("https://app.example.com"), a host ("app.example.com") or a wildcard pattern
+// ("*.example.com"), the way server.allowed_origins is matched
+func (p *policy) allows(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	origin, host := strings.ToLower(origin), strings.ToLower(u.Host)
+	for _, pattern := range p.origins {
+		if matched, _ := path.Match(pattern, origin); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
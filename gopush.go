@@ -0,0 +1,69 @@
+// Package gopush embeds the gopush WebSocket server in a Go program:
+//
+//	cfg, err := gopush.LoadConfig("config.json")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	s, err := gopush.New(cfg)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.Handle("/", s.Handler())
+//
+// The server is set up from the same config as the gopush command. Programs either mount
+// Handler on their own HTTP server, or let ListenAndServe open the listeners of the config.
+// Hub publishes to channels and manages the connections without going through HTTP.
+// A process runs a single server.
+package gopush
+
+import (
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/hub"
+	"github.com/sahakavatar/gopush/server"
+)
+
+// Config is the configuration of a server, as read from a config file
+type Config = config.Config
+
+// Server is a gopush server, see the server package
+type Server = server.Server
+
+// Hub reaches the clients of a server, see the hub package
+type Hub = hub.Hub
+
+// Message is a message published through a Hub
+type Message = hub.Message
+
+// Option changes how New sets up a server, see the server package
+type Option = server.Option
+
+// WithLogger makes the server log to a logger instead of the default slog logger
+func WithLogger(logger *slog.Logger) Option {
+	return server.WithLogger(logger)
+}
+
+// WithRegisterer registers the server's Prometheus metrics with a registerer instead of
+// the global default one
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return server.WithRegisterer(registerer)
+}
+
+// ErrServerExists is returned by New when it was already called, see New
+var ErrServerExists = server.ErrServerExists
+
+// New sets up a server from a config. It can only be called once per process: the server
+// keeps its connections and settings in package state, so programs that need several
+// servers run them as separate processes. Later calls return ErrServerExists, also after
+// a first call that failed, since what that call configured is kept.
+func New(cfg *Config, opts ...Option) (*Server, error) {
+	return server.New(cfg, opts...)
+}
+
+// LoadConfig reads a config file, or a consul:// or etcd:// key, applies the GOPUSH_*
+// environment overrides and validates the result
+func LoadConfig(path string) (*Config, error) {
+	return config.LoadConfig(path)
+}
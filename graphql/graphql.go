@@ -0,0 +1,398 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/bridge"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/websocket"
+)
+
+// Subprotocol of the graphql-ws library, the only one the endpoint speaks
+const Subprotocol = "graphql-transport-ws"
+
+// Message types of the graphql-transport-ws protocol
+const (
+	messageConnectionInit = "connection_init"
+	messageConnectionAck  = "connection_ack"
+	messagePing           = "ping"
+	messagePong           = "pong"
+	messageSubscribe      = "subscribe"
+	messageNext           = "next"
+	messageError          = "error"
+	messageComplete       = "complete"
+)
+
+// Close codes of the graphql-transport-ws protocol
+const (
+	closeBadRequest          = 4400
+	closeUnauthorized        = 4401
+	closeForbidden           = 4403
+	closeSubprotocol         = 4406
+	closeInitTimeout         = 4408
+	closeSubscriberExists    = 4409
+	closeTooManyInitRequests = 4429
+	closeInternal            = 4500
+)
+
+// Time a client has to send connection_init after connecting
+const initTimeout = 10 * time.Second
+
+// Interval of the server's pings, which clients answer with a pong
+const pingInterval = 30 * time.Second
+
+// message is a message of the protocol in either direction
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// subscribePayload is the payload of a subscribe message
+type subscribePayload struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// initPayload is the connectionParams a client passes to createClient
+type initPayload struct {
+	Token         string `json:"token"`
+	Authorization string `json:"authorization"`
+	AppKey        string `json:"app_key"`
+}
+
+// graphQLError is an error of an operation as clients receive it
+type graphQLError struct {
+	Message    string                 `json:"message"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// subscription is an operation a client runs, delivering a channel's messages
+type subscription struct {
+	channel string
+	root    field
+}
+
+// Handler serves GraphQL subscriptions over the graphql-transport-ws protocol of the
+// graphql-ws library. Each subscription field maps to a channel through the templates of
+// server.graphql.subscriptions, and the channel's messages are its results.
+func Handler(b broker.Broker, rdb redis.UniversalClient, config *config.Config, upgrader *gws.Upgrader) http.HandlerFunc {
+	upgrader.Subprotocols = []string{Subprotocol}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		websocket.ApplyReadLimit(conn)
+
+		token := auth.TokenFromRequest(r)
+		c := &client{
+			conn:          conn,
+			config:        config,
+			session:       bridge.NewSession("graphql", r.RemoteAddr, b, rdb, config),
+			subscriptions: make(map[string]subscription),
+			operations:    make(map[string][]string),
+			done:          make(chan struct{}),
+		}
+		c.session.SetRequest(auth.NewAuthorizeRequest(r, token))
+		defer reporting.Recover(reporting.Fields{"conn_id": c.session.ConnID, "remote_addr": r.RemoteAddr})
+		defer c.session.Close()
+		defer close(c.done)
+
+		if conn.Subprotocol() != Subprotocol {
+			c.close(closeSubprotocol, "Subprotocol not acceptable")
+			return
+		}
+		c.session.Log.Info("New GraphQL connection")
+		go c.ping()
+
+		initialized := false
+		conn.SetReadDeadline(time.Now().Add(initTimeout))
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				var netErr net.Error
+				if !initialized && errors.As(err, &netErr) && netErr.Timeout() {
+					c.close(closeInitTimeout, "Connection initialisation timeout")
+				}
+				c.session.Log.Info("GraphQL read failed", "error", err)
+				return
+			}
+			if initialized {
+				conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+			}
+
+			var m message
+			if err := json.Unmarshal(frame, &m); err != nil || m.Type == "" {
+				c.close(closeBadRequest, "Invalid message received")
+				return
+			}
+
+			switch m.Type {
+			case messageConnectionInit:
+				if initialized {
+					c.close(closeTooManyInitRequests, "Too many initialisation requests")
+					return
+				}
+				if !c.init(m.Payload, token, apps.KeyFromRequest(r), r) {
+					return
+				}
+				initialized = true
+				conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+			case messagePing:
+				c.send(message{Type: messagePong})
+			case messagePong:
+			case messageSubscribe:
+				if !initialized {
+					c.close(closeUnauthorized, "Unauthorized")
+					return
+				}
+				if !c.subscribe(m) {
+					return
+				}
+			case messageComplete:
+				c.complete(m.ID)
+			default:
+				c.close(closeBadRequest, "Invalid message received")
+				return
+			}
+		}
+	}
+}
+
+// client is a GraphQL client connected over a WebSocket
+type client struct {
+	conn    *gws.Conn
+	config  *config.Config
+	session *bridge.Session
+	done    chan struct{}
+
+	mu            sync.Mutex
+	subscriptions map[string]subscription // Keyed by operation ID
+	operations    map[string][]string     // Operation IDs of each channel
+
+	write sync.Mutex
+}
+
+// send writes a message and reports whether it was written
+func (c *client) send(m message) bool {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		c.session.Log.Error("Failed to encode GraphQL message", "type", m.Type, "error", err)
+		return false
+	}
+
+	c.write.Lock()
+	defer c.write.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(bridge.WriteTimeout))
+	if err := c.conn.WriteMessage(gws.TextMessage, encoded); err != nil {
+		c.session.Log.Warn("Failed to send GraphQL message", "error", err)
+		c.conn.Close()
+		return false
+	}
+	return true
+}
+
+// close ends the connection with a close code of the protocol
+func (c *client) close(code int, reason string) {
+	c.session.Log.Warn("Closing GraphQL connection", "code", code, "reason", reason)
+	c.write.Lock()
+	defer c.write.Unlock()
+	c.conn.WriteControl(gws.CloseMessage, gws.FormatCloseMessage(code, reason), time.Now().Add(bridge.WriteTimeout))
+}
+
+// ping sends pings until the connection ends, so idle subscriptions are kept open
+func (c *client) ping() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if !c.send(message{Type: messagePing}) {
+				return
+			}
+		}
+	}
+}
+
+// init authenticates the client with the token and app key of its connectionParams,
+// falling back to those of the upgrade request, and reports whether it was accepted
+func (c *client) init(raw json.RawMessage, token, appKey string, r *http.Request) bool {
+	var params initPayload
+	if len(raw) > 0 && !bytes.Equal(raw, []byte("null")) {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			c.close(closeBadRequest, "Invalid connection_init payload")
+			return false
+		}
+	}
+	if bearer, ok := strings.CutPrefix(params.Authorization, "Bearer "); ok {
+		params.Token = strings.TrimSpace(bearer)
+	}
+	if params.Token != "" {
+		token = params.Token
+		c.session.SetRequest(auth.NewAuthorizeRequest(r, token))
+	}
+	if params.AppKey != "" {
+		appKey = params.AppKey
+	}
+
+	if err := c.session.Authenticate(appKey, token, r.TLS); err != nil {
+		if bridge.Refused(err) {
+			c.close(closeForbidden, "Forbidden")
+		} else {
+			c.close(closeInternal, "Authorization unavailable")
+		}
+		return false
+	}
+	return c.send(message{Type: messageConnectionAck})
+}
+
+// subscribe starts an operation, reporting whether the connection stays open. Operations
+// that cannot run are answered with an error message.
+func (c *client) subscribe(m message) bool {
+	if m.ID == "" {
+		c.close(closeBadRequest, "Subscribe message without an id")
+		return false
+	}
+	c.mu.Lock()
+	_, exists := c.subscriptions[m.ID]
+	c.mu.Unlock()
+	if exists {
+		c.close(closeSubscriberExists, "Subscriber for "+m.ID+" already exists")
+		return false
+	}
+
+	var payload subscribePayload
+	decoder := json.NewDecoder(bytes.NewReader(m.Payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		c.close(closeBadRequest, "Invalid subscribe payload")
+		return false
+	}
+
+	doc, err := parseDocument(payload.Query)
+	if err != nil {
+		c.operationError(m.ID, err.Error(), "GRAPHQL_PARSE_FAILED")
+		return true
+	}
+	root, err := doc.subscription(payload.OperationName, payload.Variables)
+	if err != nil {
+		c.operationError(m.ID, err.Error(), "GRAPHQL_VALIDATION_FAILED")
+		return true
+	}
+	channel, err := channelFor(root, c.config.Server.GraphQL.Subscriptions)
+	if err != nil {
+		c.operationError(m.ID, err.Error(), "GRAPHQL_VALIDATION_FAILED")
+		return true
+	}
+
+	// Operations on the same channel share the session's subscription of it
+	c.mu.Lock()
+	c.subscriptions[m.ID] = subscription{channel: channel, root: root}
+	c.operations[channel] = append(c.operations[channel], m.ID)
+	first := len(c.operations[channel]) == 1
+	c.mu.Unlock()
+	if !first {
+		return true
+	}
+
+	err = c.session.Subscribe(channel, func(payload string) {
+		c.deliver(channel, payload)
+	})
+	if err != nil {
+		c.mu.Lock()
+		ids := c.operations[channel]
+		delete(c.operations, channel)
+		for _, id := range ids {
+			delete(c.subscriptions, id)
+		}
+		c.mu.Unlock()
+		for _, id := range ids {
+			c.operationError(id, err.Error(), string(bridge.ErrorCode(err)))
+		}
+	}
+	return true
+}
+
+// operationError ends an operation with an error
+func (c *client) operationError(id, text, code string) {
+	payload, _ := json.Marshal([]graphQLError{{Message: text, Extensions: map[string]interface{}{"code": code}}})
+	c.send(message{ID: id, Type: messageError, Payload: payload})
+}
+
+// complete stops an operation the client no longer wants, ending the subscription of its
+// channel when no other operation uses it
+func (c *client) complete(id string) {
+	c.mu.Lock()
+	sub, ok := c.subscriptions[id]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.subscriptions, id)
+	ids := c.operations[sub.channel]
+	for i, other := range ids {
+		if other == id {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(c.operations, sub.channel)
+	} else {
+		c.operations[sub.channel] = ids
+	}
+	c.mu.Unlock()
+
+	if len(ids) == 0 {
+		c.session.Unsubscribe(sub.channel)
+	}
+}
+
+// deliver sends a channel message to every operation of the channel, as the value of its
+// root field restricted to the fields the operation selects
+func (c *client) deliver(channel, payload string) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(bridge.Decode(payload).Message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	ids := append([]string(nil), c.operations[channel]...)
+	roots := make([]field, len(ids))
+	for i, id := range ids {
+		roots[i] = c.subscriptions[id].root
+	}
+	c.mu.Unlock()
+
+	for i, id := range ids {
+		result, err := json.Marshal(map[string]interface{}{
+			"data": map[string]interface{}{roots[i].responseKey(): project(value, roots[i].selections)},
+		})
+		if err != nil {
+			continue
+		}
+		c.send(message{ID: id, Type: messageNext, Payload: result})
+	}
+}
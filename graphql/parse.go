@@ -0,0 +1,566 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of tokens of a GraphQL document
+const (
+	tokenEOF = iota
+	tokenPunctuator
+	tokenName
+	tokenNumber
+	tokenString
+)
+
+// Deepest nesting of selections and values a document may have
+const maxDepth = 32
+
+type token struct {
+	kind  int
+	value string
+}
+
+// field is a field of a selection set with its arguments and own selections. Fragment
+// spreads are already inlined, and type conditions and directives dropped.
+type field struct {
+	alias      string
+	name       string
+	arguments  map[string]interface{}
+	selections []field
+}
+
+// responseKey returns the key of the field in the response
+func (f field) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// operation is an operation of a document
+type operation struct {
+	kind       string // query, mutation or subscription
+	name       string
+	defaults   map[string]interface{} // Default values of variables
+	selections []selection
+}
+
+// Kinds of selections
+const (
+	selectField = iota
+	selectSpread
+	selectInline
+)
+
+// selection is a field or fragment of a selection set before fragments are inlined
+type selection struct {
+	kind     int
+	field    field       // The field, without its selections
+	spread   string      // Name of a fragment spread
+	children []selection // Selections of a field or an inline fragment
+}
+
+// variable is a reference to a variable in an argument value
+type variable string
+
+// enum is an enum value in an argument value
+type enum string
+
+// document is a parsed GraphQL document
+type document struct {
+	operations []operation
+	fragments  map[string][]selection
+}
+
+// parser reads a GraphQL document, keeping what resolving a subscription needs
+type parser struct {
+	source string
+	pos    int
+	token  token
+	depth  int
+}
+
+// parseDocument parses the query of a subscribe message
+func parseDocument(source string) (doc document, err error) {
+	p := &parser{source: source}
+	defer func() {
+		if r := recover(); r != nil {
+			syntax, ok := r.(syntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = syntax
+		}
+	}()
+
+	doc.fragments = make(map[string][]selection)
+	p.next()
+	for p.token.kind != tokenEOF {
+		if p.peekName("fragment") {
+			p.next()
+			name := p.name()
+			p.expectName("on")
+			p.name()
+			p.directives()
+			doc.fragments[name] = p.selectionSet()
+			continue
+		}
+		doc.operations = append(doc.operations, p.operation())
+	}
+	if len(doc.operations) == 0 {
+		return doc, fmt.Errorf("document has no operation")
+	}
+	return doc, nil
+}
+
+// syntaxError aborts parsing from deep in the parser
+type syntaxError struct {
+	message string
+}
+
+func (e syntaxError) Error() string {
+	return e.message
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	panic(syntaxError{fmt.Sprintf("Syntax error at %d: ", p.pos) + fmt.Sprintf(format, args...)})
+}
+
+// next reads the next token, skipping whitespace, commas and comments
+func (p *parser) next() {
+	for p.pos < len(p.source) {
+		c := p.source[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.source) && p.source[p.pos] != '\n' && p.source[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(p.source[p.pos:], "\ufeff") {
+			p.pos += len("\ufeff")
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.source) {
+		p.token = token{kind: tokenEOF}
+		return
+	}
+
+	start := p.pos
+	c := p.source[p.pos]
+	switch {
+	case strings.HasPrefix(p.source[p.pos:], "..."):
+		p.pos += 3
+		p.token = token{tokenPunctuator, "..."}
+	case strings.IndexByte("!$&()/:=@[]{}|", c) >= 0:
+		p.pos++
+		p.token = token{tokenPunctuator, string(c)}
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.source) && (p.source[p.pos] == '_' || isLetter(p.source[p.pos]) || isDigit(p.source[p.pos])) {
+			p.pos++
+		}
+		p.token = token{tokenName, p.source[start:p.pos]}
+	case c == '-' || isDigit(c):
+		p.pos++
+		for p.pos < len(p.source) && (isDigit(p.source[p.pos]) || strings.IndexByte(".eE+-", p.source[p.pos]) >= 0) {
+			p.pos++
+		}
+		number := p.source[start:p.pos]
+		if _, err := strconv.ParseFloat(number, 64); err != nil {
+			p.fail("invalid number %q", number)
+		}
+		p.token = token{tokenNumber, number}
+	case strings.HasPrefix(p.source[p.pos:], `"""`):
+		end := strings.Index(p.source[p.pos+3:], `"""`)
+		if end < 0 {
+			p.fail("unterminated string")
+		}
+		value := p.source[p.pos+3 : p.pos+3+end]
+		p.pos += end + 6
+		p.token = token{tokenString, strings.TrimSpace(value)}
+	case c == '"':
+		p.pos++
+		for p.pos < len(p.source) && p.source[p.pos] != '"' {
+			if p.source[p.pos] == '\\' {
+				p.pos++
+			}
+			if p.pos < len(p.source) && (p.source[p.pos] == '\n' || p.source[p.pos] == '\r') {
+				p.fail("unterminated string")
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.source) {
+			p.fail("unterminated string")
+		}
+		p.pos++
+		// The escapes of GraphQL strings are those of JSON
+		var value string
+		if err := json.Unmarshal([]byte(p.source[start:p.pos]), &value); err != nil {
+			p.fail("invalid string %s", p.source[start:p.pos])
+		}
+		p.token = token{tokenString, value}
+	default:
+		p.fail("unexpected character %q", c)
+	}
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// peek reports whether the current token is a punctuator
+func (p *parser) peek(punctuator string) bool {
+	return p.token.kind == tokenPunctuator && p.token.value == punctuator
+}
+
+// peekName reports whether the current token is a keyword
+func (p *parser) peekName(name string) bool {
+	return p.token.kind == tokenName && p.token.value == name
+}
+
+// expect consumes a punctuator
+func (p *parser) expect(punctuator string) {
+	if !p.peek(punctuator) {
+		p.fail("expected %q, found %q", punctuator, p.token.value)
+	}
+	p.next()
+}
+
+// expectName consumes a keyword
+func (p *parser) expectName(name string) {
+	if !p.peekName(name) {
+		p.fail("expected %q, found %q", name, p.token.value)
+	}
+	p.next()
+}
+
+// name consumes a name and returns it
+func (p *parser) name() string {
+	if p.token.kind != tokenName {
+		p.fail("expected a name, found %q", p.token.value)
+	}
+	name := p.token.value
+	p.next()
+	return name
+}
+
+// enter guards against documents nested deep enough to exhaust the stack
+func (p *parser) enter() {
+	p.depth++
+	if p.depth > maxDepth {
+		p.fail("document is nested too deep")
+	}
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// operation parses an operation, either in full or as a bare selection set query
+func (p *parser) operation() operation {
+	op := operation{kind: "query", defaults: make(map[string]interface{})}
+	if p.peek("{") {
+		op.selections = p.selectionSet()
+		return op
+	}
+
+	op.kind = p.name()
+	if op.kind != "query" && op.kind != "mutation" && op.kind != "subscription" {
+		p.fail("unknown operation type %q", op.kind)
+	}
+	if p.token.kind == tokenName {
+		op.name = p.name()
+	}
+	if p.peek("(") {
+		p.next()
+		for !p.peek(")") {
+			p.expect("$")
+			name := p.name()
+			p.expect(":")
+			p.typeReference()
+			if p.peek("=") {
+				p.next()
+				op.defaults[name] = p.value(true)
+			}
+			p.directives()
+		}
+		p.next()
+	}
+	p.directives()
+	op.selections = p.selectionSet()
+	return op
+}
+
+// typeReference skips the type of a variable
+func (p *parser) typeReference() {
+	if p.peek("[") {
+		p.next()
+		p.enter()
+		p.typeReference()
+		p.leave()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	if p.peek("!") {
+		p.next()
+	}
+}
+
+// directives skips directives, which the endpoint does not evaluate
+func (p *parser) directives() {
+	for p.peek("@") {
+		p.next()
+		p.name()
+		if p.peek("(") {
+			p.arguments()
+		}
+	}
+}
+
+// selectionSet parses the selections between braces
+func (p *parser) selectionSet() []selection {
+	p.enter()
+	defer p.leave()
+
+	p.expect("{")
+	var selections []selection
+	for !p.peek("}") {
+		if p.token.kind == tokenEOF {
+			p.fail("unterminated selection set")
+		}
+		selections = append(selections, p.selection())
+	}
+	p.next()
+	if len(selections) == 0 {
+		p.fail("empty selection set")
+	}
+	return selections
+}
+
+// selection parses a field, a fragment spread or an inline fragment
+func (p *parser) selection() selection {
+	if p.peek("...") {
+		p.next()
+		if p.token.kind == tokenName && !p.peekName("on") {
+			name := p.name()
+			p.directives()
+			return selection{kind: selectSpread, spread: name}
+		}
+		if p.peekName("on") {
+			p.next()
+			p.name()
+		}
+		p.directives()
+		return selection{kind: selectInline, children: p.selectionSet()}
+	}
+
+	f := field{name: p.name()}
+	if p.peek(":") {
+		p.next()
+		f.alias, f.name = f.name, p.name()
+	}
+	if p.peek("(") {
+		f.arguments = p.arguments()
+	}
+	p.directives()
+	s := selection{kind: selectField, field: f}
+	if p.peek("{") {
+		s.children = p.selectionSet()
+	}
+	return s
+}
+
+// arguments parses the arguments of a field or directive
+func (p *parser) arguments() map[string]interface{} {
+	p.expect("(")
+	arguments := make(map[string]interface{})
+	for !p.peek(")") {
+		name := p.name()
+		p.expect(":")
+		arguments[name] = p.value(false)
+	}
+	p.next()
+	return arguments
+}
+
+// value parses an argument value; constant values may not reference variables
+func (p *parser) value(constant bool) interface{} {
+	p.enter()
+	defer p.leave()
+
+	switch {
+	case p.peek("$"):
+		if constant {
+			p.fail("unexpected variable")
+		}
+		p.next()
+		return variable(p.name())
+	case p.peek("["):
+		p.next()
+		list := []interface{}{}
+		for !p.peek("]") {
+			if p.token.kind == tokenEOF {
+				p.fail("unterminated list")
+			}
+			list = append(list, p.value(constant))
+		}
+		p.next()
+		return list
+	case p.peek("{"):
+		p.next()
+		object := make(map[string]interface{})
+		for !p.peek("}") {
+			name := p.name()
+			p.expect(":")
+			object[name] = p.value(constant)
+		}
+		p.next()
+		return object
+	}
+
+	t := p.token
+	switch t.kind {
+	case tokenNumber:
+		p.next()
+		return json.Number(t.value)
+	case tokenString:
+		p.next()
+		return t.value
+	case tokenName:
+		p.next()
+		switch t.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return enum(t.value)
+	}
+	p.fail("unexpected %q", t.value)
+	return nil
+}
+
+// subscription picks the operation a subscribe message runs and returns its root field
+// with its arguments resolved against the variables
+func (doc document) subscription(operationName string, variables map[string]interface{}) (field, error) {
+	var op *operation
+	for i := range doc.operations {
+		if operationName == "" || doc.operations[i].name == operationName {
+			if op != nil {
+				return field{}, fmt.Errorf("operationName is required for documents with several operations")
+			}
+			op = &doc.operations[i]
+		}
+	}
+	if op == nil {
+		return field{}, fmt.Errorf("unknown operation %q", operationName)
+	}
+	if op.kind != "subscription" {
+		return field{}, fmt.Errorf("only subscription operations are supported, not %s", op.kind)
+	}
+
+	fields, err := doc.inline(op.selections, 0)
+	if err != nil {
+		return field{}, err
+	}
+	if len(fields) != 1 {
+		return field{}, fmt.Errorf("subscription operations must select exactly one field")
+	}
+
+	root := fields[0]
+	resolved := make(map[string]interface{}, len(root.arguments))
+	for name, value := range root.arguments {
+		if resolved[name], err = resolve(value, variables, op.defaults); err != nil {
+			return field{}, err
+		}
+	}
+	root.arguments = resolved
+	return root, nil
+}
+
+// inline replaces fragments by their fields
+func (doc document) inline(selections []selection, depth int) ([]field, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("fragments are nested too deep")
+	}
+
+	var fields []field
+	for _, s := range selections {
+		switch s.kind {
+		case selectField:
+			f := s.field
+			if len(s.children) > 0 {
+				children, err := doc.inline(s.children, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				f.selections = children
+			}
+			fields = append(fields, f)
+		case selectInline:
+			inlined, err := doc.inline(s.children, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, inlined...)
+		default:
+			fragment, ok := doc.fragments[s.spread]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %q", s.spread)
+			}
+			inlined, err := doc.inline(fragment, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, inlined...)
+		}
+	}
+	return fields, nil
+}
+
+// resolve replaces the variables in an argument value by their values
+func resolve(value interface{}, variables, defaults map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case variable:
+		if resolved, ok := variables[string(v)]; ok {
+			return resolved, nil
+		}
+		if resolved, ok := defaults[string(v)]; ok {
+			return resolved, nil
+		}
+		return nil, fmt.Errorf("variable $%s is not provided", string(v))
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := resolve(item, variables, defaults)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = resolved
+		}
+		return list, nil
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			resolved, err := resolve(item, variables, defaults)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = resolved
+		}
+		return object, nil
+	}
+	return value, nil
+}
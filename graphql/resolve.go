@@ -0,0 +1,84 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// channelFor maps a subscription's root field to its channel through the template
+// server.graphql.subscriptions gives for the field, replacing each {name} by the
+// argument of that name
+func channelFor(root field, templates map[string]string) (string, error) {
+	template, ok := templates[root.name]
+	if !ok {
+		return "", fmt.Errorf("unknown subscription field %q", root.name)
+	}
+
+	var channel strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			channel.WriteString(template)
+			return channel.String(), nil
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("invalid channel template for %q", root.name)
+		}
+		name := template[start+1 : start+end]
+		value, err := argumentString(root.arguments, name)
+		if err != nil {
+			return "", err
+		}
+		channel.WriteString(template[:start])
+		channel.WriteString(value)
+		template = template[start+end+1:]
+	}
+}
+
+// argumentString returns a scalar argument as it appears in a channel name
+func argumentString(arguments map[string]interface{}, name string) (string, error) {
+	value, ok := arguments[name]
+	if !ok || value == nil {
+		return "", fmt.Errorf("argument %q is required", name)
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case enum:
+		return string(v), nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("argument %q must be a scalar", name)
+}
+
+// project keeps the fields a subscription selects of a message, like a resolver returning
+// the message would. Fields the message lacks are null, and a message without selections
+// is returned whole.
+func project(value interface{}, selections []field) interface{} {
+	if len(selections) == 0 {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		projected := make(map[string]interface{}, len(selections))
+		for _, f := range selections {
+			projected[f.responseKey()] = project(v[f.name], f.selections)
+		}
+		return projected
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = project(item, selections)
+		}
+		return list
+	}
+	return value
+}
@@ -0,0 +1,144 @@
+// Package hub gives programs embedding gopush the operations the REST and admin APIs
+// offer over HTTP: publishing to channels, broadcasting to every client, describing the
+// connections of the server and disconnecting them.
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/websocket"
+	"golang.org/x/net/context"
+)
+
+// ErrReservedChannel is returned for messages published to the broadcast channel, which
+// only Broadcast reaches
+var ErrReservedChannel = errors.New("the broadcast channel is reserved, use Broadcast to reach every client")
+
+// Descriptions of the connections of a server, as the admin API returns them
+type (
+	Stats            = websocket.Stats
+	ChannelStats     = websocket.ChannelStats
+	ConnectionStats  = websocket.ConnectionStats
+	ConnectionFilter = websocket.ConnectionFilter
+	ConnectionCounts = websocket.ConnectionCounts
+)
+
+// Message is a message published to a channel. Subscribers receive it in the same format
+// as messages of the send action and of the publish API.
+type Message struct {
+	Channel    string          // Channel as clients subscribe to it
+	Namespace  string          // Namespace of the app publishing, empty without apps
+	Event      string          // Optional event name
+	Payload    json.RawMessage // Delivered to subscribers as message
+	MessageID  string          // Kept when set, generated otherwise
+	Priority   string          // Push notification priority, high or normal
+	CollapseID string          // Push notifications with the same ID replace each other
+}
+
+// Encode returns the envelope subscribers receive and the ID of the message, generating
+// one when the message has none
+func (m Message) Encode() ([]byte, string, error) {
+	if m.MessageID == "" {
+		m.MessageID = websocket.NewMessageID()
+	}
+	var payload interface{}
+	if len(m.Payload) > 0 {
+		payload = m.Payload
+	}
+	data := map[string]interface{}{
+		"channel":         m.Channel,
+		"message":         payload,
+		"message_id":      m.MessageID,
+		"published_at_ms": time.Now().UnixMilli(),
+	}
+	if m.Event != "" {
+		data["event"] = m.Event
+	}
+	if m.Priority != "" {
+		data["priority"] = m.Priority
+	}
+	if m.CollapseID != "" {
+		data["collapse_id"] = m.CollapseID
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode message: %v", err)
+	}
+	return encoded, m.MessageID, nil
+}
+
+// Hub reaches the clients of a gopush server. Messages go through the message broker, so
+// they reach the subscribers of every server; connections are those of this server.
+type Hub struct{}
+
+// New returns the hub of the server running in this process
+func New() *Hub {
+	return &Hub{}
+}
+
+// Publish sends a message to the subscribers of its channel and returns its ID. Like the
+// publish API it is not subject to ACLs, payload limits or quotas.
+func (h *Hub) Publish(ctx context.Context, message Message) (string, error) {
+	if message.Channel == "" {
+		return "", errors.New("channel not specified")
+	}
+	channel := message.Namespace + message.Channel
+	if channel == websocket.BroadcastChannel {
+		return "", ErrReservedChannel
+	}
+	encoded, messageID, err := message.Encode()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := redisconn.WithPublishTimeout(ctx)
+	defer cancel()
+	if err := websocket.Publish(ctx, channel, encoded); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// Broadcast delivers an announcement to every client of every server, whatever it
+// subscribed to, and returns its ID
+func (h *Hub) Broadcast(ctx context.Context, kind string, payload json.RawMessage) (string, error) {
+	ctx, cancel := redisconn.WithPublishTimeout(ctx)
+	defer cancel()
+	return websocket.Broadcast(ctx, kind, payload)
+}
+
+// Stats returns the totals of this server's connections and traffic
+func (h *Hub) Stats() Stats {
+	return websocket.CurrentStats()
+}
+
+// Channels returns the channels with subscribers on this server
+func (h *Hub) Channels() []ChannelStats {
+	return websocket.ChannelSubscribers()
+}
+
+// Connections returns the connections of this server matching a filter
+func (h *Hub) Connections(filter ConnectionFilter) []ConnectionStats {
+	return websocket.Connections(filter)
+}
+
+// Counts returns the number of open connections of this server
+func (h *Hub) Counts() ConnectionCounts {
+	return websocket.Counts()
+}
+
+// Disconnect closes a connection of this server, sending the reason in the close frame.
+// It reports whether the connection was found.
+func (h *Hub) Disconnect(connID, reason string) bool {
+	return websocket.DisconnectConnection(connID, reason)
+}
+
+// DisconnectChannel closes the connections of this server subscribed to a channel and
+// returns how many it closed
+func (h *Hub) DisconnectChannel(channel, reason string) int {
+	return websocket.DisconnectChannel(channel, reason)
+}
@@ -0,0 +1,238 @@
+package ipfilter
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Logger of the ipfilter package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the ipfilter package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Filter admits clients by address. Deny entries always win; when allow entries are
+// configured, clients outside all of them are refused.
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+var mu sync.RWMutex
+
+// Filters for connection endpoints and for admin routes, nil when not configured
+var connections, admin *Filter
+
+// Proxies whose forwarding headers name the client, empty when none are trusted
+var trusted []*net.IPNet
+
+// Configure builds the connection and admin filters from the config. It may be called
+// again on reload; requests are checked against the lists current when they arrive.
+// Invalid lists leave the previous ones in place.
+func Configure(config *config.Config) error {
+	lists := config.Server.IPFilter
+
+	newConnections, err := New(lists.Allow, lists.Deny)
+	if err != nil {
+		return err
+	}
+	newAdmin, err := New(lists.AdminAllow, lists.AdminDeny)
+	if err != nil {
+		return err
+	}
+	newTrusted, err := parseNets(config.Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	connections, admin, trusted = newConnections, newAdmin, newTrusted
+	mu.Unlock()
+	return nil
+}
+
+// current returns the filters in use
+func current() (*Filter, *Filter, []*net.IPNet) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return connections, admin, trusted
+}
+
+// New parses allow and deny lists of CIDR ranges or single addresses. It returns nil
+// when both lists are empty, which admits every client.
+func New(allow, deny []string) (*Filter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	allowNets, err := parseNets(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseNets(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{allow: allowNets, deny: denyNets}, nil
+}
+
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %v", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Allowed reports whether the filter admits an address
+func (f *Filter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range f.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the peer that sent a request
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// RealIP replaces the remote address of requests relayed by a trusted proxy with the
+// address of the client, so logs, IP filters, audit events and webhooks see the client
+// instead of the load balancer. X-Forwarded-For is read from the right, skipping the
+// trusted hops, since clients can put anything in its leftmost entries; X-Real-IP is
+// used when it is absent. Requests from other peers keep their address, whatever
+// headers they send.
+func RealIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if TrustedProxy(ClientIP(r)) {
+			if ip := forwardedFor(r.Header); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+		}
+		next(w, r)
+	}
+}
+
+// forwardedFor returns the client named by the forwarding headers of a trusted proxy,
+// nil when they name none
+func forwardedFor(header http.Header) net.IP {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// A malformed hop cannot be vouched for, so nothing left of it is either
+			break
+		}
+		client = ip
+		if !TrustedProxy(ip) {
+			break
+		}
+	}
+	if client != nil {
+		return client
+	}
+	return net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP")))
+}
+
+// TrustedProxy reports whether an address is in server.trusted_proxies
+func TrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	_, _, trusted := current()
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connections rejects requests from addresses outside the connection lists
+func Connections(next http.HandlerFunc) http.HandlerFunc {
+	return guard(next, false)
+}
+
+// AllowConnection reports whether the connection lists admit a client, for listeners
+// that do not speak HTTP
+func AllowConnection(ip net.IP) bool {
+	connections, _, _ := current()
+	return connections.Allowed(ip)
+}
+
+// Admin rejects requests unless the address passes both the connection and admin lists
+func Admin(next http.HandlerFunc) http.HandlerFunc {
+	return guard(next, true)
+}
+
+func guard(next http.HandlerFunc, adminRoute bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		connections, admin, _ := current()
+		filters := []*Filter{connections}
+		if adminRoute {
+			filters = append(filters, admin)
+		}
+		for _, filter := range filters {
+			if !filter.Allowed(ip) {
+				logger.Warn("Rejected request from blocked address", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,127 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// trustProxies configures the trusted proxies for the duration of a test
+func trustProxies(t *testing.T, proxies ...string) {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Server.TrustedProxies = proxies
+	if err := Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Configure(&config.Config{}) })
+}
+
+func TestForwardedFor(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8", "192.0.2.1")
+
+	tests := []struct {
+		name      string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{"no headers", nil, "", "<nil>"},
+		{"single hop", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted hops are skipped", []string{"203.0.113.7, 10.0.0.2, 192.0.2.1"}, "", "203.0.113.7"},
+		{"spoofed entries left of the client are ignored", []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, "", "203.0.113.7"},
+		{"repeated headers are joined", []string{"203.0.113.7", "10.0.0.2"}, "", "203.0.113.7"},
+		{"malformed hop stops the walk", []string{"203.0.113.7, bogus, 10.0.0.2"}, "", "10.0.0.2"},
+		{"only trusted hops names the leftmost", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"IPv6 client", []string{"2001:db8::1, 10.0.0.2"}, "", "2001:db8::1"},
+		{"X-Real-IP without X-Forwarded-For", nil, "203.0.113.9", "203.0.113.9"},
+		{"X-Forwarded-For wins over X-Real-IP", []string{"203.0.113.7"}, "203.0.113.9", "203.0.113.7"},
+		{"malformed X-Real-IP", nil, "bogus", "<nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, value := range tt.forwarded {
+				header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := forwardedFor(header).String(); got != tt.want {
+				t.Errorf("forwardedFor = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"trusted proxy", "10.0.0.2:4000", "203.0.113.7", "203.0.113.7"},
+		{"untrusted peer keeps its address", "198.51.100.1:4000", "203.0.113.7", "198.51.100.1:4000"},
+		{"trusted proxy without headers", "10.0.0.2:4000", "", "10.0.0.2:4000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			var got string
+			RealIP(func(w http.ResponseWriter, r *http.Request) { got = r.RemoteAddr })(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		ip    string
+		want  bool
+	}{
+		{"no lists", nil, nil, "203.0.113.7", true},
+		{"denied address", nil, []string{"203.0.113.7"}, "203.0.113.7", false},
+		{"outside the deny list", nil, []string{"203.0.113.0/24"}, "198.51.100.1", true},
+		{"inside the allow list", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"outside the allow list", []string{"10.0.0.0/8"}, nil, "203.0.113.7", false},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.0.0.5"}, "10.0.0.5", false},
+		{"IPv6 range", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := New(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, entry := range []string{"bogus", "10.0.0.0/33", "10.0.0.1/"} {
+		if _, err := New([]string{entry}, nil); err == nil {
+			t.Errorf("New(%q) succeeded, want an error", entry)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Logger of the metrics package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the metrics package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Label of channels beyond metrics.max_channels
+const otherChannels = "_other"
+
+var mu sync.Mutex
+
+// Settings from the metrics block, set by Configure
+var (
+	enabled      bool
+	channelLabel string
+	separator    string
+	maxChannels  int
+)
+
+// Channel label values handed out so far, bounded by maxChannels
+var channels = make(map[string]bool)
+
+var (
+	subscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gopush_channel_subscribers",
+		Help: "Subscriptions to the channel held by clients of this server.",
+	}, []string{"channel"})
+	messagesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopush_channel_messages_in_total",
+		Help: "Messages published to the channel by clients of this server.",
+	}, []string{"channel"})
+	messagesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopush_channel_messages_out_total",
+		Help: "Messages of the channel delivered to clients of this server.",
+	}, []string{"channel"})
+	bytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopush_channel_bytes_in_total",
+		Help: "Bytes published to the channel by clients of this server.",
+	}, []string{"channel"})
+	bytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopush_channel_bytes_out_total",
+		Help: "Bytes of the channel delivered to clients of this server.",
+	}, []string{"channel"})
+	writeLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gopush_client_write_seconds",
+		Help:    "Time taken to write a message to a client, including waiting for earlier writes.",
+		Buckets: []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+	})
+	queueDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gopush_client_queue_depth",
+		Help:    "Messages waiting to be written to the client when a new one is queued.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500},
+	})
+	slowClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gopush_slow_clients",
+		Help: "Clients currently over the slow client thresholds.",
+	})
+	deliveryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gopush_delivery_latency_seconds",
+		Help:    "Time from publishing a message of the channel to writing it to a client of this server.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"channel"})
+	authCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopush_auth_cache_lookups_total",
+		Help: "Token lookups in the in-process and Redis caches, by whether they found a valid result, an invalid one or nothing.",
+	}, []string{"cache", "result"})
+	authRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gopush_auth_api_requests_total",
+		Help: "Token validations by the authorize API or introspection endpoint, by outcome.",
+	}, []string{"result"})
+	authLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gopush_auth_api_request_seconds",
+		Help:    "Time taken by the authorize API or introspection endpoint to validate a token, including retries.",
+		Buckets: prometheus.DefBuckets,
+	})
+	slowDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gopush_slow_client_disconnects_total",
+		Help: "Clients disconnected for staying slow longer than the grace period.",
+	})
+)
+
+// Gatherer the metrics are served from, the default one unless Configure was given a
+// registerer that is also a gatherer
+var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+
+// Configure enables the metrics as set in the metrics block, registering them with a
+// registerer, or the default one when it is nil, and starts pushing them when the sink
+// is statsd. Until it is called, or when metrics are disabled, recording them does
+// nothing.
+func Configure(config *config.Config, registerer prometheus.Registerer) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	settings := config.Metrics
+	if !settings.Enabled || enabled {
+		return nil
+	}
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	if err := register(registerer, subscribers, messagesIn, messagesOut, bytesIn, bytesOut,
+		writeLatency, queueDepth, slowClients, slowDisconnects, deliveryLatency,
+		authCache, authRequests, authLatency); err != nil {
+		return err
+	}
+	if settings.Sink == "statsd" {
+		if err := pushToStatsD(config); err != nil {
+			unregister(registerer, subscribers, messagesIn, messagesOut, bytesIn, bytesOut,
+				writeLatency, queueDepth, slowClients, slowDisconnects, deliveryLatency,
+				authCache, authRequests, authLatency)
+			return err
+		}
+	}
+	if g, ok := registerer.(prometheus.Gatherer); ok {
+		gatherer = g
+	}
+	enabled = true
+	channelLabel = settings.ChannelLabel
+	separator = settings.PrefixSeparator
+	maxChannels = settings.MaxChannels
+	return nil
+}
+
+// register registers every collector, or none of them when one fails
+func register(registerer prometheus.Registerer, collectors ...prometheus.Collector) error {
+	for i, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			unregister(registerer, collectors[:i]...)
+			return fmt.Errorf("failed to register metrics: %v", err)
+		}
+	}
+	return nil
+}
+
+func unregister(registerer prometheus.Registerer, collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		registerer.Unregister(collector)
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	mu.Lock()
+	defer mu.Unlock()
+	if gatherer == prometheus.DefaultGatherer {
+		return promhttp.Handler()
+	}
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+// Subscribed counts a new subscription to a channel
+func Subscribed(channel string) {
+	if label, ok := labelOf(channel); ok {
+		subscribers.WithLabelValues(label).Inc()
+	}
+}
+
+// Unsubscribed counts the end of a subscription to a channel
+func Unsubscribed(channel string) {
+	if label, ok := labelOf(channel); ok {
+		subscribers.WithLabelValues(label).Dec()
+	}
+}
+
+// MessageIn counts a message published to a channel
+func MessageIn(channel string, size int) {
+	if label, ok := labelOf(channel); ok {
+		messagesIn.WithLabelValues(label).Inc()
+		bytesIn.WithLabelValues(label).Add(float64(size))
+	}
+}
+
+// MessageOut counts a message delivered to a client
+func MessageOut(channel string, size int) {
+	if label, ok := labelOf(channel); ok {
+		messagesOut.WithLabelValues(label).Inc()
+		bytesOut.WithLabelValues(label).Add(float64(size))
+	}
+}
+
+// Delivered records the time from publishing a message to a channel until it was written
+// to a client. Clocks of different servers may disagree slightly, so negative latencies
+// are counted as zero.
+func Delivered(channel string, publishedAt time.Time) {
+	if label, ok := labelOf(channel); ok {
+		deliveryLatency.WithLabelValues(label).Observe(max(time.Since(publishedAt), 0).Seconds())
+	}
+}
+
+// AuthCacheLookup counts a token lookup in the memory or redis cache: a hit for a valid
+// token, a negative_hit for a rejected one, or a miss
+func AuthCacheLookup(cache string, found, valid bool) {
+	if !Enabled() {
+		return
+	}
+	result := "miss"
+	if found && valid {
+		result = "hit"
+	} else if found {
+		result = "negative_hit"
+	}
+	authCache.WithLabelValues(cache, result).Inc()
+}
+
+// AuthRequest records a call validating a token upstream and how long it took. result is
+// valid, invalid or error.
+func AuthRequest(result string, latency time.Duration) {
+	if Enabled() {
+		authRequests.WithLabelValues(result).Inc()
+		authLatency.Observe(latency.Seconds())
+	}
+}
+
+// AuthCircuitOpen counts a validation refused without calling upstream because the
+// circuit breaker is open
+func AuthCircuitOpen() {
+	if Enabled() {
+		authRequests.WithLabelValues("circuit_open").Inc()
+	}
+}
+
+// Queued records the messages already waiting to be written to a client when another one
+// is queued
+func Queued(depth int) {
+	if Enabled() {
+		queueDepth.Observe(float64(depth))
+	}
+}
+
+// Written records how long writing a message to a client took
+func Written(latency time.Duration) {
+	if Enabled() {
+		writeLatency.Observe(latency.Seconds())
+	}
+}
+
+// SlowClient counts a client crossing a slow client threshold, or with slow false
+// dropping back under all of them
+func SlowClient(slow bool) {
+	if !Enabled() {
+		return
+	}
+	if slow {
+		slowClients.Inc()
+	} else {
+		slowClients.Dec()
+	}
+}
+
+// SlowClientDisconnected counts a client disconnected for being slow
+func SlowClientDisconnected() {
+	if Enabled() {
+		slowDisconnects.Inc()
+	}
+}
+
+// Enabled reports whether metrics are recorded, for callers that would otherwise do work
+// only to feed them
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// labelOf returns the channel label a channel is counted under, reporting false while
+// metrics are disabled. Once maxChannels labels are in use, new ones are counted as
+// _other so a flood of distinct channel names cannot exhaust memory.
+func labelOf(channel string) (string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled {
+		return "", false
+	}
+
+	label := channel
+	switch channelLabel {
+	case "none":
+		return "", true
+	case "prefix":
+		if i := strings.Index(channel, separator); i >= 0 {
+			label = channel[:i]
+		}
+	}
+
+	if !channels[label] {
+		if maxChannels > 0 && len(channels) >= maxChannels {
+			return otherChannels, true
+		}
+		channels[label] = true
+	}
+	return label, true
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Metrics pushed to StatsD, leaving out the Go runtime and process collectors
+const pushedPrefix = "gopush_"
+
+// Largest UDP payload sent at once, small enough to avoid fragmentation on common links
+const maxPacketSize = 1432
+
+// Characters StatsD does not accept in names and tag values
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.\-/]`)
+
+// statsdPusher sends the registered metrics to a StatsD agent. Counters are sent as the
+// increase since the previous push, gauges as their current value, and histograms as
+// the increase of their _count and _sum.
+type statsdPusher struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	tags      []string
+	previous  map[string]float64 // Last value of each counter series
+}
+
+// pushToStatsD starts pushing the metrics every interval as set in metrics.statsd
+func pushToStatsD(config *config.Config) error {
+	settings := config.Metrics.StatsD
+	conn, err := net.Dial("udp", settings.Address)
+	if err != nil {
+		return fmt.Errorf("failed to open StatsD socket: %v", err)
+	}
+
+	p := &statsdPusher{
+		conn:      conn,
+		prefix:    settings.Prefix,
+		dogstatsd: settings.DogStatsD,
+		tags:      settings.Tags,
+		previous:  make(map[string]float64),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(settings.Interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := p.push(); err != nil {
+				logger.Warn("Failed to push metrics to StatsD", "address", settings.Address, "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// push gathers the metrics and sends them in as few packets as fit
+func (p *statsdPusher) push() error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, pushedPrefix) {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				lines = p.appendCounter(lines, name, metric.GetLabel(), metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				lines = append(lines, p.line(name, metric.GetLabel(), metric.GetGauge().GetValue(), "g"))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				lines = p.appendCounter(lines, name+"_count", metric.GetLabel(), float64(histogram.GetSampleCount()))
+				lines = p.appendCounter(lines, name+"_sum", metric.GetLabel(), histogram.GetSampleSum())
+			}
+		}
+	}
+	return p.send(lines)
+}
+
+// appendCounter adds the increase of a counter since the last push, if any
+func (p *statsdPusher) appendCounter(lines []string, name string, labels []*dto.LabelPair, value float64) []string {
+	key := seriesKey(name, labels)
+	delta := value - p.previous[key]
+	p.previous[key] = value
+	if delta <= 0 {
+		return lines
+	}
+	return append(lines, p.line(name, labels, delta, "c"))
+}
+
+// seriesKey identifies one series of a metric. Gathered labels are sorted by name.
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	key := name
+	for _, label := range labels {
+		key += "|" + label.GetName() + "=" + label.GetValue()
+	}
+	return key
+}
+
+// line formats one metric. Without DogStatsD the label values are appended to the name,
+// so series of one metric stay apart.
+func (p *statsdPusher) line(name string, labels []*dto.LabelPair, value float64, kind string) string {
+	var b strings.Builder
+	b.WriteString(p.prefix)
+	b.WriteString(name)
+	if !p.dogstatsd {
+		for _, label := range labels {
+			b.WriteByte('.')
+			b.WriteString(unsafeChars.ReplaceAllString(label.GetValue(), "_"))
+		}
+	}
+	fmt.Fprintf(&b, ":%g|%s", value, kind)
+
+	if p.dogstatsd {
+		tags := append([]string(nil), p.tags...)
+		for _, label := range labels {
+			tags = append(tags, label.GetName()+":"+unsafeChars.ReplaceAllString(label.GetValue(), "_"))
+		}
+		if len(tags) > 0 {
+			b.WriteString("|#")
+			b.WriteString(strings.Join(tags, ","))
+		}
+	}
+	return b.String()
+}
+
+// send writes the lines newline-separated, starting a new packet before one would
+// exceed maxPacketSize
+func (p *statsdPusher) send(lines []string) error {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			if _, err := p.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err := p.conn.Write(packet.Bytes())
+		return err
+	}
+	return nil
+}
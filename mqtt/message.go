@@ -0,0 +1,28 @@
+package mqtt
+
+import (
+	"encoding/json"
+
+	"github.com/sahakavatar/gopush/bridge"
+)
+
+// channelMessage returns the message field subscribers of a channel receive for an MQTT
+// payload. JSON payloads are embedded as they are, anything else as a string.
+func channelMessage(payload []byte) json.RawMessage {
+	if json.Valid(payload) {
+		return json.RawMessage(payload)
+	}
+	message, _ := json.Marshal(string(payload))
+	return message
+}
+
+// messagePayload returns what MQTT subscribers receive of a channel message: its message
+// field, unquoted when it is a string, or the whole payload when it has none
+func messagePayload(payload string) []byte {
+	message := bridge.Decode(payload).Message
+	var text string
+	if err := json.Unmarshal(message, &text); err == nil {
+		return []byte(text)
+	}
+	return message
+}
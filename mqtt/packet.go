@@ -0,0 +1,279 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types of MQTT 3.1.1
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// Return codes of a CONNACK packet
+const (
+	connackAccepted           = 0
+	connackBadProtocol        = 1
+	connackIdentifierRejected = 2
+	connackServerUnavailable  = 3
+	connackBadCredentials     = 4
+	connackNotAuthorized      = 5
+)
+
+// Return code of a SUBACK entry whose subscription was refused
+const subackFailure = 0x80
+
+// Protocol level of MQTT 3.1.1 in the CONNECT packet
+const protocolLevel = 4
+
+var errMalformed = errors.New("malformed packet")
+
+// packet is a control packet read from a client: its type, the flags of the fixed
+// header and everything after the remaining length
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads the next control packet. Packets longer than maxSize are refused
+// before their body is read.
+func readPacket(r *bufio.Reader, maxSize int) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > maxSize {
+		return packet{}, fmt.Errorf("packet of %d bytes exceeds the %d byte limit", length, maxSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// encodePacket builds a control packet from its fixed header byte and its body
+func encodePacket(header byte, body []byte) []byte {
+	out := make([]byte, 0, len(body)+5)
+	out = append(out, header)
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+// reader walks the fields of a packet body
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.data) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.data)
+	r.data = r.data[2:]
+	return v
+}
+
+// bytes reads a field prefixed by its two byte length
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.data) < n {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+// rest returns what is left of the body
+func (r *reader) rest() []byte {
+	b := r.data
+	r.data = nil
+	return b
+}
+
+// appendString appends a field prefixed by its two byte length
+func appendString(out []byte, s string) []byte {
+	out = binary.BigEndian.AppendUint16(out, uint16(len(s)))
+	return append(out, s...)
+}
+
+// connectPacket is what a client sends to open its session
+type connectPacket struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientID     string
+	will         *willMessage
+	username     string
+	password     string
+}
+
+// willMessage is published for a client whose connection drops without a DISCONNECT
+type willMessage struct {
+	topic   string
+	payload []byte
+}
+
+// parseConnect decodes the body of a CONNECT packet
+func parseConnect(body []byte) (connectPacket, error) {
+	r := &reader{data: body}
+	var c connectPacket
+	c.protocol = r.string()
+	c.level = r.byte()
+	flags := r.byte()
+	c.keepAlive = r.uint16()
+	if r.err != nil {
+		return c, r.err
+	}
+	// Clients of other protocol levels are answered before the rest is read
+	if c.protocol != "MQTT" || c.level != protocolLevel {
+		return c, nil
+	}
+	if flags&0x01 != 0 {
+		return c, errMalformed
+	}
+
+	c.cleanSession = flags&0x02 != 0
+	c.clientID = r.string()
+	if flags&0x04 != 0 {
+		c.will = &willMessage{topic: r.string(), payload: r.bytes()}
+	}
+	if flags&0x80 != 0 {
+		c.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.password = r.string()
+	}
+	return c, r.err
+}
+
+// publishPacket carries an application message in either direction
+type publishPacket struct {
+	qos      byte
+	retain   bool
+	topic    string
+	packetID uint16
+	payload  []byte
+}
+
+// parsePublish decodes a PUBLISH packet
+func parsePublish(p packet) (publishPacket, error) {
+	r := &reader{data: p.body}
+	publish := publishPacket{
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&0x01 != 0,
+		topic:  r.string(),
+	}
+	if publish.qos == 3 {
+		return publish, errMalformed
+	}
+	if publish.qos > 0 {
+		publish.packetID = r.uint16()
+	}
+	publish.payload = r.rest()
+	return publish, r.err
+}
+
+// encodePublish builds a QoS 0 PUBLISH packet
+func encodePublish(topic string, payload []byte) []byte {
+	body := appendString(make([]byte, 0, len(topic)+len(payload)+2), topic)
+	return encodePacket(packetPublish<<4, append(body, payload...))
+}
+
+// topicFilter is an entry of a SUBSCRIBE packet
+type topicFilter struct {
+	topic string
+	qos   byte
+}
+
+// parseSubscribe decodes a SUBSCRIBE packet, or the topics of an UNSUBSCRIBE packet
+// when withQoS is false
+func parseSubscribe(body []byte, withQoS bool) (uint16, []topicFilter, error) {
+	r := &reader{data: body}
+	packetID := r.uint16()
+	var filters []topicFilter
+	for r.err == nil && len(r.data) > 0 {
+		filter := topicFilter{topic: r.string()}
+		if withQoS {
+			filter.qos = r.byte()
+		}
+		filters = append(filters, filter)
+	}
+	if r.err == nil && len(filters) == 0 {
+		return packetID, nil, errMalformed
+	}
+	return packetID, filters, r.err
+}
+
+// encodeAck builds a PUBACK, PUBREC, PUBREL, PUBCOMP or UNSUBACK packet
+func encodeAck(kind byte, packetID uint16) []byte {
+	header := kind << 4
+	if kind == packetPubrel {
+		header |= 0x02
+	}
+	return encodePacket(header, binary.BigEndian.AppendUint16(nil, packetID))
+}
@@ -0,0 +1,279 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		header byte
+		size   int
+		length []byte // Encoded remaining length
+	}{
+		{"empty body", packetPingresp << 4, 0, []byte{0x00}},
+		{"one length byte", packetPublish << 4, 127, []byte{0x7f}},
+		{"two length bytes", packetPublish << 4, 128, []byte{0x80, 0x01}},
+		{"largest two byte length", packetPublish << 4, 16383, []byte{0xff, 0x7f}},
+		{"three length bytes", packetPublish << 4, 16384, []byte{0x80, 0x80, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte{'x'}, tt.size)
+			encoded := encodePacket(tt.header, body)
+			if !bytes.Equal(encoded[1:1+len(tt.length)], tt.length) {
+				t.Errorf("remaining length = % x, want % x", encoded[1:1+len(tt.length)], tt.length)
+			}
+
+			p, err := readPacket(bufio.NewReader(bytes.NewReader(encoded)), 1<<20)
+			if err != nil {
+				t.Fatalf("readPacket: %v", err)
+			}
+			if p.kind != tt.header>>4 || p.flags != tt.header&0x0f || !bytes.Equal(p.body, body) {
+				t.Errorf("readPacket = kind %d flags %d body of %d bytes, want kind %d flags %d body of %d bytes",
+					p.kind, p.flags, len(p.body), tt.header>>4, tt.header&0x0f, len(body))
+			}
+		})
+	}
+}
+
+func TestReadPacketErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize int
+		want    error // Checked with errors.Is when set
+	}{
+		{"no data", nil, 1024, io.EOF},
+		{"five length bytes", []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}, 1 << 30, errMalformed},
+		{"truncated body", []byte{0x30, 0x05, 'a', 'b'}, 1024, io.ErrUnexpectedEOF},
+		{"over the size limit", encodePacket(0x30, make([]byte, 100)), 99, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readPacket(bufio.NewReader(bytes.NewReader(tt.data)), tt.maxSize)
+			if err == nil {
+				t.Fatal("readPacket succeeded, want an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("readPacket error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// connectBody builds the body of a CONNECT packet
+func connectBody(protocol string, level, flags byte, fields ...string) []byte {
+	body := appendString(nil, protocol)
+	body = append(body, level, flags)
+	body = binary.BigEndian.AppendUint16(body, 60)
+	for _, field := range fields {
+		body = appendString(body, field)
+	}
+	return body
+}
+
+func TestParseConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    []byte
+		want    connectPacket
+		wantErr bool
+	}{
+		{
+			name: "client ID only",
+			body: connectBody("MQTT", 4, 0x02, "sensor-1"),
+			want: connectPacket{protocol: "MQTT", level: 4, cleanSession: true, keepAlive: 60, clientID: "sensor-1"},
+		},
+		{
+			name: "username and password",
+			body: connectBody("MQTT", 4, 0xc0, "sensor-1", "user", "token"),
+			want: connectPacket{protocol: "MQTT", level: 4, keepAlive: 60, clientID: "sensor-1", username: "user", password: "token"},
+		},
+		{
+			name: "will message",
+			body: connectBody("MQTT", 4, 0x04, "sensor-1", "status", "offline"),
+			want: connectPacket{protocol: "MQTT", level: 4, keepAlive: 60, clientID: "sensor-1", will: &willMessage{topic: "status", payload: []byte("offline")}},
+		},
+		{
+			name: "other protocol level stops early",
+			body: connectBody("MQTT", 5, 0x02),
+			want: connectPacket{protocol: "MQTT", level: 5, keepAlive: 60},
+		},
+		{
+			name:    "reserved flag",
+			body:    connectBody("MQTT", 4, 0x01, "sensor-1"),
+			want:    connectPacket{protocol: "MQTT", level: 4, keepAlive: 60},
+			wantErr: true,
+		},
+		{
+			name:    "missing password",
+			body:    connectBody("MQTT", 4, 0xc0, "sensor-1", "user"),
+			want:    connectPacket{protocol: "MQTT", level: 4, keepAlive: 60, clientID: "sensor-1", username: "user"},
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			body:    appendString(nil, "MQTT"),
+			want:    connectPacket{protocol: "MQTT"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConnect(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConnect error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConnect = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  packet
+		want    publishPacket
+		wantErr bool
+	}{
+		{
+			name:   "QoS 0",
+			packet: packet{kind: packetPublish, body: append(appendString(nil, "news"), "hello"...)},
+			want:   publishPacket{topic: "news", payload: []byte("hello")},
+		},
+		{
+			name:   "QoS 1 with a packet ID and retain",
+			packet: packet{kind: packetPublish, flags: 0x03, body: append(binary.BigEndian.AppendUint16(appendString(nil, "news"), 7), "hello"...)},
+			want:   publishPacket{qos: 1, retain: true, topic: "news", packetID: 7, payload: []byte("hello")},
+		},
+		{
+			name:    "QoS 3",
+			packet:  packet{kind: packetPublish, flags: 0x06, body: appendString(nil, "news")},
+			want:    publishPacket{qos: 3, topic: "news"},
+			wantErr: true,
+		},
+		{
+			name:    "truncated topic",
+			packet:  packet{kind: packetPublish, body: []byte{0x00, 0x09, 'n'}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePublish(tt.packet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePublish error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePublish = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodePublish(t *testing.T) {
+	encoded := encodePublish("news", []byte("hello"))
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(encoded)), 1024)
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	publish, err := parsePublish(p)
+	if err != nil {
+		t.Fatalf("parsePublish: %v", err)
+	}
+	if p.kind != packetPublish || publish.qos != 0 || publish.topic != "news" || string(publish.payload) != "hello" {
+		t.Errorf("encodePublish decoded to %+v", publish)
+	}
+}
+
+func TestParseSubscribe(t *testing.T) {
+	subscribe := binary.BigEndian.AppendUint16(nil, 12)
+	subscribe = append(appendString(subscribe, "news"), 0)
+	subscribe = append(appendString(subscribe, "alerts"), 1)
+
+	unsubscribe := binary.BigEndian.AppendUint16(nil, 13)
+	unsubscribe = appendString(appendString(unsubscribe, "news"), "alerts")
+
+	tests := []struct {
+		name    string
+		body    []byte
+		withQoS bool
+		wantID  uint16
+		want    []topicFilter
+		wantErr bool
+	}{
+		{"subscribe", subscribe, true, 12, []topicFilter{{"news", 0}, {"alerts", 1}}, false},
+		{"unsubscribe", unsubscribe, false, 13, []topicFilter{{"news", 0}, {"alerts", 0}}, false},
+		{"no topics", binary.BigEndian.AppendUint16(nil, 14), true, 14, nil, true},
+		{"missing QoS", appendString(binary.BigEndian.AppendUint16(nil, 15), "news"), true, 15, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, filters, err := parseSubscribe(tt.body, tt.withQoS)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSubscribe error = %v, want error %v", err, tt.wantErr)
+			}
+			if id != tt.wantID {
+				t.Errorf("packet ID = %d, want %d", id, tt.wantID)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(filters, tt.want) {
+				t.Errorf("filters = %+v, want %+v", filters, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAck(t *testing.T) {
+	tests := []struct {
+		kind byte
+		want []byte
+	}{
+		{packetPuback, []byte{0x40, 0x02, 0x01, 0x02}},
+		{packetPubrec, []byte{0x50, 0x02, 0x01, 0x02}},
+		{packetPubrel, []byte{0x62, 0x02, 0x01, 0x02}},
+		{packetPubcomp, []byte{0x70, 0x02, 0x01, 0x02}},
+		{packetUnsuback, []byte{0xb0, 0x02, 0x01, 0x02}},
+	}
+
+	for _, tt := range tests {
+		if got := encodeAck(tt.kind, 0x0102); !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeAck(%d) = % x, want % x", tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"news", true},
+		{"sensors/kitchen", true},
+		{"", false},
+		{"sensors/+", false},
+		{"sensors/#", false},
+	}
+
+	for _, tt := range tests {
+		if got := validTopic(tt.topic); got != tt.want {
+			t.Errorf("validTopic(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/bridge"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/ipfilter"
+	"github.com/sahakavatar/gopush/reporting"
+)
+
+// Largest packet a client may send when mqtt.max_packet_size is not set
+const defaultMaxPacketSize = 1 << 20
+
+// Time a new connection has to send its CONNECT packet
+const connectTimeout = 10 * time.Second
+
+var mu sync.Mutex
+
+// Connected clients by app and client identifier. A client connecting with the
+// identifier of another one takes its place.
+var clients = make(map[string]*client)
+
+// Serve accepts MQTT clients on a listener until it is closed. Topics map to the broker
+// channels of the same name behind mqtt.channel_prefix.
+func Serve(listener net.Listener, b broker.Broker, rdb redis.UniversalClient, config *config.Config) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		c := &client{
+			conn:    conn,
+			config:  config,
+			session: bridge.NewSession("mqtt", conn.RemoteAddr().String(), b, rdb, config),
+		}
+		go c.serve()
+	}
+}
+
+// maxPacketSize returns the largest packet a client may send
+func maxPacketSize(config *config.Config) int {
+	if config.MQTT.MaxPacketSize > 0 {
+		return config.MQTT.MaxPacketSize
+	}
+	return defaultMaxPacketSize
+}
+
+// client is an MQTT connection
+type client struct {
+	conn    net.Conn
+	config  *config.Config
+	session *bridge.Session
+
+	clientID string
+	key      string // Key in clients
+	will     *willMessage
+
+	write sync.Mutex
+}
+
+// serve runs a client's session from its CONNECT packet to the end of the connection
+func (c *client) serve() {
+	defer c.conn.Close()
+	defer reporting.Recover(reporting.Fields{"conn_id": c.session.ConnID, "remote_addr": c.conn.RemoteAddr().String()})
+
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if !ipfilter.AllowConnection(net.ParseIP(host)) {
+		c.session.Log.Warn("Rejected MQTT connection from blocked address")
+		return
+	}
+
+	in := bufio.NewReader(c.conn)
+	maxSize := maxPacketSize(c.config)
+	c.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(in, maxSize)
+	if err != nil || p.kind != packetConnect {
+		c.session.Log.Info("MQTT client did not send CONNECT", "error", err)
+		return
+	}
+	connect, err := parseConnect(p.body)
+	if err != nil {
+		c.session.Log.Warn("Malformed CONNECT packet", "error", err)
+		return
+	}
+
+	defer c.disconnected()
+	code := c.authenticate(connect)
+	if code != connackAccepted {
+		c.send(encodePacket(packetConnack<<4, []byte{0, code}))
+		return
+	}
+	c.send(encodePacket(packetConnack<<4, []byte{0, connackAccepted}))
+	c.session.Log.Info("New MQTT connection")
+
+	// Clients that stay silent for one and a half keep-alive periods are gone
+	keepAlive := time.Duration(connect.keepAlive) * time.Second * 3 / 2
+	c.conn.SetReadDeadline(time.Time{})
+	for {
+		if keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(keepAlive))
+		}
+		p, err := readPacket(in, maxSize)
+		if err != nil {
+			c.session.Log.Info("MQTT read failed", "error", err)
+			return
+		}
+
+		switch p.kind {
+		case packetPublish:
+			if !c.handlePublish(p) {
+				return
+			}
+		case packetPubrel:
+			// QoS 2 messages are published on arrival, so the release only completes the exchange
+			r := &reader{data: p.body}
+			c.send(encodeAck(packetPubcomp, r.uint16()))
+		case packetPuback, packetPubrec, packetPubcomp:
+			// Messages go out at QoS 0 and are never acknowledged
+		case packetSubscribe:
+			if !c.handleSubscribe(p.body) {
+				return
+			}
+		case packetUnsubscribe:
+			if !c.handleUnsubscribe(p.body) {
+				return
+			}
+		case packetPingreq:
+			c.send(encodePacket(packetPingresp<<4, nil))
+		case packetDisconnect:
+			// A client leaving on purpose does not leave its will
+			c.will = nil
+			c.session.Log.Info("MQTT client disconnected")
+			return
+		default:
+			c.session.Log.Warn("Unexpected MQTT packet, closing connection", "type", p.kind)
+			return
+		}
+	}
+}
+
+// authenticate checks a CONNECT packet and returns the CONNACK return code. In
+// multi-tenant mode the user name is the app key; the password is the auth token.
+func (c *client) authenticate(connect connectPacket) byte {
+	if connect.protocol != "MQTT" || connect.level != protocolLevel {
+		c.session.Log.Warn("Rejected MQTT connection with an unsupported protocol version", "protocol_name", connect.protocol, "protocol_level", connect.level)
+		return connackBadProtocol
+	}
+
+	// Sessions are not kept after a disconnect, so only clean sessions may go without an identifier
+	c.clientID = connect.clientID
+	if c.clientID == "" {
+		if !connect.cleanSession {
+			return connackIdentifierRejected
+		}
+		c.clientID = c.session.ConnID
+	}
+	c.session.Log = c.session.Log.With("client_id", c.clientID)
+
+	var state *tls.ConnectionState
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		connectionState := tlsConn.ConnectionState()
+		state = &connectionState
+	}
+	err := c.session.Authenticate(connect.username, connect.password, state)
+	if errors.Is(err, bridge.ErrUnknownApp) {
+		return connackNotAuthorized
+	}
+	if errors.Is(err, bridge.ErrQuotaExceeded) || auth.IsUnavailable(err) {
+		return connackServerUnavailable
+	}
+	if err != nil {
+		return connackBadCredentials
+	}
+
+	if will := connect.will; will != nil {
+		if !validTopic(will.topic) || !c.session.CanPublish(c.channel(will.topic)) {
+			c.session.Log.Warn("Rejected MQTT connection with a will it may not publish", "topic", will.topic)
+			return connackNotAuthorized
+		}
+		c.will = will
+	}
+
+	// An older connection of the same client is closed, as MQTT requires
+	c.key = c.session.Grants.AppKey + "\x00" + c.clientID
+	mu.Lock()
+	previous := clients[c.key]
+	clients[c.key] = c
+	mu.Unlock()
+	if previous != nil {
+		previous.session.Log.Info("MQTT client connected again, closing the previous connection")
+		previous.conn.Close()
+	}
+	return connackAccepted
+}
+
+// disconnected publishes a client's will unless it said goodbye and releases its state,
+// whether or not it was accepted
+func (c *client) disconnected() {
+	mu.Lock()
+	if c.key != "" && clients[c.key] == c {
+		delete(clients, c.key)
+	}
+	mu.Unlock()
+
+	if c.will != nil {
+		if _, err := c.session.Publish(c.channel(c.will.topic), "", channelMessage(c.will.payload)); err != nil {
+			c.session.Log.Error("Failed to publish will", "topic", c.will.topic, "error", err)
+		}
+	}
+	c.session.Close()
+}
+
+// send writes a packet to the client. A failed write closes the connection, which ends
+// the read loop.
+func (c *client) send(packet []byte) {
+	c.write.Lock()
+	defer c.write.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(bridge.WriteTimeout))
+	if _, err := c.conn.Write(packet); err != nil {
+		c.session.Log.Warn("Failed to send MQTT packet", "error", err)
+		c.conn.Close()
+	}
+}
+
+// channel returns the channel a topic maps to
+func (c *client) channel(topic string) string {
+	return c.config.MQTT.ChannelPrefix + topic
+}
+
+// handlePublish publishes a client's message to the channel of its topic. QoS 1 and 2
+// messages are acknowledged once the broker took them. It returns false when the
+// connection must be closed.
+func (c *client) handlePublish(p packet) bool {
+	publish, err := parsePublish(p)
+	if err != nil || !validTopic(publish.topic) {
+		c.session.Log.Warn("Malformed PUBLISH packet, closing connection", "error", err)
+		return false
+	}
+
+	// MQTT 3.1.1 cannot refuse a message, so refused ones are acknowledged and dropped;
+	// the connection only closes when the broker failed, so the client sends it again
+	_, err = c.session.Publish(c.channel(publish.topic), "", channelMessage(publish.payload))
+	if err != nil && !bridge.Refused(err) {
+		return false
+	}
+
+	switch publish.qos {
+	case 1:
+		c.send(encodeAck(packetPuback, publish.packetID))
+	case 2:
+		c.send(encodeAck(packetPubrec, publish.packetID))
+	}
+	return true
+}
+
+// handleSubscribe subscribes a client to the channels of the topics it asked for.
+// Messages are delivered at QoS 0 whatever the client requested.
+func (c *client) handleSubscribe(body []byte) bool {
+	packetID, filters, err := parseSubscribe(body, true)
+	if err != nil {
+		c.session.Log.Warn("Malformed SUBSCRIBE packet, closing connection", "error", err)
+		return false
+	}
+
+	codes := make([]byte, len(filters))
+	for i, filter := range filters {
+		if !c.subscribe(filter.topic) {
+			codes[i] = subackFailure
+		}
+	}
+	c.send(encodePacket(packetSuback<<4, append([]byte{byte(packetID >> 8), byte(packetID)}, codes...)))
+	return true
+}
+
+// handleUnsubscribe ends the subscriptions of the topics a client names
+func (c *client) handleUnsubscribe(body []byte) bool {
+	packetID, filters, err := parseSubscribe(body, false)
+	if err != nil {
+		c.session.Log.Warn("Malformed UNSUBSCRIBE packet, closing connection", "error", err)
+		return false
+	}
+
+	for _, filter := range filters {
+		c.session.Unsubscribe(c.channel(filter.topic))
+	}
+	c.send(encodeAck(packetUnsuback, packetID))
+	return true
+}
+
+// subscribe forwards the messages of a topic's channel to the client
+func (c *client) subscribe(topic string) bool {
+	// Channels are matched exactly, so wildcard filters cannot be served
+	if !validTopic(topic) {
+		c.session.Log.Warn("Refused MQTT subscription to a wildcard or invalid topic", "topic", topic)
+		return false
+	}
+
+	err := c.session.Subscribe(c.channel(topic), func(payload string) {
+		c.send(encodePublish(topic, messagePayload(payload)))
+	})
+	return err == nil
+}
+
+// validTopic reports whether a topic names a single channel: not empty and without the
+// + and # wildcards
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
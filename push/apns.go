@@ -0,0 +1,189 @@
+package push
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/context"
+)
+
+// PlatformAPNs is the platform of iOS devices reached through the Apple Push Notification service
+const PlatformAPNs = "apns"
+
+// APNs endpoints, unless push.apns.url points elsewhere
+const (
+	apnsProductionURL = "https://api.push.apple.com"
+	apnsSandboxURL    = "https://api.sandbox.push.apple.com"
+)
+
+// Apple rejects provider tokens older than an hour and refreshes more often than every 20 minutes
+const apnsTokenLifetime = 50 * time.Minute
+
+// Largest payload APNs accepts for a notification
+const apnsMaxPayload = 4096
+
+// Longest apns-collapse-id APNs accepts
+const apnsMaxCollapseID = 64
+
+// apns sends notifications through the APNs HTTP/2 API, authenticating with a .p8 signing key
+type apns struct {
+	key     *ecdsa.PrivateKey
+	keyID   string
+	teamID  string
+	topic   string
+	baseURL string
+	client  *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// newAPNs reads the signing key of an APNs auth key file
+func newAPNs(keyFile, keyID, teamID, topic string, production bool, baseURL string) (*apns, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APNs key: %v", err)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APNs key: %v", err)
+	}
+	if baseURL == "" {
+		baseURL = apnsSandboxURL
+		if production {
+			baseURL = apnsProductionURL
+		}
+	}
+
+	return &apns{
+		key:     key,
+		keyID:   keyID,
+		teamID:  teamID,
+		topic:   topic,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		// The default transport negotiates HTTP/2, which APNs requires
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// send delivers a notification to one device. Messages with a title or body show an
+// alert; the others are background notifications that only wake the app.
+func (a *apns) send(ctx context.Context, device Device, n Notification) error {
+	aps := map[string]interface{}{}
+	pushType, priority := "alert", "10"
+	if n.Title != "" || n.Body != "" {
+		alert := map[string]string{}
+		if n.Title != "" {
+			alert["title"] = n.Title
+		}
+		if n.Body != "" {
+			alert["body"] = n.Body
+		}
+		aps["alert"] = alert
+		aps["sound"] = "default"
+	} else {
+		// Background notifications must be sent with priority 5
+		aps["content-available"] = 1
+		pushType, priority = "background", "5"
+	}
+	if n.Priority == PriorityNormal {
+		priority = "5"
+	}
+
+	payload := map[string]interface{}{
+		"aps":        aps,
+		"channel":    n.Channel,
+		"message_id": n.MessageID,
+		"message":    n.Message,
+	}
+	if n.Event != "" {
+		payload["event"] = n.Event
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	// The app fetches messages too large to travel along by their ID
+	if len(body) > apnsMaxPayload {
+		delete(payload, "message")
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	token, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, a.baseURL+"/3/device/"+url.PathEscape(device.Token), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "bearer "+token)
+	request.Header.Set("apns-topic", a.topic)
+	request.Header.Set("apns-push-type", pushType)
+	request.Header.Set("apns-priority", priority)
+	if n.CollapseID != "" && len(n.CollapseID) <= apnsMaxCollapseID {
+		request.Header.Set("apns-collapse-id", n.CollapseID)
+	}
+
+	response, err := a.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var reply struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(&reply)
+	switch {
+	// Tokens of uninstalled apps come back as 410 Unregistered. BadDeviceToken is not
+	// taken as such, it also answers sandbox tokens sent to production and back.
+	case response.StatusCode == http.StatusGone:
+		return errUnregistered
+	case reply.Reason == "ExpiredProviderToken":
+		a.mu.Lock()
+		a.token = ""
+		a.mu.Unlock()
+	}
+	return fmt.Errorf("APNs answered %d: %s", response.StatusCode, reply.Reason)
+}
+
+// providerToken returns the signed token requests authenticate with, signing a new one
+// when the current one is about to expire
+func (a *apns) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Since(a.issuedAt) < apnsTokenLifetime {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": a.teamID,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = a.keyID
+	signed, err := token.SignedString(a.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign an APNs provider token: %v", err)
+	}
+	a.token, a.issuedAt = signed, now
+	return a.token, nil
+}
@@ -0,0 +1,208 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/context"
+)
+
+// PlatformFCM is the platform of devices reached through Firebase Cloud Messaging
+const PlatformFCM = "fcm"
+
+// FCM HTTP v1 API, unless push.fcm.url points elsewhere
+const defaultFCMURL = "https://fcm.googleapis.com"
+
+// OAuth2 scope of access tokens for the FCM API
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// Google's token endpoint, for service account keys that do not name one
+const defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+// serviceAccount holds the fields of a service account key file the FCM client needs
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// fcm sends notifications through the FCM HTTP v1 API, authenticating as a service account
+type fcm struct {
+	account  serviceAccount
+	endpoint string
+	client   *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// newFCM reads a service account key. The project defaults to the one of the key.
+func newFCM(credentialsFile, projectID, baseURL string) (*fcm, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FCM credentials: %v", err)
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse FCM credentials: %v", err)
+	}
+	if account.PrivateKey == "" || account.ClientEmail == "" {
+		return nil, fmt.Errorf("FCM credentials are not a service account key")
+	}
+	if _, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey)); err != nil {
+		return nil, fmt.Errorf("invalid private key in FCM credentials: %v", err)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = defaultTokenURI
+	}
+	if projectID == "" {
+		projectID = account.ProjectID
+	}
+	if projectID == "" {
+		return nil, fmt.Errorf("FCM credentials name no project, set push.fcm.project_id")
+	}
+	if baseURL == "" {
+		baseURL = defaultFCMURL
+	}
+
+	return &fcm{
+		account:  account,
+		endpoint: strings.TrimSuffix(baseURL, "/") + "/v1/projects/" + url.PathEscape(projectID) + "/messages:send",
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// fcmMessage is the body of a send request
+type fcmMessage struct {
+	Message struct {
+		Token        string            `json:"token"`
+		Notification *fcmNotification  `json:"notification,omitempty"`
+		Data         map[string]string `json:"data"`
+	} `json:"message"`
+}
+
+type fcmNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+// send delivers a notification to one device. Messages with a title or body show a
+// notification; the others only wake the app with their data.
+func (f *fcm) send(ctx context.Context, device Device, n Notification) error {
+	var message fcmMessage
+	message.Message.Token = device.Token
+	if n.Title != "" || n.Body != "" {
+		message.Message.Notification = &fcmNotification{Title: n.Title, Body: n.Body}
+	}
+	message.Message.Data = map[string]string{
+		"channel":    n.Channel,
+		"message_id": n.MessageID,
+		"message":    string(n.Message),
+	}
+	if n.Event != "" {
+		message.Message.Data["event"] = n.Event
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	token, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, f.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := f.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return nil
+	}
+	// Tokens of uninstalled apps come back as 404 UNREGISTERED
+	if response.StatusCode == http.StatusNotFound || bytes.Contains(reply, []byte("UNREGISTERED")) {
+		return errUnregistered
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		f.mu.Lock()
+		f.accessToken = ""
+		f.mu.Unlock()
+	}
+	return fmt.Errorf("FCM answered %d: %s", response.StatusCode, strings.TrimSpace(string(reply)))
+}
+
+// token returns an access token of the service account, exchanging a signed assertion
+// for a new one a minute before the current one expires
+func (f *fcm) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accessToken != "" && time.Now().Before(f.expiresAt) {
+		return f.accessToken, nil
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(f.account.PrivateKey))
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   f.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(key)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, f.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := f.client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to get an FCM access token: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		reply, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+		return "", fmt.Errorf("failed to get an FCM access token: status %d: %s", response.StatusCode, strings.TrimSpace(string(reply)))
+	}
+
+	var granted struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&granted); err != nil || granted.AccessToken == "" {
+		return "", fmt.Errorf("failed to get an FCM access token: invalid response")
+	}
+	f.accessToken = granted.AccessToken
+	f.expiresAt = now.Add(time.Duration(granted.ExpiresIn)*time.Second - time.Minute)
+	return f.accessToken, nil
+}
@@ -0,0 +1,450 @@
+package push
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// Logger of the push package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the push package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Placeholder of the user ID in push.user_channel
+const userPlaceholder = "{user_id}"
+
+// Defaults of the push block
+const (
+	defaultOnlineTTL = 90 * time.Second
+	defaultQueueSize = 10000
+)
+
+// Notifications sent at the same time
+const workers = 4
+
+// Time the providers of one notification may take together
+const sendTimeout = 30 * time.Second
+
+// Most devices a user may register
+const maxDevices = 20
+
+// Redis keys of the device registry and of the servers a user has sockets on
+const (
+	devicesKeyPrefix = "push:devices:"
+	onlineKeyPrefix  = "push:online:"
+)
+
+// Values of the priority field of published messages
+const (
+	PriorityHigh   = "high"   // Delivered right away, waking the device (default)
+	PriorityNormal = "normal" // May be delayed to save the device's battery
+)
+
+// ErrTooManyDevices is returned when registering a device for a user who has maxDevices
+var ErrTooManyDevices = fmt.Errorf("a user may register at most %d devices", maxDevices)
+
+// ErrInvalidDevice is returned when registering a device its provider cannot deliver to
+var ErrInvalidDevice = errors.New("device cannot be delivered to")
+
+// errUnregistered tells that a provider no longer knows a device, which is then forgotten
+var errUnregistered = errors.New("device is no longer registered")
+
+// Device is a registered device of a user, the destination of its notifications
+type Device struct {
+	Platform string `json:"platform"`       // Provider delivering to the device: fcm, apns or webpush
+	Token    string `json:"token"`          // Registration token the provider knows the device by, the endpoint URL for webpush
+	Keys     *Keys  `json:"keys,omitempty"` // Encryption keys of a webpush subscription
+}
+
+// key returns the field of the device in its user's hash
+func (d Device) key() string {
+	return d.Platform + ":" + d.Token
+}
+
+// Notification is a message published to a user channel while the user was offline
+type Notification struct {
+	UserID     string
+	Channel    string
+	MessageID  string
+	Event      string
+	Title      string          // The message's title field, when it is a string
+	Body       string          // The message's body field, when it is a string
+	Priority   string          // The priority field of the published message, PriorityHigh or PriorityNormal
+	CollapseID string          // The collapse_id field of the published message: newer notifications with the same ID replace older ones
+	Message    json.RawMessage // The message field of the published message
+}
+
+// provider delivers notifications to the devices of one platform
+type provider interface {
+	send(ctx context.Context, device Device, n Notification) error
+}
+
+// checker is implemented by providers that can only deliver to some devices of their platform
+type checker interface {
+	accepts(device Device) bool
+}
+
+var mu sync.Mutex
+var providers map[string]provider
+var rdb redis.UniversalClient
+var prefix, suffix string
+var onlineTTL time.Duration
+var queue chan Notification
+
+// Users with sockets on this server and how many each has
+var localUsers = make(map[string]int)
+
+// Identifies this server in the online sets of its users
+var instanceID = newInstanceID()
+
+// Notifications dropped because the queue was full, reported with the next one sent
+var dropped atomic.Int64
+
+// Configure starts forwarding messages published to user channels while their user has
+// no socket on any server to the user's devices. Until it is called, or without
+// push.user_channel or any provider, Notify does nothing.
+func Configure(client redis.UniversalClient, config *config.Config) error {
+	settings := config.Push
+	if settings.UserChannel == "" {
+		return nil
+	}
+
+	configured := make(map[string]provider)
+	if settings.FCM.CredentialsFile != "" {
+		fcm, err := newFCM(settings.FCM.CredentialsFile, settings.FCM.ProjectID, settings.FCM.URL)
+		if err != nil {
+			return err
+		}
+		configured[PlatformFCM] = fcm
+	}
+	if apnsSettings := settings.APNs; apnsSettings.KeyFile != "" {
+		apns, err := newAPNs(apnsSettings.KeyFile, apnsSettings.KeyID, apnsSettings.TeamID, apnsSettings.Topic, apnsSettings.Production, apnsSettings.URL)
+		if err != nil {
+			return err
+		}
+		configured[PlatformAPNs] = apns
+	}
+	if webPushSettings := settings.WebPush; webPushSettings.PrivateKey != "" {
+		webPush, err := newWebPush(webPushSettings.PublicKey, webPushSettings.PrivateKey, webPushSettings.Subject, webPushSettings.TTL, webPushSettings.EndpointHosts)
+		if err != nil {
+			return err
+		}
+		configured[PlatformWebPush] = webPush
+	}
+	if len(configured) == 0 {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if queue != nil {
+		return nil
+	}
+
+	providers = configured
+	rdb = client
+	prefix, suffix, _ = strings.Cut(settings.UserChannel, userPlaceholder)
+	onlineTTL = defaultOnlineTTL
+	if settings.OnlineTTL > 0 {
+		onlineTTL = time.Duration(settings.OnlineTTL) * time.Second
+	}
+	size := settings.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	queue = make(chan Notification, size)
+	for i := 0; i < workers; i++ {
+		go run(queue)
+	}
+	go refreshOnline()
+
+	// Users whose sockets opened before push was configured
+	for userID := range localUsers {
+		go markOnline(userID)
+	}
+	return nil
+}
+
+// Enabled reports whether notifications are forwarded to devices
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return queue != nil
+}
+
+// Supported reports whether devices of a platform can be registered
+func Supported(platform string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := providers[platform]
+	return ok
+}
+
+// Connected records a socket of a user on this server
+func Connected(userID string) {
+	if userID == "" {
+		return
+	}
+	mu.Lock()
+	localUsers[userID]++
+	first := localUsers[userID] == 1 && queue != nil
+	mu.Unlock()
+	if first {
+		markOnline(userID)
+	}
+}
+
+// Disconnected records that a socket of a user on this server closed
+func Disconnected(userID string) {
+	if userID == "" {
+		return
+	}
+	mu.Lock()
+	localUsers[userID]--
+	last := localUsers[userID] <= 0
+	if last {
+		delete(localUsers, userID)
+	}
+	enabled := queue != nil
+	mu.Unlock()
+	if last && enabled {
+		markOffline(userID)
+	}
+}
+
+// markOnline adds this server to the servers a user has sockets on, until its lease expires
+func markOnline(userIDs ...string) {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+
+	expiry := float64(time.Now().Add(onlineTTL).Unix())
+	pipe := rdb.Pipeline()
+	for _, userID := range userIDs {
+		pipe.ZAdd(ctx, onlineKeyPrefix+userID, redis.Z{Score: expiry, Member: instanceID})
+		pipe.Expire(ctx, onlineKeyPrefix+userID, onlineTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Warn("Failed to record online users", "users", len(userIDs), "error", err)
+	}
+}
+
+// markOffline removes this server from the servers a user has sockets on
+func markOffline(userID string) {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	if err := rdb.ZRem(ctx, onlineKeyPrefix+userID, instanceID).Err(); err != nil {
+		logger.Warn("Failed to record offline user", "user_id", userID, "error", err)
+	}
+}
+
+// refreshOnline renews the leases of this server's users well before they expire, so
+// the users of a server that stops without cleaning up are offline once they lapse
+func refreshOnline() {
+	ticker := time.NewTicker(onlineTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		mu.Lock()
+		users := make([]string, 0, len(localUsers))
+		for userID := range localUsers {
+			users = append(users, userID)
+		}
+		mu.Unlock()
+		if len(users) > 0 {
+			markOnline(users...)
+		}
+	}
+}
+
+// online reports whether a user has a socket on any server
+func online(ctx context.Context, userID string) (bool, error) {
+	count, err := rdb.ZCount(ctx, onlineKeyPrefix+userID, fmt.Sprint(time.Now().Unix()), "+inf").Result()
+	return count > 0, err
+}
+
+// UserOf returns the user a channel belongs to, if it is a user channel
+func UserOf(redisChannel string) (string, bool) {
+	mu.Lock()
+	p, s, enabled := prefix, suffix, queue != nil
+	mu.Unlock()
+	if !enabled || len(redisChannel) <= len(p)+len(s) || !strings.HasPrefix(redisChannel, p) || !strings.HasSuffix(redisChannel, s) {
+		return "", false
+	}
+	return redisChannel[len(p) : len(redisChannel)-len(s)], true
+}
+
+// Notify queues a message published to a channel for the devices of the channel's user,
+// if it is a user channel. It never blocks: when the queue is full the message is dropped.
+func Notify(redisChannel string, message []byte) {
+	userID, ok := UserOf(redisChannel)
+	if !ok {
+		return
+	}
+
+	var published struct {
+		MessageID  string          `json:"message_id"`
+		Event      string          `json:"event"`
+		Priority   string          `json:"priority"`
+		CollapseID string          `json:"collapse_id"`
+		Message    json.RawMessage `json:"message"`
+	}
+	if json.Unmarshal(message, &published) != nil || len(published.Message) == 0 {
+		published.Message = json.RawMessage(message)
+		if !json.Valid(message) {
+			published.Message, _ = json.Marshal(string(message))
+		}
+	}
+	n := Notification{
+		UserID:     userID,
+		Channel:    redisChannel,
+		MessageID:  published.MessageID,
+		Event:      published.Event,
+		Priority:   published.Priority,
+		CollapseID: published.CollapseID,
+		Message:    published.Message,
+	}
+	var content struct {
+		Title interface{} `json:"title"`
+		Body  interface{} `json:"body"`
+	}
+	if json.Unmarshal(published.Message, &content) == nil {
+		n.Title, _ = content.Title.(string)
+		n.Body, _ = content.Body.(string)
+	}
+
+	mu.Lock()
+	notifications := queue
+	mu.Unlock()
+	select {
+	case notifications <- n:
+	default:
+		dropped.Add(1)
+	}
+}
+
+// run sends queued notifications to the devices of users who are offline
+func run(notifications <-chan Notification) {
+	for n := range notifications {
+		if count := dropped.Swap(0); count > 0 {
+			logger.Warn("Dropped push notifications, the queue was full", "count", count)
+		}
+		deliver(n)
+	}
+}
+
+// deliver sends a notification to every device of its user unless the user is online
+func deliver(n Notification) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	isOnline, err := online(ctx, n.UserID)
+	if err != nil {
+		logger.Error("Failed to check whether a user is online", "user_id", n.UserID, "error", err)
+		return
+	}
+	if isOnline {
+		return
+	}
+
+	devices, err := Devices(ctx, n.UserID)
+	if err != nil {
+		logger.Error("Failed to load devices", "user_id", n.UserID, "error", err)
+		return
+	}
+	for _, device := range devices {
+		mu.Lock()
+		p, ok := providers[device.Platform]
+		mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		err := p.send(ctx, device, n)
+		if errors.Is(err, errUnregistered) {
+			logger.Info("Forgetting unregistered device", "user_id", n.UserID, "platform", device.Platform)
+			Unregister(ctx, n.UserID, device)
+			continue
+		}
+		if err != nil {
+			logger.Warn("Failed to send push notification", "user_id", n.UserID, "platform", device.Platform, "channel", n.Channel, "error", err)
+			continue
+		}
+		logger.Debug("Sent push notification", "user_id", n.UserID, "platform", device.Platform, "channel", n.Channel, "message_id", n.MessageID)
+	}
+}
+
+// Devices returns the registered devices of a user
+func Devices(ctx context.Context, userID string) ([]Device, error) {
+	values, err := rdb.HVals(ctx, devicesKeyPrefix+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(values))
+	for _, value := range values {
+		var device Device
+		if json.Unmarshal([]byte(value), &device) == nil {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// Register adds a device to a user's registry, or refreshes it when it is there already
+func Register(ctx context.Context, userID string, device Device) error {
+	mu.Lock()
+	p, ok := providers[device.Platform]
+	mu.Unlock()
+	if !ok || device.Token == "" {
+		return ErrInvalidDevice
+	}
+	if c, ok := p.(checker); ok && !c.accepts(device) {
+		return ErrInvalidDevice
+	}
+
+	key := devicesKeyPrefix + userID
+	exists, err := rdb.HExists(ctx, key, device.key()).Result()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		count, err := rdb.HLen(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if count >= maxDevices {
+			return ErrTooManyDevices
+		}
+	}
+
+	encoded, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, key, device.key(), encoded).Err()
+}
+
+// Unregister removes a device from a user's registry
+func Unregister(ctx context.Context, userID string, device Device) error {
+	return rdb.HDel(ctx, devicesKeyPrefix+userID, device.key()).Err()
+}
+
+func newInstanceID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,362 @@
+package push
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/context"
+)
+
+// PlatformWebPush is the platform of browsers reached through the Web Push protocol
+const PlatformWebPush = "webpush"
+
+// Push services of the major browsers, unless push.webpush.endpoint_hosts lists others
+var defaultEndpointHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"*.push.apple.com",
+	"*.notify.windows.com",
+}
+
+// Seconds push services keep a message for an offline browser, unless push.webpush.ttl says otherwise
+const defaultWebPushTTL = 86400
+
+// Lifetime of VAPID tokens, which push services accept for at most 24 hours
+const vapidTokenLifetime = 12 * time.Hour
+
+// Record size of the aes128gcm encoding. Messages are sent in a single record, and push
+// services only accept 4096 bytes of body, the encoding header included.
+const (
+	webPushRecordSize = 4096
+	webPushMaxPayload = webPushRecordSize - 86 - 16 - 1 // header, authentication tag and padding delimiter
+)
+
+// Keys of a browser's push subscription, base64url-encoded as in PushSubscription.toJSON()
+type Keys struct {
+	P256dh string `json:"p256dh"` // P-256 public key of the subscription
+	Auth   string `json:"auth"`   // Authentication secret of the subscription
+}
+
+// webPush sends notifications to the push services of browsers, identifying the server
+// with its VAPID key
+type webPush struct {
+	key       *ecdsa.PrivateKey
+	publicKey string // base64url, as browsers take it for applicationServerKey
+	subject   string
+	ttl       int
+	hosts     []string
+	client    *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]vapidToken // By push service origin
+}
+
+type vapidToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// newWebPush reads a VAPID key pair, both halves base64url-encoded as web-push tools
+// generate them
+func newWebPush(publicKey, privateKey, subject string, ttl int, hosts []string) (*webPush, error) {
+	private, err := decodeBase64URL(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	public := ecdhKey.PublicKey().Bytes()
+	if publicKey != "" {
+		given, err := decodeBase64URL(publicKey)
+		if err != nil || !bytes.Equal(given, public) {
+			return nil, fmt.Errorf("VAPID public key does not belong to the private key")
+		}
+	}
+	if ttl <= 0 {
+		ttl = defaultWebPushTTL
+	}
+	if len(hosts) == 0 {
+		hosts = defaultEndpointHosts
+	}
+
+	// Uncompressed point: 0x04 followed by X and Y
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(private),
+	}
+	return &webPush{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(public),
+		subject:   subject,
+		ttl:       ttl,
+		hosts:     hosts,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		tokens:    make(map[string]vapidToken),
+	}, nil
+}
+
+// VAPIDPublicKey returns the key browsers pass as applicationServerKey when they
+// subscribe, or "" when Web Push is not configured
+func VAPIDPublicKey() string {
+	mu.Lock()
+	p, ok := providers[PlatformWebPush]
+	mu.Unlock()
+	if !ok {
+		return ""
+	}
+	return p.(*webPush).publicKey
+}
+
+// accepts reports whether a subscription has usable keys and its endpoint is an HTTPS
+// URL of an allowed push service. Endpoints come from browsers, so others must not make
+// the server send requests wherever a client points it.
+func (w *webPush) accepts(device Device) bool {
+	if device.Keys == nil {
+		return false
+	}
+	key, err := decodeBase64URL(device.Keys.P256dh)
+	if err != nil {
+		return false
+	}
+	if _, err := ecdh.P256().NewPublicKey(key); err != nil {
+		return false
+	}
+	if secret, err := decodeBase64URL(device.Keys.Auth); err != nil || len(secret) != 16 {
+		return false
+	}
+
+	u, err := url.Parse(device.Token)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	for _, pattern := range w.hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers a notification to one browser, encrypted for its subscription
+func (w *webPush) send(ctx context.Context, device Device, n Notification) error {
+	if device.Keys == nil {
+		return errUnregistered
+	}
+	payload := map[string]interface{}{
+		"channel":    n.Channel,
+		"message_id": n.MessageID,
+		"message":    n.Message,
+	}
+	if n.Title != "" {
+		payload["title"] = n.Title
+	}
+	if n.Body != "" {
+		payload["body"] = n.Body
+	}
+	if n.Event != "" {
+		payload["event"] = n.Event
+	}
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	// The service worker fetches messages too large to travel along by their ID
+	if len(plaintext) > webPushMaxPayload {
+		delete(payload, "message")
+		if plaintext, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	body, err := encrypt(plaintext, *device.Keys)
+	if err != nil {
+		// Browsers always send valid keys, the device was registered with broken ones
+		return errUnregistered
+	}
+	endpoint, err := url.Parse(device.Token)
+	if err != nil {
+		return errUnregistered
+	}
+	token, err := w.vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, device.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("TTL", strconv.Itoa(w.ttl))
+	request.Header.Set("Authorization", "vapid t="+token+", k="+w.publicKey)
+	if n.Priority == PriorityNormal {
+		request.Header.Set("Urgency", "normal")
+	} else {
+		request.Header.Set("Urgency", "high")
+	}
+	if validTopic(n.CollapseID) {
+		request.Header.Set("Topic", n.CollapseID)
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return nil
+	}
+	// Expired and cancelled subscriptions come back as 404 or 410
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		return errUnregistered
+	}
+	return fmt.Errorf("push service answered %d: %s", response.StatusCode, strings.TrimSpace(string(reply)))
+}
+
+// vapidToken returns the VAPID token for a push service, signing a new one an hour
+// before the current one expires
+func (w *webPush) vapidToken(audience string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cached, ok := w.tokens[audience]; ok && time.Now().Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	expiresAt := time.Now().Add(vapidTokenLifetime)
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": audience,
+		"exp": expiresAt.Unix(),
+		"sub": w.subject,
+	}).SignedString(w.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign a VAPID token: %v", err)
+	}
+	w.tokens[audience] = vapidToken{token: signed, expiresAt: expiresAt.Add(-time.Hour)}
+	return signed, nil
+}
+
+// encrypt encodes a message for a push subscription with the aes128gcm content
+// encoding of RFC 8188, keyed as RFC 8291 describes
+func encrypt(plaintext []byte, keys Keys) ([]byte, error) {
+	subscriberKey, err := decodeBase64URL(keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64URL(keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	subscriberPublic, err := ecdh.P256().NewPublicKey(subscriberKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every message is encrypted with a key pair of its own
+	local, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := local.ECDH(subscriberPublic)
+	if err != nil {
+		return nil, err
+	}
+	localPublic := local.PublicKey().Bytes()
+
+	info := append([]byte("WebPush: info\x00"), subscriberKey...)
+	info = append(info, localPublic...)
+	ikm, err := expand(hkdf.New(sha256.New, sharedSecret, authSecret, info), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	contentKey, err := expand(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := expand(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt, record size, key ID length and the local public key as key ID
+	body := make([]byte, 0, 86+len(plaintext)+17)
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, webPushRecordSize)
+	body = append(body, byte(len(localPublic)))
+	body = append(body, localPublic...)
+	// The single record ends with the last record delimiter
+	return gcm.Seal(body, nonce, append(plaintext, 2), nil), nil
+}
+
+// expand reads n bytes of key material
+func expand(r io.Reader, n int) ([]byte, error) {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// validTopic reports whether a collapse ID can be sent as a Topic header, which allows
+// at most 32 characters of the base64url alphabet
+func validTopic(topic string) bool {
+	if topic == "" || len(topic) > 32 {
+		return false
+	}
+	for _, c := range topic {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeBase64URL decodes base64url with or without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,171 @@
+package push
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// subscription creates the keys of a browser push subscription along with its private key
+func subscription(t *testing.T) (Keys, *ecdh.PrivateKey, []byte) {
+	t.Helper()
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal(err)
+	}
+	return Keys{
+		P256dh: base64.RawURLEncoding.EncodeToString(private.PublicKey().Bytes()),
+		Auth:   base64.RawURLEncoding.EncodeToString(auth),
+	}, private, auth
+}
+
+// decrypt decodes an aes128gcm message the way the browser holding private does
+func decrypt(t *testing.T, body []byte, private *ecdh.PrivateKey, auth []byte) []byte {
+	t.Helper()
+	if len(body) < 21 {
+		t.Fatalf("body of %d bytes is shorter than the header", len(body))
+	}
+	salt := body[:16]
+	if size := binary.BigEndian.Uint32(body[16:20]); size != webPushRecordSize {
+		t.Errorf("record size = %d, want %d", size, webPushRecordSize)
+	}
+	idLength := int(body[20])
+	senderKey := body[21 : 21+idLength]
+	ciphertext := body[21+idLength:]
+
+	senderPublic, err := ecdh.P256().NewPublicKey(senderKey)
+	if err != nil {
+		t.Fatalf("key ID is not a P-256 public key: %v", err)
+	}
+	sharedSecret, err := private.ECDH(senderPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := append([]byte("WebPush: info\x00"), private.PublicKey().Bytes()...)
+	info = append(info, senderKey...)
+	ikm, _ := expand(hkdf.New(sha256.New, sharedSecret, auth, info), 32)
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	contentKey, _ := expand(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), 16)
+	nonce, _ := expand(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), 12)
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+
+	// The last record ends with the 0x02 delimiter, followed by optional zero padding
+	record = bytes.TrimRight(record, "\x00")
+	if len(record) == 0 || record[len(record)-1] != 2 {
+		t.Fatalf("record does not end with the last record delimiter")
+	}
+	return record[:len(record)-1]
+}
+
+func TestEncrypt(t *testing.T) {
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"empty", []byte{}},
+		{"JSON", []byte(`{"title":"New message","body":"Hello"}`)},
+		{"largest payload", bytes.Repeat([]byte{'x'}, webPushMaxPayload)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, private, auth := subscription(t)
+			body, err := encrypt(tt.plaintext, keys)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			if len(body) > webPushRecordSize {
+				t.Errorf("body of %d bytes exceeds the %d byte record", len(body), webPushRecordSize)
+			}
+			if got := decrypt(t, body, private, auth); !bytes.Equal(got, tt.plaintext) {
+				t.Errorf("decrypted %q, want %q", got, tt.plaintext)
+			}
+		})
+	}
+}
+
+func TestEncryptUsesFreshKeys(t *testing.T) {
+	keys, _, _ := subscription(t)
+	first, err := encrypt([]byte("hello"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encrypt([]byte("hello"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first[:16], second[:16]) {
+		t.Error("two messages share a salt")
+	}
+	if bytes.Equal(first[21:86], second[21:86]) {
+		t.Error("two messages share a sender key")
+	}
+}
+
+func TestEncryptInvalidKeys(t *testing.T) {
+	valid, _, _ := subscription(t)
+
+	tests := []struct {
+		name string
+		keys Keys
+	}{
+		{"p256dh not base64url", Keys{P256dh: "not base64!", Auth: valid.Auth}},
+		{"auth not base64url", Keys{P256dh: valid.P256dh, Auth: "not base64!"}},
+		{"p256dh not a curve point", Keys{P256dh: base64.RawURLEncoding.EncodeToString(make([]byte, 65)), Auth: valid.Auth}},
+		{"p256dh too short", Keys{P256dh: base64.RawURLEncoding.EncodeToString([]byte{4, 1, 2}), Auth: valid.Auth}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := encrypt([]byte("hello"), tt.keys); err == nil {
+				t.Error("encrypt succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestDecodeBase64URL(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"unpadded", "aGk", "hi"},
+		{"padded", "aGk=", "hi"},
+		{"URL alphabet", "-_8", "\xfb\xff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeBase64URL(tt.input)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("decodeBase64URL(%q) = %q, %v, want %q", tt.input, got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package pusher
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// Prefix of the Redis hashes holding the members of presence channels, keyed by socket ID
+const presenceKeyPrefix = "presence:"
+
+// presenceKey returns the hash of a presence channel's members
+func presenceKey(redisChannel string) string {
+	return presenceKeyPrefix + redisChannel
+}
+
+// joinPresence adds a socket's member to a channel and reports whether its user was not
+// present through another socket yet
+func joinPresence(rdb redis.UniversalClient, redisChannel, socketID string, m member) (bool, error) {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	if err := rdb.HSet(ctx, presenceKey(redisChannel), socketID, encoded).Err(); err != nil {
+		return false, err
+	}
+	sockets, err := userSockets(ctx, rdb, redisChannel, m.UserID)
+	return sockets == 1, err
+}
+
+// leavePresence removes a socket's member from a channel and reports whether its user
+// left the channel with it
+func leavePresence(rdb redis.UniversalClient, redisChannel, socketID, userID string) (bool, error) {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	if err := rdb.HDel(ctx, presenceKey(redisChannel), socketID).Err(); err != nil {
+		return false, err
+	}
+	sockets, err := userSockets(ctx, rdb, redisChannel, userID)
+	return sockets == 0, err
+}
+
+// presenceMembers lists the users present on a channel, each once however many sockets
+// it is subscribed with
+func presenceMembers(rdb redis.UniversalClient, redisChannel string) ([]member, error) {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	values, err := rdb.HVals(ctx, presenceKey(redisChannel)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]member, len(values))
+	for _, value := range values {
+		var m member
+		if json.Unmarshal([]byte(value), &m) == nil {
+			users[m.UserID] = m
+		}
+	}
+	members := make([]member, 0, len(users))
+	for _, m := range users {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+	return members, nil
+}
+
+// userSockets counts the sockets a user is subscribed to a presence channel with
+func userSockets(ctx context.Context, rdb redis.UniversalClient, redisChannel, userID string) (int, error) {
+	values, err := rdb.HVals(ctx, presenceKey(redisChannel)).Result()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, value := range values {
+		var m member
+		if json.Unmarshal([]byte(value), &m) == nil && m.UserID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,157 @@
+package pusher
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Events of the Pusher Channels protocol
+const (
+	eventConnectionEstablished = "pusher:connection_established"
+	eventError                 = "pusher:error"
+	eventPing                  = "pusher:ping"
+	eventPong                  = "pusher:pong"
+	eventSubscribe             = "pusher:subscribe"
+	eventUnsubscribe           = "pusher:unsubscribe"
+	eventSignin                = "pusher:signin"
+	eventSubscriptionSucceeded = "pusher_internal:subscription_succeeded"
+	eventSubscriptionError     = "pusher:subscription_error"
+	eventMemberAdded           = "pusher_internal:member_added"
+	eventMemberRemoved         = "pusher_internal:member_removed"
+)
+
+// Close codes of the Pusher protocol. Clients give up on 4000-4099, reconnect after a
+// back-off on 4100-4199 and reconnect at once on 4200-4299.
+const (
+	codeAppNotFound         = 4001
+	codeAppOverQuota        = 4004
+	codeUnsupportedProtocol = 4007
+	codeUnauthorized        = 4009
+	codeOverCapacity        = 4100
+	codeClientEventRejected = 4301
+)
+
+// Prefixes of channels clients need a signature from their backend for
+const (
+	privatePrefix  = "private-"
+	presencePrefix = "presence-"
+)
+
+// Prefix of events clients may send to the other subscribers of a channel
+const clientEventPrefix = "client-"
+
+// frame is a message of the protocol in either direction. Servers send data as a string
+// holding JSON, while clients send objects.
+type frame struct {
+	Event   string          `json:"event"`
+	Channel string          `json:"channel,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// subscribeData is the data of a pusher:subscribe event
+type subscribeData struct {
+	Channel     string `json:"channel"`
+	Auth        string `json:"auth"`
+	ChannelData string `json:"channel_data"`
+}
+
+// errorData is the data of a pusher:error event
+type errorData struct {
+	Message string `json:"message"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// subscriptionErrorData is the data of a pusher:subscription_error event
+type subscriptionErrorData struct {
+	Type   string `json:"type"`
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// member is a user present on a presence channel, as the channel_data of its subscription
+// names it
+type member struct {
+	UserID   string          `json:"user_id"`
+	UserInfo json.RawMessage `json:"user_info,omitempty"`
+}
+
+// parseMember reads the channel_data of a presence subscription. Backends may send the
+// user ID as a number, which clients receive as a string.
+func parseMember(channelData string) (member, error) {
+	var data struct {
+		UserID   json.RawMessage `json:"user_id"`
+		UserInfo json.RawMessage `json:"user_info"`
+	}
+	if err := json.Unmarshal([]byte(channelData), &data); err != nil {
+		return member{}, fmt.Errorf("invalid channel_data: %v", err)
+	}
+
+	var userID string
+	if err := json.Unmarshal(data.UserID, &userID); err != nil {
+		var number json.Number
+		if err := json.Unmarshal(data.UserID, &number); err != nil {
+			return member{}, fmt.Errorf("channel_data has no user_id")
+		}
+		userID = number.String()
+	}
+	if userID == "" {
+		return member{}, fmt.Errorf("channel_data has no user_id")
+	}
+	return member{UserID: userID, UserInfo: data.UserInfo}, nil
+}
+
+// presenceData is the data of the subscription_succeeded event of a presence channel
+type presenceData struct {
+	Presence struct {
+		IDs   []string                   `json:"ids"`
+		Hash  map[string]json.RawMessage `json:"hash"`
+		Count int                        `json:"count"`
+	} `json:"presence"`
+}
+
+// newPresenceData lists the users present on a channel
+func newPresenceData(members []member) presenceData {
+	var data presenceData
+	data.Presence.IDs = make([]string, 0, len(members))
+	data.Presence.Hash = make(map[string]json.RawMessage, len(members))
+	for _, m := range members {
+		data.Presence.IDs = append(data.Presence.IDs, m.UserID)
+		info := m.UserInfo
+		if len(info) == 0 {
+			info = json.RawMessage("null")
+		}
+		data.Presence.Hash[m.UserID] = info
+	}
+	data.Presence.Count = len(members)
+	return data
+}
+
+// encodeData encodes the data of a server event, a string holding JSON
+func encodeData(data interface{}) (json.RawMessage, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(encoded))
+}
+
+// newSocketID generates a socket ID in the "1234.5678" form backends such as Laravel
+// check before signing a channel
+func newSocketID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%d.%d", binary.BigEndian.Uint32(b[:4]), binary.BigEndian.Uint32(b[4:]))
+}
+
+// private reports whether subscribing to a channel needs a signature
+func private(channel string) bool {
+	return strings.HasPrefix(channel, privatePrefix) || presence(channel)
+}
+
+// presence reports whether a channel tracks the users subscribed to it
+func presence(channel string) bool {
+	return strings.HasPrefix(channel, presencePrefix)
+}
@@ -0,0 +1,375 @@
+package pusher
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/bridge"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/websocket"
+)
+
+// Path pusher-js and Laravel Echo connect to, followed by the app key
+const Path = "/app/"
+
+// Seconds of silence after which either side pings, when server.pusher leaves it unset
+const defaultActivityTimeout = 120
+
+// Time a client may take to answer a ping
+const pongTimeout = 30 * time.Second
+
+// Protocol versions the server speaks, those of pusher-js 3 and later
+const (
+	minProtocol = 5
+	maxProtocol = 7
+)
+
+// Handler serves the Pusher Channels protocol on /app/{key} so pusher-js and Laravel Echo
+// clients work unchanged. Channels keep their names; private- and presence- channels
+// need a signature from the application backend, made with the app's secret.
+func Handler(b broker.Broker, rdb redis.UniversalClient, config *config.Config, upgrader *gws.Upgrader) http.HandlerFunc {
+	activityTimeout := config.Server.Pusher.ActivityTimeout
+	if activityTimeout <= 0 {
+		activityTimeout = defaultActivityTimeout
+	}
+	interval := time.Duration(activityTimeout) * time.Second
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		appKey := strings.TrimPrefix(r.URL.Path, Path)
+		if appKey == "" || strings.Contains(appKey, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		websocket.ApplyReadLimit(conn)
+
+		token := auth.TokenFromRequest(r)
+		s := &socket{
+			conn:      conn,
+			rdb:       rdb,
+			config:    config,
+			session:   bridge.NewSession("pusher", r.RemoteAddr, b, rdb, config),
+			limiter:   websocket.NewSendLimiter(config),
+			presences: make(map[string]string),
+			done:      make(chan struct{}),
+		}
+		s.session.SocketID = newSocketID()
+		s.session.SetRequest(auth.NewAuthorizeRequest(r, token))
+		defer reporting.Recover(reporting.Fields{"conn_id": s.session.ConnID, "remote_addr": r.RemoteAddr})
+		defer s.session.Close()
+		defer s.leaveAll()
+		defer close(s.done)
+
+		protocol, _ := strconv.Atoi(r.URL.Query().Get("protocol"))
+		if protocol < minProtocol || protocol > maxProtocol {
+			s.fail(codeUnsupportedProtocol, "Unsupported protocol version")
+			return
+		}
+		// Without tenant apps the key only selects the secret channel signatures are made with
+		if !apps.Enabled(config) {
+			if _, ok := config.Server.ChannelAuth.Secrets[appKey]; !ok {
+				s.session.Log.Warn("Rejected Pusher client with unknown app key", "app_key", appKey)
+				s.fail(codeAppNotFound, "Application does not exist")
+				return
+			}
+		}
+		if err := s.session.Authenticate(appKey, token, r.TLS); err != nil {
+			switch {
+			case errors.Is(err, bridge.ErrUnknownApp):
+				s.fail(codeAppNotFound, "Application does not exist")
+			case errors.Is(err, bridge.ErrQuotaExceeded):
+				s.fail(codeAppOverQuota, "Application is over connection quota")
+			case errors.Is(err, bridge.ErrUnauthorized):
+				s.fail(codeUnauthorized, "Connection is unauthorized")
+			default:
+				s.fail(codeOverCapacity, "Over capacity")
+			}
+			return
+		}
+
+		established, _ := encodeData(map[string]interface{}{"socket_id": s.session.SocketID, "activity_timeout": activityTimeout})
+		if !s.send(frame{Event: eventConnectionEstablished, Data: established}) {
+			return
+		}
+		s.session.Log.Info("New Pusher connection", "socket_id", s.session.SocketID, "protocol_version", protocol)
+		go s.ping(interval)
+
+		for {
+			conn.SetReadDeadline(time.Now().Add(interval + pongTimeout))
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				s.session.Log.Info("Pusher read failed", "error", err)
+				return
+			}
+
+			var f frame
+			if err := json.Unmarshal(message, &f); err != nil {
+				s.sendError(0, "Invalid JSON")
+				continue
+			}
+			switch {
+			case f.Event == eventPing:
+				s.send(frame{Event: eventPong, Data: json.RawMessage(`"{}"`)})
+			case f.Event == eventPong:
+			case f.Event == eventSubscribe:
+				s.subscribe(f.Data)
+			case f.Event == eventUnsubscribe:
+				s.unsubscribe(f.Data)
+			case f.Event == eventSignin:
+				s.sendError(0, "User authentication is not supported")
+			case strings.HasPrefix(f.Event, clientEventPrefix):
+				s.clientEvent(f)
+			default:
+				s.session.Log.Debug("Ignored Pusher event", "event", f.Event)
+			}
+		}
+	}
+}
+
+// socket is a Pusher client connected over a WebSocket
+type socket struct {
+	conn    *gws.Conn
+	rdb     redis.UniversalClient
+	config  *config.Config
+	session *bridge.Session
+	limiter *websocket.SendLimiter
+	done    chan struct{}
+
+	// User ID of the client on each presence channel it joined, only touched by the read loop
+	presences map[string]string
+
+	write sync.Mutex
+}
+
+// send writes a frame and reports whether it was written
+func (s *socket) send(f frame) bool {
+	encoded, err := json.Marshal(f)
+	if err != nil {
+		s.session.Log.Error("Failed to encode Pusher event", "event", f.Event, "error", err)
+		return false
+	}
+
+	s.write.Lock()
+	defer s.write.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(bridge.WriteTimeout))
+	if err := s.conn.WriteMessage(gws.TextMessage, encoded); err != nil {
+		s.session.Log.Warn("Failed to send Pusher event", "error", err)
+		s.conn.Close()
+		return false
+	}
+	return true
+}
+
+// sendError sends a pusher:error event, leaving the code out when it is 0
+func (s *socket) sendError(code int, message string) {
+	data, _ := json.Marshal(errorData{Message: message, Code: code})
+	s.send(frame{Event: eventError, Data: data})
+}
+
+// fail sends a pusher:error event and closes the connection with its code, which tells
+// the client whether to reconnect
+func (s *socket) fail(code int, message string) {
+	s.sendError(code, message)
+	s.write.Lock()
+	defer s.write.Unlock()
+	s.conn.WriteControl(gws.CloseMessage, gws.FormatCloseMessage(code, message), time.Now().Add(bridge.WriteTimeout))
+}
+
+// ping sends pusher:ping at every activity timeout until the connection ends, so a client
+// receiving messages but never sending any is not taken for gone
+func (s *socket) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if !s.send(frame{Event: eventPing, Data: json.RawMessage(`"{}"`)}) {
+				return
+			}
+		}
+	}
+}
+
+// subscribe handles pusher:subscribe, checking the signature of private and presence
+// channels and announcing members of presence channels
+func (s *socket) subscribe(raw json.RawMessage) {
+	var data subscribeData
+	if err := json.Unmarshal(raw, &data); err != nil || data.Channel == "" {
+		s.sendError(0, "Invalid subscription")
+		return
+	}
+	channel := data.Channel
+
+	var m member
+	if private(channel) {
+		subject := channel
+		if presence(channel) {
+			var err error
+			if m, err = parseMember(data.ChannelData); err != nil {
+				s.subscriptionError(channel, "AuthError", err.Error(), http.StatusBadRequest)
+				return
+			}
+			subject = channel + ":" + data.ChannelData
+		}
+		if !s.session.VerifySignature(subject, data.Auth) {
+			s.session.Log.Warn("Invalid channel signature", "action", "subscribe", "channel", channel)
+			s.subscriptionError(channel, "AuthError", "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	err := s.session.SubscribeAuthorized(channel, func(payload string) {
+		s.deliver(channel, payload)
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if bridge.Refused(err) {
+			status = http.StatusForbidden
+		}
+		s.subscriptionError(channel, "AuthError", err.Error(), status)
+		return
+	}
+
+	succeeded := json.RawMessage(`"{}"`)
+	if presence(channel) {
+		redisChannel := s.session.RedisChannel(channel)
+		first, err := joinPresence(s.rdb, redisChannel, s.session.SocketID, m)
+		var members []member
+		if err == nil {
+			members, err = presenceMembers(s.rdb, redisChannel)
+		}
+		if err != nil {
+			s.session.Log.Error("Failed to join presence channel", "channel", channel, "error", err)
+			s.session.Unsubscribe(channel)
+			s.subscriptionError(channel, "PresenceError", "Presence unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		s.presences[channel] = m.UserID
+		if succeeded, err = encodeData(newPresenceData(members)); err != nil {
+			return
+		}
+		if first {
+			added, _ := json.Marshal(m)
+			s.session.Announce(channel, eventMemberAdded, added)
+		}
+	}
+	s.send(frame{Event: eventSubscriptionSucceeded, Channel: channel, Data: succeeded})
+}
+
+// subscriptionError tells the client a subscription was refused
+func (s *socket) subscriptionError(channel, kind, message string, status int) {
+	data, _ := json.Marshal(subscriptionErrorData{Type: kind, Error: message, Status: status})
+	s.send(frame{Event: eventSubscriptionError, Channel: channel, Data: data})
+}
+
+// unsubscribe handles pusher:unsubscribe
+func (s *socket) unsubscribe(raw json.RawMessage) {
+	var data subscribeData
+	if err := json.Unmarshal(raw, &data); err != nil || data.Channel == "" {
+		return
+	}
+	s.session.Unsubscribe(data.Channel)
+	s.leave(data.Channel)
+}
+
+// leave removes the client from a presence channel it joined, announcing its user's
+// departure when it was the user's last socket there
+func (s *socket) leave(channel string) {
+	userID, ok := s.presences[channel]
+	if !ok {
+		return
+	}
+	delete(s.presences, channel)
+
+	last, err := leavePresence(s.rdb, s.session.RedisChannel(channel), s.session.SocketID, userID)
+	if err != nil {
+		s.session.Log.Error("Failed to leave presence channel", "channel", channel, "error", err)
+		return
+	}
+	if last {
+		removed, _ := json.Marshal(member{UserID: userID})
+		s.session.Announce(channel, eventMemberRemoved, removed)
+	}
+}
+
+// leaveAll removes the client from every presence channel when it disconnects
+func (s *socket) leaveAll() {
+	for channel := range s.presences {
+		s.leave(channel)
+	}
+}
+
+// clientEvent relays an event a client sends to the other subscribers of a private or
+// presence channel, when server.pusher.client_events allows it
+func (s *socket) clientEvent(f frame) {
+	if !s.config.Server.Pusher.ClientEvents {
+		s.sendError(0, "Client events are not enabled")
+		return
+	}
+	if !private(f.Channel) {
+		s.sendError(0, "Client events are only allowed on private and presence channels")
+		return
+	}
+	if !s.session.Subscribed(f.Channel) {
+		s.sendError(0, "Client events require a subscription to the channel")
+		return
+	}
+	if !s.limiter.Allow() {
+		s.sendError(codeClientEventRejected, "Client event rejected due to rate limit")
+		if s.limiter.Exceeded() {
+			s.session.Log.Warn("Disconnecting client for exceeding the send rate limit", "action", "client_event")
+			s.conn.Close()
+		}
+		return
+	}
+
+	// Client events arrive with their data as an object or a string, either is relayed as is
+	data := f.Data
+	if len(data) == 0 {
+		data = json.RawMessage("null")
+	}
+	if _, err := s.session.Publish(f.Channel, f.Event, data); err != nil {
+		s.sendError(0, "Client event rejected: "+err.Error())
+	}
+}
+
+// deliver sends a channel message to the client as a Pusher event, the message's event or
+// "message" when it has none, with the message as data. Clients do not receive their own
+// client events.
+func (s *socket) deliver(channel, payload string) {
+	delivery := bridge.Decode(payload)
+	if delivery.SocketID != "" && delivery.SocketID == s.session.SocketID {
+		return
+	}
+	event := delivery.Event
+	if event == "" {
+		event = "message"
+	}
+
+	// Servers send data as a string, which is the message itself when it is one
+	var text string
+	if json.Unmarshal(delivery.Message, &text) != nil {
+		text = string(delivery.Message)
+	}
+	data, _ := json.Marshal(text)
+	s.send(frame{Event: event, Channel: channel, Data: data})
+}
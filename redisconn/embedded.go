@@ -0,0 +1,62 @@
+package redisconn
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/context"
+)
+
+// How often the embedded store moves its clock forward to expire keys
+const embeddedTick = time.Second
+
+// Name of the embedded store in the ring, which has no network address
+const embeddedAddress = "embedded"
+
+// connectEmbedded starts an in-process Redis-compatible store for single-server installs
+// that run without Redis. Auth cache entries, resume sessions and receipts live in it and
+// are lost when the server stops. The client reaches the store over in-memory pipes, so
+// no other process can connect to it.
+func connectEmbedded() ([]redis.UniversalClient, error) {
+	store := miniredis.NewMiniRedis()
+	if err := store.StartAddr("127.0.0.1:0"); err != nil {
+		return nil, fmt.Errorf("failed to start the embedded Redis store: %v", err)
+	}
+	// miniredis only registers its commands when it starts listening. Closing the
+	// listener at once drops any connection it accepted meanwhile and keeps the commands.
+	server := store.Server()
+	server.Close()
+	go expireEmbedded(store)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: embeddedAddress,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			server.ServeConn(peer)
+			return conn, nil
+		},
+	})
+	if err := ping(client); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to the embedded Redis store: %v", err)
+	}
+	logger.Info("No Redis configured, keeping state in an embedded store")
+
+	setRing(newRing(embeddedAddress, map[string]redis.UniversalClient{embeddedAddress: client}))
+	return []redis.UniversalClient{client}, nil
+}
+
+// expireEmbedded advances the embedded store's clock, which it does not do by itself
+func expireEmbedded(store *miniredis.Miniredis) {
+	ticker := time.NewTicker(embeddedTick)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for now := range ticker.C {
+		store.FastForward(now.Sub(last))
+		last = now
+	}
+}
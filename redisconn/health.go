@@ -0,0 +1,153 @@
+package redisconn
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// Defaults used when the health_check block is missing from the config
+const (
+	defaultHealthInterval         = 5 * time.Second
+	defaultHealthFailureThreshold = 3
+)
+
+// NodeHealth reports the state of one Redis node as seen by the health checker
+type NodeHealth struct {
+	Address   string `json:"address"`
+	Healthy   bool   `json:"healthy"`
+	Primary   bool   `json:"primary"`              // Holds auth cache entries, sessions and other shared keys
+	LastError string `json:"last_error,omitempty"` // Error of the last failed ping
+	Since     int64  `json:"since"`                // Unix seconds the node entered its current state
+}
+
+var healthMu sync.Mutex
+
+// Consecutive failed pings and the last reported state of each node, keyed by address
+var (
+	failures    = make(map[string]int)
+	nodeHealths = make(map[string]*NodeHealth)
+)
+
+// MonitorHealth pings every Redis node on an interval. A node failing the configured
+// number of pings in a row is taken out of the hash ring, moving its channels to the
+// remaining nodes, and is put back after its first successful ping.
+func MonitorHealth(config *config.Config) {
+	interval := HealthInterval(config)
+	threshold := defaultHealthFailureThreshold
+	if config.Redis.HealthCheck.FailureThreshold > 0 {
+		threshold = config.Redis.HealthCheck.FailureThreshold
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ringMu.RLock()
+		clients := make(map[string]redis.UniversalClient, len(ring.clients))
+		for address, client := range ring.clients {
+			clients[address] = client
+		}
+		ringMu.RUnlock()
+
+		for address, client := range clients {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := client.Ping(ctx).Err()
+			cancel()
+			recordPing(address, err, threshold)
+		}
+	}
+}
+
+// HealthInterval returns how often health checks run
+func HealthInterval(config *config.Config) time.Duration {
+	if config.Redis.HealthCheck.Interval > 0 {
+		return time.Duration(config.Redis.HealthCheck.Interval) * time.Second
+	}
+	return defaultHealthInterval
+}
+
+// recordPing updates a node's state after a ping and rebuilds the ring when it changed
+func recordPing(address string, err error, threshold int) {
+	healthMu.Lock()
+	state, ok := nodeHealths[address]
+	if !ok {
+		state = &NodeHealth{Address: address, Healthy: true, Since: time.Now().Unix()}
+		nodeHealths[address] = state
+	}
+
+	changed := false
+	if err != nil {
+		state.LastError = err.Error()
+		failures[address]++
+		if state.Healthy && failures[address] >= threshold {
+			state.Healthy, state.Since, changed = false, time.Now().Unix(), true
+			logger.Warn("Redis node is unhealthy", "node", address, "failed_pings", failures[address], "error", err)
+		}
+	} else {
+		failures[address] = 0
+		state.LastError = ""
+		if !state.Healthy {
+			state.Healthy, state.Since, changed = true, time.Now().Unix(), true
+			logger.Info("Redis node recovered", "node", address)
+		}
+	}
+	healthy := state.Healthy
+	healthMu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	if healthy {
+		delete(unhealthy, address)
+	} else {
+		unhealthy[address] = true
+	}
+	swapRing(newRing(ring.primary, ring.clients))
+}
+
+// forgetHealth drops the state of a node removed from the config
+func forgetHealth(address string) {
+	healthMu.Lock()
+	delete(failures, address)
+	delete(nodeHealths, address)
+	healthMu.Unlock()
+
+	ringMu.Lock()
+	delete(unhealthy, address)
+	ringMu.Unlock()
+}
+
+// Health returns the state of every Redis node, sorted by address. Nodes that have not
+// been checked yet are reported healthy.
+func Health() []NodeHealth {
+	ringMu.RLock()
+	primary := ring.primary
+	addresses := make([]string, 0, len(ring.clients))
+	for address := range ring.clients {
+		addresses = append(addresses, address)
+	}
+	ringMu.RUnlock()
+	sort.Strings(addresses)
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	nodes := make([]NodeHealth, 0, len(addresses))
+	for _, address := range addresses {
+		node := NodeHealth{Address: address, Healthy: true}
+		if state, ok := nodeHealths[address]; ok {
+			node = *state
+		}
+		node.Primary = address == primary
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
@@ -0,0 +1,40 @@
+package redisconn
+
+import (
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Probe connects to the Redis nodes, cluster or sentinel master of a config and reports
+// every one that cannot be reached. Unlike Connect it closes its clients again and leaves
+// the ring untouched, so it can check a config without starting the server.
+func Probe(config *config.Config) []error {
+	configureTimeouts(config)
+
+	var clients []redis.UniversalClient
+	var problems []error
+	check := func(client redis.UniversalClient, err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+		if client != nil {
+			clients = append(clients, client)
+		}
+	}
+
+	switch {
+	case config.Redis.Sentinel.MasterName != "":
+		check(connectSentinel(config))
+	case len(config.Redis.Cluster.Addresses) > 0:
+		check(connectCluster(config))
+	default:
+		for _, node := range config.Redis.Nodes {
+			check(connectNode(node.Address, node.Username, node.Password, node.PasswordFile, node.TLS, node.Pool))
+		}
+	}
+
+	for _, client := range clients {
+		client.Close()
+	}
+	return problems
+}
@@ -0,0 +1,208 @@
+package redisconn
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// Logger of the redisconn package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the redisconn package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Connect creates the Redis clients described by the config and checks that each one
+// is reachable. In cluster mode a single ClusterClient routes every command to the node
+// owning its key's slot, and in sentinel mode a single failover client follows the
+// current master; otherwise there is one client per standalone node and channels are
+// spread over them with a consistent hash ring (see ForChannel). With the memory broker
+// and no Redis configured, an embedded store takes its place.
+func Connect(config *config.Config) ([]redis.UniversalClient, error) {
+	configureTimeouts(config)
+
+	if sentinel := config.Redis.Sentinel; sentinel.MasterName != "" {
+		client, err := connectSentinel(config)
+		if err != nil {
+			return nil, err
+		}
+		setRing(newRing(sentinel.MasterName, map[string]redis.UniversalClient{sentinel.MasterName: client}))
+		return []redis.UniversalClient{client}, nil
+	}
+
+	if len(config.Redis.Cluster.Addresses) > 0 {
+		client, err := connectCluster(config)
+		if err != nil {
+			return nil, err
+		}
+		setRing(newRing("cluster", map[string]redis.UniversalClient{"cluster": client}))
+		return []redis.UniversalClient{client}, nil
+	}
+
+	// Single-server installs on the in-memory broker may leave Redis out entirely
+	if len(config.Redis.Nodes) == 0 {
+		if config.Broker.Type == "memory" {
+			return connectEmbedded()
+		}
+		return nil, fmt.Errorf("no Redis nodes, cluster or sentinel configured")
+	}
+
+	// Initialize Redis clients for each node with individual passwords
+	var clients []redis.UniversalClient
+	byAddress := make(map[string]redis.UniversalClient)
+	for _, node := range config.Redis.Nodes {
+		client, err := connectNode(node.Address, node.Username, node.Password, node.PasswordFile, node.TLS, node.Pool)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+		byAddress[node.Address] = client
+	}
+	setRing(newRing(config.Redis.Nodes[0].Address, byAddress))
+	return clients, nil
+}
+
+// connectSentinel creates the failover client following the master named in the config
+// and checks that it is reachable
+func connectSentinel(config *config.Config) (redis.UniversalClient, error) {
+	sentinel := config.Redis.Sentinel
+	tlsConfig, err := tlsConfig(sentinel.TLS)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:          sentinel.MasterName,
+		SentinelAddrs:       sentinel.Addresses,
+		SentinelUsername:    sentinel.SentinelUsername,
+		SentinelPassword:    sentinel.SentinelPassword,
+		Username:            sentinel.Username,
+		Password:            sentinel.Password,
+		CredentialsProvider: credentials(sentinel.Username, sentinel.Password, sentinel.PasswordFile),
+		TLSConfig:           tlsConfig,
+		PoolSize:            sentinel.Pool.PoolSize,
+		MinIdleConns:        sentinel.Pool.MinIdleConns,
+		DialTimeout:         timeout(sentinel.Pool.DialTimeout),
+		ReadTimeout:         timeout(sentinel.Pool.ReadTimeout),
+		WriteTimeout:        timeout(sentinel.Pool.WriteTimeout),
+		MaxRetries:          sentinel.Pool.MaxRetries,
+	})
+	if err := ping(client); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis master %s through sentinels %v: %v", sentinel.MasterName, sentinel.Addresses, err)
+	}
+	return client, nil
+}
+
+// connectCluster creates the Redis Cluster client and checks that it is reachable
+func connectCluster(config *config.Config) (redis.UniversalClient, error) {
+	cluster := config.Redis.Cluster
+	tlsConfig, err := tlsConfig(cluster.TLS)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:               cluster.Addresses,
+		Username:            cluster.Username,
+		Password:            cluster.Password,
+		CredentialsProvider: credentials(cluster.Username, cluster.Password, cluster.PasswordFile),
+		RouteByLatency:      cluster.RouteByLatency,
+		RouteRandomly:       cluster.RouteRandomly,
+		TLSConfig:           tlsConfig,
+		PoolSize:            cluster.Pool.PoolSize,
+		MinIdleConns:        cluster.Pool.MinIdleConns,
+		DialTimeout:         timeout(cluster.Pool.DialTimeout),
+		ReadTimeout:         timeout(cluster.Pool.ReadTimeout),
+		WriteTimeout:        timeout(cluster.Pool.WriteTimeout),
+		MaxRetries:          cluster.Pool.MaxRetries,
+	})
+	if err := ping(client); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis Cluster %v: %v", cluster.Addresses, err)
+	}
+	return client, nil
+}
+
+// connectNode creates the client of one standalone node and checks that it is reachable
+func connectNode(address, username, password, passwordFile string, settings config.RedisTLS, pool config.RedisPool) (redis.UniversalClient, error) {
+	tlsConfig, err := tlsConfig(settings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings for Redis node %s: %v", address, err)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:                address,
+		Username:            username,
+		Password:            password, // Password for each Redis node
+		CredentialsProvider: credentials(username, password, passwordFile),
+		TLSConfig:           tlsConfig,
+		PoolSize:            pool.PoolSize,
+		MinIdleConns:        pool.MinIdleConns,
+		DialTimeout:         timeout(pool.DialTimeout),
+		ReadTimeout:         timeout(pool.ReadTimeout),
+		WriteTimeout:        timeout(pool.WriteTimeout),
+		MaxRetries:          pool.MaxRetries,
+	})
+
+	// Health check to ensure the connection is alive
+	if err := ping(client); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis node %s: %v", address, err)
+	}
+	return client, nil
+}
+
+// credentials returns a provider that reads a password file again for every new
+// connection, so a rotated secret is picked up without a restart. It returns nil, using
+// the static password, when no file is configured.
+func credentials(username, password, passwordFile string) func() (string, string) {
+	if passwordFile == "" {
+		return nil
+	}
+	return func() (string, string) {
+		secret, err := config.ReadSecretFile(passwordFile)
+		if err != nil {
+			logger.Warn("Failed to read Redis password file, using the password read at startup", "file", passwordFile, "error", err)
+			return username, password
+		}
+		return username, secret
+	}
+}
+
+// Masters returns a client per master of a Redis Cluster, so node-local pub/sub such as
+// keyspace notifications can be received from every shard. Outside cluster mode it
+// returns the primary node.
+func Masters(ctx context.Context) ([]redis.UniversalClient, error) {
+	cluster, ok := Primary().(*redis.ClusterClient)
+	if !ok {
+		return []redis.UniversalClient{Primary()}, nil
+	}
+
+	var mu sync.Mutex
+	var masters []redis.UniversalClient
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		mu.Lock()
+		masters = append(masters, client)
+		mu.Unlock()
+		return nil
+	})
+	return masters, err
+}
+
+// timeout converts milliseconds from the config to a go-redis timeout, which treats -1
+// as no timeout
+func timeout(milliseconds int) time.Duration {
+	if milliseconds < 0 {
+		return -1
+	}
+	return time.Duration(milliseconds) * time.Millisecond
+}
+
+func ping(client redis.UniversalClient) error {
+	return client.Ping(context.Background()).Err()
+}
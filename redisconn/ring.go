@@ -0,0 +1,171 @@
+package redisconn
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Points each node gets on the ring, so channels spread evenly across nodes
+const virtualNodes = 160
+
+// How long clients of removed nodes stay open so their subscriptions can move first
+const removedNodeGracePeriod = 10 * time.Second
+
+// hashRing assigns channels to healthy Redis nodes by consistent hashing, so a node
+// joining or leaving only moves the channels it owns
+type hashRing struct {
+	points  []uint32
+	owners  map[uint32]string
+	clients map[string]redis.UniversalClient
+	primary string // Node holding auth cache entries, sessions and other shared keys
+}
+
+var ringMu sync.RWMutex
+
+// Ring of the connected nodes, set by Connect
+var ring *hashRing
+
+// Nodes taken out of the ring by the health checker, keyed by address
+var unhealthy = make(map[string]bool)
+
+// Closed and replaced whenever the ring changes
+var ringChanged = make(chan struct{})
+
+func newRing(primary string, clients map[string]redis.UniversalClient) *hashRing {
+	return &hashRing{clients: clients, primary: primary}
+}
+
+// build places the healthy nodes on the ring. When every node is unhealthy all of them
+// stay on it, since failing over to nothing would not help. Callers hold ringMu.
+func (r *hashRing) build() {
+	members := make([]string, 0, len(r.clients))
+	for address := range r.clients {
+		if !unhealthy[address] {
+			members = append(members, address)
+		}
+	}
+	if len(members) == 0 {
+		for address := range r.clients {
+			members = append(members, address)
+		}
+	}
+
+	r.points = nil
+	r.owners = make(map[uint32]string)
+	for _, address := range members {
+		for i := 0; i < virtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(address + "#" + strconv.Itoa(i)))
+			r.points = append(r.points, point)
+			r.owners[point] = address
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *hashRing) owner(key string) redis.UniversalClient {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.clients[r.owners[r.points[i]]]
+}
+
+// setRing swaps in a new ring and wakes up everything waiting on RingChanged
+func setRing(r *hashRing) {
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	swapRing(r)
+}
+
+// swapRing is setRing for callers already holding ringMu
+func swapRing(r *hashRing) {
+	r.build()
+	ring = r
+	close(ringChanged)
+	ringChanged = make(chan struct{})
+}
+
+// ForChannel returns the Redis client owning a channel. Every server with the same node
+// list maps a channel to the same node, for publishing and subscribing alike.
+func ForChannel(channel string) redis.UniversalClient {
+	ringMu.RLock()
+	defer ringMu.RUnlock()
+	return ring.owner(channel)
+}
+
+// RingChanged returns a channel that is closed the next time nodes are added or removed
+func RingChanged() <-chan struct{} {
+	ringMu.RLock()
+	defer ringMu.RUnlock()
+	return ringChanged
+}
+
+// Rebalance updates the ring to the standalone nodes in a reloaded config, connecting to
+// added nodes and closing removed ones. Channels move only from and to changed nodes.
+// The first node is the primary holding shared keys and cannot be replaced this way.
+func Rebalance(config *config.Config) error {
+	ringMu.RLock()
+	current := ring
+	ringMu.RUnlock()
+
+	if len(config.Redis.Nodes) == 0 || len(config.Redis.Cluster.Addresses) > 0 || config.Redis.Sentinel.MasterName != "" {
+		return fmt.Errorf("rebalancing is only supported for standalone nodes")
+	}
+	if _, ok := current.clients[current.primary]; !ok || config.Redis.Nodes[0].Address != current.primary {
+		return fmt.Errorf("the first node %s cannot be changed without a restart", current.primary)
+	}
+
+	clients := make(map[string]redis.UniversalClient)
+	for _, node := range config.Redis.Nodes {
+		if client, ok := current.clients[node.Address]; ok {
+			clients[node.Address] = client
+			continue
+		}
+		client, err := connectNode(node.Address, node.Username, node.Password, node.PasswordFile, node.TLS, node.Pool)
+		if err != nil {
+			return err
+		}
+		clients[node.Address] = client
+		logger.Info("Added Redis node", "node", node.Address)
+	}
+
+	setRing(newRing(current.primary, clients))
+
+	for address, client := range current.clients {
+		if _, ok := clients[address]; ok {
+			continue
+		}
+		logger.Info("Removed Redis node", "node", address)
+		forgetHealth(address)
+		time.AfterFunc(removedNodeGracePeriod, func() { client.Close() })
+	}
+	return nil
+}
+
+// Primary returns the client of the node holding auth cache entries, sessions and other
+// shared keys
+func Primary() redis.UniversalClient {
+	ringMu.RLock()
+	defer ringMu.RUnlock()
+	return ring.clients[ring.primary]
+}
+
+// Nodes returns the clients of every connected node, healthy or not
+func Nodes() []redis.UniversalClient {
+	ringMu.RLock()
+	defer ringMu.RUnlock()
+
+	clients := make([]redis.UniversalClient, 0, len(ring.clients))
+	for _, client := range ring.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
@@ -0,0 +1,124 @@
+package redisconn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testRing builds a ring of clients that are never dialed, with some nodes unhealthy
+func testRing(t *testing.T, addresses []string, down ...string) (*hashRing, map[redis.UniversalClient]string) {
+	t.Helper()
+	clients := make(map[string]redis.UniversalClient)
+	names := make(map[redis.UniversalClient]string)
+	for _, address := range addresses {
+		client := redis.NewClient(&redis.Options{Addr: address})
+		t.Cleanup(func() { client.Close() })
+		clients[address] = client
+		names[client] = address
+	}
+
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	unhealthy = make(map[string]bool)
+	for _, address := range down {
+		unhealthy[address] = true
+	}
+	t.Cleanup(func() { unhealthy = make(map[string]bool) })
+
+	r := newRing(addresses[0], clients)
+	r.build()
+	return r, names
+}
+
+// owners maps each of n channels to the node owning it
+func owners(r *hashRing, names map[redis.UniversalClient]string, n int) map[string]string {
+	owned := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		channel := fmt.Sprintf("channel-%d", i)
+		owned[channel] = names[r.owner(channel)]
+	}
+	return owned
+}
+
+func TestRingOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		down      []string
+		want      []string // Nodes that must own some channels
+		wantNone  []string // Nodes that must own none
+	}{
+		{
+			name:      "single node owns everything",
+			addresses: []string{"10.0.0.1:6379"},
+			want:      []string{"10.0.0.1:6379"},
+		},
+		{
+			name:      "channels spread over every node",
+			addresses: []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"},
+			want:      []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"},
+		},
+		{
+			name:      "unhealthy node is skipped",
+			addresses: []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"},
+			down:      []string{"10.0.0.2:6379"},
+			want:      []string{"10.0.0.1:6379", "10.0.0.3:6379"},
+			wantNone:  []string{"10.0.0.2:6379"},
+		},
+		{
+			name:      "every node unhealthy keeps all of them",
+			addresses: []string{"10.0.0.1:6379", "10.0.0.2:6379"},
+			down:      []string{"10.0.0.1:6379", "10.0.0.2:6379"},
+			want:      []string{"10.0.0.1:6379", "10.0.0.2:6379"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, names := testRing(t, tt.addresses, tt.down...)
+			counts := make(map[string]int)
+			for _, owner := range owners(r, names, 1000) {
+				counts[owner]++
+			}
+			for _, address := range tt.want {
+				if counts[address] == 0 {
+					t.Errorf("%s owns no channels, counts %v", address, counts)
+				}
+			}
+			for _, address := range tt.wantNone {
+				if counts[address] != 0 {
+					t.Errorf("%s owns %d channels, want none", address, counts[address])
+				}
+			}
+		})
+	}
+}
+
+func TestRingIsDeterministic(t *testing.T) {
+	addresses := []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}
+	first, firstNames := testRing(t, addresses)
+	second, secondNames := testRing(t, []string{addresses[2], addresses[0], addresses[1]})
+
+	want := owners(first, firstNames, 1000)
+	got := owners(second, secondNames, 1000)
+	for channel, owner := range want {
+		if got[channel] != owner {
+			t.Errorf("%s: owned by %s with one node order and %s with another", channel, owner, got[channel])
+		}
+	}
+}
+
+func TestRingRemovalOnlyMovesOwnedChannels(t *testing.T) {
+	all, allNames := testRing(t, []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"})
+	before := owners(all, allNames, 1000)
+	fewer, fewerNames := testRing(t, []string{"10.0.0.1:6379", "10.0.0.3:6379"})
+	after := owners(fewer, fewerNames, 1000)
+
+	for channel, owner := range before {
+		if owner != "10.0.0.2:6379" && after[channel] != owner {
+			t.Errorf("%s moved from %s to %s although its node stayed", channel, owner, after[channel])
+		}
+	}
+}
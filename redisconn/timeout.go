@@ -0,0 +1,64 @@
+package redisconn
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// Timeouts used when the redis.timeouts block leaves them unset
+const (
+	defaultOperationTimeout = 2 * time.Second
+	defaultPublishTimeout   = 2 * time.Second
+	defaultSubscribeTimeout = 5 * time.Second
+)
+
+// Deadlines of single Redis operations, set by Connect
+var (
+	operationTimeout = defaultOperationTimeout
+	publishTimeout   = defaultPublishTimeout
+	subscribeTimeout = defaultSubscribeTimeout
+)
+
+// configureTimeouts reads the operation deadlines from the config
+func configureTimeouts(config *config.Config) {
+	timeouts := config.Redis.Timeouts
+	operationTimeout = orDefault(timeouts.Operation, defaultOperationTimeout)
+	publishTimeout = orDefault(timeouts.Publish, defaultPublishTimeout)
+	subscribeTimeout = orDefault(timeouts.Subscribe, defaultSubscribeTimeout)
+}
+
+func orDefault(ms int, fallback time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return fallback
+}
+
+// WithTimeout bounds a single Redis command, such as a cache lookup or a session write
+func WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, operationTimeout)
+}
+
+// WithPublishTimeout bounds publishing a message through the broker
+func WithPublishTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, publishTimeout)
+}
+
+// WithSubscribeTimeout bounds waiting for a subscription to be confirmed
+func WithSubscribeTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, subscribeTimeout)
+}
+
+// IsTimeout reports whether an operation failed because it ran out of time, in which
+// case the client may retry it
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,122 @@
+package reporting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Fields describe where an error happened, such as the connection and channel. They are
+// attached to the report as tags, leaving out empty ones.
+type Fields map[string]string
+
+type fieldsKey struct{}
+
+var mu sync.Mutex
+var enabled bool
+
+// Configure reports errors to Sentry as set in the sentry block. Until it is called, or
+// without a DSN, reporting does nothing. It returns a function sending the reports still
+// buffered.
+func Configure(config *config.Config) (func(context.Context) error, error) {
+	settings := config.Sentry
+	if settings.Dsn == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:              settings.Dsn,
+		Environment:      config.Environment,
+		Release:          settings.Release,
+		SampleRate:       settings.SampleRate,
+		AttachStacktrace: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Sentry: %v", err)
+	}
+
+	mu.Lock()
+	enabled = true
+	mu.Unlock()
+	return flush, nil
+}
+
+func flush(ctx context.Context) error {
+	if !sentry.FlushWithContext(ctx) {
+		return errors.New("timed out sending error reports")
+	}
+	return nil
+}
+
+func isEnabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// WithFields returns a context carrying fields, which errors captured with it are
+// reported with in addition to their own
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	if outer, ok := ctx.Value(fieldsKey{}).(Fields); ok {
+		for key, value := range outer {
+			merged[key] = value
+		}
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// Capture reports an error with the fields carried by ctx and the given ones
+func Capture(ctx context.Context, err error, fields Fields) {
+	if err == nil || !isEnabled() {
+		return
+	}
+
+	hub := sentry.CurrentHub().Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		if outer, ok := ctx.Value(fieldsKey{}).(Fields); ok {
+			setTags(scope, outer)
+		}
+		setTags(scope, fields)
+		hub.CaptureException(err)
+	})
+}
+
+// Recover reports a panic with the given fields and panics again, so it is handled as it
+// would be without reporting. Call it deferred.
+func Recover(fields Fields) {
+	if recovered := recover(); recovered != nil {
+		Panic(recovered, fields)
+	}
+}
+
+// Panic reports a recovered panic with the given fields and panics again. It lets callers
+// work out the fields only once a panic happened.
+func Panic(recovered interface{}, fields Fields) {
+	if isEnabled() {
+		hub := sentry.CurrentHub().Clone()
+		hub.WithScope(func(scope *sentry.Scope) {
+			setTags(scope, fields)
+			hub.Recover(recovered)
+		})
+		// The panic may end the process before the report is sent in the background
+		sentry.Flush(2 * time.Second)
+	}
+	panic(recovered)
+}
+
+func setTags(scope *sentry.Scope, fields Fields) {
+	for key, value := range fields {
+		if value != "" {
+			scope.SetTag(key, value)
+		}
+	}
+}
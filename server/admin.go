@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/cors"
+	"github.com/sahakavatar/gopush/ipfilter"
+	"github.com/sahakavatar/gopush/metrics"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/webhooks"
+	"github.com/sahakavatar/gopush/websocket"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"path"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
+
+// adminHandler returns the routes of the admin listener, which pass the admin IP filter
+func adminHandler(config *config.Config) http.Handler {
+	mux := http.NewServeMux()
+	if config.Server.Admin.Debug {
+		handleDebug(mux)
+	}
+	if config.Server.Admin.Token != "" {
+		handleAdminAPI(mux)
+	}
+	if config.Metrics.Enabled && config.Metrics.Sink == "prometheus" {
+		mux.Handle("/metrics", metrics.Handler())
+	}
+	return ipfilter.RealIP(ipfilter.Admin(cors.Handler(mux.ServeHTTP)))
+}
+
+// serveAdmin starts the admin listener, kept apart from the WebSocket listener so it can be
+// bound to a private address
+func serveAdmin(config *config.Config) error {
+	address := config.Server.Admin.Address
+	listener, err := listenTCP(address, false)
+	if err != nil {
+		return fmt.Errorf("failed to start the admin server: %v", err)
+	}
+	logger.Info("Admin server started", "url", "http://"+address, "debug", config.Server.Admin.Debug, "api", config.Server.Admin.Token != "")
+	server := newHTTPServer(config, address, adminHandler(config))
+	go serve("Admin server", server, func() error {
+		return server.Serve(listener)
+	})
+	return nil
+}
+
+// handleAdminAPI adds the JSON endpoints describing and managing the connections of this server,
+// each requiring the admin token
+func handleAdminAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/stats", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, websocket.CurrentStats())
+	}))
+	mux.HandleFunc("/admin/channels", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, websocket.ChannelSubscribers())
+	}))
+	mux.HandleFunc("/admin/connections", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		writeJSON(w, websocket.Connections(websocket.ConnectionFilter{
+			User:    query.Get("user"),
+			Channel: query.Get("channel"),
+			IP:      query.Get("ip"),
+		}))
+	}))
+
+	// Force-disconnect one connection or every subscriber of a channel. The optional
+	// ?reason= is sent to the clients in the close frame.
+	mux.HandleFunc("DELETE /admin/connections/{id}", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.DisconnectConnection(r.PathValue("id"), r.URL.Query().Get("reason")) {
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, disconnected{Closed: 1})
+	}))
+	mux.HandleFunc("DELETE /admin/channels/{channel}", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, disconnected{Closed: websocket.DisconnectChannel(r.PathValue("channel"), r.URL.Query().Get("reason"))})
+	}))
+
+	// Reach every client of every server, whatever it subscribed to
+	mux.HandleFunc("POST /admin/broadcast", requireAdminToken(handleBroadcast))
+
+	// HTTP endpoints receiving the messages of channels, registered for every server
+	mux.HandleFunc("GET /admin/subscribers", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, webhooks.Subscribers())
+	}))
+	mux.HandleFunc("POST /admin/subscribers", requireAdminToken(handleRegisterSubscriber))
+	mux.HandleFunc("DELETE /admin/subscribers/{id}", requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		err := webhooks.Unregister(r.Context(), r.PathValue("id"))
+		if errors.Is(err, webhooks.ErrSubscriberNotFound) {
+			http.Error(w, "Subscriber not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to unregister webhook subscriber", "id", r.PathValue("id"), "error", err)
+			http.Error(w, "Failed to unregister subscriber", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// handleRegisterSubscriber registers an endpoint for the messages of some channels
+func handleRegisterSubscriber(w http.ResponseWriter, r *http.Request) {
+	var subscriber webhooks.Subscriber
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBody)).Decode(&subscriber); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(subscriber.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	if len(subscriber.Channels) == 0 {
+		http.Error(w, "channels is required", http.StatusBadRequest)
+		return
+	}
+	for _, pattern := range subscriber.Channels {
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid channel pattern %q", pattern), http.StatusBadRequest)
+			return
+		}
+	}
+
+	subscriber, err := webhooks.Register(r.Context(), subscriber)
+	if err != nil {
+		logger.Error("Failed to register webhook subscriber", "url", subscriber.URL, "error", err)
+		http.Error(w, "Failed to register subscriber", http.StatusBadGateway)
+		return
+	}
+
+	logger.Info("Registered webhook subscriber", "id", subscriber.ID, "url", subscriber.URL, "channels", subscriber.Channels)
+	subscriber.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscriber)
+}
+
+// broadcastRequest is the body of an admin broadcast
+type broadcastRequest struct {
+	Type    string          `json:"type"`    // Kind of announcement, e.g. maintenance or refresh
+	Payload json.RawMessage `json:"payload"` // Passed to the clients as message
+}
+
+// handleBroadcast publishes an announcement on the broadcast channel, from which every
+// server delivers it to all of its clients
+func handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	var request broadcastRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBody)).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := redisconn.WithPublishTimeout(r.Context())
+	messageID, err := websocket.Broadcast(ctx, request.Type, request.Payload)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to publish broadcast", "type", request.Type, "error", err)
+		http.Error(w, "Failed to publish broadcast", http.StatusBadGateway)
+		return
+	}
+
+	logger.Info("Published broadcast", "type", request.Type, "message_id", messageID, "remote_addr", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(publishResult{Status: "accepted", Channel: websocket.BroadcastChannel, MessageID: messageID})
+}
+
+// disconnected answers a force-disconnect with the number of connections closed
+type disconnected struct {
+	Closed int `json:"closed"`
+}
+
+// requireAdminToken rejects requests without the admin token as a bearer token. A
+// token removed on reload rejects every request.
+func requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := adminToken()
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			logger.Warn("Rejected admin request without a valid token", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			auditAdmin(r, audit.OutcomeDenied, "invalid admin token")
+			return
+		}
+		auditAdmin(r, audit.OutcomeAllowed, "")
+		next(w, r)
+	}
+}
+
+// auditAdmin records an admin API call
+func auditAdmin(r *http.Request, outcome, reason string) {
+	audit.Record(audit.Event{
+		Action:     audit.ActionAdmin,
+		Outcome:    outcome,
+		RemoteAddr: r.RemoteAddr,
+		Path:       r.Method + " " + r.URL.Path,
+		Reason:     reason,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// handleDebug adds the runtime debug endpoints: the pprof profiles, the expvar variables
+// and a goroutine dump
+func handleDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+}
+
+// handleGoroutines writes the stack of every goroutine as text. Goroutines sharing a
+// stack are grouped with their count, which makes leaks stand out; ?all=1 lists each one
+// with its state and how long it has been blocked.
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	debug := 1
+	if r.URL.Query().Get("all") == "1" {
+		debug = 2
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := runtimepprof.Lookup("goroutine").WriteTo(w, debug); err != nil {
+		logger.Error("Failed to write goroutine dump", "error", err)
+	}
+}
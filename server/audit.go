@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/config"
+	"net/http"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// openAuditSink opens the audit log configured under audit. The file sink is reopened on
+// SIGUSR1 like the operational log.
+func openAuditSink(config *config.Config, rdb redis.UniversalClient) (audit.Sink, error) {
+	if config.Audit.Sink == "redis" {
+		return audit.NewRedisSink(rdb, config.Audit.Stream, config.Audit.MaxLen), nil
+	}
+
+	file, err := openLogFile(config.Audit.File)
+	if err != nil {
+		return nil, err
+	}
+	go reopenLogOnSignal(file)
+	return audit.NewWriterSink(file), nil
+}
+
+// auditUpgrade records an upgrade refused before a connection existed
+func auditUpgrade(r *http.Request, connID, appKey, outcome, reason string) {
+	audit.Record(audit.Event{
+		Action:     audit.ActionAuthenticate,
+		Outcome:    outcome,
+		ConnID:     connID,
+		RemoteAddr: r.RemoteAddr,
+		App:        appKey,
+		Reason:     reason,
+	})
+}
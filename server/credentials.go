@@ -0,0 +1,39 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Credentials the admin and publish APIs check requests against. They are replaced on
+// reload, so a rotated token or secret file takes effect without a restart.
+var credentials struct {
+	mu            sync.RWMutex
+	adminToken    string
+	publishKey    string
+	publishSecret string
+}
+
+// setCredentials takes the admin token and the publish API key and secret from a config
+func setCredentials(config *config.Config) {
+	credentials.mu.Lock()
+	defer credentials.mu.Unlock()
+	credentials.adminToken = config.Server.Admin.Token
+	credentials.publishKey = config.Server.PublishAPI.Key
+	credentials.publishSecret = config.Server.PublishAPI.Secret
+}
+
+// adminToken returns the token the admin API currently requires
+func adminToken() string {
+	credentials.mu.RLock()
+	defer credentials.mu.RUnlock()
+	return credentials.adminToken
+}
+
+// publishCredentials returns the API key and signing secret the publish API currently accepts
+func publishCredentials() (key, secret string) {
+	credentials.mu.RLock()
+	defer credentials.mu.RUnlock()
+	return credentials.publishKey, credentials.publishSecret
+}
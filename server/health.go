@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/websocket"
+	"net/http"
+)
+
+// handleHealth reports the state of the Redis nodes and authorize APIs along with the
+// number of open connections. Losing some nodes or an authorize API degrades the server,
+// losing the primary node or all of them makes it unavailable.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	nodes := redisconn.Health()
+	authorize := auth.Health()
+
+	status := "ok"
+	healthy := 0
+	for _, node := range nodes {
+		if node.Healthy {
+			healthy++
+		} else if node.Primary {
+			status = "unavailable"
+		}
+	}
+	if healthy == 0 {
+		status = "unavailable"
+	} else if healthy < len(nodes) && status == "ok" {
+		status = "degraded"
+	}
+	for _, endpoint := range authorize {
+		if !endpoint.Reachable && status == "ok" {
+			status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == "unavailable" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      status,
+		"redis":       nodes,
+		"authorize":   authorize,
+		"connections": websocket.Counts(),
+	})
+}
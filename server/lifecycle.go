@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Lifecycle states reported by the readiness endpoint. Only ready accepts new traffic.
+const (
+	stateStarting  = "starting"
+	stateReady     = "ready"
+	stateReloading = "reloading"
+	stateDraining  = "draining"
+)
+
+var readinessMu sync.Mutex
+var readiness = stateStarting
+
+// setReadiness moves the server to a lifecycle state. Draining is final.
+func setReadiness(state string) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	if readiness != stateDraining {
+		readiness = state
+	}
+}
+
+// swapReadiness moves the server to a lifecycle state only when it is in the expected
+// one, so a reload neither marks a starting server ready nor undoes a drain
+func swapReadiness(from, to string) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	if readiness == from {
+		readiness = to
+	}
+}
+
+func currentReadiness() string {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	return readiness
+}
+
+// handleLiveness reports that the process is running. It never touches Redis or the
+// authorize API, so a dependency outage does not get the server restarted.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+}
+
+// handleReadiness reports whether the server should receive new connections, answering
+// 503 while it starts, reloads its config or drains before shutting down
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	state := currentReadiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	if state != stateReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": state})
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/ipfilter"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Timeouts used when the server.timeouts block leaves them unset. Reading and writing a
+// whole request stay unbounded unless configured, since CPU profiles on the admin
+// listener legitimately take half a minute.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultHandshakeTimeout  = 10 * time.Second
+)
+
+// listen opens a listener of the public server, giving a unix socket file the octal mode
+func listen(spec config.Listener, mode string, reuse bool) (net.Listener, error) {
+	if spec.UnixSocket != "" {
+		return openListener("unix:"+spec.UnixSocket, func() (net.Listener, error) {
+			return listenUnix(spec.UnixSocket, mode)
+		})
+	}
+	return listenTCP(spec.Address, reuse)
+}
+
+// listenTCP listens on a host:port address, sharing it with other processes through
+// SO_REUSEPORT when reuse is set. Like unix sockets, it reuses the listener a restart
+// handed over for the address.
+func listenTCP(address string, reuse bool) (net.Listener, error) {
+	return openListener("tcp:"+address, func() (net.Listener, error) {
+		var listenConfig net.ListenConfig
+		if reuse {
+			listenConfig.Control = reusePort
+		}
+		return listenConfig.Listen(context.Background(), "tcp", address)
+	})
+}
+
+// proxyProtocol has a listener read the PROXY protocol header, v1 or v2, that HAProxy and
+// other TCP load balancers send ahead of the forwarded connection, so the remote address
+// of requests is the client instead of the balancer. Connections from server.trusted_proxies,
+// from anywhere when the list is empty, and over unix sockets must start with the header.
+// Other peers may connect directly but are dropped if they send one, so they cannot claim
+// a different address.
+func proxyProtocol(listener net.Listener, anyPeer bool, timeout time.Duration) net.Listener {
+	return &proxyproto.Listener{
+		Listener:          listener,
+		ReadHeaderTimeout: timeout,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if anyPeer || upstream.Network() == "unix" {
+				return proxyproto.REQUIRE, nil
+			}
+			if tcp, ok := upstream.(*net.TCPAddr); ok && ipfilter.TrustedProxy(tcp.IP) {
+				return proxyproto.REQUIRE, nil
+			}
+			return proxyproto.REJECT, nil
+		},
+	}
+}
+
+// listenUnix listens on a unix socket and gives the socket file an octal mode such as
+// "0660". A socket file left behind by a previous run is removed first, unless another
+// process still accepts connections on it.
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode '%s': %v", mode, err)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket '%s' is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket '%s': %v", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the mode of socket '%s': %v", path, err)
+	}
+	return listener, nil
+}
+
+// listenerURL describes where a listener accepts connections, for the startup log
+func listenerURL(scheme string, listener net.Listener) string {
+	if listener.Addr().Network() == "unix" {
+		return "unix:" + listener.Addr().String()
+	}
+	return scheme + "://" + listener.Addr().String()
+}
+
+// newHTTPServer creates the server of a listener with the limits of server.timeouts, so
+// clients that send their headers slowly or keep idle connections open cannot tie up
+// the listener. The header timeout also bounds the TLS handshake.
+func newHTTPServer(config *config.Config, address string, handler http.Handler) *http.Server {
+	timeouts := config.Server.Timeouts
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout(config),
+		ReadTimeout:       time.Duration(timeouts.Read) * time.Millisecond,
+		WriteTimeout:      time.Duration(timeouts.Write) * time.Millisecond,
+		IdleTimeout:       orDefault(timeouts.Idle, defaultIdleTimeout),
+		MaxHeaderBytes:    timeouts.MaxHeaderBytes,
+	}
+}
+
+// readHeaderTimeout bounds reading the request headers, and the PROXY protocol header and
+// TLS handshake before them
+func readHeaderTimeout(config *config.Config) time.Duration {
+	return orDefault(config.Server.Timeouts.ReadHeader, defaultReadHeaderTimeout)
+}
+
+// handshakeTimeout bounds writing the response to a WebSocket upgrade. The server clears
+// its own deadlines when a connection is upgraded, so they never cut WebSocket connections.
+func handshakeTimeout(config *config.Config) time.Duration {
+	return orDefault(config.Server.Timeouts.Handshake, defaultHandshakeTimeout)
+}
+
+// newTLSConfig builds the TLS configuration of the public listener from server.tls: the
+// oldest protocol version, the TLS 1.2 cipher suites and curves, and the CAs verifying
+// client certificates (mTLS).
+func newTLSConfig(settings config.ServerTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	minVersion, err := config.TLSVersion(settings.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion = minVersion
+	for _, name := range settings.CipherSuites {
+		suite, err := config.CipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite)
+	}
+	for _, name := range settings.CurvePreferences {
+		curve, err := config.CurveID(name)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	// Verify client certificates against the configured CA bundle (mTLS)
+	if settings.ClientCAFile != "" {
+		clientCAs, err := auth.LoadClientCAs(settings.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if settings.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+// newCertManager creates the ACME client of server.tls.autocert and has tlsConfig take its
+// certificates from it. It requests certificates for the configured domains on their first
+// handshake, keeps them in the cache directory and renews them in the background 30 days
+// before they expire. The CA validates the domains over HTTP-01 challenges, answered by the
+// manager's HTTPHandler, or TLS-ALPN-01 challenges on the TLS listener itself.
+func newCertManager(settings config.ServerTLS, tlsConfig *tls.Config) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(settings.Autocert.Domains...),
+		Cache:      autocert.DirCache(settings.Autocert.CacheDir),
+		Email:      settings.Autocert.Email,
+	}
+	if settings.Autocert.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: settings.Autocert.DirectoryURL}
+	}
+	tlsConfig.GetCertificate = manager.GetCertificate
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	return manager
+}
+
+// mqttTLSConfig returns the TLS settings of the MQTT listener: those of the public
+// listeners, with the certificate files loaded unless ACME provides the certificates
+func mqttTLSConfig(tlsConfig *tls.Config, certFile, keyFile string) (*tls.Config, error) {
+	mqttConfig := tlsConfig.Clone()
+	if mqttConfig.GetCertificate == nil {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		mqttConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return mqttConfig, nil
+}
+
+func orDefault(ms int, fallback time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return fallback
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"github.com/sahakavatar/gopush/config"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// reopenableWriter is a log file that can be closed and opened again at the same path
+type reopenableWriter interface {
+	io.Writer
+	Reopen() error
+}
+
+// logFile appends to a log file. Reopen lets external rotators such as logrotate move
+// the file away and have the server continue in a new one.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{path: path, file: file}, nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Reopen closes the file and opens its path again, creating it if it was moved away.
+// The old file stays in use when the new one cannot be opened.
+func (f *logFile) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.mu.Unlock()
+	return old.Close()
+}
+
+// rotatingLogFile rotates the log file by size and prunes old files by age and count
+type rotatingLogFile struct {
+	*lumberjack.Logger
+}
+
+// Reopen closes the file, the next write opens its path again
+func (f rotatingLogFile) Reopen() error {
+	return f.Close()
+}
+
+// openLogOutput opens the log file, rotated by the server when logging.rotation has any
+// limit set and appended to forever otherwise
+func openLogOutput(config *config.Config) (reopenableWriter, error) {
+	logging := config.Logging
+
+	// Surface permission problems now rather than on the first write
+	file, err := openLogFile(logging.File)
+	if err != nil {
+		return nil, err
+	}
+
+	rotation := logging.Rotation
+	if rotation.MaxSize == 0 && rotation.MaxAge == 0 && rotation.MaxBackups == 0 {
+		return file, nil
+	}
+	file.file.Close()
+
+	return rotatingLogFile{&lumberjack.Logger{
+		Filename:   logging.File,
+		MaxSize:    rotation.MaxSize,
+		MaxAge:     rotation.MaxAge,
+		MaxBackups: rotation.MaxBackups,
+		Compress:   rotation.Compress,
+		LocalTime:  true,
+	}}, nil
+}
+
+// reopenLogOnSignal reopens the log file on SIGUSR1, after an external rotator moved it
+func reopenLogOnSignal(file reopenableWriter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		if err := file.Reopen(); err != nil {
+			logger.Error("Failed to reopen log file", "error", err)
+			continue
+		}
+		logger.Info("Reopened log file")
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/ipfilter"
+	"github.com/sahakavatar/gopush/metrics"
+	"github.com/sahakavatar/gopush/push"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/webhooks"
+	"github.com/sahakavatar/gopush/websocket"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Level of the loggers NewLogger creates, changed when a reload sets another logging.level
+var level slog.LevelVar
+
+// NewLogger creates the structured logger of the config, writing JSON lines unless
+// logging.format asks for text to stdout, the log file or both, as set by
+// logging.output. Lines below logging.level are dropped and tokens are redacted as
+// logging.redact says.
+func NewLogger(config *config.Config) (*slog.Logger, error) {
+	output, err := setupLogging(config)
+	if err != nil {
+		return nil, err
+	}
+	level.Set(logLevel(config.Logging.Level))
+	options := &slog.HandlerOptions{Level: &level}
+	if config.Logging.Format == "text" {
+		return redacting(slog.New(slog.NewTextHandler(output, options)), config), nil
+	}
+	return redacting(slog.New(slog.NewJSONHandler(output, options)), config), nil
+}
+
+// Logger of the server package, replaced through SetLogger or WithLogger
+var logger = slog.Default()
+
+// SetLogger makes a logger the one of the server and the packages it runs. As the
+// default logger it also receives the lines of config loading and of the standard log
+// package. Programs embedding the server pass WithLogger to New instead to keep
+// their own default logger.
+func SetLogger(l *slog.Logger) {
+	slog.SetDefault(l)
+	useLogger(l)
+}
+
+// useLogger makes a logger the one of the server and the packages it runs
+func useLogger(l *slog.Logger) {
+	logger = l
+	audit.SetLogger(l)
+	auth.SetLogger(l)
+	broker.SetLogger(l)
+	ipfilter.SetLogger(l)
+	metrics.SetLogger(l)
+	push.SetLogger(l)
+	redisconn.SetLogger(l)
+	webhooks.SetLogger(l)
+	websocket.SetLogger(l)
+}
+
+// setupLogging returns where the server logs go. When the log file cannot be opened, for
+// example on a read-only filesystem, logging.fallback decides between logging to stdout
+// and failing.
+func setupLogging(config *config.Config) (io.Writer, error) {
+	logging := config.Logging
+	if logging.Output == "stdout" {
+		return os.Stdout, nil
+	}
+
+	file, err := openLogOutput(config)
+	if err != nil {
+		if logging.Fallback == "fail" {
+			return nil, fmt.Errorf("Failed to open log file: %v", err)
+		}
+		logger.Warn("Failed to open log file, logging to stdout instead", "file", logging.File, "error", err)
+		return os.Stdout, nil
+	}
+
+	// External rotators signal the server to continue in a new file
+	go reopenLogOnSignal(file)
+
+	if logging.Output == "both" {
+		return io.MultiWriter(os.Stdout, file), nil
+	}
+	return file, nil
+}
+
+// logLevel maps logging.level to a slog level, info unless debug, warn or error is set
+func logLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option changes how New sets up a server
+type Option func(*options)
+
+type options struct {
+	logger     *slog.Logger
+	registerer prometheus.Registerer
+}
+
+// WithLogger makes the server and the packages it runs write to a logger. Unlike
+// SetLogger it leaves the process's default slog logger alone. Lines are redacted as
+// logging.redaction says before reaching it.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithRegisterer registers the Prometheus metrics with a registerer instead of the
+// global default one. When it is also a prometheus.Gatherer, such as a
+// *prometheus.Registry, the admin /metrics route serves its metrics.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = registerer
+	}
+}
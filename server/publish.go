@@ -0,0 +1,244 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/hub"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/tracing"
+	"github.com/sahakavatar/gopush/websocket"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Largest request body the publish API reads, unless server.limits.max_payload_size allows more
+const maxPublishBody = 1 << 20
+
+// Headers of a signed publish request
+const (
+	timestampHeader = "X-Timestamp" // Unix time in seconds the request was signed at
+	signatureHeader = "X-Signature" // hex(HMAC-SHA256(secret, "timestamp.body"))
+)
+
+// Prefix of the keys recording the signatures already used, so a request cannot be
+// replayed while its timestamp is still accepted
+const usedSignaturePrefix = "gopush:signatures:"
+
+// publishRequest is the body of a REST publish
+type publishRequest struct {
+	Channel    string          `json:"channel"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	MessageID  string          `json:"message_id"`  // Kept when set, generated otherwise
+	Priority   string          `json:"priority"`    // Push notification priority, high or normal
+	CollapseID string          `json:"collapse_id"` // Push notifications with the same ID replace each other
+}
+
+// publishResult answers a publish the broker accepted
+type publishResult struct {
+	Status    string `json:"status"`
+	Channel   string `json:"channel"`
+	MessageID string `json:"message_id"`
+}
+
+// handlePublish serves server.publish_api.url, through which backends publish to a
+// channel without opening a WebSocket. Messages go through the same broker as the send
+// action and reach subscribers in the same format.
+func handlePublish(rdb redis.UniversalClient, config *config.Config) http.HandlerFunc {
+	settings := config.Server.PublishAPI
+	maxSkew := time.Duration(settings.MaxSkew) * time.Second
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		bodyLimit := int64(maxPublishBody)
+		if limit := int64(websocket.MaxPayloadSize()); limit > bodyLimit {
+			bodyLimit = limit
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, bodyLimit))
+		if err != nil {
+			writePublishError(w, http.StatusRequestEntityTooLarge, websocket.ErrMessageTooLarge, fmt.Sprintf("Request body exceeds the %d byte limit", bodyLimit))
+			return
+		}
+
+		// Requests carrying an app key are signed with the app's secret and publish in its namespace
+		appKey := r.Header.Get("X-App-Key")
+		key, secret := publishCredentials()
+		app, reason := authorizePublish(r, rdb, body, appKey, key, secret, maxSkew, config)
+		if reason != "" {
+			logger.Warn("Rejected publish request", "remote_addr", r.RemoteAddr, "app_key", appKey, "reason", reason)
+			writePublishError(w, http.StatusUnauthorized, websocket.ErrUnauthorized, "Missing or invalid API key or signature")
+			auditPublish(r, appKey, "", audit.OutcomeDenied, reason)
+			return
+		}
+
+		var request publishRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			writePublishError(w, http.StatusBadRequest, websocket.ErrInvalidMessage, "Invalid JSON body")
+			return
+		}
+		if request.Channel == "" {
+			writePublishError(w, http.StatusBadRequest, websocket.ErrChannelMissing, "Channel not specified")
+			return
+		}
+		redisChannel := app.Namespace + request.Channel
+		if redisChannel == websocket.BroadcastChannel {
+			writePublishError(w, http.StatusForbidden, websocket.ErrForbidden, "Use the admin broadcast endpoint to reach every client")
+			auditPublish(r, appKey, request.Channel, audit.OutcomeDenied, "reserved channel")
+			return
+		}
+
+		// Subscribers receive the same fields as for the send action, the payload as message
+		message, messageID, err := hub.Message{
+			Channel:    request.Channel,
+			Event:      request.Event,
+			Payload:    request.Payload,
+			MessageID:  request.MessageID,
+			Priority:   request.Priority,
+			CollapseID: request.CollapseID,
+		}.Encode()
+		if err != nil {
+			writePublishError(w, http.StatusBadRequest, websocket.ErrInvalidMessage, "Invalid payload")
+			return
+		}
+
+		if websocket.PayloadTooLarge(message) {
+			writePublishError(w, http.StatusRequestEntityTooLarge, websocket.ErrMessageTooLarge, websocket.MessageTooLarge(len(message), websocket.MaxPayloadSize()))
+			return
+		}
+		if appKey != "" && !apps.AllowPublish(appKey, app) {
+			writePublishError(w, http.StatusTooManyRequests, websocket.ErrQuotaExceeded, "App publish quota exceeded")
+			auditPublish(r, appKey, request.Channel, audit.OutcomeDenied, "app publish quota exceeded")
+			return
+		}
+
+		ctx, cancel := redisconn.WithPublishTimeout(tracing.Extract(r.Context(), r.Header))
+		err = websocket.Publish(ctx, redisChannel, message)
+		cancel()
+		if redisconn.IsTimeout(err) {
+			logger.Error("Timed out publishing message", "action", "publish_api", "channel", redisChannel, "remote_addr", r.RemoteAddr, "error", err)
+			writePublishError(w, http.StatusGatewayTimeout, websocket.ErrTimeout, "Publishing timed out, try again later")
+			auditPublish(r, appKey, request.Channel, audit.OutcomeError, err.Error())
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to publish message", "action", "publish_api", "channel", redisChannel, "remote_addr", r.RemoteAddr, "error", err)
+			writePublishError(w, http.StatusBadGateway, websocket.ErrPublishFailed, "Failed to publish message")
+			auditPublish(r, appKey, request.Channel, audit.OutcomeError, err.Error())
+			return
+		}
+
+		logger.Debug("Published message", "action", "publish_api", "channel", redisChannel, "message_id", messageID, "remote_addr", r.RemoteAddr)
+		auditPublish(r, appKey, request.Channel, audit.OutcomeAllowed, "")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(publishResult{Status: "accepted", Channel: request.Channel, MessageID: messageID})
+	}
+}
+
+// authorizePublish checks the credentials of a publish request and returns the app it
+// publishes for, or why it was refused. App requests must be signed with the app's
+// secret; other requests carry the API key as a bearer token or are signed with the
+// server secret.
+func authorizePublish(r *http.Request, rdb redis.UniversalClient, body []byte, appKey, key, secret string, maxSkew time.Duration, config *config.Config) (app config.App, reason string) {
+	if appKey != "" {
+		app, ok := apps.Lookup(config, appKey)
+		if !ok {
+			return app, "unknown app key"
+		}
+		if app.Secret == "" {
+			return app, "app has no secret"
+		}
+		if err := verifyPublishSignature(r, rdb, body, app.Secret, maxSkew); err != nil {
+			return app, err.Error()
+		}
+		return app, ""
+	}
+
+	if given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && key != "" {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) != 1 {
+			return app, "invalid API key"
+		}
+		return app, ""
+	}
+	if secret == "" {
+		return app, "no API key or signature"
+	}
+	if err := verifyPublishSignature(r, rdb, body, secret, maxSkew); err != nil {
+		return app, err.Error()
+	}
+	return app, ""
+}
+
+// verifyPublishSignature checks the signature headers of a request. The timestamp must
+// be within maxSkew of the server clock, so a captured request cannot be replayed later,
+// and each signature is recorded in Redis for as long as its timestamp is accepted, so
+// it cannot be replayed within that window either.
+func verifyPublishSignature(r *http.Request, rdb redis.UniversalClient, body []byte, secret string, maxSkew time.Duration) error {
+	timestamp, signature := r.Header.Get(timestampHeader), r.Header.Get(signatureHeader)
+	if timestamp == "" || signature == "" {
+		return errors.New("no API key or signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed timestamp")
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > maxSkew || skew < -maxSkew {
+		return errors.New("timestamp outside the allowed skew")
+	}
+	if !auth.VerifyRequestSignature(secret, timestamp, body, signature) {
+		return errors.New("invalid signature")
+	}
+
+	// The timestamp is accepted from maxSkew before until maxSkew after it
+	ctx, cancel := redisconn.WithTimeout(r.Context())
+	defer cancel()
+	fresh, err := rdb.SetNX(ctx, usedSignaturePrefix+signature, 1, 2*maxSkew+time.Second).Result()
+	if err != nil {
+		return fmt.Errorf("failed to record signature: %v", err)
+	}
+	if !fresh {
+		return errors.New("signature already used")
+	}
+	return nil
+}
+
+// writePublishError answers a failed publish with the error format of the WebSocket API
+func writePublishError(w http.ResponseWriter, status int, code websocket.ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(websocket.ErrorMessage{
+		Status:  "error",
+		Event:   "error",
+		Code:    code,
+		Message: message,
+		Action:  "publish",
+	})
+}
+
+// auditPublish records a publish made through the REST API
+func auditPublish(r *http.Request, appKey, channel, outcome, reason string) {
+	audit.Record(audit.Event{
+		Action:     audit.ActionPublish,
+		Outcome:    outcome,
+		RemoteAddr: r.RemoteAddr,
+		App:        appKey,
+		Channel:    channel,
+		Reason:     reason,
+	})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sahakavatar/gopush/config"
+	"log/slog"
+)
+
+// Characters of a token kept by the truncate redaction
+const truncatedTokenLength = 6
+
+// redactor returns the ReplaceAttr function of the log handler. It applies
+// logging.redaction to every line, whichever package wrote it: tokens are logged as a
+// digest or a prefix, and payloads and response bodies only by size.
+func redactor(config *config.Config) func(groups []string, attr slog.Attr) slog.Attr {
+	redaction := config.Logging.Redaction
+	return func(groups []string, attr slog.Attr) slog.Attr {
+		switch attr.Key {
+		case "token":
+			attr.Value = slog.StringValue(redactToken(attr.Value.String(), redaction.Tokens))
+		case "payload", "body":
+			attr.Value = redactPayload(attr.Value, redaction.Payloads)
+		}
+		return attr
+	}
+}
+
+// redactingHandler applies a redactor to every attribute before passing lines on to
+// another handler. It wraps the handlers of NewLogger as well as loggers handed to New,
+// which the server did not create and cannot give a ReplaceAttr function.
+type redactingHandler struct {
+	next    slog.Handler
+	replace func(groups []string, attr slog.Attr) slog.Attr
+	groups  []string
+}
+
+// redacting returns a logger writing through a handler that redacts as the config says.
+// Loggers that already redact are returned as they are.
+func redacting(l *slog.Logger, config *config.Config) *slog.Logger {
+	if _, ok := l.Handler().(*redactingHandler); ok {
+		return l
+	}
+	return slog.New(&redactingHandler{next: l.Handler(), replace: redactor(config)})
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redact(h.groups, attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redact(h.groups, attr)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted), replace: h.replace, groups: h.groups}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	groups := append(append([]string(nil), h.groups...), name)
+	return &redactingHandler{next: h.next.WithGroup(name), replace: h.replace, groups: groups}
+}
+
+// redact applies the redactor to an attribute, or to the members of a group
+func (h *redactingHandler) redact(groups []string, attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() != slog.KindGroup {
+		return h.replace(groups, attr)
+	}
+
+	members := attr.Value.Group()
+	redacted := make([]slog.Attr, len(members))
+	for i, member := range members {
+		redacted[i] = h.redact(append(groups[:len(groups):len(groups)], attr.Key), member)
+	}
+	return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redacted...)}
+}
+
+// redactToken hides a token while keeping lines about the same token recognizable
+func redactToken(token, mode string) string {
+	if token == "" {
+		return ""
+	}
+	switch mode {
+	case "none":
+		return token
+	case "truncate":
+		if len(token) <= truncatedTokenLength {
+			return "..."
+		}
+		return token[:truncatedTokenLength] + "..."
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// redactPayload replaces a payload with its size unless payload logging is enabled, in
+// which case byte payloads are logged as text
+func redactPayload(value slog.Value, enabled bool) slog.Value {
+	var text string
+	switch payload := value.Any().(type) {
+	case []byte:
+		text = string(payload)
+	case string:
+		text = payload
+	default:
+		return value
+	}
+
+	if enabled {
+		return slog.StringValue(text)
+	}
+	return slog.StringValue(fmt.Sprintf("[%d bytes redacted]", len(text)))
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+func TestRedactToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		mode  string
+		want  string
+	}{
+		{"empty token", "", "hash", ""},
+		{"hash", "secret-token", "hash", "sha256:930bbdc51b6aed5c"},
+		{"hash by default", "secret-token", "", "sha256:930bbdc51b6aed5c"},
+		{"unknown mode hashes", "secret-token", "bogus", "sha256:930bbdc51b6aed5c"},
+		{"truncate", "secret-token", "truncate", "secret..."},
+		{"truncate a short token", "abc", "truncate", "..."},
+		{"truncate a token of the kept length", "abcdef", "truncate", "..."},
+		{"none", "secret-token", "none", "secret-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactToken(tt.token, tt.mode); got != tt.want {
+				t.Errorf("redactToken(%q, %q) = %q, want %q", tt.token, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   slog.Value
+		enabled bool
+		want    string
+	}{
+		{"bytes redacted", slog.AnyValue([]byte(`{"a":1}`)), false, "[7 bytes redacted]"},
+		{"string redacted", slog.StringValue("hello"), false, "[5 bytes redacted]"},
+		{"bytes logged as text", slog.AnyValue([]byte(`{"a":1}`)), true, `{"a":1}`},
+		{"other values kept", slog.IntValue(42), false, "42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactPayload(tt.value, tt.enabled).String(); got != tt.want {
+				t.Errorf("redactPayload = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactingHandler(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logging.Redaction.Tokens = "hash"
+
+	var out bytes.Buffer
+	logger := redacting(slog.New(slog.NewTextHandler(&out, nil)), cfg)
+	logger.With("token", "secret-token").WithGroup("request").Info("Validating token", "token", "secret-token", "payload", "hello")
+
+	line := out.String()
+	if strings.Contains(line, "secret-token") {
+		t.Errorf("token logged in clear: %s", line)
+	}
+	for _, want := range []string{"token=sha256:930bbdc51b6aed5c", "request.token=sha256:930bbdc51b6aed5c", `request.payload="[5 bytes redacted]"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("line %q does not contain %q", line, want)
+		}
+	}
+
+	if redacting(logger, cfg) != logger {
+		t.Error("a redacting logger was wrapped again")
+	}
+}
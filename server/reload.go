@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Settings Reload applies to the running server, as prefixes of their config paths
+var reloadable = []string{
+	"logging.level",
+	"server.limits.",
+	"server.cors.",
+	"server.ip_filter.",
+	"server.trusted_proxies",
+	"server.admin.token",
+	"server.publish_api.key",
+	"server.publish_api.secret",
+	"redis.nodes",
+}
+
+// restartRequired returns the paths of the settings that differ between two configs
+// and only take effect on restart, without their values, which may be secrets
+func restartRequired(running, reloaded *config.Config) []string {
+	before, after := flatten(running), flatten(reloaded)
+
+	var changed []string
+	for path, value := range after {
+		if !reflect.DeepEqual(before[path], value) && !isReloadable(path) {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok && !isReloadable(path) {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func isReloadable(path string) bool {
+	for _, prefix := range reloadable {
+		if path == strings.TrimSuffix(prefix, ".") || strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten maps the JSON paths of a config's settings to their values. Lists are
+// compared as a whole.
+func flatten(cfg *config.Config) map[string]interface{} {
+	encoded, _ := json.Marshal(cfg)
+	var tree map[string]interface{}
+	json.Unmarshal(encoded, &tree)
+
+	flat := make(map[string]interface{})
+	var walk func(prefix string, value interface{})
+	walk = func(prefix string, value interface{}) {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			flat[prefix] = value
+			return
+		}
+		for key, child := range object {
+			walk(prefix+"."+key, child)
+		}
+	}
+	for key, value := range tree {
+		walk(key, value)
+	}
+	return flat
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables through which a restarting server hands its listeners to the new
+// process: the names of the listeners in the order of their descriptors, which start at 3,
+// and the descriptor of the pipe on which the new process reports that it is ready
+const (
+	envInheritedListeners = "GOPUSH_LISTENERS"
+	envReadyFD            = "GOPUSH_READY_FD"
+)
+
+// Time the new process gets to start up before the restart is abandoned
+const restartReadyTimeout = time.Minute
+
+var listenersMu sync.Mutex
+
+// Listeners handed over by the previous process that were not opened again yet
+var inherited = make(map[string]net.Listener)
+
+// Listeners of this process by name, such as "tcp:0.0.0.0:6001" or "unix:/run/gopush.sock",
+// and the servers running on them
+var active = make(map[string]net.Listener)
+var servers []*http.Server
+
+// Pipe to the previous process, nil when this process was not started by a restart
+var readyPipe *os.File
+
+// Whether the listeners were handed to a new process and closed here
+var handedOver bool
+
+// Errors of the servers, which stop ListenAndServe
+var failures = make(chan error, 1)
+
+// InheritListeners picks up the listeners of the previous process when this one was
+// started by a restart, so it accepts on the same sockets without a gap. It must run
+// before ListenAndServe.
+func InheritListeners() error {
+	names := os.Getenv(envInheritedListeners)
+	fd := os.Getenv(envReadyFD)
+	os.Unsetenv(envInheritedListeners)
+	os.Unsetenv(envReadyFD)
+	if fd == "" {
+		return nil
+	}
+
+	readyFD, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("invalid %s '%s': %v", envReadyFD, fd, err)
+	}
+	readyPipe = os.NewFile(uintptr(readyFD), "ready")
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	for i, name := range strings.Split(names, ",") {
+		if name == "" {
+			continue
+		}
+		file := os.NewFile(uintptr(3+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to inherit listener '%s': %v", name, err)
+		}
+		inherited[name] = listener
+	}
+	logger.Info("Inherited listeners from the previous process", "listeners", len(inherited))
+	return nil
+}
+
+// openListener returns the listener of that name handed over by the previous process, or
+// opens it, and keeps it for the next restart
+func openListener(name string, open func() (net.Listener, error)) (net.Listener, error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	listener, ok := inherited[name]
+	if ok {
+		delete(inherited, name)
+	} else {
+		var err error
+		if listener, err = open(); err != nil {
+			return nil, err
+		}
+	}
+	active[name] = listener
+	return listener, nil
+}
+
+// serve runs an HTTP server until it fails, or until it is shut down after a restart
+func serve(what string, server *http.Server, run func() error) {
+	listenersMu.Lock()
+	servers = append(servers, server)
+	listenersMu.Unlock()
+
+	err := run()
+	listenersMu.Lock()
+	stopped := handedOver
+	listenersMu.Unlock()
+	if !stopped && !errors.Is(err, http.ErrServerClosed) {
+		fail(fmt.Errorf("%s stopped: %v", what, err))
+	}
+}
+
+// fail reports the error of a server to ListenAndServe, keeping the first one
+func fail(err error) {
+	select {
+	case failures <- err:
+	default:
+	}
+}
+
+// notifyReady tells the previous process that this one accepts connections, so it can
+// stop its servers and drain its clients. Listeners it handed over that the config no
+// longer uses are closed.
+func notifyReady() {
+	listenersMu.Lock()
+	for name, listener := range inherited {
+		logger.Info("Closing inherited listener that is no longer configured", "listener", name)
+		listener.Close()
+	}
+	inherited = make(map[string]net.Listener)
+	listenersMu.Unlock()
+
+	if readyPipe == nil {
+		return
+	}
+	if _, err := readyPipe.WriteString("ready\n"); err != nil {
+		logger.Error("Failed to notify the previous process", "error", err)
+	}
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// restart starts a new process from the current executable with the same arguments and
+// hands it the listeners. It returns once the new process reports ready; on error this
+// process keeps serving.
+func restart() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %v", err)
+	}
+
+	listenersMu.Lock()
+	names := make([]string, 0, len(active))
+	for name := range active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*os.File, 0, len(names))
+	var fileErr error
+	for _, name := range names {
+		listener, ok := active[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			fileErr = fmt.Errorf("listener '%s' cannot be handed over", name)
+			break
+		}
+		file, err := listener.File()
+		if err != nil {
+			fileErr = fmt.Errorf("failed to hand over listener '%s': %v", name, err)
+			break
+		}
+		files = append(files, file)
+	}
+	listenersMu.Unlock()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if fileErr != nil {
+		return fileErr
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create the ready pipe: %v", err)
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		envInheritedListeners+"="+strings.Join(names, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start the new process: %v", err)
+	}
+	logger.Info("Started the new process", "pid", cmd.Process.Pid, "listeners", len(names))
+
+	// Reap the new process if it exits before this one
+	go cmd.Wait()
+
+	ready.SetReadDeadline(time.Now().Add(restartReadyTimeout))
+	if _, err := bufio.NewReader(ready).ReadString('\n'); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("the new process did not become ready: %v", err)
+	}
+	return nil
+}
+
+// stopServers stops accepting connections after the listeners were handed over and shuts
+// the servers down. Unix socket files are left in place for the new process.
+func stopServers() {
+	listenersMu.Lock()
+	handedOver = true
+	for _, listener := range active {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+		listener.Close()
+	}
+	stopping := servers
+	listenersMu.Unlock()
+
+	// A server drops requests it reads once it is shutting down, so connections accepted
+	// right before the listeners closed get a moment to send theirs first
+	time.Sleep(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range stopping {
+		server.Shutdown(ctx)
+	}
+}
+
+// shutdownServers stops the servers and closes their listeners
+func shutdownServers(ctx context.Context) {
+	listenersMu.Lock()
+	stopping := servers
+	servers = nil
+	listenersMu.Unlock()
+
+	for _, server := range stopping {
+		server.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// reusePort reports that this platform does not balance connections over processes
+// sharing a port. SO_REUSEPORT is only used on Linux, where the kernel does.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return fmt.Errorf("server.reuse_port is not supported on %s", runtime.GOOS)
+}
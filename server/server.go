@@ -0,0 +1,489 @@
+// Package server runs gopush: the WebSocket endpoint, the REST and admin APIs, the
+// protocol bridges and the listeners of the config. Programs embedding it either mount
+// Handler on their own HTTP server or have ListenAndServe open the configured listeners.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	gws "github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/cors"
+	"github.com/sahakavatar/gopush/graphql"
+	"github.com/sahakavatar/gopush/hub"
+	"github.com/sahakavatar/gopush/ipfilter"
+	"github.com/sahakavatar/gopush/metrics"
+	"github.com/sahakavatar/gopush/mqtt"
+	"github.com/sahakavatar/gopush/push"
+	"github.com/sahakavatar/gopush/pusher"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/socketio"
+	"github.com/sahakavatar/gopush/tracing"
+	"github.com/sahakavatar/gopush/webhooks"
+	"github.com/sahakavatar/gopush/websocket"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Server is a gopush server set up from a config. The packages it is made of keep their
+// state globally, so a process runs one Server.
+type Server struct {
+	config  *config.Config
+	rdbs    []redis.UniversalClient
+	broker  broker.Broker
+	hub     *hub.Hub
+	handler http.Handler
+
+	flushTraces  func(context.Context) error
+	flushReports func(context.Context) error
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var createdMu sync.Mutex
+var created bool
+
+// ErrServerExists is returned by New when the process already set up a server. The
+// connections, subscriptions and settings of a server live in package state shared by the
+// whole process, so a second server would take over the first one's.
+var ErrServerExists = errors.New("gopush: the process already has a server, New can only be called once")
+
+// New sets up a server from a config: it configures authentication, connects to Redis
+// and the message broker and builds the routes, but does not listen yet. It fails when
+// the process already has a server, or already tried to set one up: the packages keep
+// what New configured before a failure, so it is not retried.
+func New(config *config.Config, opts ...Option) (*Server, error) {
+	createdMu.Lock()
+	defer createdMu.Unlock()
+	if created {
+		return nil, ErrServerExists
+	}
+	created = true
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.logger == nil {
+		// The default logger as the program set it up, possibly through SetLogger
+		o.logger = slog.Default()
+	}
+	// Loggers the program brings do not know logging.redaction, so tokens and payloads
+	// are redacted before they reach them
+	useLogger(redacting(o.logger, config))
+
+	// Verify JWTs locally when a JWKS endpoint is configured
+	if jwtConfig := config.Server.Authorize.JWT; jwtConfig.JwksUrl != "" {
+		if err := auth.ConfigureJWT(jwtConfig.JwksUrl, jwtConfig.Audience, jwtConfig.Issuer, jwtConfig.RolesClaim); err != nil {
+			return nil, fmt.Errorf("failed to configure JWT validation: %v", err)
+		}
+	}
+
+	// Validate opaque tokens against an OAuth2 introspection endpoint instead of the authorize URL
+	if introspection := config.Server.Authorize.Introspection; introspection.Url != "" {
+		auth.ConfigureIntrospection(introspection.Url, introspection.ClientID, introspection.ClientSecret)
+	}
+
+	// Answer hot tokens from memory instead of Redis
+	if cache := config.Server.Authorize.CacheTTL; cache.L1Size > 0 {
+		auth.ConfigureL1Cache(cache.L1Size, time.Duration(cache.L1TTL)*time.Second)
+	}
+
+	// Ride out short blips of the authorize API
+	if retry := config.Server.Authorize.Retry; retry.Attempts > 0 {
+		auth.ConfigureRetries(retry.Attempts, time.Duration(retry.BaseDelay)*time.Millisecond, time.Duration(retry.MaxDelay)*time.Millisecond)
+	}
+
+	// Stop waiting on the authorize API while it is failing
+	if breaker := config.Server.Authorize.CircuitBreaker; breaker.FailureThreshold > 0 {
+		auth.ConfigureBreaker(breaker.FailureThreshold, time.Duration(breaker.OpenDuration)*time.Second, breaker.HalfOpenProbes,
+			breaker.Fallback, time.Duration(breaker.StaleTTL)*time.Second)
+	}
+
+	// Shape authorize API calls to fit the existing auth service
+	webhook := config.Server.Authorize.Webhook
+	if err := auth.ConfigureAuthorizeRequest(webhook.Method, webhook.BodyTemplate, webhook.ForwardHeaders); err != nil {
+		return nil, fmt.Errorf("failed to configure authorize requests: %v", err)
+	}
+
+	s := &Server{config: config, hub: hub.New(), done: make(chan struct{})}
+
+	// Export spans over OTLP when tracing is enabled
+	var err error
+	if s.flushTraces, err = tracing.Configure(config); err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %v", err)
+	}
+
+	// Report panics and errors to Sentry when a DSN is set
+	if s.flushReports, err = reporting.Configure(config); err != nil {
+		return nil, fmt.Errorf("failed to set up error reporting: %v", err)
+	}
+
+	// Connect to the standalone Redis nodes, or to the Redis Cluster when configured
+	if s.rdbs, err = redisconn.Connect(config); err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+
+	// Count subscribers and traffic per channel when metrics are enabled
+	if err := metrics.Configure(config, o.registerer); err != nil {
+		return nil, fmt.Errorf("failed to set up metrics: %v", err)
+	}
+
+	// Audit events go to their own file or Redis stream, apart from the operational log
+	if config.Audit.Enabled {
+		sink, err := openAuditSink(config, s.rdbs[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the audit log: %v", err)
+		}
+		audit.SetSink(sink)
+	}
+
+	// Tell the application backend about connections and subscriptions, off the socket path
+	webhooks.Configure(config)
+
+	// Systems without a WebSocket receive the messages of the channels they subscribed to
+	webhooks.ConfigureSubscribers(s.rdbs[0], config)
+
+	// Users without an open socket get the messages of their channel on their devices
+	if err := push.Configure(s.rdbs[0], config); err != nil {
+		return nil, fmt.Errorf("failed to set up push notifications: %v", err)
+	}
+
+	websocket.SetLimits(config)
+	websocket.SetCompressionThreshold(config.Server.Compression.MinSize)
+	websocket.SetSlowClientLimits(config)
+
+	if err := ipfilter.Configure(config); err != nil {
+		return nil, fmt.Errorf("invalid IP filter configuration: %v", err)
+	}
+	cors.Configure(config)
+	setCredentials(config)
+
+	// Channels travel between servers through the configured message broker
+	if s.broker, err = broker.New(config); err != nil {
+		return nil, fmt.Errorf("failed to set up the message broker: %v", err)
+	}
+	websocket.SetBroker(s.broker)
+
+	// Announcements from the admin API reach every client, whatever it subscribed to
+	if err := websocket.ListenForBroadcasts(); err != nil {
+		return nil, fmt.Errorf("failed to listen for broadcasts: %v", err)
+	}
+
+	// Webhook subscribers and push notifications also get the messages published to the broker directly
+	if err := websocket.ListenForDispatch(s.rdbs[0]); err != nil {
+		return nil, err
+	}
+
+	// Take failing Redis nodes out of rotation until they recover
+	go redisconn.MonitorHealth(config)
+
+	// Drop revoked tokens and their connections as soon as the application announces them
+	if config.Server.Authorize.RevocationChannel != "" {
+		go websocket.WatchRevocations(s.rdbs[0], config)
+	}
+
+	s.handler = s.routes()
+	return s, nil
+}
+
+// routes returns the handler of the public listeners
+func (s *Server) routes() http.Handler {
+	config := s.config
+
+	// The public listener has its own mux so the debug handlers that net/http/pprof and
+	// expvar register on the default one are never exposed on it
+	mux := http.NewServeMux()
+
+	if config.Server.HealthCheckUrl != "" {
+		mux.HandleFunc(config.Server.HealthCheckUrl, handleHealth)
+
+		// Probe the authorize APIs in the background so health checks stay cheap
+		if urls := apps.AuthorizeURLs(config); len(urls) > 0 {
+			go auth.MonitorHealth(urls, redisconn.HealthInterval(config))
+		}
+	}
+
+	// Orchestrators restart the server when liveness fails and route new connections to
+	// it only while it is ready
+	if config.Server.LivenessUrl != "" {
+		mux.HandleFunc(config.Server.LivenessUrl, handleLiveness)
+	}
+	if config.Server.ReadinessUrl != "" {
+		mux.HandleFunc(config.Server.ReadinessUrl, handleReadiness)
+	}
+
+	// Tells which build runs on this node and what its config turns on
+	if config.Server.VersionUrl != "" {
+		mux.HandleFunc(config.Server.VersionUrl, handleVersion(config))
+	}
+
+	// Backends publish over HTTP without opening a WebSocket or talking to the broker
+	if config.Server.PublishAPI.Url != "" {
+		mux.HandleFunc(config.Server.PublishAPI.Url, handlePublish(s.rdbs[0], config))
+	}
+
+	// Browsers register their push subscriptions to be notified while no tab is connected
+	if push.VAPIDPublicKey() != "" {
+		webPushPath := config.Push.WebPush.Path
+		if webPushPath == "" {
+			webPushPath = defaultWebPushPath
+		}
+		mux.HandleFunc(webPushPath, handlePushSubscriptions(s.rdbs[0], config))
+	}
+
+	// Frontends written against socket.io-client connect without being rewritten first
+	if config.Server.SocketIO.Path != "" {
+		mux.HandleFunc(config.Server.SocketIO.Path, ipfilter.Connections(socketio.Handler(s.broker, s.rdbs[0], config, &gws.Upgrader{
+			CheckOrigin:      websocket.CheckOrigin(config),
+			HandshakeTimeout: handshakeTimeout(config),
+		})))
+	}
+
+	// pusher-js and Laravel Echo clients only need their host pointed at the server
+	if config.Server.Pusher.Enabled {
+		mux.HandleFunc(pusher.Path, ipfilter.Connections(pusher.Handler(s.broker, s.rdbs[0], config, &gws.Upgrader{
+			CheckOrigin:      websocket.CheckOrigin(config),
+			HandshakeTimeout: handshakeTimeout(config),
+		})))
+	}
+
+	// GraphQL-first frontends subscribe to channels through graphql-ws without a gateway
+	if config.Server.GraphQL.Path != "" {
+		mux.HandleFunc(config.Server.GraphQL.Path, ipfilter.Connections(graphql.Handler(s.broker, s.rdbs[0], config, &gws.Upgrader{
+			CheckOrigin:      websocket.CheckOrigin(config),
+			HandshakeTimeout: handshakeTimeout(config),
+		})))
+	}
+
+	// WebSocket server setup, blocked addresses are refused before the upgrade
+	mux.HandleFunc(config.Server.WsUrl, ipfilter.Connections(s.handleUpgrade))
+
+	// Browsers may call the HTTP endpoints from the origins in server.cors, and requests
+	// relayed by server.trusted_proxies carry the address of the client
+	return ipfilter.RealIP(cors.Handler(mux.ServeHTTP))
+}
+
+// Handler returns the handler of the public listeners: the WebSocket endpoint and every
+// HTTP endpoint the config enables. Programs serving it on their own listener call Ready
+// once they accept connections.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// AdminHandler returns the handler of the admin listener, with the debug endpoints, the
+// admin API and the Prometheus metrics the config enables. It must not be exposed on a
+// public listener.
+func (s *Server) AdminHandler() http.Handler {
+	return adminHandler(s.config)
+}
+
+// Hub returns the connections of this server, through which the embedding program
+// publishes, broadcasts and disconnects clients
+func (s *Server) Hub() *hub.Hub {
+	return s.hub
+}
+
+// ListenAndServe opens the listeners of the config: the public ones, the admin listener,
+// the ACME challenge listener and the MQTT listener. It reports the server ready and
+// blocks until a listener fails or Shutdown stops them, returning http.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	config := s.config
+
+	// Check if TLS is enabled (wss://)
+	var tlsConfig *tls.Config
+	certFile := config.Server.TLS.CertFile
+	keyFile := config.Server.TLS.KeyFile
+	if config.Server.TLS.Enabled {
+		var err error
+		tlsConfig, err = newTLSConfig(config.Server.TLS)
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %v", err)
+		}
+
+		if config.Server.TLS.Autocert.Enabled {
+			// Certificates come from the ACME CA instead of files
+			manager := newCertManager(config.Server.TLS, tlsConfig)
+			certFile, keyFile = "", ""
+
+			// Processes sharing the port also share the challenge listener, and answer
+			// challenges of each other through the cache directory
+			challengeAddress := config.Server.TLS.Autocert.HTTPAddress
+			challengeListener, err := listenTCP(challengeAddress, config.Server.ReusePort)
+			if err != nil {
+				return fmt.Errorf("failed to start the ACME challenge listener: %v", err)
+			}
+			logger.Info("ACME challenge listener started", "url", "http://"+challengeAddress, "domains", config.Server.TLS.Autocert.Domains)
+			challengeServer := newHTTPServer(config, challengeAddress, manager.HTTPHandler(nil))
+			go serve("ACME challenge listener", challengeServer, func() error {
+				return challengeServer.Serve(challengeListener)
+			})
+		} else {
+			// Ensure cert and key files exist for TLS
+			if _, err := os.Stat(certFile); os.IsNotExist(err) {
+				return fmt.Errorf("TLS cert file not found: %v", err)
+			}
+			if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+				return fmt.Errorf("TLS key file not found: %v", err)
+			}
+		}
+	}
+
+	if config.Server.Admin.Address != "" {
+		if err := serveAdmin(config); err != nil {
+			return err
+		}
+	}
+
+	// Every listener serves the same routes, so clients can use wss:// while internal
+	// callers reach the health check and REST endpoints over ws://
+	for _, spec := range config.PublicListeners() {
+		listener, err := listen(spec, config.Server.UnixSocket.Mode, config.Server.ReusePort)
+		if err != nil {
+			return fmt.Errorf("failed to start the WebSocket server: %v", err)
+		}
+		if spec.ProxyProtocol {
+			listener = proxyProtocol(listener, len(config.Server.TrustedProxies) == 0, readHeaderTimeout(config))
+		}
+		server := newHTTPServer(config, listener.Addr().String(), s.handler)
+
+		if spec.TLS {
+			// Start a secure WebSocket server (wss://)
+			server.TLSConfig = tlsConfig
+			logger.Info("WebSocket server started", "url", listenerURL("wss", listener))
+			go serve("WebSocket server", server, func() error {
+				return server.ServeTLS(listener, certFile, keyFile)
+			})
+		} else {
+			// Start a non-secure WebSocket server (ws://)
+			logger.Info("WebSocket server started", "url", listenerURL("ws", listener))
+			go serve("WebSocket server", server, func() error {
+				return server.Serve(listener)
+			})
+		}
+	}
+
+	// IoT devices publish and subscribe over MQTT to the same channels
+	if config.MQTT.Address != "" {
+		listener, err := listenTCP(config.MQTT.Address, config.Server.ReusePort)
+		if err != nil {
+			return fmt.Errorf("failed to start the MQTT listener: %v", err)
+		}
+		scheme := "mqtt"
+		if config.MQTT.TLS {
+			mqttConfig, err := mqttTLSConfig(tlsConfig, certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to configure TLS of the MQTT listener: %v", err)
+			}
+			listener = tls.NewListener(listener, mqttConfig)
+			scheme = "mqtts"
+		}
+		logger.Info("MQTT listener started", "url", scheme+"://"+config.MQTT.Address)
+		go func() {
+			if err := mqtt.Serve(listener, s.broker, s.rdbs[0], config); err != nil {
+				fail(fmt.Errorf("MQTT listener stopped: %v", err))
+			}
+		}()
+	}
+
+	s.Ready()
+	notifyReady()
+
+	select {
+	case err := <-failures:
+		return err
+	case <-s.done:
+		return http.ErrServerClosed
+	}
+}
+
+// Ready reports the server ready on the readiness endpoint. ListenAndServe does so once
+// its listeners are open.
+func (s *Server) Ready() {
+	setReadiness(stateReady)
+}
+
+// Drain reports the server not ready for good, so load balancers stop sending it new
+// connections while the open ones keep working
+func (s *Server) Drain() {
+	setReadiness(stateDraining)
+}
+
+// Reload applies a reloaded config. The log level, server.limits, CORS, the IP filters
+// and trusted proxies take effect at once, and channels move between the standalone Redis
+// nodes it lists. Other changed settings are logged as needing a restart. The readiness
+// endpoint reports reloading meanwhile.
+func (s *Server) Reload(config *config.Config) error {
+	swapReadiness(stateReady, stateReloading)
+	defer swapReadiness(stateReloading, stateReady)
+
+	if err := ipfilter.Configure(config); err != nil {
+		return fmt.Errorf("invalid IP filter configuration: %v", err)
+	}
+	level.Set(logLevel(config.Logging.Level))
+	websocket.SetLimits(config)
+	cors.Configure(config)
+	setCredentials(config)
+
+	if len(s.config.Redis.Nodes) > 0 {
+		if err := redisconn.Rebalance(config); err != nil {
+			return fmt.Errorf("failed to rebalance Redis nodes: %v", err)
+		}
+	}
+
+	changed := restartRequired(s.config, config)
+	if s.config.Server.Admin.Token == "" && config.Server.Admin.Token != "" {
+		// The admin API routes are only registered when it starts with a token
+		changed = append(changed, "server.admin.token")
+	}
+	if len(changed) > 0 {
+		logger.Warn("Changed settings take effect on restart", "keys", changed)
+	}
+	return nil
+}
+
+// Restart starts a new process from the current executable and hands it the listeners.
+// Once it is ready, this server stops accepting and closes its WebSocket connections,
+// spread over drain so the clients don't reconnect all at once. On error this server
+// keeps serving.
+func (s *Server) Restart(drain time.Duration) error {
+	if err := restart(); err != nil {
+		return err
+	}
+	setReadiness(stateDraining)
+	stopServers()
+	logger.Info("Handed the listeners to the new process, closing connections", "duration", drain)
+	closed := websocket.DrainConnections(drain)
+	logger.Info("Closed connections for the restart", "connections", closed)
+	return nil
+}
+
+// Shutdown stops the listeners ListenAndServe opened, closes the WebSocket connections
+// and flushes the buffered spans and error reports
+func (s *Server) Shutdown(ctx context.Context) error {
+	setReadiness(stateDraining)
+	shutdownServers(ctx)
+	websocket.DrainConnections(0)
+	s.stopOnce.Do(func() { close(s.done) })
+
+	var errs []error
+	if err := s.flushTraces(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush traces: %v", err))
+	}
+	if err := s.flushReports(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush error reports: %v", err))
+	}
+	return errors.Join(errs...)
+}
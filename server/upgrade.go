@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gws "github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/tracing"
+	"github.com/sahakavatar/gopush/webhooks"
+	"github.com/sahakavatar/gopush/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// handleUpgrade authenticates a client, upgrades its request to a WebSocket and serves
+// its actions until it disconnects
+func (s *Server) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	config := s.config
+
+	// The connection ID is assigned before authentication so log lines and audit events
+	// of a refused upgrade carry it too
+	connID := websocket.NewConnectionID()
+	upgradeLog := slog.With("conn_id", connID, "remote_addr", r.RemoteAddr)
+	defer reporting.Recover(reporting.Fields{"conn_id": connID, "remote_addr": r.RemoteAddr})
+
+	// The upgrade span covers authentication and the handshake, continuing the trace
+	// of the client's traceparent header if it sent one
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "websocket.upgrade", attribute.String("conn_id", connID), attribute.String("remote_addr", r.RemoteAddr))
+
+	// In multi-tenant mode every connection must present a registered app key
+	appKey := ""
+	if apps.Enabled(config) {
+		appKey = apps.KeyFromRequest(r)
+		span.SetAttributes(attribute.String("app_key", appKey))
+		app, ok := apps.Lookup(config, appKey)
+		if !ok {
+			upgradeLog.Warn("Rejected upgrade with unknown app key", "app_key", appKey)
+			http.Error(w, "Unknown app key", http.StatusUnauthorized)
+			auditUpgrade(r, connID, appKey, audit.OutcomeDenied, "unknown app key")
+			tracing.End(span, errors.New("unknown app key"))
+			return
+		}
+		if !apps.Acquire(appKey, app) {
+			upgradeLog.Warn("Rejected upgrade, app is at its connection quota", "app_key", appKey)
+			http.Error(w, "App connection quota exceeded", http.StatusServiceUnavailable)
+			auditUpgrade(r, connID, appKey, audit.OutcomeDenied, "app connection quota exceeded")
+			tracing.End(span, errors.New("app connection quota exceeded"))
+			return
+		}
+		defer apps.Release(appKey)
+	}
+
+	// Clients with a verified certificate are authenticated by the TLS handshake
+	identity := auth.CertificateIdentity(r.TLS, websocket.KnownIdentity(config))
+
+	// Authenticate before upgrading so unauthorized clients never hold a socket
+	token := auth.TokenFromRequest(r)
+	authRequest := auth.NewAuthorizeRequest(r, token)
+	var tokenInfo auth.TokenInfo
+	if identity == "" && (token != "" || config.Server.Authorize.RequireUpgradeToken) {
+		var err error
+		ctx := reporting.WithFields(ctx, reporting.Fields{"conn_id": connID, "remote_addr": r.RemoteAddr, "app": appKey})
+		tokenInfo, err = apps.ValidateToken(ctx, s.rdbs[0], config, appKey, authRequest)
+		if auth.IsUnavailable(err) {
+			upgradeLog.Error("Rejected upgrade, authorization service unavailable", "error", err)
+			http.Error(w, "Authorization service unavailable", http.StatusServiceUnavailable)
+			auditUpgrade(r, connID, appKey, audit.OutcomeError, err.Error())
+			tracing.End(span, err)
+			return
+		}
+		if token == "" || err != nil || !tokenInfo.Valid {
+			upgradeLog.Warn("Rejected unauthorized upgrade", "error", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			auditUpgrade(r, connID, appKey, audit.OutcomeDenied, "invalid or missing token")
+			tracing.End(span, errors.New("unauthorized"))
+			return
+		}
+	}
+
+	upgrader := &gws.Upgrader{
+		CheckOrigin:       websocket.CheckOrigin(config),
+		EnableCompression: config.Server.Compression.Enabled,
+		Subprotocols:      websocket.Subprotocols,
+		HandshakeTimeout:  handshakeTimeout(config),
+	}
+
+	// Clients and proxies can quote the ID from the handshake response
+	conn, err := upgrader.Upgrade(w, r, http.Header{"X-Connection-Id": {connID}})
+	if err != nil {
+		upgradeLog.Warn("WebSocket upgrade failed", "error", err)
+		tracing.End(span, err)
+		return
+	}
+	defer conn.Close()
+
+	// Every log line about the connection carries its conn_id
+	websocket.RegisterConnection(conn, connID, r.RemoteAddr)
+	tracing.End(span, nil)
+	connLog := websocket.ConnLogger(conn)
+	if identity != "" {
+		connLog.Info("New WebSocket connection", "identity", identity)
+	} else {
+		connLog.Info("New WebSocket connection")
+	}
+
+	// Reject oversized frames before they are buffered in memory
+	websocket.ApplyReadLimit(conn)
+	websocket.ConfigureCompression(conn, config)
+	websocket.RegisterEncoding(conn)
+	websocket.SetConnectionToken(conn, token)
+	websocket.SetAuthorizeRequest(conn, authRequest)
+	websocket.SetConnectionGrants(conn, tokenInfo)
+	websocket.SetConnectionUser(conn, tokenInfo)
+	websocket.SetConnectionApp(conn, appKey, config)
+	websocket.SetConnectionIdentity(conn, identity)
+	websocket.Audit(conn, audit.ActionAuthenticate, audit.OutcomeAllowed, "", "")
+
+	// Clients need their socket ID to request channel signatures from their backend
+	if len(config.Server.ChannelAuth.Secrets) > 0 || apps.Enabled(config) {
+		websocket.AssignSocketID(conn)
+	}
+	websocket.Notify(conn, webhooks.EventConnect, "")
+
+	// Each connection gets its own token bucket for the send action
+	limiter := websocket.NewSendLimiter(config)
+
+	// The first decoded message selects the wire protocol version
+	negotiated := false
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err == gws.ErrReadLimit {
+			connLog.Warn("Client sent a frame larger than the read limit, closing connection")
+		}
+		if err != nil {
+			connLog.Info("WebSocket read failed", "error", err)
+			websocket.HandleDisconnect(s.rdbs[0], conn, config)
+			break
+		}
+
+		data, err := websocket.DecodeMessage(conn, messageType, message)
+		if err != nil {
+			websocket.SendError(conn, nil, websocket.ErrInvalidMessage, "Invalid message format")
+			continue
+		}
+
+		if !negotiated {
+			negotiated = true
+			if !websocket.NegotiateVersion(conn, data) {
+				connLog.Warn("Client requested an unsupported protocol version")
+				websocket.HandleDisconnect(s.rdbs[0], conn, config)
+				break
+			}
+
+			// A first message carrying only the version is a handshake, not an action
+			_, hasVersion := data["version"]
+			_, hasAction := data["action"]
+			if hasVersion && !hasAction {
+				continue
+			}
+		}
+
+		action, ok := data["action"].(string)
+		if !ok {
+			websocket.SendError(conn, data, websocket.ErrActionMissing, "Action not specified")
+			continue
+		}
+
+		if action == "subscribe" {
+			websocket.HandleSubscribe(s.rdbs, conn, data, config)
+		} else if action == "send" {
+			if !limiter.Allow() {
+				websocket.SendError(conn, data, websocket.ErrRateLimited, "Rate limit exceeded")
+				if limiter.Exceeded() {
+					connLog.Warn("Disconnecting client for exceeding the send rate limit", "action", "send")
+					websocket.CloseConnection(conn, gws.ClosePolicyViolation, "Rate limit exceeded")
+					websocket.HandleDisconnect(s.rdbs[0], conn, config)
+					break
+				}
+				continue
+			}
+			handleSend(conn, data, config)
+		} else if action == "refresh_token" {
+			websocket.HandleRefreshToken(s.rdbs, conn, data, config)
+		} else if action == "resume" {
+			websocket.HandleResume(s.rdbs, conn, data, config)
+		} else if action == "ack" {
+			websocket.HandleAck(s.rdbs[0], conn, data, config)
+		} else if action == "receipts" {
+			websocket.HandleReceipts(s.rdbs[0], conn, data, config)
+		} else if action == "register_device" {
+			websocket.HandleRegisterDevice(conn, data)
+		} else if action == "unregister_device" {
+			websocket.HandleUnregisterDevice(conn, data)
+		} else {
+			websocket.SendError(conn, data, websocket.ErrUnknownAction, fmt.Sprintf("Unknown action: %s", action))
+		}
+	}
+}
+
+// handleSend publishes a message a client sent to a channel
+func handleSend(conn *gws.Conn, data map[string]interface{}, config *config.Config) {
+	channel, ok := data["channel"].(string)
+	if !ok {
+		websocket.SendError(conn, data, websocket.ErrChannelMissing, "Channel not specified")
+		return
+	}
+
+	if !websocket.CanPublish(conn, channel, config) {
+		websocket.SendError(conn, data, websocket.ErrForbidden, fmt.Sprintf("Not allowed to publish to channel: %s", channel))
+		websocket.ConnLogger(conn).Warn("ACL denied publish", "action", "send", "channel", channel)
+		websocket.Audit(conn, audit.ActionPublish, audit.OutcomeDenied, channel, "denied by ACL")
+		return
+	}
+
+	// Tag the message with an ID so subscribers can acknowledge it. Clients cannot choose
+	// it, or they could reuse the ID of another message and tamper with its receipts.
+	messageID := websocket.NewMessageID()
+	data["message_id"] = messageID
+
+	// Stamp the publish time so delivery latency can be measured where it is delivered
+	data["published_at_ms"] = time.Now().UnixMilli()
+
+	message, err := json.Marshal(data)
+	if err != nil {
+		websocket.SendError(conn, data, websocket.ErrInvalidMessage, "Invalid message format")
+		return
+	}
+
+	if websocket.PayloadTooLarge(message) {
+		websocket.SendError(conn, data, websocket.ErrMessageTooLarge, websocket.MessageTooLarge(len(message), websocket.MaxPayloadSize()))
+		return
+	}
+
+	if !websocket.AllowPublish(conn, config) {
+		websocket.SendError(conn, data, websocket.ErrQuotaExceeded, "App publish quota exceeded")
+		websocket.Audit(conn, audit.ActionPublish, audit.OutcomeDenied, channel, "app publish quota exceeded")
+		return
+	}
+
+	// Tenant apps publish inside their own channel namespace
+	redisChannel := websocket.RedisChannel(conn, channel)
+
+	// A slow Redis must not stall the connection's read loop
+	ctx, cancel := redisconn.WithPublishTimeout(context.Background())
+	err = websocket.Publish(ctx, redisChannel, message)
+	cancel()
+	if redisconn.IsTimeout(err) {
+		websocket.ConnLogger(conn).Error("Timed out publishing message", "action", "send", "channel", redisChannel, "error", err)
+		websocket.SendError(conn, data, websocket.ErrTimeout, "Publishing timed out, try again later")
+		websocket.Audit(conn, audit.ActionPublish, audit.OutcomeError, channel, err.Error())
+		return
+	}
+	if err != nil {
+		websocket.ConnLogger(conn).Error("Failed to publish message", "action", "send", "channel", redisChannel, "error", err)
+		websocket.SendError(conn, data, websocket.ErrPublishFailed, "Failed to publish message")
+		websocket.Audit(conn, audit.ActionPublish, audit.OutcomeError, channel, err.Error())
+		return
+	}
+
+	websocket.SendPublishConfirmation(conn, channel, messageID)
+	websocket.Audit(conn, audit.ActionPublish, audit.OutcomeAllowed, channel, "")
+}
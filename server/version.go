@@ -0,0 +1,105 @@
+package server
+
+import (
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/config"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build details, set by SetBuild. A commit or build date left unset is taken from the VCS
+// stamp Go adds to the binary, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// When the process started, reported as its uptime
+var startedAt = time.Now()
+
+// buildInfo describes the running binary and the features its config enables
+type buildInfo struct {
+	Version       string   `json:"version"`
+	Commit        string   `json:"commit,omitempty"`
+	BuildDate     string   `json:"build_date,omitempty"`
+	GoVersion     string   `json:"go_version"`
+	Features      features `json:"features"`
+	StartedAt     string   `json:"started_at"`
+	UptimeSeconds int64    `json:"uptime_seconds"`
+}
+
+// features lists what the config of this server turns on
+type features struct {
+	TLS         bool   `json:"tls"`
+	ClientCerts bool   `json:"client_certs"`
+	Broker      string `json:"broker"`
+	Metrics     string `json:"metrics,omitempty"` // Sink of the metrics, empty when disabled
+	Tracing     bool   `json:"tracing"`
+	MultiTenant bool   `json:"multi_tenant"`
+}
+
+// SetBuild sets the build details the version endpoint and Build report. Unset, the
+// version is "dev".
+func SetBuild(buildVersion, buildCommit, date string) {
+	if buildVersion != "" {
+		version = buildVersion
+	}
+	commit, buildDate = buildCommit, date
+}
+
+// Build returns the version, commit and build date of the running binary
+func Build() (string, string, string) {
+	revision, date := buildCommit()
+	return version, revision, date
+}
+
+// buildCommit returns the commit and build date, falling back to the VCS stamp
+func buildCommit() (string, string) {
+	revision, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && revision == "":
+				revision = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+	return revision, date
+}
+
+// currentBuildInfo returns the build details with the features of config
+func currentBuildInfo(config *config.Config) buildInfo {
+	revision, date := buildCommit()
+	info := buildInfo{
+		Version:   version,
+		Commit:    revision,
+		BuildDate: date,
+		GoVersion: runtime.Version(),
+		Features: features{
+			TLS:         config.Server.TLS.Enabled,
+			ClientCerts: config.Server.TLS.Enabled && config.Server.TLS.ClientCAFile != "",
+			Broker:      config.Broker.Type,
+			Tracing:     config.Tracing.Enabled,
+			MultiTenant: apps.Enabled(config),
+		},
+		StartedAt:     startedAt.UTC().Format(time.RFC3339),
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+	}
+	if config.Metrics.Enabled {
+		info.Features.Metrics = config.Metrics.Sink
+	}
+	return info
+}
+
+// handleVersion answers with the build details, so operators can tell which build runs on
+// each node
+func handleVersion(config *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentBuildInfo(config))
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/push"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/websocket"
+	"net/http"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Largest push subscription the endpoint reads
+const maxSubscriptionBody = 8 << 10
+
+// Path of the Web Push subscription endpoint, unless push.webpush.path says otherwise
+const defaultWebPushPath = "/push/subscriptions"
+
+// pushSubscription is a browser's PushSubscription as serialized by toJSON()
+type pushSubscription struct {
+	Endpoint string     `json:"endpoint"`
+	Keys     *push.Keys `json:"keys"`
+}
+
+// handlePushSubscriptions serves push.webpush.path. GET answers the VAPID public key
+// browsers subscribe with, and signed-in browsers POST their subscription to receive the
+// messages of their user's channel while no socket is open, or DELETE it to stop.
+func handlePushSubscriptions(rdb redis.UniversalClient, config *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"public_key": push.VAPIDPublicKey()})
+			return
+		case http.MethodPost, http.MethodDelete:
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		action := "register_device"
+		if r.Method == http.MethodDelete {
+			action = "unregister_device"
+		}
+
+		var subscription pushSubscription
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubscriptionBody)).Decode(&subscription); err != nil || subscription.Endpoint == "" {
+			writeDeviceError(w, http.StatusBadRequest, websocket.ErrDeviceInvalid, "Body must be a push subscription with an endpoint", action)
+			return
+		}
+
+		// Subscriptions belong to the user of the token, validated like at the WebSocket upgrade
+		appKey := ""
+		if apps.Enabled(config) {
+			appKey = apps.KeyFromRequest(r)
+			if _, ok := apps.Lookup(config, appKey); !ok {
+				writeDeviceError(w, http.StatusUnauthorized, websocket.ErrUnauthorized, "Unknown app key", action)
+				return
+			}
+		}
+		token := auth.TokenFromRequest(r)
+		if token == "" {
+			writeDeviceError(w, http.StatusUnauthorized, websocket.ErrTokenMissing, "Token not specified", action)
+			return
+		}
+		tokenInfo, err := apps.ValidateToken(r.Context(), rdb, config, appKey, auth.NewAuthorizeRequest(r, token))
+		if auth.IsUnavailable(err) {
+			writeDeviceError(w, http.StatusServiceUnavailable, websocket.ErrAuthUnavailable, "Authorization service unavailable", action)
+			return
+		}
+		if err != nil || !tokenInfo.Valid {
+			writeDeviceError(w, http.StatusUnauthorized, websocket.ErrTokenInvalid, "Invalid token", action)
+			return
+		}
+		if tokenInfo.UserID == "" {
+			writeDeviceError(w, http.StatusForbidden, websocket.ErrUserUnknown, "The token belongs to no user", action)
+			return
+		}
+
+		device := push.Device{Platform: push.PlatformWebPush, Token: subscription.Endpoint, Keys: subscription.Keys}
+		ctx, cancel := redisconn.WithTimeout(r.Context())
+		defer cancel()
+		if r.Method == http.MethodDelete {
+			err = push.Unregister(ctx, tokenInfo.UserID, device)
+		} else {
+			err = push.Register(ctx, tokenInfo.UserID, device)
+		}
+		switch {
+		case errors.Is(err, push.ErrInvalidDevice):
+			writeDeviceError(w, http.StatusBadRequest, websocket.ErrDeviceInvalid, "The subscription has invalid keys or an endpoint of an unknown push service", action)
+			return
+		case errors.Is(err, push.ErrTooManyDevices):
+			writeDeviceError(w, http.StatusConflict, websocket.ErrTooManyDevices, err.Error(), action)
+			return
+		case err != nil:
+			logger.Error("Failed to store push subscription", "action", action, "user_id", tokenInfo.UserID, "error", err)
+			writeDeviceError(w, http.StatusServiceUnavailable, websocket.ErrInternal, "Failed to store the subscription", action)
+			return
+		}
+
+		logger.Info("Stored push subscription", "action", action, "user_id", tokenInfo.UserID, "remote_addr", r.RemoteAddr)
+		event := "device_registered"
+		if r.Method == http.MethodDelete {
+			event = "device_unregistered"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(websocket.DeviceMessage{Status: "success", Event: event, Platform: push.PlatformWebPush})
+	}
+}
+
+// writeDeviceError answers a subscription request with the error format of the WebSocket API
+func writeDeviceError(w http.ResponseWriter, status int, code websocket.ErrorCode, message, action string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(websocket.ErrorMessage{
+		Status:  "error",
+		Event:   "error",
+		Code:    code,
+		Message: message,
+		Action:  action,
+	})
+}
@@ -0,0 +1,99 @@
+package socketio
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Engine.IO v4 packet types, the first character of every WebSocket frame
+const (
+	engineOpen    = '0'
+	engineClose   = '1'
+	enginePing    = '2'
+	enginePong    = '3'
+	engineMessage = '4'
+	engineUpgrade = '5'
+	engineNoop    = '6'
+)
+
+// Socket.IO v5 packet types, the first character of an Engine.IO message
+const (
+	packetConnect      = '0'
+	packetDisconnect   = '1'
+	packetEvent        = '2'
+	packetAck          = '3'
+	packetConnectError = '4'
+	packetBinaryEvent  = '5'
+	packetBinaryAck    = '6'
+)
+
+var errMalformed = errors.New("malformed packet")
+
+// packet is a Socket.IO packet: its type, namespace, acknowledgment ID and JSON data
+type packet struct {
+	kind      byte
+	namespace string
+	ackID     int // -1 when the sender expects no acknowledgment
+	data      json.RawMessage
+}
+
+// parsePacket decodes a Socket.IO packet, the frame of an Engine.IO message without its type
+func parsePacket(frame string) (packet, error) {
+	if frame == "" {
+		return packet{}, errMalformed
+	}
+	p := packet{kind: frame[0], namespace: "/", ackID: -1}
+	rest := frame[1:]
+
+	if strings.HasPrefix(rest, "/") {
+		end := strings.IndexByte(rest, ',')
+		if end < 0 {
+			p.namespace, rest = rest, ""
+		} else {
+			p.namespace, rest = rest[:end], rest[end+1:]
+		}
+	}
+
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 {
+		id, err := strconv.Atoi(rest[:digits])
+		if err != nil {
+			return p, errMalformed
+		}
+		p.ackID, rest = id, rest[digits:]
+	}
+
+	if rest != "" {
+		if !json.Valid([]byte(rest)) {
+			return p, errMalformed
+		}
+		p.data = json.RawMessage(rest)
+	}
+	return p, nil
+}
+
+// encodePacket builds the Engine.IO frame of a Socket.IO packet
+func encodePacket(namespace string, kind byte, ackID int, data interface{}) (string, error) {
+	var frame strings.Builder
+	frame.WriteByte(engineMessage)
+	frame.WriteByte(kind)
+	if namespace != "/" {
+		frame.WriteString(namespace + ",")
+	}
+	if ackID >= 0 {
+		frame.WriteString(strconv.Itoa(ackID))
+	}
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+		frame.Write(encoded)
+	}
+	return frame.String(), nil
+}
@@ -0,0 +1,384 @@
+package socketio
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/bridge"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/websocket"
+)
+
+// Ping timing announced in the handshake when server.socketio leaves it unset
+const (
+	defaultPingInterval = 25 * time.Second
+	defaultPingTimeout  = 20 * time.Second
+)
+
+// Engine.IO error codes answered to requests the endpoint cannot serve
+const (
+	errorTransportUnknown  = 0
+	errorSessionIDUnknown  = 1
+	errorUnsupportedEngine = 5
+)
+
+// handshake is the data of the Engine.IO open packet
+type handshake struct {
+	SID          string   `json:"sid"`
+	Upgrades     []string `json:"upgrades"`
+	PingInterval int64    `json:"pingInterval"`
+	PingTimeout  int64    `json:"pingTimeout"`
+	MaxPayload   int64    `json:"maxPayload"`
+}
+
+// connectAuth is the auth object a client passes to io() in socket.io-client
+type connectAuth struct {
+	Token  string `json:"token"`
+	AppKey string `json:"app_key"`
+}
+
+// publishRequest is the argument of the publish event
+type publishRequest struct {
+	Channel string          `json:"channel"`
+	Event   string          `json:"event"`
+	Message json.RawMessage `json:"message"`
+}
+
+// ackResult is the argument of an acknowledgment
+type ackResult struct {
+	Status    string              `json:"status"`
+	MessageID string              `json:"message_id,omitempty"`
+	Code      websocket.ErrorCode `json:"code,omitempty"`
+	Message   string              `json:"message,omitempty"`
+}
+
+// connectError is the data of a CONNECT_ERROR packet, which socket.io-client reports
+// as a connect_error event
+type connectError struct {
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// durationOr converts milliseconds, falling back when they are not set
+func durationOr(ms int, fallback time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return fallback
+}
+
+// Handler serves server.socketio.path to socket.io-client over the WebSocket transport.
+// Rooms map to channels: clients emit join and leave with a channel name and publish
+// with a channel, event and message, and receive channel messages as events.
+func Handler(b broker.Broker, rdb redis.UniversalClient, config *config.Config, upgrader *gws.Upgrader) http.HandlerFunc {
+	pingInterval := durationOr(config.Server.SocketIO.PingInterval, defaultPingInterval)
+	pingTimeout := durationOr(config.Server.SocketIO.PingTimeout, defaultPingTimeout)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("EIO") != "4" {
+			writeEngineError(w, errorUnsupportedEngine, "Unsupported protocol version")
+			return
+		}
+		if query.Get("sid") != "" {
+			writeEngineError(w, errorSessionIDUnknown, "Session ID unknown")
+			return
+		}
+		if query.Get("transport") != "websocket" {
+			// Long polling keeps sessions on the server, which clients would have to stick to
+			writeEngineError(w, errorTransportUnknown, "Transport unknown")
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		websocket.ApplyReadLimit(conn)
+
+		token := auth.TokenFromRequest(r)
+		s := &socket{
+			conn:    conn,
+			config:  config,
+			session: bridge.NewSession("socketio", r.RemoteAddr, b, rdb, config),
+			limiter: websocket.NewSendLimiter(config),
+			done:    make(chan struct{}),
+		}
+		s.session.SetRequest(auth.NewAuthorizeRequest(r, token))
+		defer reporting.Recover(reporting.Fields{"conn_id": s.session.ConnID, "remote_addr": r.RemoteAddr})
+		defer s.session.Close()
+		defer close(s.done)
+
+		open, _ := json.Marshal(handshake{
+			SID:          s.session.ConnID,
+			Upgrades:     []string{},
+			PingInterval: pingInterval.Milliseconds(),
+			PingTimeout:  pingTimeout.Milliseconds(),
+			MaxPayload:   websocket.ReadLimit(),
+		})
+		if !s.send(string(engineOpen) + string(open)) {
+			return
+		}
+		s.session.Log.Info("New Socket.IO connection")
+		go s.ping(pingInterval)
+
+		for {
+			// A client missing a ping for longer than the timeout is gone
+			conn.SetReadDeadline(time.Now().Add(pingInterval + pingTimeout))
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				s.session.Log.Info("Socket.IO read failed", "error", err)
+				return
+			}
+			if messageType != gws.TextMessage || len(message) == 0 {
+				s.session.Log.Warn("Binary Socket.IO packets are not supported, closing connection")
+				return
+			}
+
+			switch message[0] {
+			case enginePong, engineNoop, engineUpgrade:
+			case enginePing:
+				s.send(string(enginePong) + string(message[1:]))
+			case engineClose:
+				return
+			case engineMessage:
+				if !s.handle(string(message[1:]), token, apps.KeyFromRequest(r), r) {
+					return
+				}
+			default:
+				s.session.Log.Warn("Unexpected Engine.IO packet, closing connection", "type", string(message[0]))
+				return
+			}
+		}
+	}
+}
+
+// writeEngineError answers a request the endpoint cannot serve like an Engine.IO server
+func writeEngineError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message})
+}
+
+// socket is a Socket.IO client connected over a WebSocket
+type socket struct {
+	conn      *gws.Conn
+	config    *config.Config
+	session   *bridge.Session
+	limiter   *websocket.SendLimiter
+	connected bool // The client connected to the default namespace
+	done      chan struct{}
+
+	write sync.Mutex
+}
+
+// send writes an Engine.IO frame and reports whether it was written
+func (s *socket) send(frame string) bool {
+	s.write.Lock()
+	defer s.write.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(bridge.WriteTimeout))
+	if err := s.conn.WriteMessage(gws.TextMessage, []byte(frame)); err != nil {
+		s.session.Log.Warn("Failed to send Socket.IO packet", "error", err)
+		s.conn.Close()
+		return false
+	}
+	return true
+}
+
+// sendPacket writes a Socket.IO packet
+func (s *socket) sendPacket(namespace string, kind byte, ackID int, data interface{}) {
+	frame, err := encodePacket(namespace, kind, ackID, data)
+	if err != nil {
+		s.session.Log.Error("Failed to encode Socket.IO packet", "error", err)
+		return
+	}
+	s.send(frame)
+}
+
+// ping sends Engine.IO pings until the connection ends; the client answers each with a pong
+func (s *socket) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if !s.send(string(enginePing)) {
+				return
+			}
+		}
+	}
+}
+
+// handle processes a Socket.IO packet and reports whether the connection stays open
+func (s *socket) handle(frame, token, appKey string, r *http.Request) bool {
+	p, err := parsePacket(frame)
+	if err != nil {
+		s.session.Log.Warn("Malformed Socket.IO packet, closing connection", "error", err)
+		return false
+	}
+
+	switch p.kind {
+	case packetConnect:
+		return s.connect(p, token, appKey, r)
+	case packetDisconnect:
+		s.session.Log.Info("Socket.IO client disconnected")
+		return false
+	case packetEvent:
+		if !s.connected || p.namespace != "/" {
+			return true
+		}
+		s.event(p)
+	case packetAck:
+		// The server emits no events that expect an acknowledgment
+	case packetBinaryEvent, packetBinaryAck:
+		s.session.Log.Warn("Binary Socket.IO packets are not supported, closing connection")
+		return false
+	default:
+		s.session.Log.Warn("Unexpected Socket.IO packet, closing connection", "type", string(p.kind))
+		return false
+	}
+	return true
+}
+
+// connect admits a client to the default namespace. The token and app key of the auth
+// object take precedence over those of the upgrade request.
+func (s *socket) connect(p packet, token, appKey string, r *http.Request) bool {
+	if p.namespace != "/" {
+		s.sendPacket(p.namespace, packetConnectError, -1, connectError{Message: "Invalid namespace"})
+		return true
+	}
+	if s.connected {
+		return true
+	}
+
+	var credentials connectAuth
+	if len(p.data) > 0 {
+		json.Unmarshal(p.data, &credentials)
+	}
+	if credentials.Token != "" {
+		token = credentials.Token
+		s.session.SetRequest(auth.NewAuthorizeRequest(r, token))
+	}
+	if credentials.AppKey != "" {
+		appKey = credentials.AppKey
+	}
+
+	if err := s.session.Authenticate(appKey, token, r.TLS); err != nil {
+		s.sendPacket("/", packetConnectError, -1, connectError{
+			Message: "Unauthorized",
+			Data:    map[string]interface{}{"code": bridge.ErrorCode(err)},
+		})
+		return false
+	}
+	s.connected = true
+	s.sendPacket("/", packetConnect, -1, map[string]string{"sid": s.session.ConnID})
+	return true
+}
+
+// event runs the join, leave and publish events and acknowledges them when asked to
+func (s *socket) event(p packet) {
+	var args []json.RawMessage
+	var name string
+	if err := json.Unmarshal(p.data, &args); err != nil || len(args) == 0 || json.Unmarshal(args[0], &name) != nil {
+		s.ack(p.ackID, ackResult{Status: "error", Code: websocket.ErrInvalidMessage, Message: "Invalid event"})
+		return
+	}
+	args = args[1:]
+
+	switch name {
+	case "join":
+		channel, ok := channelArg(args)
+		if !ok {
+			s.ack(p.ackID, ackResult{Status: "error", Code: websocket.ErrChannelMissing, Message: "Channel not specified"})
+			return
+		}
+		err := s.session.Subscribe(channel, func(payload string) {
+			s.deliver(channel, payload)
+		})
+		s.ackError(p.ackID, "", err)
+	case "leave":
+		channel, ok := channelArg(args)
+		if !ok {
+			s.ack(p.ackID, ackResult{Status: "error", Code: websocket.ErrChannelMissing, Message: "Channel not specified"})
+			return
+		}
+		s.session.Unsubscribe(channel)
+		s.ack(p.ackID, ackResult{Status: "ok"})
+	case "publish":
+		var request publishRequest
+		if len(args) == 0 || json.Unmarshal(args[0], &request) != nil || request.Channel == "" {
+			s.ack(p.ackID, ackResult{Status: "error", Code: websocket.ErrChannelMissing, Message: "Channel not specified"})
+			return
+		}
+		if !s.limiter.Allow() {
+			s.ack(p.ackID, ackResult{Status: "error", Code: websocket.ErrRateLimited, Message: "Rate limit exceeded"})
+			if s.limiter.Exceeded() {
+				s.session.Log.Warn("Disconnecting client for exceeding the send rate limit", "action", "publish")
+				s.conn.Close()
+			}
+			return
+		}
+		messageID, err := s.session.Publish(request.Channel, request.Event, request.Message)
+		s.ackError(p.ackID, messageID, err)
+	default:
+		s.ack(p.ackID, ackResult{Status: "error", Code: websocket.ErrUnknownAction, Message: fmt.Sprintf("Unknown event: %s", name)})
+	}
+}
+
+// channelArg returns the channel name passed as the first argument of an event
+func channelArg(args []json.RawMessage) (string, bool) {
+	var channel string
+	if len(args) == 0 || json.Unmarshal(args[0], &channel) != nil || channel == "" {
+		return "", false
+	}
+	return channel, true
+}
+
+// ack acknowledges an event when the client asked for it
+func (s *socket) ack(ackID int, result ackResult) {
+	if ackID >= 0 {
+		s.sendPacket("/", packetAck, ackID, []ackResult{result})
+	}
+}
+
+// ackError acknowledges an event with the outcome of a session call
+func (s *socket) ackError(ackID int, messageID string, err error) {
+	if err == nil {
+		s.ack(ackID, ackResult{Status: "ok", MessageID: messageID})
+		return
+	}
+	message := err.Error()
+	if !bridge.Refused(err) {
+		message = "Request failed, try again later"
+	}
+	s.ack(ackID, ackResult{Status: "error", Code: bridge.ErrorCode(err), Message: message})
+}
+
+// deliver emits a channel message to the client as the message's event, "message" when
+// it has none, with the message and its channel and ID as arguments
+func (s *socket) deliver(channel, payload string) {
+	delivery := bridge.Decode(payload)
+	event := delivery.Event
+	if event == "" {
+		event = "message"
+	}
+	meta := map[string]string{"channel": channel}
+	if delivery.MessageID != "" {
+		meta["message_id"] = delivery.MessageID
+	}
+	s.sendPacket("/", packetEvent, -1, []interface{}{event, delivery.Message, meta})
+}
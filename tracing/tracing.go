@@ -0,0 +1,102 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/sahakavatar/gopush/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name the spans of the server are recorded under
+const instrumentation = "socket"
+
+// Configure exports spans over OTLP/HTTP as set in the tracing block. Until it is called,
+// or when tracing is disabled, spans are no-ops. It returns a function flushing the spans
+// still buffered.
+func Configure(config *config.Config) (func(context.Context) error, error) {
+	tracing := config.Tracing
+	if !tracing.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// Without an endpoint the exporter follows the OTEL_EXPORTER_OTLP_* variables
+	var options []otlptracehttp.Option
+	if tracing.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(tracing.Endpoint))
+	}
+	if len(tracing.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(tracing.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	serviceName := tracing.ServiceName
+	if serviceName == "" {
+		serviceName = "gopush"
+	}
+	ratio := 1.0
+	if tracing.SampleRatio > 0 {
+		ratio = tracing.SampleRatio
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the one in ctx, if any
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Annotate adds attributes to the span carried by ctx
+func Annotate(ctx context.Context, attributes ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attributes...)
+}
+
+// Fail marks a span as failed with err
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End marks a span as failed when err is set and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		Fail(span, err)
+	}
+	span.End()
+}
+
+// Detach returns a context carrying the trace of ctx but not its deadline or
+// cancellation, for work that outlives the request that started it
+func Detach(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// Extract returns a context continuing the trace of an incoming HTTP request
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject adds the trace of ctx to the headers of an outgoing HTTP request, so the
+// service called continues it
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
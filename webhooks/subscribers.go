@@ -0,0 +1,328 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/acl"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// Redis hash holding the subscribers registered through the admin API, keyed by ID
+const subscribersKey = "webhook_subscribers"
+
+// How often every server reloads the registered subscribers
+const subscribersSync = 5 * time.Second
+
+// ErrSubscriberNotFound is returned when unregistering an unknown or configured subscriber
+var ErrSubscriberNotFound = errors.New("subscriber not found")
+
+// Subscriber is an HTTP endpoint receiving every message published to the channels
+// matching its patterns
+type Subscriber struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	Channels   []string `json:"channels"`         // Channel patterns such as orders-*, matched against the broker channel
+	Secret     string   `json:"secret,omitempty"` // Signs each request body with HMAC-SHA256 in the X-Webhook-Signature header
+	Configured bool     `json:"configured"`       // Comes from webhooks.subscribers rather than the admin API
+}
+
+// delivery is the body of a request to a subscriber, one published message
+type delivery struct {
+	TimeMs  int64           `json:"time_ms"`
+	Channel string          `json:"channel"`
+	Message json.RawMessage `json:"message"`
+}
+
+// subscriberWorker delivers the messages of one subscriber in the order they were published
+type subscriberWorker struct {
+	subscriber Subscriber
+	queue      chan delivery
+	stop       chan struct{}
+	dropped    atomic.Int64 // Messages dropped because the queue was full, reported with the next delivery
+}
+
+// subscriberSettings are the webhooks settings shared by every subscriber
+type subscriberSettings struct {
+	client    *http.Client
+	retries   int
+	queueSize int
+}
+
+var subscribersMu sync.Mutex
+var workers map[string]*subscriberWorker
+var configured []Subscriber
+var settings subscriberSettings
+var subscribersRDB redis.UniversalClient
+
+// ConfigureSubscribers starts delivering published messages to the subscribers of
+// webhooks.subscribers and those registered through the admin API, which are kept in
+// Redis so every server delivers the messages it publishes to them
+func ConfigureSubscribers(rdb redis.UniversalClient, config *config.Config) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	if workers != nil {
+		return
+	}
+
+	block := config.Webhooks
+	settings = subscriberSettings{
+		client:    &http.Client{Timeout: orDefault(block.Timeout, time.Millisecond, defaultTimeout)},
+		retries:   block.Retries,
+		queueSize: block.QueueSize,
+	}
+	if settings.queueSize <= 0 {
+		settings.queueSize = defaultQueueSize
+	}
+	subscribersRDB = rdb
+	workers = make(map[string]*subscriberWorker)
+
+	configured = nil
+	for i, s := range block.Subscribers {
+		configured = append(configured, Subscriber{
+			ID:         fmt.Sprintf("config-%d", i),
+			URL:        s.URL,
+			Channels:   s.Channels,
+			Secret:     s.Secret,
+			Configured: true,
+		})
+	}
+	registered, err := loadRegistered(rdb)
+	if err != nil {
+		logger.Warn("Failed to load webhook subscribers", "error", err)
+	}
+	applySubscribers(registered)
+	go syncSubscribers()
+}
+
+// Dispatch queues a published message for the subscribers of its channel. It never
+// blocks: a subscriber whose queue is full misses the message.
+func Dispatch(redisChannel string, message []byte) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	if len(workers) == 0 {
+		return
+	}
+
+	body := json.RawMessage(message)
+	if !json.Valid(message) {
+		body, _ = json.Marshal(string(message))
+	}
+	d := delivery{TimeMs: time.Now().UnixMilli(), Channel: redisChannel, Message: body}
+	for _, w := range workers {
+		if !acl.Granted(w.subscriber.Channels, redisChannel) {
+			continue
+		}
+		select {
+		case w.queue <- d:
+		default:
+			w.dropped.Add(1)
+		}
+	}
+}
+
+// Wants reports whether any subscriber receives the messages of a channel
+func Wants(redisChannel string) bool {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	for _, w := range workers {
+		if acl.Granted(w.subscriber.Channels, redisChannel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribers lists the subscribers messages are delivered to, without their secrets
+func Subscribers() []Subscriber {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	list := make([]Subscriber, 0, len(workers))
+	for _, w := range workers {
+		s := w.subscriber
+		s.Secret = ""
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Register adds a subscriber for every server and returns it with its new ID
+func Register(ctx context.Context, subscriber Subscriber) (Subscriber, error) {
+	var id [16]byte
+	rand.Read(id[:])
+	subscriber.ID = hex.EncodeToString(id[:])
+	subscriber.Configured = false
+
+	encoded, err := json.Marshal(subscriber)
+	if err != nil {
+		return Subscriber{}, err
+	}
+	if err := rdb().HSet(ctx, subscribersKey, subscriber.ID, encoded).Err(); err != nil {
+		return Subscriber{}, err
+	}
+	reloadSubscribers()
+	return subscriber, nil
+}
+
+// Unregister removes a subscriber registered through the admin API from every server
+func Unregister(ctx context.Context, id string) error {
+	removed, err := rdb().HDel(ctx, subscribersKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrSubscriberNotFound
+	}
+	reloadSubscribers()
+	return nil
+}
+
+func rdb() redis.UniversalClient {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	return subscribersRDB
+}
+
+// loadRegistered reads the subscribers registered through the admin API
+func loadRegistered(rdb redis.UniversalClient) ([]Subscriber, error) {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	values, err := rdb.HVals(ctx, subscribersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	registered := make([]Subscriber, 0, len(values))
+	for _, value := range values {
+		var s Subscriber
+		if err := json.Unmarshal([]byte(value), &s); err != nil {
+			logger.Warn("Skipping invalid webhook subscriber", "error", err)
+			continue
+		}
+		registered = append(registered, s)
+	}
+	return registered, nil
+}
+
+// reloadSubscribers picks up registrations made on any server
+func reloadSubscribers() {
+	registered, err := loadRegistered(rdb())
+	if err != nil {
+		logger.Warn("Failed to reload webhook subscribers", "error", err)
+		return
+	}
+
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	applySubscribers(registered)
+}
+
+// syncSubscribers reloads the registered subscribers periodically
+func syncSubscribers() {
+	ticker := time.NewTicker(subscribersSync)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloadSubscribers()
+	}
+}
+
+// applySubscribers starts a worker for every new or changed subscriber and stops those of
+// subscribers that are gone. The caller holds subscribersMu.
+func applySubscribers(registered []Subscriber) {
+	wanted := make(map[string]Subscriber, len(configured)+len(registered))
+	for _, s := range configured {
+		wanted[s.ID] = s
+	}
+	for _, s := range registered {
+		wanted[s.ID] = s
+	}
+
+	for id, w := range workers {
+		if s, ok := wanted[id]; !ok || !sameSubscriber(s, w.subscriber) {
+			close(w.stop)
+			delete(workers, id)
+		}
+	}
+	for id, s := range wanted {
+		if _, ok := workers[id]; ok {
+			continue
+		}
+		w := &subscriberWorker{
+			subscriber: s,
+			queue:      make(chan delivery, settings.queueSize),
+			stop:       make(chan struct{}),
+		}
+		workers[id] = w
+		go w.run()
+	}
+}
+
+func sameSubscriber(a, b Subscriber) bool {
+	if a.URL != b.URL || a.Secret != b.Secret || len(a.Channels) != len(b.Channels) {
+		return false
+	}
+	for i := range a.Channels {
+		if a.Channels[i] != b.Channels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// run delivers queued messages until the subscriber is removed
+func (w *subscriberWorker) run() {
+	for {
+		select {
+		case <-w.stop:
+			return
+		case d := <-w.queue:
+			w.deliver(d)
+		}
+	}
+}
+
+// deliver posts a message, retrying with growing delays, and logs it when it has to be given up
+func (w *subscriberWorker) deliver(d delivery) {
+	if count := w.dropped.Swap(0); count > 0 {
+		logger.Warn("Dropped messages for a webhook subscriber, its queue was full", "subscriber", w.subscriber.ID, "count", count)
+	}
+
+	body, err := json.Marshal(d)
+	if err != nil {
+		logger.Error("Failed to encode webhook message", "error", err)
+		return
+	}
+
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err = post(settings.client, w.subscriber.URL, []byte(w.subscriber.Secret), body)
+		if err == nil {
+			return
+		}
+		if attempt >= settings.retries {
+			break
+		}
+		logger.Warn("Retrying webhook message", "subscriber", w.subscriber.ID, "url", w.subscriber.URL, "delay", delay, "attempt", attempt+1, "error", err)
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	logger.Error("Failed to deliver webhook message", "subscriber", w.subscriber.ID, "url", w.subscriber.URL, "channel", d.Channel, "error", err)
+}
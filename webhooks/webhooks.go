@@ -0,0 +1,228 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Logger of the webhooks package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the webhooks package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// Lifecycle events sent to the application backend
+const (
+	EventConnect     = "connect"
+	EventDisconnect  = "disconnect"
+	EventSubscribe   = "subscribe"
+	EventUnsubscribe = "unsubscribe"
+)
+
+// Defaults of the webhooks block
+const (
+	defaultBatchSize     = 100
+	defaultBatchInterval = time.Second
+	defaultQueueSize     = 10000
+	defaultTimeout       = 5 * time.Second
+)
+
+// Header carrying the hex HMAC-SHA256 of the request body when a secret is set
+const SignatureHeader = "X-Webhook-Signature"
+
+// Event is one connection lifecycle event
+type Event struct {
+	Name     string `json:"name"`
+	TimeMs   int64  `json:"time_ms"`
+	ConnID   string `json:"conn_id"`
+	SocketID string `json:"socket_id,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	App      string `json:"app,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+}
+
+// batch is the body of one webhook request
+type batch struct {
+	TimeMs int64   `json:"time_ms"`
+	Events []Event `json:"events"`
+}
+
+// sender delivers batches to the configured endpoint
+type sender struct {
+	client   *http.Client
+	url      string
+	secret   []byte
+	retries  int
+	size     int
+	interval time.Duration
+}
+
+var mu sync.Mutex
+var queue chan Event
+var wanted map[string]bool
+
+// Events dropped because the queue was full, reported with the next delivery
+var dropped atomic.Int64
+
+// Configure starts delivering the events selected in the webhooks block. Until it is
+// called, or without a URL, Emit does nothing.
+func Configure(config *config.Config) {
+	settings := config.Webhooks
+	if settings.URL == "" {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if queue != nil {
+		return
+	}
+
+	wanted = make(map[string]bool)
+	for _, name := range settings.Events {
+		wanted[name] = true
+	}
+	if len(wanted) == 0 {
+		for _, name := range []string{EventConnect, EventDisconnect, EventSubscribe, EventUnsubscribe} {
+			wanted[name] = true
+		}
+	}
+
+	s := &sender{
+		client:   &http.Client{Timeout: orDefault(settings.Timeout, time.Millisecond, defaultTimeout)},
+		url:      settings.URL,
+		secret:   []byte(settings.Secret),
+		retries:  settings.Retries,
+		size:     settings.BatchSize,
+		interval: orDefault(settings.BatchInterval, time.Millisecond, defaultBatchInterval),
+	}
+	if s.size <= 0 {
+		s.size = defaultBatchSize
+	}
+	size := settings.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	queue = make(chan Event, size)
+	go s.run(queue)
+}
+
+func orDefault(value int, unit, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return time.Duration(value) * unit
+}
+
+// Emit queues an event for delivery, stamping it with the current time. It never blocks:
+// when the queue is full the event is dropped.
+func Emit(event Event) {
+	mu.Lock()
+	events, ok := queue, wanted[event.Name]
+	mu.Unlock()
+	if events == nil || !ok {
+		return
+	}
+
+	if event.TimeMs == 0 {
+		event.TimeMs = time.Now().UnixMilli()
+	}
+	select {
+	case events <- event:
+	default:
+		dropped.Add(1)
+	}
+}
+
+// run sends the queued events in batches of up to size events, waiting at most interval
+// for a batch to fill
+func (s *sender) run(events <-chan Event) {
+	pending := make([]Event, 0, s.size)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			pending = append(pending, event)
+			if len(pending) < s.size {
+				continue
+			}
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+		}
+
+		s.deliver(pending)
+		pending = make([]Event, 0, s.size)
+	}
+}
+
+// deliver sends a batch, retrying with growing delays, and logs it when it has to be given up
+func (s *sender) deliver(events []Event) {
+	if count := dropped.Swap(0); count > 0 {
+		logger.Warn("Dropped webhook events, the delivery queue was full", "count", count)
+	}
+
+	body, err := json.Marshal(batch{TimeMs: time.Now().UnixMilli(), Events: events})
+	if err != nil {
+		logger.Error("Failed to encode webhook events", "error", err)
+		return
+	}
+
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err = post(s.client, s.url, s.secret, body)
+		if err == nil {
+			return
+		}
+		if attempt >= s.retries {
+			break
+		}
+		logger.Warn("Retrying webhook delivery", "url", s.url, "delay", delay, "attempt", attempt+1, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	logger.Error("Failed to deliver webhook events", "url", s.url, "events", len(events), "error", err)
+}
+
+// post sends a request body, signed when there is a secret
+func post(client *http.Client, url string, secret, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		request.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
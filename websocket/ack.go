@@ -0,0 +1,228 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// DeliveryMessage wraps a Redis payload forwarded to a client that requested acknowledgments
+type DeliveryMessage struct {
+	Event     string          `json:"event"`
+	Channel   string          `json:"channel"`
+	MessageID string          `json:"message_id"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// PublishMessage confirms to the publisher that a message was sent
+type PublishMessage struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	Channel   string `json:"channel"`
+	Event     string `json:"event"`
+	MessageID string `json:"message_id"`
+	ConnID    string `json:"conn_id,omitempty"`
+}
+
+// ReceiptsMessage lists the subscribers that confirmed delivery of a message
+type ReceiptsMessage struct {
+	Status    string           `json:"status"`
+	Event     string           `json:"event"`
+	Channel   string           `json:"channel"`
+	MessageID string           `json:"message_id"`
+	Receipts  map[string]int64 `json:"receipts"`
+}
+
+// Redis key prefix under which delivery receipts are stored
+const ackKeyPrefix = "gopush:acks:"
+
+// Default lifetime of delivery receipts when not configured
+const defaultReceiptTTL = time.Hour
+
+// NewMessageID generates a random ID for a message published through the server
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logger.Error("Failed to generate message ID", "error", err)
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// MessageID returns the ID carried in a Redis payload, or derives a deterministic one
+// from the channel and payload so every server instance assigns the same ID
+func MessageID(channel, payload string) string {
+	var envelope struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &envelope); err == nil && envelope.MessageID != "" {
+		return envelope.MessageID
+	}
+
+	sum := sha1.Sum([]byte(channel + "\x00" + payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// PublishedAt returns when a Redis payload was published, from the published_at_ms field
+// the server stamps on messages sent by clients. Payloads published by other means only
+// carry it when their publisher set it.
+func PublishedAt(payload string) (time.Time, bool) {
+	var envelope struct {
+		PublishedAtMs int64 `json:"published_at_ms"`
+	}
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil || envelope.PublishedAtMs <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(envelope.PublishedAtMs), true
+}
+
+// MarshalDelivery wraps a Redis payload with its message ID for clients that acknowledge delivery
+func MarshalDelivery(channel, payload string) string {
+	data := json.RawMessage(payload)
+	if !json.Valid(data) {
+		// Non-JSON payloads are forwarded as a JSON string
+		quoted, _ := json.Marshal(payload)
+		data = quoted
+	}
+
+	return MarshalMessage(DeliveryMessage{
+		Event:     "message",
+		Channel:   channel,
+		MessageID: MessageID(channel, payload),
+		Data:      data,
+	})
+}
+
+// receiptsKey returns the Redis key of the receipts of a message, kept per channel so
+// clients only see the receipts of channels they may read
+func receiptsKey(conn *websocket.Conn, channel, messageID string) string {
+	return ackKeyPrefix + RedisChannel(conn, channel) + ":" + messageID
+}
+
+// subscriberOf names a connection in the receipts: its user, or the connection itself
+// for clients without one
+func subscriberOf(conn *websocket.Conn) string {
+	if userID := UserID(conn); userID != "" {
+		return "user:" + userID
+	}
+	return "conn:" + connID(conn)
+}
+
+// subscribed reports whether a connection is subscribed to a channel
+func subscribed(conn *websocket.Conn, channel string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return subscriptions[conn][channel] != nil
+}
+
+// HandleAck records a client's confirmation that it received a message of a channel it is subscribed to
+func HandleAck(rdb redis.UniversalClient, conn *websocket.Conn, data map[string]interface{}, config *config.Config) {
+	messageID, ok := data["message_id"].(string)
+	if !ok || messageID == "" {
+		SendError(conn, data, ErrMessageIDMissing, "Message ID not specified")
+		return
+	}
+	channel, ok := data["channel"].(string)
+	if !ok || channel == "" {
+		SendError(conn, data, ErrChannelMissing, "Channel not specified")
+		return
+	}
+	if !subscribed(conn, channel) {
+		SendError(conn, data, ErrForbidden, fmt.Sprintf("Not subscribed to channel: %s", channel))
+		ConnLogger(conn).Warn("Ack for a channel the client is not subscribed to", "action", "ack", "channel", channel, "message_id", messageID)
+		return
+	}
+
+	ttl := defaultReceiptTTL
+	if config.Server.Acks.ReceiptTTL > 0 {
+		ttl = time.Duration(config.Server.Acks.ReceiptTTL) * time.Second
+	}
+
+	// Receipts are keyed by subscriber so repeated acks only refresh the timestamp
+	key := receiptsKey(conn, channel, messageID)
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	if err := rdb.HSet(ctx, key, subscriberOf(conn), time.Now().Unix()).Err(); err != nil {
+		ConnLogger(conn).Error("Failed to record ack", "action", "ack", "message_id", messageID, "error", err)
+		sendRedisError(conn, data, err, ErrInternal, "Failed to record acknowledgment")
+		return
+	}
+	if err := rdb.Expire(ctx, key, ttl).Err(); err != nil {
+		ConnLogger(conn).Error("Failed to set TTL on receipts", "action", "ack", "message_id", messageID, "error", err)
+	}
+
+	ConnLogger(conn).Debug("Client acknowledged message", "action", "ack", "channel", channel, "message_id", messageID)
+}
+
+// HandleReceipts replies with the subscribers that acknowledged a message of a channel the client may read
+func HandleReceipts(rdb redis.UniversalClient, conn *websocket.Conn, data map[string]interface{}, config *config.Config) {
+	messageID, ok := data["message_id"].(string)
+	if !ok || messageID == "" {
+		SendError(conn, data, ErrMessageIDMissing, "Message ID not specified")
+		return
+	}
+	channel, ok := data["channel"].(string)
+	if !ok || channel == "" {
+		SendError(conn, data, ErrChannelMissing, "Channel not specified")
+		return
+	}
+	if !canSubscribe(conn, channel, config) {
+		SendError(conn, data, ErrForbidden, fmt.Sprintf("Not allowed to read channel: %s", channel))
+		ConnLogger(conn).Warn("ACL denied receipts", "action", "receipts", "channel", channel, "message_id", messageID)
+		return
+	}
+
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	entries, err := rdb.HGetAll(ctx, receiptsKey(conn, channel, messageID)).Result()
+	if err != nil {
+		ConnLogger(conn).Error("Failed to fetch receipts", "action", "receipts", "message_id", messageID, "error", err)
+		sendRedisError(conn, data, err, ErrInternal, "Failed to fetch receipts")
+		return
+	}
+
+	receipts := make(map[string]int64, len(entries))
+	for subscriber, value := range entries {
+		ackedAt, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			ConnLogger(conn).Warn("Ignoring malformed receipt", "action", "receipts", "message_id", messageID, "receipt", value, "error", err)
+			continue
+		}
+		receipts[subscriber] = ackedAt
+	}
+
+	SendMessageToClient(conn, MarshalMessage(ReceiptsMessage{
+		Status:    "success",
+		Event:     "receipts",
+		Channel:   channel,
+		MessageID: messageID,
+		Receipts:  receipts,
+	}))
+}
+
+// SendPublishConfirmation tells the publisher its message was sent and which ID it was assigned
+func SendPublishConfirmation(conn *websocket.Conn, channel, messageID string) {
+	if protocolVersion(conn) == ProtocolV1 {
+		SendMessageToClient(conn, "Message sent successfully")
+		return
+	}
+
+	SendMessageToClient(conn, MarshalMessage(PublishMessage{
+		Status:    "success",
+		Message:   "Message sent successfully",
+		Channel:   channel,
+		Event:     "sent",
+		MessageID: messageID,
+		ConnID:    connID(conn),
+	}))
+}
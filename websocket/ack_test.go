@@ -0,0 +1,174 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// testRedis starts an in-memory Redis for the duration of a test
+func testRedis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	t.Helper()
+	store := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: store.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return store, rdb
+}
+
+// useVersion makes a connection speak a protocol version, as if it had negotiated it
+func useVersion(t *testing.T, conn *websocket.Conn, version int) {
+	t.Helper()
+	if !NegotiateVersion(conn, map[string]interface{}{"version": float64(version)}) {
+		t.Fatalf("version %d was refused", version)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(versions, conn)
+		mu.Unlock()
+	})
+}
+
+// markSubscribed records a connection as subscribed to a channel without a broker
+func markSubscribed(t *testing.T, conn *websocket.Conn, channel string) {
+	t.Helper()
+	mu.Lock()
+	if subscriptions[conn] == nil {
+		subscriptions[conn] = make(map[string]*broker.Subscription)
+	}
+	subscriptions[conn][channel] = &broker.Subscription{}
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(subscriptions, conn)
+		mu.Unlock()
+	})
+}
+
+// readJSON reads the next message a client received and decodes it into v
+func readJSON(t *testing.T, client *websocket.Conn, v interface{}) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, payload, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Fatalf("decode %s: %v", payload, err)
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	tests := []struct {
+		name    string
+		channel string
+		payload string
+		want    string
+	}{
+		{"ID from the payload", "news", `{"message_id":"abc","text":"hi"}`, "abc"},
+		{"derived for JSON without an ID", "news", `{"text":"hi"}`, "077c31060021224b66c83d4d75f2dff2e091dee7"},
+		{"derived for plain text", "news", "hi", "6067e42d0123dcd0f9f6c78bc8d42e8528004a46"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MessageID(tt.channel, tt.payload); got != tt.want {
+				t.Errorf("MessageID(%q, %q) = %q, want %q", tt.channel, tt.payload, got, tt.want)
+			}
+		})
+	}
+
+	if MessageID("news", "hi") == MessageID("sports", "hi") {
+		t.Error("the same payload on two channels got the same ID")
+	}
+}
+
+func TestAckReceipts(t *testing.T) {
+	store, rdb := testRedis(t)
+	cfg := &config.Config{}
+	cfg.Server.ACL = []config.ACLRule{{Pattern: "news", Read: true}}
+	cfg.Server.Acks.ReceiptTTL = 60
+
+	alice, aliceClient := testConn(t)
+	useVersion(t, alice, ProtocolV2)
+	SetConnectionUser(alice, auth.TokenInfo{UserID: "alice"})
+	t.Cleanup(func() { SetConnectionUser(alice, auth.TokenInfo{}) })
+	markSubscribed(t, alice, "news")
+
+	anonymous, _ := testConn(t)
+	useVersion(t, anonymous, ProtocolV2)
+	markSubscribed(t, anonymous, "news")
+
+	ack := map[string]interface{}{"action": "ack", "channel": "news", "message_id": "m1"}
+	HandleAck(rdb, alice, ack, cfg)
+	HandleAck(rdb, anonymous, ack, cfg)
+	HandleAck(rdb, anonymous, ack, cfg)
+
+	key := "gopush:acks:news:m1"
+	if ttl := store.TTL(key); ttl != time.Minute {
+		t.Errorf("receipts TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	HandleReceipts(rdb, alice, map[string]interface{}{"action": "receipts", "channel": "news", "message_id": "m1"}, cfg)
+	var got ReceiptsMessage
+	readJSON(t, aliceClient, &got)
+	if got.Event != "receipts" || got.Channel != "news" || got.MessageID != "m1" {
+		t.Errorf("receipts message = %+v", got)
+	}
+	var subscribers []string
+	for subscriber := range got.Receipts {
+		subscribers = append(subscribers, subscriber)
+	}
+	want := map[string]bool{"user:alice": true, "conn:" + connID(anonymous): true}
+	if len(got.Receipts) != len(want) {
+		t.Fatalf("receipts from %q, want %v", subscribers, want)
+	}
+	for _, subscriber := range subscribers {
+		if !want[subscriber] {
+			t.Errorf("unexpected receipt from %q", subscriber)
+		}
+	}
+}
+
+func TestAckErrors(t *testing.T) {
+	_, rdb := testRedis(t)
+	cfg := &config.Config{}
+	cfg.Server.ACL = []config.ACLRule{{Pattern: "news", Read: true}}
+
+	conn, client := testConn(t)
+	useVersion(t, conn, ProtocolV2)
+	markSubscribed(t, conn, "news")
+
+	tests := []struct {
+		name   string
+		handle func(redis.UniversalClient, *websocket.Conn, map[string]interface{}, *config.Config)
+		data   map[string]interface{}
+		want   ErrorCode
+	}{
+		{"ack without a message ID", HandleAck, map[string]interface{}{"action": "ack", "channel": "news"}, ErrMessageIDMissing},
+		{"ack without a channel", HandleAck, map[string]interface{}{"action": "ack", "message_id": "m1"}, ErrChannelMissing},
+		{"ack on a channel not subscribed to", HandleAck, map[string]interface{}{"action": "ack", "channel": "sports", "message_id": "m1"}, ErrForbidden},
+		{"receipts without a message ID", HandleReceipts, map[string]interface{}{"action": "receipts", "channel": "news"}, ErrMessageIDMissing},
+		{"receipts of a channel the ACL denies", HandleReceipts, map[string]interface{}{"action": "receipts", "channel": "sports", "message_id": "m1"}, ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.handle(rdb, conn, tt.data, cfg)
+			var got ErrorMessage
+			readJSON(t, client, &got)
+			want := ErrorMessage{Status: "error", Event: "error", Code: tt.want, Action: tt.data["action"].(string), ConnID: connID(conn)}
+			got.Message = ""
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("error = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/acl"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Grants is what a client authenticated with, which decides the channels it may use.
+// Clients of other protocols than WebSocket are checked against the same rules with it.
+type Grants struct {
+	Identity string   // Client certificate identity, empty for token-authenticated clients
+	AppKey   string   // Tenant app, empty in single-tenant mode
+	Channels []string // Channel names or patterns the authorize response limited the user to
+	Scopes   []string // OAuth2 scopes of the token
+	Roles    []string // Roles of the token
+}
+
+// grantsOf returns the grants of a WebSocket connection
+func grantsOf(conn *websocket.Conn) Grants {
+	return Grants{
+		Identity: identityOf(conn),
+		AppKey:   appOf(conn).key,
+		Channels: userOf(conn).channels,
+		Scopes:   scopesOf(conn),
+		Roles:    rolesOf(conn),
+	}
+}
+
+// aclRules returns the channel rules that apply to a client. Rules of a client
+// certificate identity take precedence, then a tenant app's own rules, which replace
+// the server-wide rules for its connections.
+func aclRules(grants Grants, config *config.Config) []config.ACLRule {
+	if grants.Identity != "" {
+		if rules := config.Identities[grants.Identity].ACL; len(rules) > 0 {
+			return rules
+		}
+	}
+	if grants.AppKey != "" {
+		if app, _ := apps.Lookup(config, grants.AppKey); len(app.ACL) > 0 {
+			return app.ACL
+		}
+	}
+	return config.Server.ACL
+}
+
+// roleRules returns the channel rules of each role for a client. A tenant app's own
+// role map replaces the server-wide one for its connections.
+func roleRules(grants Grants, config *config.Config) map[string][]config.ACLRule {
+	if grants.AppKey != "" {
+		if app, _ := apps.Lookup(config, grants.AppKey); len(app.Roles) > 0 {
+			return app.Roles
+		}
+	}
+	return config.Server.Roles
+}
+
+// grantedRules returns the rule sets granted by a client's token scopes and roles that
+// have an entry in scope_acl or the role map
+func grantedRules(grants Grants, config *config.Config) (sets [][]config.ACLRule) {
+	scopeACL := config.Server.Authorize.Introspection.ScopeACL
+	for _, scope := range grants.Scopes {
+		if rules, ok := scopeACL[scope]; ok {
+			sets = append(sets, rules)
+		}
+	}
+
+	roles := roleRules(grants, config)
+	for _, role := range grants.Roles {
+		if rules, ok := roles[role]; ok {
+			sets = append(sets, rules)
+		}
+	}
+	return sets
+}
+
+// ChannelAllowed reports whether a client holds a permission on a channel. Clients whose
+// tokens carry mapped scopes or roles are authorized by those alone, any of which may
+// grant access; other clients fall back to aclRules. The broadcast channel is never allowed.
+func ChannelAllowed(grants Grants, channel string, permission acl.Permission, config *config.Config) bool {
+	if app, _ := apps.Lookup(config, grants.AppKey); app.Namespace+channel == BroadcastChannel {
+		return false
+	}
+
+	// Channels granted by the authorize response narrow every other rule
+	if !acl.Granted(grants.Channels, channel) {
+		return false
+	}
+
+	if sets := grantedRules(grants, config); len(sets) > 0 {
+		for _, rules := range sets {
+			if acl.Allowed(rules, channel, permission) {
+				return true
+			}
+		}
+		return false
+	}
+	return acl.Allowed(aclRules(grants, config), channel, permission)
+}
+
+// allowed reports whether a connection holds a permission on a channel
+func allowed(conn *websocket.Conn, channel string, permission acl.Permission, config *config.Config) bool {
+	return ChannelAllowed(grantsOf(conn), channel, permission, config)
+}
+
+// CanPublish reports whether a connection may publish to a channel
+func CanPublish(conn *websocket.Conn, channel string, config *config.Config) bool {
+	return allowed(conn, channel, acl.Write, config)
+}
+
+// canSubscribe reports whether a connection may subscribe to a channel
+func canSubscribe(conn *websocket.Conn, channel string, config *config.Config) bool {
+	return allowed(conn, channel, acl.Read, config)
+}
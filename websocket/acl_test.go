@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/sahakavatar/gopush/acl"
+	"github.com/sahakavatar/gopush/config"
+)
+
+func TestChannelAllowed(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.ACL = []config.ACLRule{
+		{Pattern: "public.*", Read: true},
+		{Pattern: "chat.*", Read: true, Write: true},
+	}
+	cfg.Server.Roles = map[string][]config.ACLRule{
+		"support": {{Pattern: "tickets.*", Read: true, Write: true}},
+	}
+	cfg.Server.Authorize.Introspection.ScopeACL = map[string][]config.ACLRule{
+		"orders:read": {{Pattern: "orders.*", Read: true}},
+	}
+	cfg.Identities = map[string]config.Identity{
+		"billing-service": {ACL: []config.ACLRule{{Pattern: "invoices.*", Read: true, Write: true}}},
+	}
+	cfg.Apps = map[string]config.App{
+		"tenant": {
+			Namespace: "tenant:",
+			ACL:       []config.ACLRule{{Pattern: "tenant-only", Read: true}},
+			Roles:     map[string][]config.ACLRule{"support": {{Pattern: "desk", Read: true}}},
+		},
+		"plain":    {Namespace: "plain:"},
+		"reserved": {Namespace: "gopush:", ACL: []config.ACLRule{{Pattern: "*", Read: true}}},
+	}
+
+	tests := []struct {
+		name       string
+		grants     Grants
+		channel    string
+		permission acl.Permission
+		want       bool
+	}{
+		{"server ACL allows reading", Grants{}, "public.news", acl.Read, true},
+		{"server ACL denies writing", Grants{}, "public.news", acl.Write, false},
+		{"server ACL denies unmatched channels", Grants{}, "private", acl.Read, false},
+		{"granted channels narrow the ACL", Grants{Channels: []string{"chat.a"}}, "chat.b", acl.Read, false},
+		{"granted channel passes the ACL", Grants{Channels: []string{"chat.a"}}, "chat.a", acl.Write, true},
+		{"role replaces the ACL", Grants{Roles: []string{"support"}}, "tickets.1", acl.Write, true},
+		{"role alone decides", Grants{Roles: []string{"support"}}, "chat.room", acl.Read, false},
+		{"unmapped role falls back to the ACL", Grants{Roles: []string{"guest"}}, "chat.room", acl.Write, true},
+		{"scope grants its rules", Grants{Scopes: []string{"orders:read"}}, "orders.7", acl.Read, true},
+		{"scope grants nothing more", Grants{Scopes: []string{"orders:read"}}, "orders.7", acl.Write, false},
+		{"any scope or role may allow", Grants{Scopes: []string{"orders:read"}, Roles: []string{"support"}}, "tickets.1", acl.Read, true},
+		{"identity ACL replaces the others", Grants{Identity: "billing-service"}, "invoices.9", acl.Write, true},
+		{"identity without rules uses the server ACL", Grants{Identity: "unknown"}, "public.news", acl.Read, true},
+		{"app ACL replaces the server ACL", Grants{AppKey: "tenant"}, "public.news", acl.Read, false},
+		{"app ACL allows its channels", Grants{AppKey: "tenant"}, "tenant-only", acl.Read, true},
+		{"app roles replace the server roles", Grants{AppKey: "tenant", Roles: []string{"support"}}, "desk", acl.Read, true},
+		{"app without an ACL uses the server ACL", Grants{AppKey: "plain"}, "public.news", acl.Read, true},
+		{"broadcast channel is never allowed", Grants{}, BroadcastChannel, acl.Read, false},
+		{"broadcast channel through a namespace", Grants{AppKey: "reserved"}, "broadcast", acl.Read, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChannelAllowed(tt.grants, tt.channel, tt.permission, cfg); got != tt.want {
+				t.Errorf("ChannelAllowed(%+v, %q, %s) = %v, want %v", tt.grants, tt.channel, tt.permission, got, tt.want)
+			}
+		})
+	}
+}
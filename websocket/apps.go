@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/apps"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/reporting"
+	"golang.org/x/net/context"
+)
+
+// connectionApp is the tenant app a connection presented at upgrade
+type connectionApp struct {
+	key       string
+	namespace string
+}
+
+// Tenant app of each connection, absent in single-tenant mode
+var connApps = make(map[*websocket.Conn]connectionApp)
+
+// SetConnectionApp records the tenant app a connection belongs to
+func SetConnectionApp(conn *websocket.Conn, appKey string, config *config.Config) {
+	if appKey == "" {
+		return
+	}
+
+	app, _ := apps.Lookup(config, appKey)
+	mu.Lock()
+	connApps[conn] = connectionApp{key: appKey, namespace: app.Namespace}
+	mu.Unlock()
+}
+
+func appOf(conn *websocket.Conn) connectionApp {
+	mu.Lock()
+	defer mu.Unlock()
+	return connApps[conn]
+}
+
+// RedisChannel maps a client-visible channel name to the Redis channel in the connection's app namespace
+func RedisChannel(conn *websocket.Conn, channel string) string {
+	return appOf(conn).namespace + channel
+}
+
+// AllowPublish reports whether the connection's app is within its publish quota
+func AllowPublish(conn *websocket.Conn, config *config.Config) bool {
+	key := appOf(conn).key
+	if key == "" {
+		return true
+	}
+
+	app, _ := apps.Lookup(config, key)
+	return apps.AllowPublish(key, app)
+}
+
+// validateToken validates a token against the authorize URL of the connection's app,
+// passing along the client details captured at upgrade and the channel, if any
+func validateToken(ctx context.Context, rdb redis.UniversalClient, conn *websocket.Conn, token, channel string, config *config.Config) (auth.TokenInfo, error) {
+	request := authorizeRequestOf(conn)
+	request.Token = token
+	request.Channel = channel
+	ctx = reporting.WithFields(ctx, reportFields(conn, channel))
+	return apps.ValidateToken(ctx, rdb, config, appOf(conn).key, request)
+}
+
+// channelSecrets returns the secrets a connection's channel signatures may be signed with.
+// Connections of a tenant app only accept signatures made with that app's secret.
+func channelSecrets(conn *websocket.Conn, config *config.Config) map[string]string {
+	if key := appOf(conn).key; key != "" {
+		app, _ := apps.Lookup(config, key)
+		return map[string]string{key: app.Secret}
+	}
+	return config.Server.ChannelAuth.Secrets
+}
@@ -0,0 +1,32 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/audit"
+)
+
+// auditEvent returns an audit event carrying the identity of a connection
+func auditEvent(conn *websocket.Conn) audit.Event {
+	return audit.Event{
+		ConnID:     connID(conn),
+		RemoteAddr: remoteAddr(conn),
+		User:       UserID(conn),
+		Identity:   identityOf(conn),
+		App:        appOf(conn).key,
+	}
+}
+
+// Audit records an action of a connection in the audit log
+func Audit(conn *websocket.Conn, action, outcome, channel, reason string) {
+	recordAudit(auditEvent(conn), action, outcome, channel, reason)
+}
+
+// recordAudit records an action in the audit log under an identity captured earlier,
+// for connections whose state may already be gone
+func recordAudit(event audit.Event, action, outcome, channel, reason string) {
+	event.Action = action
+	event.Outcome = outcome
+	event.Channel = channel
+	event.Reason = reason
+	audit.Record(event)
+}
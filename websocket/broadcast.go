@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/metrics"
+	"golang.org/x/net/context"
+)
+
+// BroadcastChannel is the reserved broker channel carrying messages for every client of
+// every server. Clients can neither subscribe nor publish to it.
+const BroadcastChannel = "gopush:broadcast"
+
+// BroadcastMessage is delivered to every connected client regardless of its subscriptions,
+// such as a maintenance notice or a request to refresh
+type BroadcastMessage struct {
+	Event         string          `json:"event"` // Always "broadcast"
+	Type          string          `json:"type,omitempty"`
+	Message       json.RawMessage `json:"message,omitempty"`
+	MessageID     string          `json:"message_id"`
+	PublishedAtMs int64           `json:"published_at_ms"`
+}
+
+// Broadcast publishes a message that every server delivers to all of its clients
+func Broadcast(ctx context.Context, kind string, payload json.RawMessage) (string, error) {
+	message := BroadcastMessage{
+		Event:         "broadcast",
+		Type:          kind,
+		Message:       payload,
+		MessageID:     NewMessageID(),
+		PublishedAtMs: time.Now().UnixMilli(),
+	}
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode broadcast: %v", err)
+	}
+	return message.MessageID, Publish(ctx, BroadcastChannel, encoded)
+}
+
+// ListenForBroadcasts subscribes this server to the broadcast channel for as long as it runs
+func ListenForBroadcasts() error {
+	_, err := messageBroker.Subscribe(BroadcastChannel, func(msg broker.Message) error {
+		if msg.Gap {
+			return nil
+		}
+
+		connIDsMu.Lock()
+		conns := make([]*websocket.Conn, 0, len(connIDs))
+		for conn := range connIDs {
+			conns = append(conns, conn)
+		}
+		connIDsMu.Unlock()
+
+		// Each client is written to on its own so a slow one does not hold up the others
+		for _, conn := range conns {
+			go deliverBroadcast(conn, msg.Payload)
+		}
+		logger.Info("Delivered broadcast", "connections", len(conns))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %v", BroadcastChannel, err)
+	}
+	return nil
+}
+
+func deliverBroadcast(conn *websocket.Conn, message string) {
+	if err := writeToClient(conn, message); err != nil {
+		ConnLogger(conn).Warn("Failed to send broadcast", "error", err)
+		reportWriteError(conn, "", err)
+		return
+	}
+	delivered.mark()
+	metrics.MessageOut(BroadcastChannel, len(message))
+}
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/metrics"
+	"github.com/sahakavatar/gopush/push"
+	"github.com/sahakavatar/gopush/reporting"
+	"github.com/sahakavatar/gopush/tracing"
+	"github.com/sahakavatar/gopush/webhooks"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+)
+
+// Broker carrying channel messages between servers, set at startup
+var messageBroker broker.Broker
+
+// Broker subscriptions of each connection, keyed by channel
+var subscriptions = make(map[*websocket.Conn]map[string]*broker.Subscription)
+
+// SetBroker sets the message broker used to publish and subscribe
+func SetBroker(b broker.Broker) {
+	messageBroker = b
+}
+
+// Publish sends a message to every subscriber of a channel, on any server
+func Publish(ctx context.Context, redisChannel string, message []byte) error {
+	ctx, span := tracing.Start(ctx, "websocket.publish", attribute.String("channel", redisChannel))
+	err := messageBroker.Publish(ctx, redisChannel, message)
+	tracing.End(span, err)
+	if err == nil {
+		published.mark()
+		metrics.MessageIn(redisChannel, len(message))
+		if redisChannel != BroadcastChannel {
+			if !tapped {
+				webhooks.Dispatch(redisChannel, message)
+				push.Notify(redisChannel, message)
+			}
+		}
+	}
+	return err
+}
+
+// listen forwards a channel's messages to a client until the subscription expires, the
+// client subscribes to the channel again or disconnects. For a resumed channel, missed
+// messages are sent first; live ones arriving meanwhile are held back and sent after
+// them, except those the replay already contained.
+func listen(conn *websocket.Conn, channel string, ack bool, missed *missedMessages, config *config.Config) {
+	if key, ok := keyspaceKey(channel, config); ok {
+		SubscribeToKeyspace(conn, channel, key, config)
+		if missed != nil {
+			missed.replayed(0)
+		}
+		return
+	}
+
+	redisChannel := RedisChannel(conn, channel)
+	deliver := func(msg broker.Message) error {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				reporting.Panic(recovered, reportFields(conn, channel))
+			}
+		}()
+
+		if msg.Gap {
+			notifyGap(conn, channel)
+			return nil
+		}
+		// Messages arriving after the expiry are dropped, the timer below ends the subscription
+		if untilExpiry(conn, channel) == 0 {
+			return nil
+		}
+
+		_, span := tracing.Start(context.Background(), "websocket.deliver", attribute.String("conn_id", connID(conn)), attribute.String("channel", channel))
+		defer span.End()
+
+		ConnLogger(conn).Debug("Received message", "channel", channel, "payload", msg.Payload)
+		message := msg.Payload
+		if ack {
+			message = MarshalDelivery(channel, msg.Payload)
+		}
+		if err := writeToClient(conn, message); err != nil {
+			tracing.Fail(span, err)
+			ConnLogger(conn).Warn("Failed to send WebSocket message", "channel", channel, "error", err)
+			reportWriteError(conn, channel, err)
+			return err
+		}
+		delivered.mark()
+		metrics.MessageOut(redisChannel, len(message))
+		if metrics.Enabled() {
+			if publishedAt, ok := PublishedAt(msg.Payload); ok {
+				metrics.Delivered(redisChannel, publishedAt)
+			}
+		}
+		return nil
+	}
+
+	var held struct {
+		sync.Mutex
+		replaying bool
+		messages  []broker.Message
+	}
+	held.replaying = missed != nil
+
+	sub, err := messageBroker.Subscribe(redisChannel, func(msg broker.Message) error {
+		held.Lock()
+		defer held.Unlock()
+		if held.replaying {
+			held.messages = append(held.messages, msg)
+			return nil
+		}
+		return deliver(msg)
+	})
+	if err != nil {
+		ConnLogger(conn).Error("Failed to subscribe", "channel", channel, "error", err)
+		reportError(conn, channel, fmt.Errorf("failed to subscribe: %v", err))
+		mu.Lock()
+		delete(clients, conn)
+		mu.Unlock()
+		return
+	}
+
+	mu.Lock()
+	if subscriptions[conn] == nil {
+		subscriptions[conn] = make(map[string]*broker.Subscription)
+	}
+	previous := subscriptions[conn][channel]
+	subscriptions[conn][channel] = sub
+	mu.Unlock()
+	if previous != nil {
+		messageBroker.Unsubscribe(previous)
+	}
+
+	if missed != nil {
+		// Subscribed first, so nothing published during the replay is lost
+		replayed := make(map[string]bool)
+		messages := history(conn, channel, missed.since)
+		for _, payload := range messages {
+			replayed[MessageID(redisChannel, payload)] = true
+			deliver(broker.Message{Channel: redisChannel, Payload: payload})
+		}
+
+		held.Lock()
+		for _, msg := range held.messages {
+			if msg.Gap || !replayed[MessageID(redisChannel, msg.Payload)] {
+				deliver(msg)
+			}
+		}
+		held.replaying, held.messages = false, nil
+		held.Unlock()
+
+		missed.replayed(len(messages))
+	}
+
+	// The connection's state may be gone by the time it unsubscribes
+	identity := auditEvent(conn)
+	lifecycle := lifecycleEvent(conn, channel)
+	notify(lifecycle, webhooks.EventSubscribe)
+
+	metrics.Subscribed(redisChannel)
+	defer func() {
+		messageBroker.Unsubscribe(sub)
+		metrics.Unsubscribed(redisChannel)
+
+		mu.Lock()
+		delete(clients, conn)
+		if subscriptions[conn][channel] == sub {
+			delete(subscriptions[conn], channel)
+		}
+		mu.Unlock()
+
+		ConnLogger(conn).Info("Client unsubscribed", "channel", channel)
+		recordAudit(identity, audit.ActionUnsubscribe, audit.OutcomeAllowed, channel, "")
+		notify(lifecycle, webhooks.EventUnsubscribe)
+	}()
+
+	// Wake up when the subscription is due to expire; refresh_token may push it back
+	expiry := time.NewTimer(untilExpiry(conn, channel))
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-sub.Done():
+			return
+		case <-expiry.C:
+			if remaining := untilExpiry(conn, channel); remaining > 0 {
+				expiry.Reset(remaining)
+				continue
+			}
+			expireSubscription(conn, channel)
+			return
+		}
+	}
+}
+
+// unsubscribeAll stops every broker subscription and keyspace watch of a connection
+func unsubscribeAll(conn *websocket.Conn) {
+	stopKeyspaceWatches(conn)
+
+	mu.Lock()
+	subs := subscriptions[conn]
+	delete(subscriptions, conn)
+	mu.Unlock()
+
+	for _, sub := range subs {
+		messageBroker.Unsubscribe(sub)
+	}
+}
@@ -0,0 +1,26 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Messages shorter than this many bytes are written uncompressed
+var compressionThreshold int
+
+// SetCompressionThreshold sets the minimum message size that is compressed when permessage-deflate is negotiated
+func SetCompressionThreshold(minSize int) {
+	compressionThreshold = minSize
+}
+
+// ConfigureCompression applies the configured compression level to a connection.
+// It has no effect unless the client negotiated permessage-deflate during the upgrade.
+func ConfigureCompression(conn *websocket.Conn, config *config.Config) {
+	if !config.Server.Compression.Enabled || config.Server.Compression.Level == 0 {
+		return
+	}
+
+	if err := conn.SetCompressionLevel(config.Server.Compression.Level); err != nil {
+		ConnLogger(conn).Warn("Invalid compression level", "level", config.Server.Compression.Level, "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseDisconnected is the close code sent to clients disconnected through the admin API
+const CloseDisconnected = 4004
+
+// Reason sent in the close frame when the admin gives none
+const defaultDisconnectReason = "Disconnected by the server"
+
+// Longest reason a close frame can carry next to its code
+const maxCloseReason = 123
+
+// DisconnectConnection closes the connection with the given ID, sending the reason in the
+// close frame. It reports whether the connection was found.
+func DisconnectConnection(id, reason string) bool {
+	var found *websocket.Conn
+	connIDsMu.Lock()
+	for conn, entry := range connIDs {
+		if entry.id == id {
+			found = conn
+			break
+		}
+	}
+	connIDsMu.Unlock()
+
+	if found == nil {
+		return false
+	}
+	disconnect([]*websocket.Conn{found}, reason)
+	return true
+}
+
+// DisconnectChannel closes every connection subscribed to a channel, sending the reason
+// in the close frame, and returns how many were closed
+func DisconnectChannel(channel, reason string) int {
+	var affected []*websocket.Conn
+	mu.Lock()
+	for conn, channels := range subscriptions {
+		if _, ok := channels[channel]; ok {
+			affected = append(affected, conn)
+		}
+	}
+	mu.Unlock()
+
+	disconnect(affected, reason)
+	return len(affected)
+}
+
+// disconnect closes connections at the admin's request. Closing the socket ends each
+// connection's read loop, which releases its state.
+func disconnect(conns []*websocket.Conn, reason string) {
+	if reason == "" {
+		reason = defaultDisconnectReason
+	}
+	reason = truncateReason(reason)
+
+	for _, conn := range conns {
+		ConnLogger(conn).Info("Closing connection at admin request", "reason", reason)
+		CloseConnection(conn, CloseDisconnected, reason)
+		conn.Close()
+	}
+}
+
+// DrainConnections closes every open connection with code 1012 (service restart), spread
+// evenly over the period so the clients do not all reconnect at the same moment. It returns
+// how many connections were closed.
+func DrainConnections(period time.Duration) int {
+	connIDsMu.Lock()
+	conns := make([]*websocket.Conn, 0, len(connIDs))
+	for conn := range connIDs {
+		conns = append(conns, conn)
+	}
+	connIDsMu.Unlock()
+
+	if len(conns) == 0 {
+		return 0
+	}
+	interval := period / time.Duration(len(conns))
+	for i, conn := range conns {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		CloseConnection(conn, websocket.CloseServiceRestart, "Server restarting")
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// truncateReason shortens a close reason to fit a close frame without splitting a character
+func truncateReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	reason = reason[:maxCloseReason]
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
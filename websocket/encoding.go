@@ -0,0 +1,116 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackSubprotocol is the Sec-WebSocket-Protocol value clients request to exchange
+// MessagePack envelopes over binary frames instead of JSON text frames
+const MsgpackSubprotocol = "msgpack"
+
+// ProtobufSubprotocol is the Sec-WebSocket-Protocol value clients request to exchange
+// protobuf Envelope messages (see proto/envelope.proto) over binary frames
+const ProtobufSubprotocol = "protobuf"
+
+// Subprotocols lists the wire encodings the server can negotiate during the upgrade
+var Subprotocols = []string{MsgpackSubprotocol, ProtobufSubprotocol}
+
+// Binary encoding negotiated by each connection, absent for JSON clients
+var encodings = make(map[*websocket.Conn]string)
+
+// RegisterEncoding records the encoding a connection negotiated during the upgrade
+func RegisterEncoding(conn *websocket.Conn) {
+	subprotocol := conn.Subprotocol()
+	if subprotocol == "" {
+		return
+	}
+
+	mu.Lock()
+	encodings[conn] = subprotocol
+	mu.Unlock()
+}
+
+func encodingOf(conn *websocket.Conn) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return encodings[conn]
+}
+
+// DecodeMessage decodes an inbound frame into an action envelope using the connection's encoding
+func DecodeMessage(conn *websocket.Conn, messageType int, message []byte) (map[string]interface{}, error) {
+	if messageType == websocket.BinaryMessage {
+		switch encodingOf(conn) {
+		case MsgpackSubprotocol:
+			var data map[string]interface{}
+			if err := msgpack.Unmarshal(message, &data); err != nil {
+				return nil, fmt.Errorf("invalid MessagePack envelope: %v", err)
+			}
+			return data, nil
+		case ProtobufSubprotocol:
+			return decodeProtobuf(message)
+		}
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(message, &data); err != nil {
+		return nil, fmt.Errorf("invalid JSON envelope: %v", err)
+	}
+	return data, nil
+}
+
+// encodeMessage converts an outgoing message to the frame type and encoding the connection negotiated
+func encodeMessage(conn *websocket.Conn, message string) (int, []byte, error) {
+	switch encodingOf(conn) {
+	case MsgpackSubprotocol:
+		encoded, err := transcodeToMsgpack(message)
+		return websocket.BinaryMessage, encoded, err
+	case ProtobufSubprotocol:
+		encoded, err := transcodeToProtobuf(message)
+		return websocket.BinaryMessage, encoded, err
+	default:
+		return websocket.TextMessage, []byte(message), nil
+	}
+}
+
+// transcodeToMsgpack converts an outgoing JSON message to MessagePack.
+// Messages that are not JSON (such as plain status strings) are encoded as a MessagePack string.
+func transcodeToMsgpack(message string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(message)))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return msgpack.Marshal(message)
+	}
+	return msgpack.Marshal(normalizeNumbers(value))
+}
+
+// normalizeNumbers replaces json.Number values with integers where possible so they
+// are encoded as MessagePack integers rather than floats
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
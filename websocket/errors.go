@@ -0,0 +1,91 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/redisconn"
+)
+
+// ErrorCode is a machine-readable identifier for a failed client action
+type ErrorCode string
+
+// Error codes sent to clients in ErrorMessage.Code
+const (
+	ErrInvalidMessage     ErrorCode = "invalid_message"      // The frame could not be decoded
+	ErrActionMissing      ErrorCode = "action_missing"       // The message has no action
+	ErrUnknownAction      ErrorCode = "unknown_action"       // The action is not supported
+	ErrTokenMissing       ErrorCode = "token_missing"        // Subscribe was sent without a token
+	ErrTokenInvalid       ErrorCode = "token_invalid"        // The token failed validation
+	ErrAuthUnavailable    ErrorCode = "auth_unavailable"     // The auth service could not answer, retry later
+	ErrSignatureInvalid   ErrorCode = "signature_invalid"    // The channel signature does not match
+	ErrForbidden          ErrorCode = "forbidden"            // The ACL does not grant access to the channel
+	ErrChannelMissing     ErrorCode = "channel_missing"      // The action requires a channel
+	ErrMessageIDMissing   ErrorCode = "message_id_missing"   // Ack or receipts was sent without a message ID
+	ErrResumeTokenMissing ErrorCode = "resume_token_missing" // Resume was sent without a resume token
+	ErrResumeTokenInvalid ErrorCode = "resume_token_invalid" // The resume token is unknown or expired
+	ErrRateLimited        ErrorCode = "rate_limited"         // The connection is sending too fast
+	ErrQuotaExceeded      ErrorCode = "quota_exceeded"       // The connection's app is over its publish quota
+	ErrMessageTooLarge    ErrorCode = "message_too_large"    // The payload exceeds the configured limit
+	ErrPublishFailed      ErrorCode = "publish_failed"       // The message could not be published to Redis
+	ErrTimeout            ErrorCode = "timeout"              // Redis did not answer in time, retry later
+	ErrInternal           ErrorCode = "internal_error"       // A server-side failure unrelated to the request
+	ErrUnauthorized       ErrorCode = "unauthorized"         // A REST API request has no valid API key or signature
+	ErrUserUnknown        ErrorCode = "user_unknown"         // The action needs a user, which the auth service did not report
+	ErrDeviceInvalid      ErrorCode = "device_invalid"       // The device has no token or a platform push is not enabled for
+	ErrTooManyDevices     ErrorCode = "too_many_devices"     // The user registered the most devices allowed
+)
+
+// ErrorMessage is sent to a client when one of its actions fails
+type ErrorMessage struct {
+	Status    string    `json:"status"`
+	Event     string    `json:"event"`
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Action    string    `json:"action,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	ConnID    string    `json:"conn_id,omitempty"` // Quote it when reporting a problem
+}
+
+// SendError reports a failed action to a client. The action and the optional
+// client-supplied request_id are echoed from the request so clients can correlate them.
+func SendError(conn *websocket.Conn, data map[string]interface{}, code ErrorCode, message string) {
+	// Protocol v1 clients only understand the plain-text message
+	if protocolVersion(conn) == ProtocolV1 {
+		SendMessageToClient(conn, message)
+		return
+	}
+
+	errorMessage := ErrorMessage{
+		Status:  "error",
+		Event:   "error",
+		Code:    code,
+		Message: message,
+		ConnID:  connID(conn),
+	}
+	if data != nil {
+		errorMessage.Action, _ = data["action"].(string)
+		errorMessage.RequestID, _ = data["request_id"].(string)
+	}
+
+	SendMessageToClient(conn, MarshalMessage(errorMessage))
+}
+
+// sendRedisError reports a failed Redis operation, telling the client to retry when it
+// only timed out
+func sendRedisError(conn *websocket.Conn, data map[string]interface{}, err error, code ErrorCode, message string) {
+	if redisconn.IsTimeout(err) {
+		SendError(conn, data, ErrTimeout, "Timed out, try again later")
+		return
+	}
+	SendError(conn, data, code, message)
+}
+
+// sendTokenError reports a failed token validation, telling the client to retry later
+// when the auth service was unavailable instead of claiming the token is invalid
+func sendTokenError(conn *websocket.Conn, data map[string]interface{}, err error) {
+	if auth.IsUnavailable(err) {
+		SendError(conn, data, ErrAuthUnavailable, "Authorization service unavailable, try again later")
+		return
+	}
+	SendError(conn, data, ErrTokenInvalid, "Token validation failed")
+}
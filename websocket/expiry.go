@@ -0,0 +1,78 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// ExpiredMessage tells a client that a subscription lapsed and no more messages will be forwarded
+type ExpiredMessage struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	Channel   string `json:"channel"`
+	Event     string `json:"event"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Expiry (Unix seconds) of each subscription, keyed by connection and channel
+var expiries = make(map[*websocket.Conn]map[string]int64)
+
+// How long to wait before checking a subscription that never expires
+const noExpiryCheckInterval = time.Hour
+
+// expirationTime returns when a subscription authorized now expires, or 0 when
+// subscriptions do not expire because no cache timeout is configured
+func expirationTime(config *config.Config) int64 {
+	if config.Server.Authorize.CashTimeOut <= 0 {
+		return 0
+	}
+	return time.Now().Add(time.Duration(config.Server.Authorize.CashTimeOut) * time.Minute).Unix()
+}
+
+// trackExpiry records when a connection's subscription to a channel expires
+func trackExpiry(conn *websocket.Conn, channel string, expiresAt int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	if expiries[conn] == nil {
+		expiries[conn] = make(map[string]int64)
+	}
+	expiries[conn][channel] = expiresAt
+}
+
+// untilExpiry returns how long a subscription has left. It is never negative; untracked
+// subscriptions and subscriptions without an expiry report a long interval.
+func untilExpiry(conn *websocket.Conn, channel string) time.Duration {
+	mu.Lock()
+	expiresAt := expiries[conn][channel]
+	mu.Unlock()
+
+	if expiresAt == 0 {
+		return noExpiryCheckInterval
+	}
+	remaining := time.Until(time.Unix(expiresAt, 0))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// expireSubscription stops tracking a lapsed subscription and tells the client to re-authenticate
+func expireSubscription(conn *websocket.Conn, channel string) {
+	mu.Lock()
+	expiresAt := expiries[conn][channel]
+	delete(expiries[conn], channel)
+	mu.Unlock()
+
+	SendMessageToClient(conn, MarshalMessage(ExpiredMessage{
+		Status:    "error",
+		Message:   fmt.Sprintf("Subscription to channel %s expired, subscribe again with a valid token", channel),
+		Channel:   channel,
+		Event:     "expired",
+		ExpiresAt: expiresAt,
+	}))
+
+	ConnLogger(conn).Info("Subscription expired", "channel", channel)
+}
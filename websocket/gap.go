@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// GapMessage warns a client that its subscription was interrupted and messages published
+// in the meantime may not have been delivered
+type GapMessage struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Channel string `json:"channel"`
+	Event   string `json:"event"`
+}
+
+// subscriptionActive reports whether a connection still holds a subscription to a channel
+func subscriptionActive(conn *websocket.Conn, channel string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := expiries[conn][channel]
+	return ok
+}
+
+// notifyGap tells a client that messages on a channel may have been missed
+func notifyGap(conn *websocket.Conn, channel string) {
+	SendMessageToClient(conn, MarshalMessage(GapMessage{
+		Status:  "warning",
+		Message: fmt.Sprintf("Subscription to channel %s was interrupted, messages may have been missed", channel),
+		Channel: channel,
+		Event:   "gap",
+	}))
+
+	ConnLogger(conn).Warn("Notified client of a possible gap", "channel", channel)
+}
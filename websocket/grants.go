@@ -0,0 +1,62 @@
+package websocket
+
+import (
+	"sort"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/auth"
+)
+
+// OAuth2 scopes granted to each connection by the tokens it authenticated with
+var connScopes = make(map[*websocket.Conn]map[string]bool)
+
+// Roles granted to each connection by the tokens it authenticated with
+var connRoles = make(map[*websocket.Conn]map[string]bool)
+
+// SetConnectionGrants records the scopes and roles of the token a connection presented during the upgrade
+func SetConnectionGrants(conn *websocket.Conn, info auth.TokenInfo) {
+	rememberGrants(conn, info)
+}
+
+// rememberGrants records the scopes and roles of a validated token on a connection.
+// Both follow the latest token, so a narrower token drops the grants of the previous one.
+func rememberGrants(conn *websocket.Conn, info auth.TokenInfo) {
+	mu.Lock()
+	defer mu.Unlock()
+	setGrants(connScopes, conn, info.Scopes)
+	setGrants(connRoles, conn, info.Roles)
+}
+
+// setGrants replaces a connection's grants with the given values
+func setGrants(grants map[*websocket.Conn]map[string]bool, conn *websocket.Conn, values []string) {
+	delete(grants, conn)
+	if len(values) == 0 {
+		return
+	}
+	grants[conn] = make(map[string]bool, len(values))
+	for _, value := range values {
+		grants[conn][value] = true
+	}
+}
+
+// scopesOf returns a connection's scopes in a stable order
+func scopesOf(conn *websocket.Conn) []string {
+	return sortedGrants(connScopes, conn)
+}
+
+// rolesOf returns a connection's roles in a stable order
+func rolesOf(conn *websocket.Conn) []string {
+	return sortedGrants(connRoles, conn)
+}
+
+func sortedGrants(grants map[*websocket.Conn]map[string]bool, conn *websocket.Conn) []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	values := make([]string, 0, len(grants[conn]))
+	for value := range grants[conn] {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
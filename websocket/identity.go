@@ -0,0 +1,34 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Client certificate identity of each connection, absent for token-authenticated clients
+var identities = make(map[*websocket.Conn]string)
+
+// SetConnectionIdentity records the client certificate identity a connection authenticated with
+func SetConnectionIdentity(conn *websocket.Conn, identity string) {
+	if identity == "" {
+		return
+	}
+
+	mu.Lock()
+	identities[conn] = identity
+	mu.Unlock()
+}
+
+func identityOf(conn *websocket.Conn) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return identities[conn]
+}
+
+// KnownIdentity reports whether a certificate name has an entry in the identities config
+func KnownIdentity(config *config.Config) func(string) bool {
+	return func(name string) bool {
+		_, ok := config.Identities[name]
+		return ok
+	}
+}
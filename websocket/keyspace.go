@@ -0,0 +1,243 @@
+package websocket
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/webhooks"
+	"golang.org/x/net/context"
+)
+
+// KeyspaceEvent tells a client that a watched Redis key changed
+type KeyspaceEvent struct {
+	Event     string `json:"event"`
+	Channel   string `json:"channel"`
+	Key       string `json:"key"`
+	Operation string `json:"operation"` // Command that changed the key, e.g. set, del, expired
+}
+
+// Default prefix of the channels that watch Redis keys
+const defaultKeyspacePrefix = "keyspace:"
+
+// Characters of Redis glob patterns
+const globMeta = `*?[\`
+
+// Prefixes of the keys gopush keeps in Redis for itself: resume sessions, delivery
+// receipts, replay buffers and streams, push devices, presence, webhook subscribers and
+// the audit stream. Keyspace channels never watch or report them, whatever
+// redis.keyspace.keys allows.
+var internalKeyPrefixes = []string{
+	"stream:", "push:", "presence:", "webhook_subscribers", "gopush:",
+}
+
+// keyspaceKey returns the key or key pattern watched by a keyspace channel, and false
+// for regular channels or when keyspace mode is off
+func keyspaceKey(channel string, config *config.Config) (string, bool) {
+	if !config.Redis.Keyspace.Enabled {
+		return "", false
+	}
+	prefix := config.Redis.Keyspace.Prefix
+	if prefix == "" {
+		prefix = defaultKeyspacePrefix
+	}
+	if !strings.HasPrefix(channel, prefix) || len(channel) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(channel, prefix), true
+}
+
+// keyspaceWatchable reports whether a client may watch a key or key pattern. A plain key
+// must match one of redis.keyspace.keys. A pattern must be one of them, or narrow one
+// ending in * without other wildcards, so clients cannot widen what they see with glob
+// characters. Internal keys of gopush are never watchable.
+func keyspaceWatchable(key, namespace string, config *config.Config) bool {
+	literal := key
+	if i := strings.IndexAny(key, globMeta); i >= 0 {
+		literal = key[:i]
+	}
+	for _, prefix := range internalKeyPrefixes {
+		full := namespace + literal
+		if strings.HasPrefix(full, prefix) || strings.HasPrefix(prefix, full) {
+			return false
+		}
+	}
+
+	for _, pattern := range config.Redis.Keyspace.Keys {
+		if literal == key {
+			if matched, _ := path.Match(pattern, key); matched {
+				return true
+			}
+			continue
+		}
+		if key == pattern {
+			return true
+		}
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if wildcard && !strings.ContainsAny(prefix, globMeta) && strings.HasPrefix(literal, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyspaceReported reports whether a notification about a key may reach a client. The
+// key, without the namespace, must match redis.keyspace.keys, which also keeps out what a
+// Redis glob matches beyond path.Match, such as slashes under *.
+func keyspaceReported(key, namespace string, config *config.Config) bool {
+	for _, prefix := range internalKeyPrefixes {
+		if strings.HasPrefix(namespace+key, prefix) {
+			return false
+		}
+	}
+	for _, pattern := range config.Redis.Keyspace.Keys {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop channels of each connection's keyspace watches, keyed by channel. They are not
+// broker subscriptions, so they are tracked apart from subscriptions.
+var keyspaceWatches = make(map[*websocket.Conn]map[string]chan struct{})
+
+// watchKeyspace registers a keyspace watch and returns the channel that is closed to stop
+// it. A previous watch of the same channel is stopped, as a resubscribe replaces it.
+func watchKeyspace(conn *websocket.Conn, channel string) chan struct{} {
+	mu.Lock()
+	defer mu.Unlock()
+	if keyspaceWatches[conn] == nil {
+		keyspaceWatches[conn] = make(map[string]chan struct{})
+	}
+	if previous, ok := keyspaceWatches[conn][channel]; ok {
+		close(previous)
+	}
+	stop := make(chan struct{})
+	keyspaceWatches[conn][channel] = stop
+	return stop
+}
+
+// unwatchKeyspace forgets a keyspace watch that ended, unless it was already replaced
+func unwatchKeyspace(conn *websocket.Conn, channel string, stop chan struct{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if keyspaceWatches[conn][channel] != stop {
+		return
+	}
+	delete(keyspaceWatches[conn], channel)
+	if len(keyspaceWatches[conn]) == 0 {
+		delete(keyspaceWatches, conn)
+	}
+}
+
+// stopKeyspaceWatches ends every keyspace watch of a connection
+func stopKeyspaceWatches(conn *websocket.Conn) {
+	mu.Lock()
+	watches := keyspaceWatches[conn]
+	delete(keyspaceWatches, conn)
+	mu.Unlock()
+
+	for _, stop := range watches {
+		close(stop)
+	}
+}
+
+// SubscribeToKeyspace forwards keyspace notifications of the keys matching a pattern as
+// KeyspaceEvent messages. Tenant apps only see keys inside their namespace. In cluster
+// mode every master is subscribed to, since notifications stay on the node that holds
+// the key.
+func SubscribeToKeyspace(conn *websocket.Conn, channel, key string, config *config.Config) {
+	lifecycle := lifecycleEvent(conn, channel)
+	stop := watchKeyspace(conn, channel)
+	defer func() {
+		unwatchKeyspace(conn, channel, stop)
+		mu.Lock()
+		delete(clients, conn)
+		mu.Unlock()
+
+		ConnLogger(conn).Info("Client unsubscribed", "channel", channel)
+	}()
+
+	ctx := context.Background()
+	prefix := fmt.Sprintf("__keyspace@%d__:", config.Redis.Keyspace.Database)
+	namespace := appOf(conn).namespace
+	pattern := prefix + namespace + key
+
+	// Resumed sessions come back here without going through HandleSubscribe
+	if !keyspaceWatchable(key, namespace, config) {
+		ConnLogger(conn).Warn("Refused to watch keys outside redis.keyspace.keys", "channel", channel, "keys", key)
+		return
+	}
+
+	masters, err := redisconn.Masters(ctx)
+	if err != nil {
+		ConnLogger(conn).Error("Failed to list Redis masters", "channel", channel, "error", err)
+		reportError(conn, channel, fmt.Errorf("failed to list Redis masters: %v", err))
+		return
+	}
+
+	notifications := make(chan *redis.Message, 100)
+	done := make(chan struct{})
+	defer close(done)
+	for _, rdb := range masters {
+		pubsub := rdb.PSubscribe(ctx, pattern)
+		defer pubsub.Close()
+
+		go func(messages <-chan *redis.Message) {
+			for msg := range messages {
+				select {
+				case notifications <- msg:
+				case <-done:
+					return
+				}
+			}
+		}(pubsub.Channel())
+	}
+
+	ConnLogger(conn).Info("Watching keys", "channel", channel, "keys", namespace+key)
+	notify(lifecycle, webhooks.EventSubscribe)
+	defer notify(lifecycle, webhooks.EventUnsubscribe)
+
+	// Wake up when the subscription is due to expire; refresh_token may push it back
+	expiry := time.NewTimer(untilExpiry(conn, channel))
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case msg := <-notifications:
+			if untilExpiry(conn, channel) == 0 {
+				expireSubscription(conn, channel)
+				return
+			}
+			if !subscriptionActive(conn, channel) {
+				return
+			}
+
+			changed := strings.TrimPrefix(strings.TrimPrefix(msg.Channel, prefix), namespace)
+			if !keyspaceReported(changed, namespace, config) {
+				continue
+			}
+			SendMessageToClient(conn, MarshalMessage(KeyspaceEvent{
+				Event:     "keyspace",
+				Channel:   channel,
+				Key:       changed,
+				Operation: msg.Payload,
+			}))
+		case <-expiry.C:
+			if remaining := untilExpiry(conn, channel); remaining > 0 {
+				expiry.Reset(remaining)
+				continue
+			}
+			expireSubscription(conn, channel)
+			return
+		}
+	}
+}
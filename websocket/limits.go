@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// Default maximum inbound frame size when the limits block is missing from the config
+const defaultMaxFrameSize = 1 << 20
+
+// Limits of the server.limits block, set by SetLimits and changed on reload
+var maxFrameSize, maxPayloadSize atomic.Int64
+
+// SetLimits applies the server.limits block. Connections opened before a reload keep
+// the frame limit they started with.
+func SetLimits(config *config.Config) {
+	maxFrameSize.Store(config.Server.Limits.MaxFrameSize)
+	maxPayloadSize.Store(int64(config.Server.Limits.MaxPayloadSize))
+}
+
+// ApplyReadLimit caps the size of frames the server will read from a connection.
+// Oversized frames make the next read fail and close the socket with code 1009.
+func ApplyReadLimit(conn *websocket.Conn) {
+	conn.SetReadLimit(ReadLimit())
+}
+
+// ReadLimit returns the largest inbound frame the server reads
+func ReadLimit() int64 {
+	if limit := maxFrameSize.Load(); limit > 0 {
+		return limit
+	}
+	return defaultMaxFrameSize
+}
+
+// MaxPayloadSize returns the largest publish payload accepted, 0 for no limit
+func MaxPayloadSize() int {
+	return int(maxPayloadSize.Load())
+}
+
+// PayloadTooLarge reports whether a publish payload exceeds the configured maximum
+func PayloadTooLarge(payload []byte) bool {
+	limit := MaxPayloadSize()
+	return limit > 0 && len(payload) > limit
+}
+
+// MessageTooLarge describes a payload that exceeded a size limit
+func MessageTooLarge(size, limit int) string {
+	return fmt.Sprintf("Message too large: %d bytes exceeds the %d byte limit", size, limit)
+}
@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Logger of the websocket package, replaced through server.SetLogger
+var logger = slog.Default()
+
+// SetLogger sets the structured logger the websocket package writes to
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// registration is the ID a connection is logged with, as conn_id, when it connected and
+// the messages waiting to be written to it
+type registration struct {
+	id          string
+	remoteAddr  string
+	connectedAt time.Time
+	out         *outbound
+}
+
+// Registration of each open connection. It has its own lock so log lines can be written
+// while mu is held.
+var connIDsMu sync.Mutex
+var connIDs = make(map[*websocket.Conn]registration)
+
+// NewConnectionID returns a random UUID identifying a connection from its upgrade on
+func NewConnectionID() string {
+	return uuid.NewString()
+}
+
+// RegisterConnection records the ID a new connection's log lines, client messages, audit
+// events and webhooks carry, and the client address of its upgrade request, which differs
+// from the peer address behind a trusted proxy
+func RegisterConnection(conn *websocket.Conn, id, remoteAddr string) {
+	connIDsMu.Lock()
+	connIDs[conn] = registration{id: id, remoteAddr: remoteAddr, connectedAt: time.Now(), out: &outbound{}}
+	connIDsMu.Unlock()
+}
+
+// forgetConnection drops the ID of a closed connection
+func forgetConnection(conn *websocket.Conn) {
+	connIDsMu.Lock()
+	entry, ok := connIDs[conn]
+	delete(connIDs, conn)
+	connIDsMu.Unlock()
+
+	if ok {
+		entry.out.release()
+	}
+}
+
+// ConnLogger returns the logger for lines about one connection, carrying its conn_id and
+// remote_addr
+func ConnLogger(conn *websocket.Conn) *slog.Logger {
+	return logger.With("conn_id", connID(conn), "remote_addr", remoteAddr(conn))
+}
+
+// connID returns the ID a connection was registered with
+func connID(conn *websocket.Conn) string {
+	connIDsMu.Lock()
+	defer connIDsMu.Unlock()
+	return connIDs[conn].id
+}
+
+// remoteAddr returns the client address a connection was registered with, or its peer
+// address when it was not registered
+func remoteAddr(conn *websocket.Conn) string {
+	connIDsMu.Lock()
+	entry, ok := connIDs[conn]
+	connIDsMu.Unlock()
+	if ok && entry.remoteAddr != "" {
+		return entry.remoteAddr
+	}
+	return conn.RemoteAddr().String()
+}
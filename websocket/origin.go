@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/sahakavatar/gopush/config"
+)
+
+// CheckOrigin builds the upgrader's origin check from the configured allowlist.
+// Entries may be exact hosts ("app.example.com"), full origins ("https://app.example.com")
+// or wildcard patterns ("*.example.com"). Without an allowlist only same-origin
+// requests are accepted, unless allow_all_origins is set for development.
+func CheckOrigin(config *config.Config) func(r *http.Request) bool {
+	allowed := make([]string, 0, len(config.Server.AllowedOrigins))
+	for _, origin := range config.Server.AllowedOrigins {
+		allowed = append(allowed, strings.ToLower(strings.TrimSpace(origin)))
+	}
+
+	return func(r *http.Request) bool {
+		if config.Server.AllowAllOrigins {
+			return true
+		}
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Non-browser clients do not send an Origin header
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			logger.Warn("Rejected connection with malformed origin", "remote_addr", r.RemoteAddr, "origin", origin)
+			return false
+		}
+
+		if len(allowed) == 0 {
+			if strings.EqualFold(u.Host, r.Host) {
+				return true
+			}
+		} else if originAllowed(allowed, strings.ToLower(origin), strings.ToLower(u.Host)) {
+			return true
+		}
+
+		logger.Warn("Rejected connection with disallowed origin", "remote_addr", r.RemoteAddr, "origin", origin)
+		return false
+	}
+}
+
+// originAllowed reports whether an origin or its host matches any allowlist entry
+func originAllowed(allowed []string, origin, host string) bool {
+	for _, pattern := range allowed {
+		if matched, _ := path.Match(pattern, origin); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
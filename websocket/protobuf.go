@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sahakavatar/gopush/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeProtobuf converts an inbound Envelope into the action map used by the handlers
+func decodeProtobuf(message []byte) (map[string]interface{}, error) {
+	envelope := &pb.Envelope{}
+	if err := proto.Unmarshal(message, envelope); err != nil {
+		return nil, fmt.Errorf("invalid protobuf envelope: %v", err)
+	}
+
+	data := make(map[string]interface{})
+	setIfPresent(data, "action", envelope.Action)
+	setIfPresent(data, "channel", envelope.Channel)
+	setIfPresent(data, "token", envelope.Token)
+	setIfPresent(data, "message_id", envelope.MessageId)
+	setIfPresent(data, "resume_token", envelope.ResumeToken)
+	setIfPresent(data, "request_id", envelope.RequestId)
+	if envelope.Ack {
+		data["ack"] = true
+	}
+	if envelope.Version != 0 {
+		data["version"] = envelope.Version
+	}
+
+	if len(envelope.Payload) > 0 {
+		var payload interface{}
+		if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+			// Opaque payloads are published as a JSON string
+			payload = string(envelope.Payload)
+		}
+		data["payload"] = payload
+	}
+
+	return data, nil
+}
+
+func setIfPresent(data map[string]interface{}, key, value string) {
+	if value != "" {
+		data[key] = value
+	}
+}
+
+// transcodeToProtobuf converts an outgoing message into an Envelope. Well-known fields of
+// JSON messages are lifted into typed envelope fields and the full document is kept in
+// the payload; plain-text status messages only populate the message field.
+func transcodeToProtobuf(message string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return proto.Marshal(&pb.Envelope{Message: message})
+	}
+
+	envelope := &pb.Envelope{
+		Action:      stringField(fields, "action"),
+		Channel:     stringField(fields, "channel"),
+		MessageId:   stringField(fields, "message_id"),
+		ResumeToken: stringField(fields, "resume_token"),
+		Event:       stringField(fields, "event"),
+		Status:      stringField(fields, "status"),
+		Message:     stringField(fields, "message"),
+		Code:        stringField(fields, "code"),
+		RequestId:   stringField(fields, "request_id"),
+		Payload:     []byte(message),
+	}
+	if raw, ok := fields["expires_at"]; ok {
+		json.Unmarshal(raw, &envelope.ExpiresAt)
+	}
+
+	return proto.Marshal(envelope)
+}
+
+// stringField returns a string value from a decoded JSON object, or "" when missing or not a string
+func stringField(fields map[string]json.RawMessage, key string) string {
+	var value string
+	if raw, ok := fields[key]; ok {
+		json.Unmarshal(raw, &value)
+	}
+	return value
+}
@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/push"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// DeviceMessage confirms that a device was registered or unregistered
+type DeviceMessage struct {
+	Status   string `json:"status"`
+	Event    string `json:"event"`
+	Platform string `json:"platform"`
+}
+
+// HandleRegisterDevice adds a device to the registry of the connection's user, to which
+// messages of the user's channel are pushed while the user has no socket open
+func HandleRegisterDevice(conn *websocket.Conn, data map[string]interface{}) {
+	device, ok := deviceOf(conn, data)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	err := push.Register(ctx, UserID(conn), device)
+	if errors.Is(err, push.ErrTooManyDevices) {
+		SendError(conn, data, ErrTooManyDevices, err.Error())
+		return
+	}
+	if errors.Is(err, push.ErrInvalidDevice) {
+		SendError(conn, data, ErrDeviceInvalid, "The device has invalid keys or an endpoint of an unknown push service")
+		return
+	}
+	if err != nil {
+		ConnLogger(conn).Error("Failed to register device", "action", "register_device", "platform", device.Platform, "error", err)
+		sendRedisError(conn, data, err, ErrInternal, "Failed to register device")
+		return
+	}
+
+	ConnLogger(conn).Info("Registered device", "action", "register_device", "platform", device.Platform)
+	SendMessageToClient(conn, MarshalMessage(DeviceMessage{Status: "success", Event: "device_registered", Platform: device.Platform}))
+}
+
+// HandleUnregisterDevice removes a device from the registry of the connection's user
+func HandleUnregisterDevice(conn *websocket.Conn, data map[string]interface{}) {
+	device, ok := deviceOf(conn, data)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	if err := push.Unregister(ctx, UserID(conn), device); err != nil {
+		ConnLogger(conn).Error("Failed to unregister device", "action", "unregister_device", "platform", device.Platform, "error", err)
+		sendRedisError(conn, data, err, ErrInternal, "Failed to unregister device")
+		return
+	}
+
+	ConnLogger(conn).Info("Unregistered device", "action", "unregister_device", "platform", device.Platform)
+	SendMessageToClient(conn, MarshalMessage(DeviceMessage{Status: "success", Event: "device_unregistered", Platform: device.Platform}))
+}
+
+// deviceOf reads the device of a register_device or unregister_device action, answering
+// the client with an error when it cannot be registered
+func deviceOf(conn *websocket.Conn, data map[string]interface{}) (push.Device, bool) {
+	if UserID(conn) == "" {
+		SendError(conn, data, ErrUserUnknown, "Devices can only be registered by connections of a known user")
+		return push.Device{}, false
+	}
+
+	platform, _ := data["platform"].(string)
+	token, _ := data["token"].(string)
+	if token == "" || !push.Supported(platform) {
+		SendError(conn, data, ErrDeviceInvalid, "Device needs a token and a platform push notifications are enabled for")
+		return push.Device{}, false
+	}
+	device := push.Device{Platform: platform, Token: token}
+	// Browsers send the keys of their push subscription along with its endpoint as token
+	if keys, ok := data["keys"].(map[string]interface{}); ok {
+		p256dh, _ := keys["p256dh"].(string)
+		auth, _ := keys["auth"].(string)
+		device.Keys = &push.Keys{P256dh: p256dh, Auth: auth}
+	}
+	return device, true
+}
@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/time/rate"
+)
+
+// SendLimiter throttles the send action for a single connection using a token bucket
+type SendLimiter struct {
+	limiter       *rate.Limiter
+	violations    int
+	maxViolations int
+}
+
+// NewSendLimiter creates a limiter from the rate limit config, or returns nil when rate limiting is disabled
+func NewSendLimiter(config *config.Config) *SendLimiter {
+	limits := config.Server.RateLimit
+	if limits.MessagesPerSecond <= 0 {
+		return nil
+	}
+
+	burst := limits.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &SendLimiter{
+		limiter:       rate.NewLimiter(rate.Limit(limits.MessagesPerSecond), burst),
+		maxViolations: limits.MaxViolations,
+	}
+}
+
+// Allow reports whether the connection may send another message right now
+func (l *SendLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	if l.limiter.Allow() {
+		return true
+	}
+	l.violations++
+	return false
+}
+
+// Exceeded reports whether the connection has been throttled often enough to be disconnected
+func (l *SendLimiter) Exceeded() bool {
+	return l != nil && l.maxViolations > 0 && l.violations >= l.maxViolations
+}
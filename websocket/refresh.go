@@ -0,0 +1,73 @@
+package websocket
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// RefreshMessage confirms a token refresh and reports when the subscriptions now expire
+type RefreshMessage struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	Event     string `json:"event"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// HandleRefreshToken swaps the connection's token for a new one without reconnecting.
+// The new token is validated, replaces the old one for later subscriptions, resumes and
+// revocation checks, and pushes back the expiry of every active subscription.
+func HandleRefreshToken(rdbs []redis.UniversalClient, conn *websocket.Conn, data map[string]interface{}, config *config.Config) {
+	token, ok := data["token"].(string)
+	if !ok || token == "" {
+		SendError(conn, data, ErrTokenMissing, "Invalid or missing token")
+		return
+	}
+
+	info, err := validateToken(context.Background(), rdbs[0], conn, token, "", config)
+	if err != nil || !info.Valid {
+		sendTokenError(conn, data, err)
+		ConnLogger(conn).Warn("Token refresh failed", "action", "refresh_token", "error", err)
+		return
+	}
+
+	expiresAt := expirationTime(config)
+
+	mu.Lock()
+	connTokens[conn] = token
+	usedTokens[conn] = map[string]bool{token: true}
+	delete(connScopes, conn)
+	delete(connRoles, conn)
+	for channel := range expiries[conn] {
+		expiries[conn][channel] = expiresAt
+	}
+	resumeToken := resumeTokens[conn]
+	mu.Unlock()
+
+	// Permissions follow the new token's scopes, roles and channel grants
+	rememberGrants(conn, info)
+	SetConnectionUser(conn, info)
+
+	// Resuming later must revalidate the new token rather than the expired one
+	if resumeToken != "" {
+		session, err := loadSession(rdbs[0], resumeToken)
+		if err == nil {
+			session.TokenHash = hashToken(token)
+			err = saveSession(rdbs[0], resumeToken, session, config)
+		}
+		if err != nil {
+			ConnLogger(conn).Error("Failed to update resume session", "action", "refresh_token", "error", err)
+		}
+	}
+
+	SendMessageToClient(conn, MarshalMessage(RefreshMessage{
+		Status:    "success",
+		Message:   "Token refreshed",
+		Event:     "token_refreshed",
+		ExpiresAt: expiresAt,
+	}))
+
+	ConnLogger(conn).Info("Client refreshed its token", "action", "refresh_token")
+}
@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/reporting"
+	"golang.org/x/net/context"
+)
+
+// reportFields returns the connection and channel an error is reported with
+func reportFields(conn *websocket.Conn, channel string) reporting.Fields {
+	event := auditEvent(conn)
+	return reporting.Fields{
+		"conn_id":     event.ConnID,
+		"remote_addr": event.RemoteAddr,
+		"user":        event.User,
+		"identity":    event.Identity,
+		"app":         event.App,
+		"channel":     channel,
+	}
+}
+
+// reportError reports an error about a connection and, when set, one of its channels
+func reportError(conn *websocket.Conn, channel string, err error) {
+	reporting.Capture(context.Background(), err, reportFields(conn, channel))
+}
+
+// reportWriteError reports a failed write, unless it failed because the connection was
+// already closed, which is how most clients leave
+func reportWriteError(conn *websocket.Conn, channel string, err error) {
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, errQueueFull) || errors.Is(err, errConnectionClosed) {
+		return
+	}
+	reportError(conn, channel, err)
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/redisconn"
+	"golang.org/x/net/context"
+)
+
+// ResumeSession is persisted in Redis so a reconnecting client can restore its subscriptions
+type ResumeSession struct {
+	TokenHash      string          `json:"token_hash"`         // SHA-256 of the auth token, presented again on resume
+	Channels       map[string]bool `json:"channels"`           // Subscribed channels and whether each uses acks
+	Signed         map[string]bool `json:"signed,omitempty"`   // Channels authorized by a channel signature
+	DisconnectedAt int64           `json:"disconnected_at"`    // Unix milliseconds, zero while connected
+	AppKey         string          `json:"app_key,omitempty"`  // Tenant app the session belongs to
+	Identity       string          `json:"identity,omitempty"` // Client certificate identity the session was opened with
+}
+
+// signed reports whether a channel was authorized by a channel signature. Sessions
+// without a token or certificate identity were authorized by signatures alone.
+func (s *ResumeSession) signed(channel string) bool {
+	return s.Signed[channel] || s.TokenHash == "" && s.Identity == ""
+}
+
+// hashToken returns the hash a resume session keeps instead of the auth token, so
+// reading Redis does not reveal tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// missedMessages asks listen to replay a resumed channel's missed messages before its live ones
+type missedMessages struct {
+	since    time.Time
+	replayed func(count int) // Called once the missed messages were sent
+}
+
+// Redis key prefix for resume sessions
+const resumeKeyPrefix = "gopush:resume:"
+
+// Session lifetime used when the resume block is missing from the config
+const defaultSessionTTL = 5 * time.Minute
+
+// Resume token issued to each connection, shared by all of its subscriptions
+var resumeTokens = make(map[*websocket.Conn]string)
+
+func sessionTTL(config *config.Config) time.Duration {
+	if config.Server.Resume.SessionTTL > 0 {
+		return time.Duration(config.Server.Resume.SessionTTL) * time.Second
+	}
+	return defaultSessionTTL
+}
+
+func loadSession(rdb redis.UniversalClient, resumeToken string) (*ResumeSession, error) {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+
+	raw, err := rdb.Get(ctx, resumeKeyPrefix+resumeToken).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &ResumeSession{}
+	if err := json.Unmarshal([]byte(raw), session); err != nil {
+		return nil, fmt.Errorf("failed to decode resume session: %v", err)
+	}
+	return session, nil
+}
+
+func saveSession(rdb redis.UniversalClient, resumeToken string, session *ResumeSession, config *config.Config) error {
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode resume session: %v", err)
+	}
+
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+	return rdb.Set(ctx, resumeKeyPrefix+resumeToken, raw, sessionTTL(config)).Err()
+}
+
+// trackSubscription records a channel in the connection's resume session and returns its resume token.
+// signed tells whether the channel was authorized by a channel signature rather than the token.
+func trackSubscription(rdb redis.UniversalClient, conn *websocket.Conn, token, channel string, ack, signed bool, config *config.Config) string {
+	mu.Lock()
+	resumeToken, ok := resumeTokens[conn]
+	if !ok {
+		resumeToken = NewMessageID()
+		resumeTokens[conn] = resumeToken
+	}
+	mu.Unlock()
+
+	session, err := loadSession(rdb, resumeToken)
+	if err != nil {
+		session = &ResumeSession{Channels: make(map[string]bool)}
+	}
+	if token != "" {
+		session.TokenHash = hashToken(token)
+	}
+	session.AppKey = appOf(conn).key
+	session.Identity = identityOf(conn)
+	session.Channels[channel] = ack
+	if signed {
+		if session.Signed == nil {
+			session.Signed = make(map[string]bool)
+		}
+		session.Signed[channel] = true
+	} else {
+		delete(session.Signed, channel)
+	}
+
+	if err := saveSession(rdb, resumeToken, session, config); err != nil {
+		ConnLogger(conn).Error("Failed to save resume session", "channel", channel, "error", err)
+		return ""
+	}
+	return resumeToken
+}
+
+// markSessionDisconnected records when the connection's resume session lost its socket
+func markSessionDisconnected(rdb redis.UniversalClient, conn *websocket.Conn, config *config.Config) {
+	mu.Lock()
+	resumeToken, ok := resumeTokens[conn]
+	delete(resumeTokens, conn)
+	mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	session, err := loadSession(rdb, resumeToken)
+	if err != nil {
+		ConnLogger(conn).Error("Failed to load resume session", "error", err)
+		return
+	}
+	session.DisconnectedAt = time.Now().UnixMilli()
+
+	if err := saveSession(rdb, resumeToken, session, config); err != nil {
+		ConnLogger(conn).Error("Failed to save resume session", "error", err)
+	}
+}
+
+// HandleResume restores the subscriptions of a previous connection and replays the messages it missed
+func HandleResume(rdbs []redis.UniversalClient, conn *websocket.Conn, data map[string]interface{}, config *config.Config) {
+	resumeToken, ok := data["resume_token"].(string)
+	if !ok || resumeToken == "" {
+		SendError(conn, data, ErrResumeTokenMissing, "Resume token not specified")
+		return
+	}
+
+	session, err := loadSession(rdbs[0], resumeToken)
+	if err != nil {
+		sendRedisError(conn, data, err, ErrResumeTokenInvalid, "Resume token expired or invalid")
+		ConnLogger(conn).Warn("Failed to resume session", "action", "resume", "error", err)
+		return
+	}
+
+	// Sessions cannot move between tenant apps
+	if session.AppKey != appOf(conn).key {
+		SendError(conn, data, ErrResumeTokenInvalid, "Resume token expired or invalid")
+		ConnLogger(conn).Warn("Client tried to resume a session of another app", "action", "resume")
+		return
+	}
+
+	// Certificate sessions can only be resumed by a client presenting the same identity
+	if session.Identity != identityOf(conn) {
+		SendError(conn, data, ErrResumeTokenInvalid, "Resume token expired or invalid")
+		ConnLogger(conn).Warn("Client tried to resume a session of another identity", "action", "resume")
+		return
+	}
+
+	// The session only keeps a hash of its auth token, so the client presents the token
+	// again, and it must still be valid to pick the session back up. Sessions authorized
+	// only by channel signatures have no token and are checked per channel below.
+	if session.TokenHash != "" {
+		token, ok := data["token"].(string)
+		if !ok {
+			token, ok = connectionToken(conn)
+		}
+		if !ok {
+			SendError(conn, data, ErrTokenMissing, "Invalid or missing token")
+			ConnLogger(conn).Warn("Resume without the session's token", "action", "resume")
+			return
+		}
+		if hashToken(token) != session.TokenHash {
+			SendError(conn, data, ErrResumeTokenInvalid, "Resume token expired or invalid")
+			ConnLogger(conn).Warn("Client tried to resume a session of another token", "action", "resume")
+			return
+		}
+
+		info, err := validateToken(context.Background(), rdbs[0], conn, token, "", config)
+		if err != nil || !info.Valid {
+			sendTokenError(conn, data, err)
+			ConnLogger(conn).Warn("Token validation failed while resuming session", "action", "resume", "error", err)
+			return
+		}
+		rememberToken(conn, token)
+		rememberGrants(conn, info)
+		SetConnectionUser(conn, info)
+	}
+
+	// A session still marked connected lost its server before the disconnect was recorded.
+	// It cannot have missed more than its lifetime, and replays are deduplicated by
+	// message ID against live messages only, so clients dedupe the rest.
+	since := time.UnixMilli(session.DisconnectedAt)
+	if session.DisconnectedAt == 0 {
+		since = time.Now().Add(-sessionTTL(config))
+	}
+	session.DisconnectedAt = 0
+	if err := saveSession(rdbs[0], resumeToken, session, config); err != nil {
+		ConnLogger(conn).Error("Failed to save resume session", "action", "resume", "error", err)
+	}
+
+	mu.Lock()
+	resumeTokens[conn] = resumeToken
+	mu.Unlock()
+
+	// Fresh signatures for the new socket ID, keyed by channel
+	signatures, _ := data["auth"].(map[string]interface{})
+
+	for channel, ack := range session.Channels {
+		if !authorizeResumed(rdbs, conn, data, session, signatures, channel, config) {
+			continue
+		}
+
+		mu.Lock()
+		clients[conn] = channel
+		mu.Unlock()
+
+		expiresAt := expirationTime(config)
+		trackExpiry(conn, channel, expiresAt)
+
+		go listen(conn, channel, ack, &missedMessages{
+			since: since,
+			replayed: func(count int) {
+				subscriptionMessage := newSubscriptionMessage(conn, config, channel, fmt.Sprintf("Resumed channel: %s, replayed %d messages", channel, count), "resumed")
+				subscriptionMessage.ResumeToken = resumeToken
+				subscriptionMessage.ExpiresAt = expiresAt
+				SendMessageToClient(conn, MarshalMessage(subscriptionMessage))
+			},
+		}, config)
+	}
+
+	ConnLogger(conn).Info("Client resumed its session", "action", "resume", "subscriptions", len(session.Channels))
+}
+
+// authorizeResumed checks a restored channel the way HandleSubscribe checks a new one,
+// since the token's grants and the ACL may have changed since the session was created
+func authorizeResumed(rdbs []redis.UniversalClient, conn *websocket.Conn, data map[string]interface{}, session *ResumeSession, signatures map[string]interface{}, channel string, config *config.Config) bool {
+	if session.signed(channel) {
+		// Signatures are bound to the socket ID of the connection they were issued for
+		signature, _ := signatures[channel].(string)
+		if !auth.VerifyChannelSignature(channelSecrets(conn, config), socketIDOf(conn), channel, signature) {
+			SendError(conn, data, ErrSignatureInvalid, fmt.Sprintf("Channel signature is invalid: %s", channel))
+			ConnLogger(conn).Warn("Invalid channel signature for resumed subscription", "action", "resume", "channel", channel)
+			Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "invalid channel signature")
+			return false
+		}
+	} else if _, ok := authorizeSubscription(context.Background(), rdbs, conn, data, channel, config); !ok {
+		return false
+	}
+
+	if !canSubscribe(conn, channel, config) {
+		Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "denied by ACL")
+		SendError(conn, data, ErrForbidden, fmt.Sprintf("Not allowed to subscribe to channel: %s", channel))
+		ConnLogger(conn).Warn("ACL denied resumed subscription", "action", "resume", "channel", channel)
+		return false
+	}
+
+	if key, ok := keyspaceKey(channel, config); ok && !keyspaceWatchable(key, appOf(conn).namespace, config) {
+		Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "keys not watchable")
+		SendError(conn, data, ErrForbidden, fmt.Sprintf("Not allowed to watch keys: %s", key))
+		ConnLogger(conn).Warn("Refused to watch keys outside redis.keyspace.keys", "action", "resume", "channel", channel)
+		return false
+	}
+	return true
+}
+
+// history returns the messages a channel received after a point in time
+func history(conn *websocket.Conn, channel string, since time.Time) []string {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+
+	messages, err := messageBroker.History(ctx, RedisChannel(conn, channel), since)
+	if err != nil {
+		ConnLogger(conn).Error("Failed to read message history", "action", "resume", "channel", channel, "error", err)
+		return nil
+	}
+	return messages
+}
@@ -0,0 +1,158 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// resumeConfig returns a config with a memory broker and an ACL that only allows reading news
+func resumeConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Broker.Type = "memory"
+	cfg.Server.Resume.BufferSize = 10
+	cfg.Server.Resume.BufferTTL = 60
+	cfg.Server.ACL = []config.ACLRule{{Pattern: "news", Read: true}}
+
+	b, err := broker.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := messageBroker
+	SetBroker(b)
+	t.Cleanup(func() { SetBroker(previous) })
+	return cfg
+}
+
+// certificateConn opens a protocol v2 connection authenticated with a certificate identity,
+// released again when the test ends
+func certificateConn(t *testing.T, rdb redis.UniversalClient, identity string, cfg *config.Config) (server, client *websocket.Conn) {
+	t.Helper()
+	server, client = testConn(t)
+	useVersion(t, server, ProtocolV2)
+	SetConnectionIdentity(server, identity)
+	t.Cleanup(func() { HandleDisconnect(rdb, server, cfg) })
+	return server, client
+}
+
+// readText reads the next message a client received
+func readText(t *testing.T, client *websocket.Conn) string {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, payload, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(payload)
+}
+
+func TestHandleResume(t *testing.T) {
+	_, rdb := testRedis(t)
+	cfg := resumeConfig(t)
+	conn, client := certificateConn(t, rdb, "billing", cfg)
+
+	disconnectedAt := time.Now().Add(-time.Second)
+	session := &ResumeSession{
+		Identity:       "billing",
+		Channels:       map[string]bool{"news": false, "secret": false},
+		DisconnectedAt: disconnectedAt.UnixMilli(),
+	}
+	if err := saveSession(rdb, "r1", session, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{`{"text":"missed 1"}`, `{"text":"missed 2"}`} {
+		messageBroker.Publish(context.Background(), "news", []byte(payload))
+		messageBroker.Publish(context.Background(), "secret", []byte(payload))
+	}
+
+	HandleResume([]redis.UniversalClient{rdb}, conn, map[string]interface{}{"action": "resume", "resume_token": "r1"}, cfg)
+
+	// The denied channel is reported while the other one replays in the background, so
+	// the error may come at any point of the replay
+	var news []string
+	var denied ErrorMessage
+	for i := 0; i < 4; i++ {
+		message := readText(t, client)
+		var reply ErrorMessage
+		if err := json.Unmarshal([]byte(message), &reply); err == nil && reply.Event == "error" {
+			denied = reply
+			continue
+		}
+		news = append(news, message)
+	}
+	if denied.Code != ErrForbidden || denied.Message != "Not allowed to subscribe to channel: secret" {
+		t.Errorf("error = %+v, want the secret channel forbidden", denied)
+	}
+	if len(news) != 3 {
+		t.Fatalf("news messages = %q, want two replayed and the resumed event", news)
+	}
+	for i, want := range []string{`{"text":"missed 1"}`, `{"text":"missed 2"}`} {
+		if news[i] != want {
+			t.Errorf("replayed %s, want %s", news[i], want)
+		}
+	}
+	var resumed SubscriptionMessage
+	json.Unmarshal([]byte(news[2]), &resumed)
+	if resumed.Event != "resumed" || resumed.Channel != "news" || resumed.ResumeToken != "r1" {
+		t.Errorf("resumed message = %s", news[2])
+	}
+
+	messageBroker.Publish(context.Background(), "news", []byte(`{"text":"live"}`))
+	if got := readText(t, client); got != `{"text":"live"}` {
+		t.Errorf("live message = %s", got)
+	}
+	if subscribed(conn, "secret") {
+		t.Error("the denied channel was restored")
+	}
+
+	saved, err := loadSession(rdb, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.DisconnectedAt != 0 {
+		t.Errorf("session still marked disconnected at %d", saved.DisconnectedAt)
+	}
+}
+
+func TestHandleResumeRefused(t *testing.T) {
+	_, rdb := testRedis(t)
+	cfg := resumeConfig(t)
+	session := &ResumeSession{Identity: "billing", Channels: map[string]bool{"news": false}}
+	if err := saveSession(rdb, "r1", session, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		identity string
+		data     map[string]interface{}
+		want     ErrorCode
+	}{
+		{"no resume token", "billing", map[string]interface{}{"action": "resume"}, ErrResumeTokenMissing},
+		{"unknown resume token", "billing", map[string]interface{}{"action": "resume", "resume_token": "r2"}, ErrResumeTokenInvalid},
+		{"session of another identity", "shipping", map[string]interface{}{"action": "resume", "resume_token": "r1"}, ErrResumeTokenInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := certificateConn(t, rdb, tt.identity, cfg)
+			HandleResume([]redis.UniversalClient{rdb}, conn, tt.data, cfg)
+
+			var got ErrorMessage
+			readJSON(t, client, &got)
+			if got.Code != tt.want {
+				t.Errorf("error code = %q, want %q", got.Code, tt.want)
+			}
+			if subscribed(conn, "news") {
+				t.Error("the session was resumed")
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"golang.org/x/net/context"
+)
+
+// CloseTokenRevoked is the close code sent to clients whose token was revoked
+const CloseTokenRevoked = 4003
+
+// RevocationMessage is published by the application on the revocation channel to revoke
+// a token or every token of a user. A bare token string is accepted as well.
+type RevocationMessage struct {
+	Token  string `json:"token,omitempty"`
+	UserID string `json:"user_id,omitempty"` // Revokes every connection of the user
+}
+
+// Every token each connection authenticated with, at upgrade or on subscribe
+var usedTokens = make(map[*websocket.Conn]map[string]bool)
+
+// rememberToken records that a connection is authorized by a token
+func rememberToken(conn *websocket.Conn, token string) {
+	if token == "" {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if usedTokens[conn] == nil {
+		usedTokens[conn] = make(map[string]bool)
+	}
+	usedTokens[conn][token] = true
+}
+
+// WatchRevocations listens on the revocation control channel, drops revoked tokens
+// from the auth cache and closes every connection that used them
+func WatchRevocations(rdb redis.UniversalClient, config *config.Config) {
+	channel := config.Server.Authorize.RevocationChannel
+	pubsub := rdb.Subscribe(context.Background(), channel)
+	defer pubsub.Close()
+
+	logger.Info("Listening for token revocations", "channel", channel)
+
+	for msg := range pubsub.Channel() {
+		revocation := parseRevocation(msg.Payload)
+		if revocation.Token == "" && revocation.UserID == "" {
+			logger.Warn("Ignoring malformed revocation message", "channel", channel)
+			continue
+		}
+		if revocation.Token != "" {
+			revokeToken(rdb, revocation.Token, config)
+		}
+		if revocation.UserID != "" {
+			revokeUser(rdb, revocation.UserID, config)
+		}
+	}
+}
+
+func parseRevocation(payload string) RevocationMessage {
+	var message RevocationMessage
+	if err := json.Unmarshal([]byte(payload), &message); err == nil {
+		return message
+	}
+	return RevocationMessage{Token: strings.TrimSpace(payload)}
+}
+
+// revokeUser revokes every token used by the connections of a user
+func revokeUser(rdb redis.UniversalClient, userID string, config *config.Config) {
+	tokens := make(map[string]bool)
+	mu.Lock()
+	for conn, user := range connUsers {
+		if user.id != userID {
+			continue
+		}
+		for token := range usedTokens[conn] {
+			tokens[token] = true
+		}
+	}
+	mu.Unlock()
+
+	for token := range tokens {
+		revokeToken(rdb, token, config)
+	}
+	logger.Info("User revoked", "user_id", userID, "tokens", len(tokens))
+}
+
+// revokeToken removes a token's cached validation results and disconnects its connections
+func revokeToken(rdb redis.UniversalClient, token string, config *config.Config) {
+	appKeys := make([]string, 0, len(config.Apps))
+	for appKey := range config.Apps {
+		appKeys = append(appKeys, appKey)
+	}
+	if err := auth.InvalidateToken(context.Background(), rdb, token, appKeys...); err != nil {
+		logger.Error("Failed to invalidate cached token", "token", token, "error", err)
+	}
+
+	var affected []*websocket.Conn
+	mu.Lock()
+	for conn, tokens := range usedTokens {
+		if tokens[token] {
+			affected = append(affected, conn)
+		}
+	}
+	mu.Unlock()
+
+	// Closing the socket ends the connection's read loop, which releases its state
+	for _, conn := range affected {
+		ConnLogger(conn).Info("Closing connection after token revocation")
+		CloseConnection(conn, CloseTokenRevoked, "Token revoked")
+		conn.Close()
+	}
+
+	logger.Info("Token revoked", "token", token, "connections", len(affected))
+}
@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/metrics"
+)
+
+// Grace period used when server.slow_clients.grace is not set
+const defaultSlowGrace = 10 * time.Second
+
+// Slow client limits, set by SetSlowClientLimits
+var (
+	maxQueue        int
+	maxWriteLatency time.Duration
+	slowGrace       time.Duration
+	writeTimeout    time.Duration
+)
+
+var watchSlowClientsOnce sync.Once
+
+// SetSlowClientLimits applies the server.slow_clients block. When a threshold is set,
+// connections are checked every second and those that stay over it for longer than the
+// grace period are disconnected.
+func SetSlowClientLimits(config *config.Config) {
+	limits := config.Server.SlowClients
+	maxQueue = limits.MaxQueue
+	maxWriteLatency = time.Duration(limits.MaxWriteLatency) * time.Millisecond
+	slowGrace = time.Duration(limits.Grace) * time.Second
+	if slowGrace == 0 {
+		slowGrace = defaultSlowGrace
+	}
+	writeTimeout = time.Duration(limits.WriteTimeout) * time.Millisecond
+
+	if maxQueue > 0 || maxWriteLatency > 0 {
+		watchSlowClientsOnce.Do(func() {
+			go watchSlowClients()
+		})
+	}
+}
+
+// outbound tracks the messages waiting to be written to a connection
+type outbound struct {
+	write sync.Mutex // Held while a message is written, gorilla/websocket allows one writer at a time
+
+	mu           sync.Mutex
+	queued       int           // Messages waiting for or in the middle of a write
+	writingSince time.Time     // Start of the write in progress, zero between writes
+	lastLatency  time.Duration // Time from queueing to written of the last message
+	slowSince    time.Time     // When the connection went over a threshold, zero while it is not
+	closing      bool          // A disconnect was started
+	released     bool          // The connection was closed and is no longer tracked
+}
+
+// outboundOf returns the outbound queue of a registered connection, or nil
+func outboundOf(conn *websocket.Conn) *outbound {
+	connIDsMu.Lock()
+	defer connIDsMu.Unlock()
+	return connIDs[conn].out
+}
+
+// errQueueFull is returned for a message refused because max_queue messages already
+// wait for the connection
+var errQueueFull = errors.New("outbound queue is full")
+
+// errConnectionClosed is returned for a message to a connection that was already released
+var errConnectionClosed = errors.New("connection is closed")
+
+// enqueue counts a message waiting to be written and returns when it was queued. With
+// max_queue messages already waiting the message is refused and the client, which
+// misses it, is disconnected at once.
+func (o *outbound) enqueue(conn *websocket.Conn) (time.Time, error) {
+	o.mu.Lock()
+	if o.released {
+		o.mu.Unlock()
+		return time.Time{}, errConnectionClosed
+	}
+	if maxQueue > 0 && o.queued >= maxQueue {
+		now := time.Now()
+		queued, latency := o.state(now)
+		var slowFor time.Duration
+		if !o.slowSince.IsZero() {
+			slowFor = now.Sub(o.slowSince)
+		}
+		disconnect := !o.closing && !o.released
+		o.closing = true
+		o.mu.Unlock()
+
+		if disconnect {
+			go disconnectSlowClient(conn, queued, latency, slowFor)
+		}
+		return time.Time{}, errQueueFull
+	}
+	metrics.Queued(o.queued)
+	o.queued++
+	o.mu.Unlock()
+
+	o.check(conn)
+	return time.Now(), nil
+}
+
+// started marks the beginning of a write, once earlier writes are done
+func (o *outbound) started() {
+	o.mu.Lock()
+	o.writingSince = time.Now()
+	o.mu.Unlock()
+}
+
+// done records a finished write and the time since the message was queued
+func (o *outbound) done(conn *websocket.Conn, latency time.Duration) {
+	o.mu.Lock()
+	o.queued--
+	o.writingSince = time.Time{}
+	o.lastLatency = latency
+	o.mu.Unlock()
+
+	metrics.Written(latency)
+	o.check(conn)
+}
+
+// state returns the queue depth and the write latency, counting a write still in progress
+// by how long it has been running
+func (o *outbound) state(now time.Time) (int, time.Duration) {
+	latency := o.lastLatency
+	if !o.writingSince.IsZero() && now.Sub(o.writingSince) > latency {
+		latency = now.Sub(o.writingSince)
+	}
+	return o.queued, latency
+}
+
+// check compares the connection with the write latency threshold, and disconnects it once
+// it has been over it for longer than the grace period
+func (o *outbound) check(conn *websocket.Conn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closing || o.released {
+		return
+	}
+
+	now := time.Now()
+	queued, latency := o.state(now)
+	slow := maxWriteLatency > 0 && latency > maxWriteLatency
+
+	switch {
+	case slow && o.slowSince.IsZero():
+		o.slowSince = now
+		metrics.SlowClient(true)
+		ConnLogger(conn).Warn("Client is falling behind", "queued", queued, "write_latency_ms", latency.Milliseconds())
+	case slow && now.Sub(o.slowSince) >= slowGrace:
+		o.closing = true
+		go disconnectSlowClient(conn, queued, latency, now.Sub(o.slowSince))
+	case !slow && !o.slowSince.IsZero():
+		o.slowSince = time.Time{}
+		metrics.SlowClient(false)
+		ConnLogger(conn).Info("Client caught up", "queued", queued, "write_latency_ms", latency.Milliseconds())
+	}
+}
+
+// release stops tracking a closed connection
+func (o *outbound) release() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.slowSince.IsZero() {
+		metrics.SlowClient(false)
+	}
+	o.released = true
+}
+
+// disconnectSlowClient closes a connection that stayed slow for longer than the grace period
+func disconnectSlowClient(conn *websocket.Conn, queued int, latency, slowFor time.Duration) {
+	ConnLogger(conn).Warn("Disconnecting slow client", "queued", queued, "write_latency_ms", latency.Milliseconds(), "slow_for", slowFor.String())
+	metrics.SlowClientDisconnected()
+
+	CloseConnection(conn, websocket.CloseTryAgainLater, "Client too slow")
+	// Closing the socket fails a write blocked on a client that stopped reading, and ends
+	// the read loop so the connection is cleaned up as usual
+	conn.Close()
+}
+
+// watchSlowClients checks every connection once a second, so a client is noticed and
+// disconnected even when no further messages are sent to it
+func watchSlowClients() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		connIDsMu.Lock()
+		registered := make(map[*websocket.Conn]*outbound, len(connIDs))
+		for conn, entry := range connIDs {
+			registered[conn] = entry.out
+		}
+		connIDsMu.Unlock()
+
+		for conn, out := range registered {
+			out.check(conn)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/config"
+)
+
+// slowClientLimits applies server.slow_clients for the duration of a test
+func slowClientLimits(t *testing.T, maxQueue int) {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Server.SlowClients.MaxQueue = maxQueue
+	SetSlowClientLimits(cfg)
+	t.Cleanup(func() { SetSlowClientLimits(&config.Config{}) })
+}
+
+// queued returns the number of messages waiting for a connection
+func queued(conn *websocket.Conn) int {
+	out := outboundOf(conn)
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return out.queued
+}
+
+func TestQueueCap(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxQueue   int
+		waiting    int // Messages stuck behind a blocked write
+		wantRefuse bool
+	}{
+		{"no cap", 0, 5, false},
+		{"under the cap", 3, 2, false},
+		{"at the cap", 3, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slowClientLimits(t, tt.maxQueue)
+			server, client := testConn(t)
+
+			// Hold the write lock so messages pile up as behind a client that stopped reading
+			out := outboundOf(server)
+			out.write.Lock()
+			results := make(chan error, tt.waiting+1)
+			for i := 0; i < tt.waiting; i++ {
+				go func() { results <- writeToClient(server, `{"event":"queued"}`) }()
+			}
+			deadline := time.Now().Add(time.Second)
+			for queued(server) < tt.waiting {
+				if time.Now().After(deadline) {
+					t.Fatalf("%d messages queued, want %d", queued(server), tt.waiting)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if !tt.wantRefuse {
+				go func() { results <- writeToClient(server, `{"event":"one more"}`) }()
+				out.write.Unlock()
+				for i := 0; i <= tt.waiting; i++ {
+					if err := <-results; err != nil {
+						t.Fatalf("writeToClient = %v, want the message written", err)
+					}
+				}
+				return
+			}
+
+			// The message over the cap is refused at once, without waiting for the write lock
+			err := writeToClient(server, `{"event":"one more"}`)
+			out.write.Unlock()
+			if !errors.Is(err, errQueueFull) {
+				t.Fatalf("writeToClient = %v, want %v", err, errQueueFull)
+			}
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				_, _, err := client.ReadMessage()
+				if err == nil {
+					continue
+				}
+				if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+					t.Fatalf("client read %v, want close code %d", err, websocket.CloseTryAgainLater)
+				}
+				return
+			}
+		})
+	}
+}
+
+func TestWriteAfterRelease(t *testing.T) {
+	server, _ := testConn(t)
+	forgetConnection(server)
+
+	if err := writeToClient(server, `{"event":"late"}`); !errors.Is(err, errConnectionClosed) {
+		t.Errorf("writeToClient = %v, want %v", err, errConnectionClosed)
+	}
+}
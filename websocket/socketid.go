@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionMessage is sent to a client right after the upgrade with the socket ID
+// its application backend signs channel authorizations for
+type ConnectionMessage struct {
+	Status   string `json:"status"`
+	Event    string `json:"event"`
+	SocketID string `json:"socket_id"`
+	ConnID   string `json:"conn_id,omitempty"`
+}
+
+// Socket ID assigned to each connection
+var socketIDs = make(map[*websocket.Conn]string)
+
+// AssignSocketID gives a connection its socket ID and announces it to the client
+func AssignSocketID(conn *websocket.Conn) string {
+	socketID := NewMessageID()
+
+	mu.Lock()
+	socketIDs[conn] = socketID
+	mu.Unlock()
+
+	SendMessageToClient(conn, MarshalMessage(ConnectionMessage{
+		Status:   "success",
+		Event:    "connection_established",
+		SocketID: socketID,
+		ConnID:   connID(conn),
+	}))
+
+	ConnLogger(conn).Info("Assigned socket ID", "socket_id", socketID)
+	return socketID
+}
+
+func socketIDOf(conn *websocket.Conn) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return socketIDs[conn]
+}
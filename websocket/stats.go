@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Window message rates are averaged over
+const rateWindow = 60
+
+// rateMeter counts events in one-second buckets covering the last rateWindow seconds
+type rateMeter struct {
+	mu      sync.Mutex
+	total   int64
+	seconds [rateWindow]int64 // Unix second each bucket counts
+	counts  [rateWindow]int64
+}
+
+// mark counts one event
+func (m *rateMeter) mark() {
+	now := time.Now().Unix()
+	i := now % rateWindow
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.counts[i] = 0
+	}
+	m.counts[i]++
+	m.total++
+}
+
+// rate returns the events per second over the last rateWindow seconds and the total
+func (m *rateMeter) rate() (float64, int64) {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for i := range m.counts {
+		if now-m.seconds[i] < rateWindow {
+			count += m.counts[i]
+		}
+	}
+	return float64(count) / rateWindow, m.total
+}
+
+// Messages published by this server and delivered to its clients
+var (
+	published rateMeter
+	delivered rateMeter
+)
+
+// Stats summarizes the connections of this server and its message rates, averaged over
+// the last minute
+type Stats struct {
+	Connections        int     `json:"connections"`
+	Subscriptions      int     `json:"subscriptions"`
+	Channels           int     `json:"channels"`
+	PublishedPerSecond float64 `json:"published_per_second"`
+	DeliveredPerSecond float64 `json:"delivered_per_second"`
+	PublishedTotal     int64   `json:"published_total"`
+	DeliveredTotal     int64   `json:"delivered_total"`
+}
+
+// ChannelStats reports the subscribers a channel has on this server
+type ChannelStats struct {
+	Channel     string `json:"channel"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// ConnectionStats describes an open connection
+type ConnectionStats struct {
+	ID           string   `json:"conn_id"`
+	RemoteAddr   string   `json:"remote_addr"`
+	User         string   `json:"user,omitempty"`
+	App          string   `json:"app,omitempty"`
+	Channels     []string `json:"channels"`
+	ConnectedAt  int64    `json:"connected_at"`     // Unix seconds
+	Queued       int      `json:"queued"`           // Messages waiting to be written
+	WriteLatency int64    `json:"write_latency_ms"` // Milliseconds the last or current write took
+}
+
+// ConnectionFilter selects connections listed by the admin API. Empty fields match any
+// connection.
+type ConnectionFilter struct {
+	User    string
+	Channel string
+	IP      string // Remote address without the port
+}
+
+// matches reports whether a connection passes the filter
+func (f ConnectionFilter) matches(stats ConnectionStats) bool {
+	if f.User != "" && stats.User != f.User {
+		return false
+	}
+	if f.IP != "" {
+		// Addresses set from forwarding headers carry no port
+		host, _, err := net.SplitHostPort(stats.RemoteAddr)
+		if err != nil {
+			host = stats.RemoteAddr
+		}
+		if host != f.IP {
+			return false
+		}
+	}
+	if f.Channel != "" {
+		i := sort.SearchStrings(stats.Channels, f.Channel)
+		if i == len(stats.Channels) || stats.Channels[i] != f.Channel {
+			return false
+		}
+	}
+	return true
+}
+
+// CurrentStats returns the connection counts and message rates of this server
+func CurrentStats() Stats {
+	counts := Counts()
+	stats := Stats{
+		Connections:   counts.Connections,
+		Subscriptions: counts.Subscriptions,
+		Channels:      len(ChannelSubscribers()),
+	}
+	stats.PublishedPerSecond, stats.PublishedTotal = published.rate()
+	stats.DeliveredPerSecond, stats.DeliveredTotal = delivered.rate()
+	return stats
+}
+
+// ChannelSubscribers returns the channels subscribed to on this server, busiest first
+func ChannelSubscribers() []ChannelStats {
+	subscribers := make(map[string]int)
+	mu.Lock()
+	for _, channels := range subscriptions {
+		for channel := range channels {
+			subscribers[channel]++
+		}
+	}
+	mu.Unlock()
+
+	stats := make([]ChannelStats, 0, len(subscribers))
+	for channel, count := range subscribers {
+		stats = append(stats, ChannelStats{Channel: channel, Subscribers: count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Subscribers != stats[j].Subscribers {
+			return stats[i].Subscribers > stats[j].Subscribers
+		}
+		return stats[i].Channel < stats[j].Channel
+	})
+	return stats
+}
+
+// Connections describes the open connections passing the filter, oldest first
+func Connections(filter ConnectionFilter) []ConnectionStats {
+	connIDsMu.Lock()
+	registered := make(map[*websocket.Conn]registration, len(connIDs))
+	for conn, entry := range connIDs {
+		registered[conn] = entry
+	}
+	connIDsMu.Unlock()
+
+	now := time.Now()
+	stats := make([]ConnectionStats, 0, len(registered))
+	mu.Lock()
+	for conn, entry := range registered {
+		channels := make([]string, 0, len(subscriptions[conn]))
+		for channel := range subscriptions[conn] {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+		entry.out.mu.Lock()
+		queued, latency := entry.out.state(now)
+		entry.out.mu.Unlock()
+		connection := ConnectionStats{
+			ID:           entry.id,
+			RemoteAddr:   entry.remoteAddr,
+			User:         connUsers[conn].id,
+			App:          connApps[conn].key,
+			Channels:     channels,
+			ConnectedAt:  entry.connectedAt.Unix(),
+			Queued:       queued,
+			WriteLatency: latency.Milliseconds(),
+		}
+		if filter.matches(connection) {
+			stats = append(stats, connection)
+		}
+	}
+	mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ConnectedAt != stats[j].ConnectedAt {
+			return stats[i].ConnectedAt < stats[j].ConnectedAt
+		}
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
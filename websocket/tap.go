@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/broker"
+	"github.com/sahakavatar/gopush/push"
+	"github.com/sahakavatar/gopush/redisconn"
+	"github.com/sahakavatar/gopush/webhooks"
+	"golang.org/x/net/context"
+)
+
+// How long a server's claim on dispatching a message is kept. Servers receive a message
+// well within it, so exactly one of them dispatches it.
+const dispatchClaimTTL = 10 * time.Second
+
+// Whether webhook subscribers and push notifications are fed from the broker's pattern
+// subscription rather than by Publish, set by ListenForDispatch
+var tapped bool
+
+// ListenForDispatch feeds webhook subscribers and the devices of user channels from a
+// subscription to every broker channel, so messages other programs publish to the broker
+// directly reach them too. Brokers without pattern subscriptions leave dispatching to
+// Publish, which only sees the messages published through this server.
+func ListenForDispatch(rdb redis.UniversalClient) error {
+	patterns, ok := messageBroker.(broker.PatternSubscriber)
+	if !ok {
+		return nil
+	}
+
+	_, err := patterns.SubscribePattern("*", func(msg broker.Message) error {
+		// Keyspace notifications are not published messages
+		if msg.Gap || msg.Channel == BroadcastChannel || strings.HasPrefix(msg.Channel, "__key") {
+			return nil
+		}
+		dispatch := webhooks.Wants(msg.Channel)
+		_, notify := push.UserOf(msg.Channel)
+		if !dispatch && !notify || !claimDispatch(rdb, msg.Channel, msg.Payload) {
+			return nil
+		}
+		if dispatch {
+			webhooks.Dispatch(msg.Channel, []byte(msg.Payload))
+		}
+		if notify {
+			push.Notify(msg.Channel, []byte(msg.Payload))
+		}
+		return nil
+	})
+	if errors.Is(err, broker.ErrPatternsUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to every channel: %v", err)
+	}
+	tapped = true
+	return nil
+}
+
+// claimDispatch reports whether this server is the first to receive a message and so
+// dispatches it. Without Redis every server dispatches it.
+func claimDispatch(rdb redis.UniversalClient, channel, payload string) bool {
+	ctx, cancel := redisconn.WithTimeout(context.Background())
+	defer cancel()
+
+	claimed, err := rdb.SetNX(ctx, "gopush:dispatched:"+MessageID(channel, payload), 1, dispatchClaimTTL).Result()
+	if err != nil {
+		logger.Warn("Failed to claim a message for dispatch", "channel", channel, "error", err)
+		return true
+	}
+	return claimed
+}
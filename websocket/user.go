@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/push"
+)
+
+// connectionUser is what the auth service reported about the user behind a connection
+type connectionUser struct {
+	id       string
+	channels []string        // Channel names or patterns the user is limited to, empty for no limit
+	metadata json.RawMessage // Application data passed through from the authorize response
+}
+
+// User of each connection authenticated with a token that the auth service described
+var connUsers = make(map[*websocket.Conn]connectionUser)
+
+// SetConnectionUser records the user and channel grants of the token a connection authenticated with
+func SetConnectionUser(conn *websocket.Conn, info auth.TokenInfo) {
+	mu.Lock()
+	previous := connUsers[conn].id
+	if info.UserID == "" && len(info.AllowedChannels) == 0 && len(info.Metadata) == 0 {
+		delete(connUsers, conn)
+	} else {
+		connUsers[conn] = connectionUser{
+			id:       info.UserID,
+			channels: info.AllowedChannels,
+			metadata: info.Metadata,
+		}
+	}
+	mu.Unlock()
+
+	// Push notifications go to users without a socket on any server
+	if previous != info.UserID {
+		push.Disconnected(previous)
+		push.Connected(info.UserID)
+	}
+}
+
+func userOf(conn *websocket.Conn) connectionUser {
+	mu.Lock()
+	defer mu.Unlock()
+	return connUsers[conn]
+}
+
+// UserID returns the user a connection belongs to, empty when the auth service did not say
+func UserID(conn *websocket.Conn) string {
+	return userOf(conn).id
+}
@@ -0,0 +1,88 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Wire protocol revisions a client can select with the version field of its first message
+const (
+	ProtocolV1 = 1 // Plain-text errors and publish confirmations
+	ProtocolV2 = 2 // Structured errors with machine-readable codes
+)
+
+// DefaultVersion is used for clients that do not request a version, so clients written
+// before versions existed keep receiving plain-text errors
+const DefaultVersion = ProtocolV1
+
+// LatestVersion is the newest revision a client can request
+const LatestVersion = ProtocolV2
+
+// CloseUnsupportedVersion is the close code sent when a client requests an unknown protocol version
+const CloseUnsupportedVersion = 4001
+
+// Protocol version selected by each connection
+var versions = make(map[*websocket.Conn]int)
+
+// NegotiateVersion fixes the connection's protocol version from its first message.
+// It returns false after closing the connection when the requested version is unsupported.
+func NegotiateVersion(conn *websocket.Conn, data map[string]interface{}) bool {
+	version := DefaultVersion
+	if raw, ok := data["version"]; ok {
+		requested, ok := versionNumber(raw)
+		if !ok || requested < ProtocolV1 || requested > LatestVersion {
+			CloseConnection(conn, CloseUnsupportedVersion, fmt.Sprintf("Unsupported protocol version: %v", raw))
+			return false
+		}
+		version = requested
+	}
+
+	mu.Lock()
+	versions[conn] = version
+	mu.Unlock()
+	return true
+}
+
+// protocolVersion returns the protocol version a connection negotiated
+func protocolVersion(conn *websocket.Conn) int {
+	mu.Lock()
+	defer mu.Unlock()
+	if version, ok := versions[conn]; ok {
+		return version
+	}
+	return DefaultVersion
+}
+
+// versionNumber converts a decoded version field to an int. JSON decodes numbers as
+// float64 while MessagePack produces sized integer types.
+func versionNumber(raw interface{}) (int, bool) {
+	switch v := raw.(type) {
+	case float64:
+		return int(v), v == float64(int(v))
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err == nil
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case int:
+		return v, true
+	default:
+		return 0, false
+	}
+}
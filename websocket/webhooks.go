@@ -0,0 +1,29 @@
+package websocket
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sahakavatar/gopush/webhooks"
+)
+
+// lifecycleEvent returns a webhook event carrying the IDs of a connection and its user
+func lifecycleEvent(conn *websocket.Conn, channel string) webhooks.Event {
+	return webhooks.Event{
+		ConnID:   connID(conn),
+		SocketID: socketIDOf(conn),
+		UserID:   UserID(conn),
+		App:      appOf(conn).key,
+		Channel:  channel,
+	}
+}
+
+// Notify sends a lifecycle event of a connection to the application backend
+func Notify(conn *websocket.Conn, name, channel string) {
+	notify(lifecycleEvent(conn, channel), name)
+}
+
+// notify sends a lifecycle event for IDs captured earlier, for connections whose state
+// may already be gone
+func notify(event webhooks.Event, name string) {
+	event.Name = name
+	webhooks.Emit(event)
+}
@@ -1,54 +1,113 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
-	"golang.org/x/net/context"
-	"socket/auth"
-	"socket/config"
+	"github.com/redis/go-redis/v9"
+	"github.com/sahakavatar/gopush/acl"
+	"github.com/sahakavatar/gopush/audit"
+	"github.com/sahakavatar/gopush/auth"
+	"github.com/sahakavatar/gopush/config"
+	"github.com/sahakavatar/gopush/push"
+	"github.com/sahakavatar/gopush/tracing"
+	"github.com/sahakavatar/gopush/webhooks"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // SubscriptionMessage represents the structure sent to clients
 type SubscriptionMessage struct {
-	Status    string `json:"status"`
-	Message   string `json:"message"`
-	Channel   string `json:"channel"`
-	Event     string `json:"event"`
-	WsUrl     string `json:"ws_url"`
-	ExpiresAt int64  `json:"expires_at"`
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	Channel     string `json:"channel"`
+	Event       string `json:"event"`
+	WsUrl       string `json:"ws_url"`
+	ExpiresAt   int64  `json:"expires_at"`
+	ResumeToken string `json:"resume_token,omitempty"`
+	ConnID      string `json:"conn_id,omitempty"`
 }
 
 var mu sync.Mutex
 var clients = make(map[*websocket.Conn]string)
 
+// Token each connection authenticated with during the upgrade
+var connTokens = make(map[*websocket.Conn]string)
+
+// SetConnectionToken records the token a connection presented during the upgrade,
+// so later subscriptions on that connection do not need to repeat it
+func SetConnectionToken(conn *websocket.Conn, token string) {
+	if token == "" {
+		return
+	}
+
+	mu.Lock()
+	connTokens[conn] = token
+	mu.Unlock()
+
+	rememberToken(conn, token)
+}
+
+// Client details of each connection's upgrade request, forwarded to the authorize API
+var connRequests = make(map[*websocket.Conn]auth.AuthorizeRequest)
+
+// SetAuthorizeRequest records the upgrade request details used for later token checks
+func SetAuthorizeRequest(conn *websocket.Conn, request auth.AuthorizeRequest) {
+	mu.Lock()
+	connRequests[conn] = request
+	mu.Unlock()
+}
+
+func authorizeRequestOf(conn *websocket.Conn) auth.AuthorizeRequest {
+	mu.Lock()
+	defer mu.Unlock()
+	return connRequests[conn]
+}
+
+func connectionToken(conn *websocket.Conn) (string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	token, ok := connTokens[conn]
+	return token, ok
+}
+
 // HandleSubscribe handles WebSocket subscription requests
 // Now accepting a slice of Redis clients (rdbs)
-func HandleSubscribe(rdbs []*redis.Client, conn *websocket.Conn, data map[string]interface{}, config *config.Config) {
-	token, ok := data["token"].(string)
+func HandleSubscribe(rdbs []redis.UniversalClient, conn *websocket.Conn, data map[string]interface{}, config *config.Config) {
+	channel, ok := data["channel"].(string)
 	if !ok {
-		SendMessageToClient(conn, "Invalid or missing token")
-		log.Printf("Received invalid or missing token from client: %v", conn.RemoteAddr())
+		SendError(conn, data, ErrChannelMissing, "Channel not specified")
+		ConnLogger(conn).Warn("Channel not specified in subscription request", "action", "subscribe")
 		return
 	}
 
-	authorizeURL := config.Server.Authorize.Url
-	isValid, err := auth.ValidateToken(rdbs[0], token, authorizeURL, config.Server.Authorize.CashTimeOut) // Assuming using the first client for token validation
-	if err != nil || !isValid {
-		SendMessageToClient(conn, "Token validation failed")
-		log.Printf("Token validation failed for client %v with token %s: %v", conn.RemoteAddr(), token, err)
+	ctx, span := tracing.Start(context.Background(), "websocket.subscribe", attribute.String("conn_id", connID(conn)), attribute.String("channel", channel))
+	defer span.End()
+
+	token, ok := authorizeSubscription(ctx, rdbs, conn, data, channel, config)
+	if !ok {
+		tracing.Fail(span, errors.New("subscription not authorized"))
 		return
 	}
 
-	channel, ok := data["channel"].(string)
-	if !ok {
-		SendMessageToClient(conn, "Channel not specified")
-		log.Printf("Channel not specified in subscription request from client %v", conn.RemoteAddr())
+	if !canSubscribe(conn, channel, config) {
+		tracing.Fail(span, errors.New("subscription denied by ACL"))
+		Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "denied by ACL")
+		SendError(conn, data, ErrForbidden, fmt.Sprintf("Not allowed to subscribe to channel: %s", channel))
+		ConnLogger(conn).Warn("ACL denied subscription", "action", "subscribe", "channel", channel)
+		return
+	}
+
+	// Keyspace channels only watch the keys redis.keyspace.keys allows
+	if key, ok := keyspaceKey(channel, config); ok && !keyspaceWatchable(key, appOf(conn).namespace, config) {
+		tracing.Fail(span, errors.New("keys not watchable"))
+		Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "keys not watchable")
+		SendError(conn, data, ErrForbidden, fmt.Sprintf("Not allowed to watch keys: %s", key))
+		ConnLogger(conn).Warn("Refused to watch keys outside redis.keyspace.keys", "action", "subscribe", "channel", channel)
 		return
 	}
 
@@ -56,59 +115,202 @@ func HandleSubscribe(rdbs []*redis.Client, conn *websocket.Conn, data map[string
 	clients[conn] = channel
 	mu.Unlock()
 
-	// You can implement logic to choose the appropriate Redis client from the list (rdbs)
-	// For example, you can select based on channel name or some other logic
-	selectedClient := rdbs[0] // Selecting the first Redis client (for now)
+	// Clients that opt into acknowledgments receive payloads wrapped with a message ID
+	ack, _ := data["ack"].(bool)
+
+	// Track the expiry before listening so the forwarding loop sees it from the start
+	subscriptionMessage := newSubscriptionMessage(conn, config, channel, fmt.Sprintf("Subscribed to channel: %s", channel), "subscription")
+	trackExpiry(conn, channel, subscriptionMessage.ExpiresAt)
+
+	// Start listening on the Redis node owning the channel asynchronously
+	go listen(conn, channel, ack, nil, config)
+
+	_, signed := data["auth"].(string)
+	subscriptionMessage.ResumeToken = trackSubscription(rdbs[0], conn, token, channel, ack, signed, config)
+	SendMessageToClient(conn, MarshalMessage(subscriptionMessage))
+
+	ConnLogger(conn).Info("Client subscribed", "action", "subscribe", "channel", channel)
+	Audit(conn, audit.ActionSubscribe, audit.OutcomeAllowed, channel, "")
+}
+
+// authorizeSubscription checks that a client may subscribe to a channel, either with a
+// channel signature issued by its application backend or with an auth token.
+// It returns the token the subscription was authorized with, empty for signatures.
+func authorizeSubscription(ctx context.Context, rdbs []redis.UniversalClient, conn *websocket.Conn, data map[string]interface{}, channel string, config *config.Config) (string, bool) {
+	if signature, ok := data["auth"].(string); ok {
+		if !auth.VerifyChannelSignature(channelSecrets(conn, config), socketIDOf(conn), channel, signature) {
+			SendError(conn, data, ErrSignatureInvalid, "Channel signature is invalid")
+			ConnLogger(conn).Warn("Invalid channel signature", "action", "subscribe", "channel", channel)
+			Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "invalid channel signature")
+			return "", false
+		}
+		return "", true
+	}
+
+	// Clients with a verified certificate are already authenticated
+	if identityOf(conn) != "" {
+		return "", true
+	}
+
+	token, ok := data["token"].(string)
+	if !ok {
+		// Fall back to the token the connection authenticated with at upgrade time
+		token, ok = connectionToken(conn)
+	}
+	if !ok {
+		SendError(conn, data, ErrTokenMissing, "Invalid or missing token")
+		ConnLogger(conn).Warn("Invalid or missing token", "action", "subscribe", "channel", channel)
+		Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "missing token")
+		return "", false
+	}
+
+	info, err := validateToken(ctx, rdbs[0], conn, token, channel, config) // Assuming using the first client for token validation
+	if err != nil || !info.Valid {
+		sendTokenError(conn, data, err)
+		ConnLogger(conn).Warn("Token validation failed", "action", "subscribe", "channel", channel, "token", token, "error", err)
+		if err != nil {
+			Audit(conn, audit.ActionSubscribe, audit.OutcomeError, channel, err.Error())
+		} else {
+			Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "invalid token")
+		}
+		return "", false
+	}
+
+	// A token limited to certain channels cannot be used for others
+	if !acl.Granted(info.AllowedChannels, channel) {
+		SendError(conn, data, ErrForbidden, fmt.Sprintf("Not allowed to subscribe to channel: %s", channel))
+		ConnLogger(conn).Warn("Token is not granted the channel", "action", "subscribe", "channel", channel)
+		Audit(conn, audit.ActionSubscribe, audit.OutcomeDenied, channel, "channel not granted to the token")
+		return "", false
+	}
 
-	// Start listening to the Redis channel asynchronously
-	go SubscribeToRedisChannel(selectedClient, conn, channel)
+	rememberToken(conn, token)
+	rememberGrants(conn, info)
+	return token, true
+}
 
-	expiration := time.Now().Add(time.Duration(config.Server.Authorize.CashTimeOut) * time.Minute).Unix()
-	subscriptionMessage := SubscriptionMessage{
+// newSubscriptionMessage builds the confirmation sent to a client for a channel subscription
+func newSubscriptionMessage(conn *websocket.Conn, config *config.Config, channel, message, event string) SubscriptionMessage {
+	expiration := expirationTime(config)
+	return SubscriptionMessage{
 		Status:    "success",
-		Message:   fmt.Sprintf("Subscribed to channel: %s", channel),
+		Message:   message,
 		Channel:   channel,
-		Event:     "subscription",
+		Event:     event,
 		WsUrl:     fmt.Sprintf("ws://%s:%s%s", config.Server.Host, config.Server.Port, config.Server.WsUrl),
 		ExpiresAt: expiration,
+		ConnID:    connID(conn),
 	}
-	SendMessageToClient(conn, MarshalMessage(subscriptionMessage))
-
-	log.Printf("Client %v successfully subscribed to channel %s", conn.RemoteAddr(), channel)
 }
 
-// SubscribeToRedisChannel listens for messages on a Redis channel
-func SubscribeToRedisChannel(rdb *redis.Client, conn *websocket.Conn, channel string) {
-	pubsub := rdb.Subscribe(context.Background(), channel)
-	defer pubsub.Close()
+// HandleDisconnect releases the per-connection state of a closed client and marks its
+// resume session as disconnected so missed messages can be replayed
+func HandleDisconnect(rdb redis.UniversalClient, conn *websocket.Conn, config *config.Config) {
+	lifecycle := lifecycleEvent(conn, "")
+
+	mu.Lock()
+	userID := connUsers[conn].id
+	delete(encodings, conn)
+	delete(versions, conn)
+	delete(connTokens, conn)
+	delete(connRequests, conn)
+	delete(socketIDs, conn)
+	delete(connApps, conn)
+	delete(usedTokens, conn)
+	delete(expiries, conn)
+	delete(identities, conn)
+	delete(connScopes, conn)
+	delete(connRoles, conn)
+	delete(connUsers, conn)
+	mu.Unlock()
+
+	push.Disconnected(userID)
+	unsubscribeAll(conn)
 
-	log.Printf("Listening for messages on channel %s", channel)
+	markSessionDisconnected(rdb, conn, config)
+	forgetConnection(conn)
+	notify(lifecycle, webhooks.EventDisconnect)
+}
 
-	for msg := range pubsub.Channel() {
-		log.Printf("Received message on channel %s: %s", channel, msg.Payload)
-		SendMessageToClient(conn, msg.Payload)
-	}
+// ConnectionCounts reports the open connections and their channel subscriptions
+type ConnectionCounts struct {
+	Connections   int `json:"connections"`
+	Subscriptions int `json:"subscriptions"`
+}
+
+// Counts returns the number of open connections and channel subscriptions
+func Counts() ConnectionCounts {
+	connIDsMu.Lock()
+	counts := ConnectionCounts{Connections: len(connIDs)}
+	connIDsMu.Unlock()
 
 	mu.Lock()
-	delete(clients, conn)
+	for _, channels := range subscriptions {
+		counts.Subscriptions += len(channels)
+	}
 	mu.Unlock()
-
-	log.Printf("Client %v unsubscribed from channel %s", conn.RemoteAddr(), channel)
+	return counts
 }
 
 // SendMessageToClient sends a message to a WebSocket client
 func SendMessageToClient(conn *websocket.Conn, message string) {
-	err := conn.WriteMessage(websocket.TextMessage, []byte(message))
+	if err := writeToClient(conn, message); err != nil && !errors.Is(err, errConnectionClosed) {
+		ConnLogger(conn).Warn("Failed to send WebSocket message", "error", err)
+		reportWriteError(conn, "", err)
+	}
+}
+
+// writeToClient sends a message to a WebSocket client and reports whether it was written
+func writeToClient(conn *websocket.Conn, message string) error {
+	messageType, payload, err := encodeMessage(conn, message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+
+	// Writes are serialized by the connection's write lock, so one that has already been
+	// disconnected and forgotten is not written to at all
+	out := outboundOf(conn)
+	if out == nil {
+		return errConnectionClosed
+	}
+
+	queuedAt, err := out.enqueue(conn)
+	if err != nil {
+		return err
+	}
+	out.write.Lock()
+	out.started()
+	err = writeMessage(conn, messageType, payload)
+	out.write.Unlock()
+	out.done(conn, time.Since(queuedAt))
+	return err
+}
+
+// writeMessage writes an encoded message, failing after server.slow_clients.write_timeout
+func writeMessage(conn *websocket.Conn, messageType int, payload []byte) error {
+	// Small messages are cheaper to send as-is than to deflate
+	conn.EnableWriteCompression(len(payload) >= compressionThreshold)
+
+	if writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	return conn.WriteMessage(messageType, payload)
+}
+
+// CloseConnection sends a close frame with the given code and reason to a WebSocket client
+func CloseConnection(conn *websocket.Conn, code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
 	if err != nil {
-		log.Printf("Failed to send WebSocket message to client %v: %v", conn.RemoteAddr(), err)
+		ConnLogger(conn).Warn("Failed to send close frame", "error", err)
 	}
 }
 
 // MarshalMessage converts a message to JSON
-func MarshalMessage(message SubscriptionMessage) string {
+func MarshalMessage(message interface{}) string {
 	bytes, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Error marshaling message: %v", err)
+		logger.Error("Failed to marshal message", "error", err)
 		return ""
 	}
 	return string(bytes)